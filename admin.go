@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+const adminUsage = "usage: admin <id> state|view-change|checkpoint|recover|drain|shutdown"
+
+/*
+runAdmin drives the admin API of a local node, the token is read from PBFT_ADMIN_TOKEN like the node does:
+
+	PBFT admin 1 view-change
+*/
+func runAdmin(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf(adminUsage)
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid node id[%s]: %s", args[0], err)
+	}
+
+	method := http.MethodPost
+	switch args[1] {
+	case "state":
+		method = http.MethodGet
+	case "view-change", "checkpoint", "recover", "drain", "shutdown":
+	default:
+		return fmt.Errorf(adminUsage)
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/admin/%s", message.HTTPPortByID(int64(id)), args[1])
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	if token := os.Getenv("PBFT_ADMIN_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	cli := &http.Client{Timeout: 30 * time.Second}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("node[%d] %s: %s", id, resp.Status, body)
+	}
+	fmt.Print(string(body))
+	return nil
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+/*
+A client signs its requests with an ed25519 key so that the replicas can trust what a request declares about its
+client, like the endpoint its replies go to. The signature covers the request as the client sent it; the sequence
+number is left out since the primary assigns it. client.<id>.key is the key of client id and only belongs on that
+client, client.<id>.pub is its public key and every replica reads those of all clients.
+*/
+func clientKeyFile(dir, id, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("client.%s.%s", id, ext))
+}
+
+var (
+	ErrRequestSignature = errors.New("invalid request signature")
+	ErrNotOperator      = errors.New("client isn't an operator")
+)
+
+func requestContent(r *message.Request) []byte {
+	content := *r
+	content.SeqID = 0
+	content.Sig = ""
+	data, err := message.Marshal(&content)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// SignRequest sets the signature of r, it is called again whenever the client changes the request.
+func SignRequest(r *message.Request, key ed25519.PrivateKey) {
+	r.Sig = hex.EncodeToString(ed25519.Sign(key, requestContent(r)))
+}
+
+// VerifyRequest checks that r is signed with the key of its client.
+func VerifyRequest(r *message.Request, pub ed25519.PublicKey) error {
+	sig, err := hex.DecodeString(r.Sig)
+	if err != nil || !ed25519.Verify(pub, requestContent(r), sig) {
+		return fmt.Errorf("request of client[%s] at %d: %w", r.ClientID, r.TimeStamp, ErrRequestSignature)
+	}
+	return nil
+}
+
+// VerifyOperator checks that r is signed by its client and that the client is one of the operators of config.
+func VerifyOperator(r *message.Request, config *message.Config) error {
+	key, ok := config.Operators[r.ClientID]
+	if !ok {
+		return fmt.Errorf("client[%s]: %w", r.ClientID, ErrNotOperator)
+	}
+	pub, err := hex.DecodeString(key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("operator[%s] has an invalid public key", r.ClientID)
+	}
+	return VerifyRequest(r, pub)
+}
+
+// WriteClientKeys generates a key for every client in ids and writes it to dir.
+func WriteClientKeys(dir string, ids []string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id == "" || strings.ContainsRune(id, filepath.Separator) {
+			return fmt.Errorf("invalid client id %q", id)
+		}
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(clientKeyFile(dir, id, "key"), []byte(hex.EncodeToString(key.Seed())+"\n"), 0o600); err != nil {
+			return err
+		}
+		if err := os.WriteFile(clientKeyFile(dir, id, "pub"), []byte(hex.EncodeToString(pub)+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadClientKey reads the key of client id from dir.
+func LoadClientKey(dir, id string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(clientKeyFile(dir, id, "key"))
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: invalid client key", clientKeyFile(dir, id, "key"))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// LoadClientKeys reads the public keys of all clients in dir, there are none if no client key was written.
+func LoadClientKeys(dir string) (map[string]ed25519.PublicKey, error) {
+	files, err := filepath.Glob(clientKeyFile(dir, "*", "pub"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]ed25519.PublicKey, len(files))
+	for _, file := range files {
+		id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "client."), ".pub")
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s: invalid client public key", file)
+		}
+		keys[id] = pub
+	}
+	return keys, nil
+}
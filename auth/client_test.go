@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+func TestRequestSignature(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteClientKeys(dir, []string{"alice", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadClientKey(dir, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadClientKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("loaded %d client keys", len(keys))
+	}
+
+	r := &message.Request{TimeStamp: 7, ClientID: "alice", Operation: "put x 1", Endpoint: "127.0.0.1:9000"}
+	SignRequest(r, key)
+	if err := VerifyRequest(r, keys["alice"]); err != nil {
+		t.Fatal(err)
+	}
+
+	// the primary assigns the sequence number after the client signed
+	r.SeqID = 12
+	if err := VerifyRequest(r, keys["alice"]); err != nil {
+		t.Fatalf("sequence number broke the signature: %v", err)
+	}
+	if err := VerifyRequest(r, keys["bob"]); !errors.Is(err, ErrRequestSignature) {
+		t.Fatalf("bob's key verified alice's request: %v", err)
+	}
+	r.Endpoint = "10.0.0.66:9000"
+	if err := VerifyRequest(r, keys["alice"]); !errors.Is(err, ErrRequestSignature) {
+		t.Fatalf("redirected endpoint verified: %v", err)
+	}
+}
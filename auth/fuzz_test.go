@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/p2pnetwork"
+)
+
+// fuzzKeyrings returns a keyring for every replica, the keys drawn from a fixed seed.
+func fuzzKeyrings(send func(interface{})) []*Keyring {
+	r := rand.New(rand.NewSource(1))
+	config := message.DefaultConfig()
+	keys := make([]*KeyPair, message.TotalNodeNO)
+	for i := range keys {
+		keys[i], _ = GenerateKey(r)
+		config.Keys[int64(i)] = keys[i].Public()
+	}
+	krs := make([]*Keyring, message.TotalNodeNO)
+	for i := range krs {
+		krs[i] = NewKeyring(int64(i), keys[i], config.Copy, &p2pnetwork.SimulationP2P{
+			TotalNodes:  message.TotalNodeNO,
+			Synchronous: true,
+			Send:        send,
+		})
+		krs[i].Rand = r
+		krs[i].Log = logging.Nop()
+	}
+	return krs
+}
+
+/*
+FuzzKeyring hands replica 1 a message from a peer as its node would: a NEW-KEY goes to HandleNewKey, anything else has
+its authenticator checked. The keyring may refuse the message, it must never crash on it.
+*/
+func FuzzKeyring(f *testing.F) {
+	var sent []*message.ConMessage
+	krs := fuzzKeyrings(func(v interface{}) {
+		if msg, ok := v.(*message.ConMessage); ok {
+			sent = append(sent, msg)
+		}
+	})
+	if err := krs[0].RefreshKeys(); err != nil {
+		f.Fatal(err)
+	}
+	prepare := message.CreateConMsg(message.MTPrepare, &message.Prepare{SequenceID: 1, Digest: "d"})
+	krs[0].Seal(prepare, []int64{1, 2, 3})
+	for _, m := range append(sent, prepare) {
+		data, err := message.JSONCodec{}.Encode(m)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := message.JSONCodec{}.Decode(data)
+		if err != nil {
+			return
+		}
+		kr := fuzzKeyrings(func(interface{}) {})[1]
+		if msg.Typ == message.MTNewKey {
+			_ = kr.HandleNewKey(msg)
+			return
+		}
+		_ = kr.Verify(msg)
+	})
+}
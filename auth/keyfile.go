@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+A key directory holds the long-term keys of a cluster: <id>.key is the key pair of replica id and only belongs on that
+replica, <id>.pub is its public key and every replica reads those of all the others.
+*/
+func keyFile(dir string, id int64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%d.%s", id, ext))
+}
+
+// WriteKeys generates a key pair for every replica in ids and writes it to dir.
+func WriteKeys(dir string, ids []int64) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		kp, err := GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyFile(dir, id, "key"), []byte(kp.String()+"\n"), 0o600); err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyFile(dir, id, "pub"), []byte(kp.Public()+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadKeys reads the key pair of replica id and the public keys of the replicas in ids from dir.
+func LoadKeys(dir string, id int64, ids []int64) (*KeyPair, map[int64]string, error) {
+	data, err := os.ReadFile(keyFile(dir, id, "key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	kp, err := ParseKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", keyFile(dir, id, "key"), err)
+	}
+	pubs := make(map[int64]string, len(ids))
+	for _, r := range ids {
+		data, err := os.ReadFile(keyFile(dir, r, "pub"))
+		if err != nil {
+			return nil, nil, err
+		}
+		pub := strings.TrimSpace(string(data))
+		if _, err := parsePublic(pub); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", keyFile(dir, r, "pub"), err)
+		}
+		pubs[r] = pub
+	}
+	if pubs[id] != "" && pubs[id] != kp.Public() {
+		return nil, nil, fmt.Errorf("%s doesn't match %s", keyFile(dir, id, "pub"), keyFile(dir, id, "key"))
+	}
+	return kp, pubs, nil
+}
@@ -0,0 +1,414 @@
+/*
+Package auth authenticates the consensus messages between replicas with MACs under session keys that are refreshed
+periodically, so a replica that was compromised and recovered can't keep impersonating the others with keys it learned.
+
+Replica i picks the key k(j,i) every replica j authenticates its messages to i with. Until i hands out the first one,
+k(j,i) is derived from the long-term X25519 keys of i and j, so both have it without a message. Every Interval, and
+whenever the
+watchdog recovers it, i picks new keys and sends them in a NEW-KEY message: k(j,i) is encrypted under the X25519 key of
+j and the whole message is signed with the ed25519 key of i, both public keys are in the configuration. The key k(j,i)
+it replaces is retired as soon as a message of j under the new key arrives, or RetireAfter after the NEW-KEY at the
+latest, so what j sent before it got the NEW-KEY isn't lost. A message authenticated with a retired key is discarded
+and its sender gets the NEW-KEY again, in case the first one was lost. A message sent to several replicas carries one
+MAC for each of them, the authenticator.
+
+The key state lives in a Keyring, apart from the consensus engine, which only sees it as a consensus.Authenticator.
+*/
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/p2pnetwork"
+)
+
+const (
+	// DefaultInterval is how often a replica hands out new session keys unless Keyring.Interval says otherwise.
+	DefaultInterval = time.Minute
+	// ResendDelay is how long a replica waits before it sends its NEW-KEY to the same peer again.
+	ResendDelay = time.Second
+	// RetireAfter is how long a replaced key is still taken from a peer that hasn't used the new one yet.
+	RetireAfter = time.Second
+	KeySize     = 32
+	MACSize     = 16
+)
+
+var (
+	// ErrNotAddressed is returned for a message without a MAC for this replica, it was sent to others.
+	ErrNotAddressed = errors.New("message carries no MAC for this replica")
+	ErrRetiredKey   = errors.New("message is authenticated with a retired session key")
+	ErrBadMAC       = errors.New("message authenticator doesn't match")
+)
+
+type session struct {
+	time int64
+	key  []byte
+}
+
+type Keyring struct {
+	Interval time.Duration
+	// Now and Rand are the clock the NEW-KEY timestamps come from and the source of the keys, a simulation replaces them.
+	Now  func() time.Time
+	Rand io.Reader
+	Log  logging.Logger
+
+	id     int64
+	key    *KeyPair
+	config func() *message.Config
+	wire   p2pnetwork.P2pNetwork
+
+	mu      sync.Mutex
+	stamp   int64
+	in      map[int64][]byte
+	prev    map[int64]*session
+	out     map[int64]*session
+	statics map[int64][]byte
+	since   time.Time
+	last    *message.ConMessage
+	resent  map[int64]time.Time
+	stop    chan struct{}
+	once    sync.Once
+}
+
+/*
+NewKeyring keeps the session keys of replica id, whose long-term keys are key. config returns the configuration in
+force, with the public keys of the replicas, and the NEW-KEY messages are sent on wire.
+*/
+func NewKeyring(id int64, key *KeyPair, config func() *message.Config, wire p2pnetwork.P2pNetwork) *Keyring {
+	return &Keyring{
+		Interval: DefaultInterval,
+		Now:      time.Now,
+		Rand:     rand.Reader,
+		Log:      logging.Default(),
+		id:       id,
+		key:      key,
+		config:   config,
+		wire:     wire,
+		in:       make(map[int64][]byte),
+		prev:     make(map[int64]*session),
+		out:      make(map[int64]*session),
+		statics:  make(map[int64][]byte),
+		resent:   make(map[int64]time.Time),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Run hands out new session keys right away and then every Interval until Stop is called.
+func (k *Keyring) Run() {
+	ticker := time.NewTicker(k.Interval)
+	defer ticker.Stop()
+	for {
+		if err := k.RefreshKeys(); err != nil {
+			k.Log.Error("session key refresh failed", logging.F("node", k.id), logging.Err(err))
+		}
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (k *Keyring) Stop() {
+	k.once.Do(func() {
+		close(k.stop)
+	})
+}
+
+/*
+RefreshKeys picks new keys for every replica of the configuration, retires the old ones and sends the NEW-KEY. A
+replica without a valid public key in the configuration gets no key, its messages are discarded until it has one.
+*/
+func (k *Keyring) RefreshKeys() error {
+	config := k.config()
+
+	k.mu.Lock()
+	stamp := k.Now().UnixNano()
+	if stamp <= k.stamp {
+		stamp = k.stamp + 1
+	}
+	ephemeral, err := newBoxKey(k.Rand)
+	if err != nil {
+		k.mu.Unlock()
+		return err
+	}
+	nk := &message.NewKey{
+		NodeID:    k.id,
+		Timestamp: stamp,
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+		Keys:      make(map[int64][]byte),
+	}
+	in := make(map[int64][]byte)
+	for _, j := range config.Replicas {
+		key := make([]byte, KeySize)
+		if _, err := io.ReadFull(k.Rand, key); err != nil {
+			k.mu.Unlock()
+			return err
+		}
+		if j == k.id {
+			in[j] = key
+			continue
+		}
+		pub, err := parsePublic(config.Keys[j])
+		if err != nil {
+			k.Log.Warn("replica has no usable public key", logging.F("node", k.id), logging.F("peer", j), logging.Err(err))
+			continue
+		}
+		shared, err := ephemeral.ECDH(pub.box)
+		if err != nil {
+			k.Log.Warn("key agreement failed", logging.F("node", k.id), logging.F("peer", j), logging.Err(err))
+			continue
+		}
+		nk.Keys[j] = newAEAD(shared).Seal(nil, make([]byte, 12), key, keyContext(k.id, j, stamp))
+		in[j] = key
+	}
+	data, err := message.Marshal(nk)
+	if err != nil {
+		k.mu.Unlock()
+		return err
+	}
+	nk.Sig = ed25519.Sign(k.key.Sign, data)
+	consMsg := message.CreateConMsg(message.MTNewKey, nk)
+	consMsg.From = uint(k.id)
+
+	k.prev = make(map[int64]*session, len(config.Replicas))
+	for _, j := range config.Replicas {
+		old := k.in[j]
+		if k.stamp == 0 {
+			old = k.initial(j, j, k.id)
+		}
+		if old != nil {
+			k.prev[j] = &session{time: k.stamp, key: old}
+		}
+	}
+	k.stamp = stamp
+	k.since = k.Now()
+	k.in = in
+	k.statics = make(map[int64][]byte)
+	k.out[k.id] = &session{time: stamp, key: in[k.id]}
+	k.last = consMsg
+	k.resent = make(map[int64]time.Time)
+	k.mu.Unlock()
+
+	k.Log.Debug("session keys refreshed", logging.F("node", k.id), logging.F("timestamp", stamp))
+	return k.wire.BroadCast(consMsg)
+}
+
+// HandleNewKey takes the key a peer handed out to this replica, once its signature and timestamp are checked.
+func (k *Keyring) HandleNewKey(msg *message.ConMessage) error {
+	body, err := msg.Body()
+	if err != nil {
+		return fmt.Errorf("invalid NEW-KEY: %w", err)
+	}
+	nk, ok := body.(*message.NewKey)
+	if !ok {
+		return fmt.Errorf("%s message isn't a NEW-KEY", msg.Typ)
+	}
+	if int64(msg.From) != nk.NodeID {
+		return fmt.Errorf("NEW-KEY of node[%d] sent by node[%d]", nk.NodeID, msg.From)
+	}
+	if nk.NodeID == k.id {
+		return nil
+	}
+	config := k.config()
+	if !config.Contains(nk.NodeID) {
+		return fmt.Errorf("NEW-KEY of node[%d] that isn't a replica of %s", nk.NodeID, config)
+	}
+	pub, err := parsePublic(config.Keys[nk.NodeID])
+	if err != nil {
+		return fmt.Errorf("NEW-KEY of node[%d]: %w", nk.NodeID, err)
+	}
+	unsigned := *nk
+	unsigned.Sig = nil
+	data, err := message.Marshal(&unsigned)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub.sign, data, nk.Sig) {
+		return fmt.Errorf("NEW-KEY of node[%d] has an invalid signature", nk.NodeID)
+	}
+	sealed, ok := nk.Keys[k.id]
+	if !ok {
+		return fmt.Errorf("NEW-KEY of node[%d] carries no key for node[%d]", nk.NodeID, k.id)
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(nk.Ephemeral)
+	if err != nil {
+		return fmt.Errorf("NEW-KEY of node[%d]: %w", nk.NodeID, err)
+	}
+	shared, err := k.key.Box.ECDH(ephemeral)
+	if err != nil {
+		return fmt.Errorf("NEW-KEY of node[%d]: %w", nk.NodeID, err)
+	}
+	key, err := newAEAD(shared).Open(nil, make([]byte, 12), sealed, keyContext(nk.NodeID, k.id, nk.Timestamp))
+	if err != nil {
+		return fmt.Errorf("NEW-KEY of node[%d] doesn't decrypt: %w", nk.NodeID, err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if cur, ok := k.out[nk.NodeID]; ok && nk.Timestamp <= cur.time {
+		if nk.Timestamp == cur.time && hmac.Equal(key, cur.key) {
+			// the same NEW-KEY sent again
+			return nil
+		}
+		return fmt.Errorf("NEW-KEY of node[%d] at %d isn't newer than %d", nk.NodeID, nk.Timestamp, cur.time)
+	}
+	k.out[nk.NodeID] = &session{time: nk.Timestamp, key: key}
+	k.Log.Debug("session key taken", logging.F("node", k.id), logging.F("peer", nk.NodeID),
+		logging.F("timestamp", nk.Timestamp))
+	return nil
+}
+
+/*
+Seal puts the authenticator on msg, a MAC for every replica in to. A replica without a public key gets an empty MAC,
+which it can't take.
+*/
+func (k *Keyring) Seal(msg *message.ConMessage, to []int64) {
+	content := macContent(msg)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	msg.Auth = make(map[int64]*message.MAC, len(to))
+	for _, j := range to {
+		s, ok := k.out[j]
+		if !ok {
+			s = &session{key: k.initial(j, k.id, j)}
+		}
+		if s.key == nil {
+			msg.Auth[j] = &message.MAC{}
+			continue
+		}
+		msg.Auth[j] = &message.MAC{KeyTime: s.time, Sum: sum(s.key, content)}
+	}
+}
+
+// Verify checks the MAC of msg for this replica under the key its sender was handed last.
+func (k *Keyring) Verify(msg *message.ConMessage) error {
+	mac, ok := msg.Auth[k.id]
+	if !ok || mac == nil {
+		return ErrNotAddressed
+	}
+	from := int64(msg.From)
+	k.mu.Lock()
+	var key []byte
+	current := mac.KeyTime == k.stamp
+	switch {
+	case current && k.stamp == 0:
+		key = k.initial(from, from, k.id)
+	case current:
+		key = k.in[from]
+	default:
+		if prev, ok := k.prev[from]; ok && mac.KeyTime == prev.time && k.Now().Sub(k.since) < RetireAfter {
+			key = prev.key
+		}
+	}
+	k.mu.Unlock()
+	if key == nil {
+		k.resend(from)
+		return ErrRetiredKey
+	}
+	if !hmac.Equal(mac.Sum, sum(key, macContent(msg))) {
+		return ErrBadMAC
+	}
+	if current {
+		k.retire(from)
+	}
+	return nil
+}
+
+/*
+initial is the key replica from authenticates its messages to replica to with before to handed out one, peer is the
+one of the two that isn't this replica. It is nil when peer has no public key.
+*/
+func (k *Keyring) initial(peer, from, to int64) []byte {
+	shared, ok := k.statics[peer]
+	if !ok {
+		pub, err := parsePublic(k.config().Keys[peer])
+		if err != nil {
+			return nil
+		}
+		if shared, err = k.key.Box.ECDH(pub.box); err != nil {
+			return nil
+		}
+		k.statics[peer] = shared
+	}
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(keyContext(from, to, 0))
+	return h.Sum(nil)
+}
+
+// retire stops taking the replaced key from a peer that uses the new one.
+func (k *Keyring) retire(from int64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.prev, from)
+}
+
+// resend sends the last NEW-KEY to a peer that still uses a retired key, at most once every ResendDelay.
+func (k *Keyring) resend(to int64) {
+	k.mu.Lock()
+	msg := k.last
+	now := k.Now()
+	if msg == nil || to == k.id || now.Sub(k.resent[to]) < ResendDelay {
+		k.mu.Unlock()
+		return
+	}
+	k.resent[to] = now
+	k.mu.Unlock()
+	if err := k.wire.SendToNode(to, msg); err != nil {
+		k.Log.Warn("resend NEW-KEY failed", logging.F("node", k.id), logging.F("peer", to), logging.Err(err))
+	}
+}
+
+/*
+macContent is what the MACs of msg cover: its type, its sender and the canonical encoding of its payload, which stays
+the same whatever codec carries the message.
+*/
+func macContent(msg *message.ConMessage) []byte {
+	h := sha256.New()
+	var head [binary.MaxVarintLen64 * 2]byte
+	n := binary.PutUvarint(head[:], uint64(msg.Typ))
+	n += binary.PutUvarint(head[n:], uint64(msg.From))
+	h.Write(head[:n])
+	payload, err := msg.CanonicalPayload()
+	if err != nil {
+		payload = msg.Payload
+	}
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func sum(key, content []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(content)
+	return mac.Sum(nil)[:MACSize]
+}
+
+// keyContext binds an encrypted session key to who handed it out, to whom and when.
+func keyContext(from, to, stamp int64) []byte {
+	ctx := binary.AppendVarint(nil, from)
+	ctx = binary.AppendVarint(ctx, to)
+	return binary.AppendVarint(ctx, stamp)
+}
+
+// newAEAD keys AES-GCM with the hash of a shared secret; every secret comes from a fresh ephemeral key and seals one key.
+func newAEAD(shared []byte) cipher.AEAD {
+	key := sha256.Sum256(shared)
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
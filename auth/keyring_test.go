@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+func TestMACHoldsAcrossCodecs(t *testing.T) {
+	krs := fuzzKeyrings(func(interface{}) {})
+	msg := message.CreateConMsg(message.MTCommit, &message.Commit{ViewID: 0, SequenceID: 1, Digest: "d", NodeID: 0})
+	krs[0].Seal(msg, []int64{1})
+
+	for _, c := range []message.Codec{message.JSONCodec{}, message.BinaryCodec{}} {
+		data, err := c.Encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := krs[1].Verify(got); err != nil {
+			t.Fatalf("MAC of a message sent with the %s codec: %v", c.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+/*
+KeyPair is the long-term identity of a replica: an ed25519 key it signs its NEW-KEY messages with and an X25519 key the
+others encrypt the session keys they hand out to it under. The public half of every replica is its entry in the Keys of
+the configuration, see Public.
+*/
+type KeyPair struct {
+	Sign ed25519.PrivateKey
+	Box  *ecdh.PrivateKey
+}
+
+// GenerateKey reads the keys from rand as they are, so a deterministic rand gives the same key pair every time.
+func GenerateKey(rand io.Reader) (*KeyPair, error) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, err
+	}
+	box, err := newBoxKey(rand)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Sign: ed25519.NewKeyFromSeed(seed), Box: box}, nil
+}
+
+func newBoxKey(rand io.Reader) (*ecdh.PrivateKey, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand, key); err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(key)
+}
+
+// ParseKey reads a key pair in the form String writes it: the hex of the ed25519 seed followed by the X25519 key.
+func ParseKey(s string) (*KeyPair, error) {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key pair: %w", err)
+	}
+	if len(data) != ed25519.SeedSize+32 {
+		return nil, fmt.Errorf("invalid key pair: %d bytes", len(data))
+	}
+	box, err := ecdh.X25519().NewPrivateKey(data[ed25519.SeedSize:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key pair: %w", err)
+	}
+	return &KeyPair{Sign: ed25519.NewKeyFromSeed(data[:ed25519.SeedSize]), Box: box}, nil
+}
+
+func (kp *KeyPair) String() string {
+	return hex.EncodeToString(append(kp.Sign.Seed(), kp.Box.Bytes()...))
+}
+
+// Public is the public half of the key pair as it goes into message.Config.Keys.
+func (kp *KeyPair) Public() string {
+	return hex.EncodeToString(append(kp.Sign.Public().(ed25519.PublicKey), kp.Box.PublicKey().Bytes()...))
+}
+
+type publicKey struct {
+	sign ed25519.PublicKey
+	box  *ecdh.PublicKey
+}
+
+func parsePublic(s string) (*publicKey, error) {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if len(data) != ed25519.PublicKeySize+32 {
+		return nil, fmt.Errorf("invalid public key: %d bytes", len(data))
+	}
+	box, err := ecdh.X25519().NewPublicKey(data[ed25519.PublicKeySize:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return &publicKey{sign: ed25519.PublicKey(data[:ed25519.PublicKeySize]), box: box}, nil
+}
@@ -0,0 +1,181 @@
+/*
+Package bls implements BLS signatures over the BLS12-381 curve, following the proof-of-possession scheme of the IETF BLS
+signature draft with signatures in G1 and public keys in G2: signatures stay small, and any number of them on the same
+message aggregate into one that verifies against the sum of the public keys of the signers. Against rogue keys every
+public key comes with a proof that its owner holds the secret key, see Prove.
+
+The curve, the hash to G1 of RFC 9380 and the pairing are those of github.com/cloudflare/circl; points are encoded
+compressed, as the draft and the zkcrypto format do.
+*/
+package bls
+
+import (
+	"errors"
+	"io"
+
+	"github.com/cloudflare/circl/ecc/bls12381"
+)
+
+const (
+	SecretKeySize = bls12381.ScalarSize
+	PublicKeySize = bls12381.G2SizeCompressed
+	SignatureSize = bls12381.G1SizeCompressed
+)
+
+var (
+	ErrInvalidKey       = errors.New("bls: invalid key")
+	ErrInvalidSignature = errors.New("bls: invalid signature")
+)
+
+// the ciphersuites BLS_SIG_ and BLS_POP_ of the minimal-signature-size proof-of-possession scheme
+var (
+	sigDomain = []byte("BLS_SIG_BLS12381G1_XMD:SHA-256_SSWU_RO_POP_")
+	popDomain = []byte("BLS_POP_BLS12381G1_XMD:SHA-256_SSWU_RO_POP_")
+)
+
+type SecretKey struct {
+	s bls12381.Scalar
+}
+
+type PublicKey struct {
+	p bls12381.G2
+}
+
+type Signature struct {
+	p bls12381.G1
+}
+
+// GenerateKey reads 64 bytes from rand and reduces them mod r, so a deterministic rand gives the same key every time.
+func GenerateKey(rand io.Reader) (*SecretKey, error) {
+	seed := make([]byte, 64)
+	for {
+		if _, err := io.ReadFull(rand, seed); err != nil {
+			return nil, err
+		}
+		sk := &SecretKey{}
+		sk.s.SetBytes(seed)
+		if sk.s.IsZero() == 0 {
+			return sk, nil
+		}
+	}
+}
+
+func SecretKeyFromBytes(b []byte) (*SecretKey, error) {
+	sk := &SecretKey{}
+	if len(b) != SecretKeySize || sk.s.UnmarshalBinary(b) != nil || sk.s.IsZero() == 1 {
+		return nil, ErrInvalidKey
+	}
+	return sk, nil
+}
+
+func (sk *SecretKey) Bytes() []byte {
+	b, _ := sk.s.MarshalBinary()
+	return b
+}
+
+func (sk *SecretKey) PublicKey() *PublicKey {
+	pk := &PublicKey{}
+	pk.p.ScalarMult(&sk.s, bls12381.G2Generator())
+	return pk
+}
+
+func (sk *SecretKey) Sign(msg []byte) *Signature {
+	return sk.sign(sigDomain, msg)
+}
+
+// Prove signs the public key of sk, the proof of possession that goes along with the public key.
+func (sk *SecretKey) Prove() *Signature {
+	return sk.sign(popDomain, sk.PublicKey().Bytes())
+}
+
+func (sk *SecretKey) sign(domain, msg []byte) *Signature {
+	sig := &Signature{}
+	sig.p.Hash(msg, domain)
+	sig.p.ScalarMult(&sk.s, &sig.p)
+	return sig
+}
+
+// PublicKeyFromBytes reads a public key Bytes wrote, it has to be a point of G2 other than the point at infinity.
+func PublicKeyFromBytes(b []byte) (*PublicKey, error) {
+	pk := &PublicKey{}
+	if len(b) != PublicKeySize || pk.p.SetBytes(b) != nil || pk.p.IsIdentity() {
+		return nil, ErrInvalidKey
+	}
+	return pk, nil
+}
+
+func (pk *PublicKey) Bytes() []byte {
+	return pk.p.BytesCompressed()
+}
+
+func (pk *PublicKey) Equal(other *PublicKey) bool {
+	return pk.p.IsEqual(&other.p)
+}
+
+// SignatureFromBytes reads a signature Bytes wrote, it has to be a point of G1.
+func SignatureFromBytes(b []byte) (*Signature, error) {
+	sig := &Signature{}
+	if len(b) != SignatureSize || sig.p.SetBytes(b) != nil {
+		return nil, ErrInvalidSignature
+	}
+	return sig, nil
+}
+
+func (sig *Signature) Bytes() []byte {
+	return sig.p.BytesCompressed()
+}
+
+// Verify reports whether sig is a signature of msg by pk.
+func Verify(pk *PublicKey, msg []byte, sig *Signature) bool {
+	return verify(pk, sigDomain, msg, sig)
+}
+
+// VerifyPossession reports whether proof shows the owner of pk holds its secret key.
+func VerifyPossession(pk *PublicKey, proof *Signature) bool {
+	return verify(pk, popDomain, pk.Bytes(), proof)
+}
+
+// verify checks e(sig, g2) = e(H(msg), pk) as e(sig, g2)^-1·e(H(msg), pk) = 1.
+func verify(pk *PublicKey, domain, msg []byte, sig *Signature) bool {
+	if pk.p.IsIdentity() {
+		return false
+	}
+	var h bls12381.G1
+	h.Hash(msg, domain)
+	e := bls12381.ProdPairFrac([]*bls12381.G1{&sig.p, &h}, []*bls12381.G2{bls12381.G2Generator(), &pk.p}, []int{-1, 1})
+	return e.IsIdentity()
+}
+
+// AggregateSignatures adds signatures up, the sum of signatures of one message verifies against the sum of the keys.
+func AggregateSignatures(sigs ...*Signature) *Signature {
+	agg := &Signature{}
+	agg.p.SetIdentity()
+	for _, sig := range sigs {
+		agg.p.Add(&agg.p, &sig.p)
+	}
+	return agg
+}
+
+// AggregateBytes reads the signatures in sigs, each has to be a point of G1, and adds them up.
+func AggregateBytes(sigs ...[]byte) (*Signature, error) {
+	agg := &Signature{}
+	agg.p.SetIdentity()
+	for _, b := range sigs {
+		sig, err := SignatureFromBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		agg.p.Add(&agg.p, &sig.p)
+	}
+	return agg, nil
+}
+
+// AggregatePublicKeys adds public keys up. Only keys whose proofs of possession were checked may be added.
+func AggregatePublicKeys(pks ...*PublicKey) *PublicKey {
+	agg := &PublicKey{}
+	agg.p.SetIdentity()
+	for _, pk := range pks {
+		agg.p.Add(&agg.p, &pk.p)
+	}
+	return agg
+}
@@ -0,0 +1,152 @@
+package bls
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// one is the secret key 1, its public key is the generator of G2 and it signs a message with the hash of the message.
+func one(t *testing.T) *SecretKey {
+	sk, err := SecretKeyFromBytes(append(make([]byte, SecretKeySize-1), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk
+}
+
+func TestPublicKeyOfOneIsTheGenerator(t *testing.T) {
+	// the generator of G2 compressed in the zkcrypto format the IETF draft encodes points in
+	g2 := "93e02b6052719f607dacd3a088274f65596bd0d09920b61ab5da61bbdc7f5049334cf11213945d57e5ac7d055d042b7e" +
+		"024aa2b2f08f0a91260805272dc51051c6e47ad4fa403b02b4510b647ae3d1770bac0326a805bbefd48056c8c121bdb8"
+	if got := hex.EncodeToString(one(t).PublicKey().Bytes()); got != g2 {
+		t.Fatalf("public key of 1 is %s", got)
+	}
+}
+
+func TestMessagesHashToG1AsRFC9380(t *testing.T) {
+	// the BLS12381G1_XMD:SHA-256_SSWU_RO_ vectors of RFC 9380, appendix J.9.1, as the uncompressed x and y of the point
+	dst := []byte("QUUX-V01-CS02-with-BLS12381G1_XMD:SHA-256_SSWU_RO_")
+	vectors := []struct{ msg, x, y string }{
+		{"",
+			"052926add2207b76ca4fa57a8734416c8dc95e24501772c814278700eed6d1e4e8cf62d9c09db0fac349612b759e79a1",
+			"08ba738453bfed09cb546dbb0783dbb3a5f1f566ed67bb6be0e8c67e2e81a4cc68ee29813bb7994998f3eae0c9c6a265"},
+		{"abc",
+			"03567bc5ef9c690c2ab2ecdf6a96ef1c139cc0b2f284dca0a9a7943388a49a3aee664ba5379a7655d3c68900be2f6903",
+			"0b9c15f3fe6e5cf4211f346271d7b01c8f3b28be689c8429c85b67af215533311f0b8dfaaa154fa6b88176c229f2885d"},
+	}
+	for _, v := range vectors {
+		sig := one(t).sign(dst, []byte(v.msg))
+		if got := hex.EncodeToString(sig.p.Bytes()); got != v.x+v.y {
+			t.Fatalf("%q hashes to %s", v.msg, got)
+		}
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	sk, _ := GenerateKey(r)
+	other, _ := GenerateKey(r)
+	msg := []byte("prepare")
+	sig := sk.Sign(msg)
+
+	if !Verify(sk.PublicKey(), msg, sig) {
+		t.Fatal("signature doesn't verify")
+	}
+	if Verify(sk.PublicKey(), []byte("commit"), sig) {
+		t.Fatal("signature verifies for another message")
+	}
+	if Verify(other.PublicKey(), msg, sig) {
+		t.Fatal("signature verifies for another key")
+	}
+	if Verify(sk.PublicKey(), sk.PublicKey().Bytes(), sk.Prove()) {
+		t.Fatal("proof of possession verifies as a signature")
+	}
+	if !VerifyPossession(sk.PublicKey(), sk.Prove()) || VerifyPossession(other.PublicKey(), sk.Prove()) {
+		t.Fatal("proof of possession is wrong")
+	}
+}
+
+func TestAggregateVerifiesAgainstTheSumOfTheKeys(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	msg := []byte("checkpoint")
+	var pks []*PublicKey
+	var sigs [][]byte
+	for i := 0; i < 4; i++ {
+		sk, _ := GenerateKey(r)
+		pks = append(pks, sk.PublicKey())
+		sigs = append(sigs, sk.Sign(msg).Bytes())
+	}
+	agg, err := AggregateBytes(sigs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Verify(AggregatePublicKeys(pks...), msg, agg) {
+		t.Fatal("aggregate doesn't verify")
+	}
+	if Verify(AggregatePublicKeys(pks[:3]...), msg, agg) {
+		t.Fatal("aggregate verifies without one of the signers")
+	}
+	parsed := make([]*Signature, 0, len(sigs))
+	for _, b := range sigs {
+		sig, err := SignatureFromBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, sig)
+	}
+	if !bytes.Equal(AggregateSignatures(parsed...).Bytes(), agg.Bytes()) {
+		t.Fatal("aggregates of the same signatures differ")
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	sk, _ := GenerateKey(rand.New(rand.NewSource(3)))
+	if again, err := SecretKeyFromBytes(sk.Bytes()); err != nil || !again.PublicKey().Equal(sk.PublicKey()) {
+		t.Fatal("secret key doesn't read back")
+	}
+	if pk, err := PublicKeyFromBytes(sk.PublicKey().Bytes()); err != nil || !pk.Equal(sk.PublicKey()) {
+		t.Fatal("public key doesn't read back")
+	}
+	sig := sk.Sign([]byte("m"))
+	if again, err := SignatureFromBytes(sig.Bytes()); err != nil || !bytes.Equal(again.Bytes(), sig.Bytes()) {
+		t.Fatal("signature doesn't read back")
+	}
+
+	order := mustHex(t, "73eda753299d7d483339d80809a1d80553bda402fffe5bfeffffffff00000001")
+	for _, b := range [][]byte{make([]byte, SecretKeySize), order, sk.Bytes()[1:]} {
+		if _, err := SecretKeyFromBytes(b); err == nil {
+			t.Fatalf("secret key %x read", b)
+		}
+	}
+	infinity := append([]byte{0xc0}, make([]byte, PublicKeySize-1)...)
+	if _, err := PublicKeyFromBytes(infinity); err == nil {
+		t.Fatal("public key at infinity read")
+	}
+	bad := sig.Bytes()
+	bad[len(bad)-1] ^= 1
+	if s, err := SignatureFromBytes(bad); err == nil && Verify(sk.PublicKey(), []byte("m"), s) {
+		t.Fatal("altered signature verifies")
+	}
+	if _, err := AggregateBytes(sig.Bytes(), sig.Bytes()[1:]); err == nil {
+		t.Fatal("short signature aggregated")
+	}
+}
+
+func TestGenerateKeyIsDeterministic(t *testing.T) {
+	a, _ := GenerateKey(rand.New(rand.NewSource(4)))
+	b, _ := GenerateKey(rand.New(rand.NewSource(4)))
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Fatal("same seed gave different keys")
+	}
+}
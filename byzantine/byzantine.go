@@ -0,0 +1,121 @@
+package byzantine
+
+import (
+	"fmt"
+
+	"github.com/sakesake/PBFT/consensus"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/p2pnetwork"
+)
+
+/*
+A faulty replica runs an ordinary StateEngine whose traffic passes through a Strategy. Node stands between the engine
+and its P2pNetwork: every message the engine sends, to one replica or to all of them, is handed to the strategy once
+per destination, and every message delivered to the replica is shown to the strategy before the engine sees it. A
+strategy can change, drop, multiply or invent messages, which covers the behaviours PBFT has to survive from at most
+f replicas.
+*/
+type Strategy interface {
+	// Outgoing returns what the faulty replica really sends to replica to when its engine sends msg.
+	Outgoing(n *Node, to int64, msg *message.ConMessage) []*message.ConMessage
+	// Incoming sees every message delivered to the faulty replica and reports whether the engine gets it.
+	Incoming(n *Node, msg *message.ConMessage) bool
+}
+
+type Node struct {
+	ID       int64
+	Engine   *consensus.StateEngine
+	Strategy Strategy
+	// Auth, when the replicas authenticate their messages, seals what the strategy sends with the keys of the replica.
+	Auth     consensus.Authenticator
+	wire     p2pnetwork.P2pNetwork
+	replicas []int64
+}
+
+/*
+Wrap puts strategy between engine and wire, the transport the engine would use if it were correct. From then on the
+replica's incoming messages have to be passed to Node.HandleMessage instead of the engine.
+*/
+func Wrap(engine *consensus.StateEngine, wire p2pnetwork.P2pNetwork, strategy Strategy) *Node {
+	n := &Node{
+		ID:       engine.NodeID,
+		Engine:   engine,
+		Strategy: strategy,
+		wire:     wire,
+		replicas: engine.Config().Replicas,
+	}
+	engine.SetP2pNetwork(n)
+	return n
+}
+
+func (n *Node) BroadCast(v interface{}) error {
+	msg, ok := v.(*message.ConMessage)
+	if !ok {
+		return fmt.Errorf("BroadCast: expected *message.ConMessage, got %T", v)
+	}
+	for _, to := range n.replicas {
+		cp := *msg
+		n.sendAll(to, n.Strategy.Outgoing(n, to, &cp))
+	}
+	return nil
+}
+
+func (n *Node) SendToNode(nodeID int64, v interface{}) error {
+	msg, ok := v.(*message.ConMessage)
+	if !ok {
+		return fmt.Errorf("SendToNode: expected *message.ConMessage, got %T", v)
+	}
+	cp := *msg
+	n.sendAll(nodeID, n.Strategy.Outgoing(n, nodeID, &cp))
+	return nil
+}
+
+func (n *Node) PeerCount() int {
+	return n.wire.PeerCount()
+}
+
+func (n *Node) SetPeers(ids []int64) {
+	n.replicas = append([]int64(nil), ids...)
+	if ps, ok := n.wire.(p2pnetwork.PeerSetter); ok {
+		ps.SetPeers(ids)
+	}
+}
+
+func (n *Node) sendAll(to int64, msgs []*message.ConMessage) {
+	for _, m := range msgs {
+		_ = n.Send(to, m)
+	}
+}
+
+// Send puts msg on the wire without going through the strategy, sealed for to when there is an Auth.
+func (n *Node) Send(to int64, msg *message.ConMessage) error {
+	if n.Auth != nil {
+		n.Auth.Seal(msg, []int64{to})
+	}
+	return n.wire.SendToNode(to, msg)
+}
+
+// Multicast sends msg to every replica, the faulty one included, without going through the strategy.
+func (n *Node) Multicast(msg *message.ConMessage) {
+	for _, to := range n.replicas {
+		cp := *msg
+		_ = n.Send(to, &cp)
+	}
+}
+
+func (n *Node) HandleMessage(msg *message.ConMessage) {
+	if n.Strategy.Incoming(n, msg) {
+		n.Engine.HandleMessage(msg)
+	}
+}
+
+// Honest passes everything through, strategies embed it and override what they change.
+type Honest struct{}
+
+func (Honest) Outgoing(_ *Node, _ int64, msg *message.ConMessage) []*message.ConMessage {
+	return []*message.ConMessage{msg}
+}
+
+func (Honest) Incoming(_ *Node, _ *message.ConMessage) bool {
+	return true
+}
@@ -0,0 +1,274 @@
+package byzantine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+func rewrite(msg *message.ConMessage, payload interface{}) *message.ConMessage {
+	cp := *msg
+	if err := cp.SetBody(payload); err != nil {
+		return msg
+	}
+	return &cp
+}
+
+/*
+Equivocate makes a primary tell two stories: the backups with an odd id get PRE-PREPAREs with a different digest than
+the others. Neither half can gather a quorum of matching PREPAREs for the other story.
+*/
+type Equivocate struct {
+	Honest
+}
+
+func (Equivocate) Outgoing(n *Node, to int64, msg *message.ConMessage) []*message.ConMessage {
+	if msg.Typ != message.MTPrePrepare || to == n.ID || to%2 == 0 {
+		return []*message.ConMessage{msg}
+	}
+	body, err := msg.Body()
+	if err != nil {
+		return []*message.ConMessage{msg}
+	}
+	pp := *body.(*message.PrePrepare)
+	pp.Digest = fmt.Sprintf("equivocated-%d-%d", pp.ViewID, pp.SequenceID)
+	return []*message.ConMessage{rewrite(msg, &pp)}
+}
+
+/*
+VoteForEverything sends a PREPARE and a COMMIT for every view, sequence number and digest it sees in a PRE-PREPARE,
+PREPARE or COMMIT, whether or not it is consistent with anything else it voted for.
+*/
+type VoteForEverything struct {
+	Honest
+	voted map[string]bool
+}
+
+type vote struct {
+	ViewID     int64  `json:"viewID"`
+	SequenceID int64  `json:"sequenceID"`
+	Digest     string `json:"digest"`
+}
+
+func (vf *VoteForEverything) Incoming(n *Node, msg *message.ConMessage) bool {
+	switch msg.Typ {
+	case message.MTPrePrepare, message.MTPrepare, message.MTCommit:
+	default:
+		return true
+	}
+	v := &vote{}
+	if err := json.Unmarshal(msg.Payload, v); err != nil {
+		return true
+	}
+	if vf.voted == nil {
+		vf.voted = make(map[string]bool)
+	}
+	key := fmt.Sprintf("%d-%d-%s", v.ViewID, v.SequenceID, v.Digest)
+	if vf.voted[key] {
+		return true
+	}
+	vf.voted[key] = true
+
+	prepare := message.CreateConMsg(message.MTPrepare, &message.Prepare{
+		ViewID:     v.ViewID,
+		SequenceID: v.SequenceID,
+		Digest:     v.Digest,
+		NodeID:     n.ID,
+	})
+	prepare.From = uint(n.ID)
+	commit := message.CreateConMsg(message.MTCommit, &message.Commit{
+		ViewID:     v.ViewID,
+		SequenceID: v.SequenceID,
+		Digest:     v.Digest,
+		NodeID:     n.ID,
+	})
+	commit.From = uint(n.ID)
+	n.Multicast(prepare)
+	n.Multicast(commit)
+	return true
+}
+
+// Silent receives everything and never sends a message, like a crashed replica that the others can't tell is crashed.
+type Silent struct {
+	Honest
+}
+
+func (Silent) Outgoing(_ *Node, _ int64, _ *message.ConMessage) []*message.ConMessage {
+	return nil
+}
+
+/*
+ForgeFrom sends its messages claiming to come from replica As, or from the next replica when As is negative. Only the
+transport field is forged, the engine takes the voter from the signed payload, so the forgery must not count as a vote
+of As.
+*/
+type ForgeFrom struct {
+	Honest
+	As int64
+}
+
+func (ff ForgeFrom) Outgoing(n *Node, _ int64, msg *message.ConMessage) []*message.ConMessage {
+	as := ff.As
+	if as < 0 {
+		as = (n.ID + 1) % message.TotalNodeNO
+	}
+	msg.From = uint(as)
+	return []*message.ConMessage{msg}
+}
+
+/*
+Replay keeps every message it receives and, each time it sends a message, also sends one of the recorded messages from
+an older view to the same replica, oldest first.
+*/
+type Replay struct {
+	Honest
+	history []*message.ConMessage
+	next    int
+}
+
+func (rp *Replay) Incoming(_ *Node, msg *message.ConMessage) bool {
+	rp.history = append(rp.history, msg)
+	return true
+}
+
+func (rp *Replay) Outgoing(n *Node, _ int64, msg *message.ConMessage) []*message.ConMessage {
+	out := []*message.ConMessage{msg}
+	for rp.next < len(rp.history) {
+		old := rp.history[rp.next]
+		rp.next++
+		if viewOf(old) < n.Engine.CurViewID {
+			out = append(out, old)
+			break
+		}
+	}
+	return out
+}
+
+func viewOf(msg *message.ConMessage) int64 {
+	v := &vote{}
+	if err := json.Unmarshal(msg.Payload, v); err != nil {
+		return -1
+	}
+	return v.ViewID
+}
+
+/*
+FabricatePMsg sends VIEW-CHANGEs claiming that Count requests above its last stable checkpoint prepared in the previous
+view with a digest nobody ever proposed, backed by PREPAREs it makes up for every replica.
+*/
+type FabricatePMsg struct {
+	Honest
+	Count int64
+}
+
+func (fp FabricatePMsg) Outgoing(_ *Node, _ int64, msg *message.ConMessage) []*message.ConMessage {
+	if msg.Typ != message.MTViewChange {
+		return []*message.ConMessage{msg}
+	}
+	body, err := msg.Body()
+	if err != nil {
+		return []*message.ConMessage{msg}
+	}
+	vc := *body.(*message.ViewChange)
+
+	count := fp.Count
+	if count <= 0 {
+		count = 1
+	}
+	vc.PMsg = make(map[int64]*message.PTuple)
+	for seq := vc.LastCPSeq + 1; seq <= vc.LastCPSeq+count; seq++ {
+		pp := &message.PrePrepare{
+			ViewID:     vc.NewViewID - 1,
+			SequenceID: seq,
+			Digest:     fmt.Sprintf("fabricated-%d", seq),
+		}
+		prepares := make(message.PrepareMsg)
+		for id := int64(0); id < message.TotalNodeNO; id++ {
+			prepares[id] = &message.Prepare{
+				ViewID:     pp.ViewID,
+				SequenceID: seq,
+				Digest:     pp.Digest,
+				NodeID:     id,
+			}
+		}
+		vc.PMsg[seq] = &message.PTuple{
+			PPMsg: pp,
+			PMsg:  prepares,
+		}
+	}
+	return []*message.ConMessage{rewrite(msg, &vc)}
+}
+
+/*
+ForgeNewView sends, along with the first PREPARE of every view, a NEW-VIEW for the next view whose primary it isn't.
+The new view claims every replica asked for it with nothing prepared, and still pre-prepares a digest nobody proposed
+at the sequence number being prepared.
+*/
+type ForgeNewView struct {
+	Honest
+	forged map[int64]bool
+}
+
+func (fn *ForgeNewView) Outgoing(n *Node, _ int64, msg *message.ConMessage) []*message.ConMessage {
+	if msg.Typ != message.MTPrepare {
+		return []*message.ConMessage{msg}
+	}
+	body, err := msg.Body()
+	if err != nil {
+		return []*message.ConMessage{msg}
+	}
+	prepare := body.(*message.Prepare)
+	view := prepare.ViewID + 1
+	if n.Engine.Config().Primary(view) == n.ID {
+		view++
+	}
+	if fn.forged == nil {
+		fn.forged = make(map[int64]bool)
+	}
+	if fn.forged[view] {
+		return []*message.ConMessage{msg}
+	}
+	fn.forged[view] = true
+
+	nv := &message.NewView{
+		NewViewID: view,
+		VMsg:      make(message.VMessage),
+		OMsg: message.OMessage{prepare.SequenceID: {
+			ViewID:     view,
+			SequenceID: prepare.SequenceID,
+			Digest:     fmt.Sprintf("forged-%d", prepare.SequenceID),
+		}},
+		NMsg: make(message.OMessage),
+	}
+	for _, id := range n.replicas {
+		nv.VMsg[id] = &message.ViewChange{NewViewID: view, NodeID: id, PMsg: map[int64]*message.PTuple{}}
+	}
+	forged := message.CreateConMsg(message.MTNewView, nv)
+	forged.From = uint(n.ID)
+	n.Multicast(forged)
+	return []*message.ConMessage{msg}
+}
+
+// ByName returns a fresh instance of a strategy, for command lines and test tables.
+func ByName(name string) (Strategy, error) {
+	switch name {
+	case "honest":
+		return Honest{}, nil
+	case "equivocate":
+		return Equivocate{}, nil
+	case "vote-all":
+		return &VoteForEverything{}, nil
+	case "silent":
+		return Silent{}, nil
+	case "forge-from":
+		return ForgeFrom{As: -1}, nil
+	case "replay":
+		return &Replay{}, nil
+	case "fabricate-pmsg":
+		return FabricatePMsg{Count: 3}, nil
+	case "forge-new-view":
+		return &ForgeNewView{}, nil
+	}
+	return nil, fmt.Errorf("unknown byzantine strategy[%s]", name)
+}
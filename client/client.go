@@ -0,0 +1,388 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/tracing"
+)
+
+/*
+A client c requests the execution of state machine operation o by sending a <REQUEST, o, t, c> message to the
+primary. Timestamp t is used to ensure exactly-once semantics for the execution of client requests. Timestamps for c’s
+requests are totally ordered such that later requests have higher timestamps than earlier ones.
+
+Each message sent by the replicas to the client includes the current view number, allowing the client to track the
+view and hence the current primary. A replica sends the reply to the request directly to the client. The reply has the
+form <REPLY, v, t, c, i, r> where v is the current view number, t is the timestamp of the corresponding request, i is
+the replica number, and r is the result of executing the requested operation.
+
+The client waits for f+1 replies with valid signatures from different replicas, and with the same t and r, before
+accepting the result r. This ensures that the result is valid, since at most f replicas can be faulty.
+
+If the client does not receive replies soon enough, it broadcasts the request to all replicas. If the request has
+already been processed, the replicas simply re-send the reply; replicas remember the last reply message they sent to
+each client. Otherwise, if the replica is not the primary, it relays the request to the primary.
+*/
+
+const DefaultTimeout = 2 * time.Second
+const MaxReplyNO = 100
+
+var ErrRejected = errors.New("request rejected by replicas")
+
+type Client struct {
+	ID            string
+	Endpoint      string
+	Timeout       time.Duration
+	DigestReplies bool
+	// Key signs the requests, replicas that authenticate clients drop requests without a valid signature
+	Key      ed25519.PrivateKey
+	Log      logging.Logger
+	conn     *net.UDPConn
+	replicas map[int64]*net.UDPAddr
+	lastTime int64
+	replies  chan *message.Reply
+
+	// viewID is read by View while an invocation holds mu and moves the view forward
+	viewID atomic.Int64
+	mu     sync.Mutex
+}
+
+func NewClient(id string, local *net.UDPAddr, replicas map[int64]*net.UDPAddr) (*Client, error) {
+	if len(replicas) < message.TotalNodeNO {
+		return nil, fmt.Errorf("need %d replica addresses, got %d", message.TotalNodeNO, len(replicas))
+	}
+	conn, err := net.ListenUDP("udp4", local)
+	if err != nil {
+		return nil, err
+	}
+
+	// replicas that didn't get the request straight from us can only reply to an endpoint declared in the request
+	endpoint, err := localEndpoint(conn, replicas)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &Client{
+		ID:       id,
+		Endpoint: endpoint,
+		Timeout:  DefaultTimeout,
+		Log:      logging.Default().With(logging.F("client", id)),
+		conn:     conn,
+		replicas: replicas,
+		replies:  make(chan *message.Reply, MaxReplyNO),
+	}
+	go c.waitReply()
+	return c, nil
+}
+
+/*
+localEndpoint is the address replicas reach conn at. When conn is bound to all interfaces it is the address of the
+interface the first replica is routed through; connecting a UDP socket sends nothing.
+*/
+func localEndpoint(conn *net.UDPConn, replicas map[int64]*net.UDPAddr) (string, error) {
+	local := conn.LocalAddr().(*net.UDPAddr)
+	if !local.IP.IsUnspecified() {
+		return local.String(), nil
+	}
+	ids := make([]int64, 0, len(replicas))
+	for id := range replicas {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	probe, err := net.DialUDP("udp4", nil, replicas[ids[0]])
+	if err != nil {
+		return "", fmt.Errorf("resolve local endpoint: %w", err)
+	}
+	defer probe.Close()
+	ip := probe.LocalAddr().(*net.UDPAddr).IP
+	return (&net.UDPAddr{IP: ip, Port: local.Port}).String(), nil
+}
+
+func LocalReplicas() map[int64]*net.UDPAddr {
+	replicas := make(map[int64]*net.UDPAddr)
+	for id := int64(0); id < message.TotalNodeNO; id++ {
+		replicas[id] = &net.UDPAddr{
+			Port: message.PortByID(id),
+		}
+	}
+	return replicas
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// View returns the view the client believes is current.
+func (c *Client) View() int64 {
+	return c.viewID.Load()
+}
+
+// SetView makes the client send its next requests to the primary of view.
+func (c *Client) SetView(view int64) {
+	c.viewID.Store(view)
+}
+
+func (c *Client) primaryID() int64 {
+	return c.View() % message.TotalNodeNO
+}
+
+func (c *Client) nextTimeStamp() int64 {
+	ts := time.Now().UnixNano()
+	if ts <= c.lastTime {
+		ts = c.lastTime + 1
+	}
+	c.lastTime = ts
+	return ts
+}
+
+func (c *Client) waitReply() {
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				close(c.replies)
+				return
+			}
+			c.Log.Error("read reply failed", logging.Err(err))
+			continue
+		}
+
+		reply := &message.Reply{}
+		if err := json.Unmarshal(buf[:n], reply); err != nil {
+			c.Log.Error("invalid reply", logging.Err(err))
+			continue
+		}
+		c.replies <- reply
+	}
+}
+
+func (c *Client) send(id int64, data []byte) error {
+	addr, ok := c.replicas[id]
+	if !ok {
+		return fmt.Errorf("no address for replica[%d]", id)
+	}
+	_, err := c.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (c *Client) encode(request *message.Request) ([]byte, error) {
+	if c.Key != nil {
+		auth.SignRequest(request, c.Key)
+	}
+	return json.Marshal(request)
+}
+
+func (c *Client) multicast(data []byte) {
+	for id := range c.replicas {
+		if err := c.send(id, data); err != nil {
+			c.Log.Error("send to replica failed", logging.F("peer", id), logging.Err(err))
+		}
+	}
+}
+
+// newRequest leaves SeqID zero, the sequence number is assigned by the primary that orders the request.
+func (c *Client) newRequest(op string, readOnly bool) *message.Request {
+	request := &message.Request{
+		TimeStamp: c.nextTimeStamp(),
+		ClientID:  c.ID,
+		Operation: op,
+		Endpoint:  c.Endpoint,
+		ReadOnly:  readOnly,
+		TraceID:   tracing.NewTraceID(),
+	}
+	if c.DigestReplies {
+		request.DigestReply = true
+		request.Replier = request.TimeStamp % message.TotalNodeNO
+	}
+	return request
+}
+
+/*
+Invoke sends the operation to the primary of the view the client believes is current and blocks until f+1 different
+replicas agree on the result, the context is done or the client is closed. Every time the timeout expires without an
+accepted result the request is multicast to all replicas.
+*/
+func (c *Client) Invoke(ctx context.Context, op string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.invoke(ctx, op)
+}
+
+/*
+InvokeReadOnly multicasts a read-only operation to all replicas, which execute it right away against their current
+state. The result is accepted once 2f+1 different replicas agree on it. If that doesn't happen before the timeout, or
+the replies can no longer reach such a quorum, the operation is retransmitted as a regular request.
+*/
+func (c *Client) InvokeReadOnly(ctx context.Context, op string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	request := c.newRequest(op, true)
+	data, err := c.encode(request)
+	if err != nil {
+		return "", err
+	}
+	c.multicast(data)
+
+	result, err := c.collect(ctx, request, 2*message.MaxFaultyNode+1, func() bool {
+		return false
+	})
+	if err == nil || ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+		return result, err
+	}
+
+	c.Log.Info("read-only request failed, retry as read-write", logging.F("timestamp", request.TimeStamp), logging.Err(err))
+	return c.invoke(ctx, op)
+}
+
+func (c *Client) invoke(ctx context.Context, op string) (string, error) {
+	request := c.newRequest(op, false)
+	data, err := c.encode(request)
+	if err != nil {
+		return "", err
+	}
+	if err := c.send(c.primaryID(), data); err != nil {
+		return "", err
+	}
+
+	return c.collect(ctx, request, message.MaxFaultyNode+1, func() bool {
+		c.Log.Info("request timeout, multicast to all replicas", logging.F("timestamp", request.TimeStamp))
+		if data, err := c.encode(request); err == nil {
+			c.multicast(data)
+		}
+		return true
+	})
+}
+
+/*
+collect waits until quorum different replicas send the same result for request, or 2f+1 replicas send the same result
+when some of them are tentative replies. With digest replies the replicas vote with the digest of the result, and the
+result itself must come from one of them. If only digests agree the designated replier is suspected and another of
+the agreeing replicas is asked for the full result. retry is called every time the timeout expires, collect gives up
+when it returns false. A read-only request also gives up once its replies can't reach quorum, every replica answers it
+once; a read-write request keeps waiting, the replicas whose tentative replies disagree still send committed ones.
+*/
+func (c *Client) collect(ctx context.Context, request *message.Request, quorum int, retry func() bool) (string, error) {
+	timer := time.NewTimer(c.Timeout)
+	defer timer.Stop()
+
+	votes := make(map[string]map[int64]*message.Reply)
+	committed := make(map[string]map[int64]*message.Reply)
+	results := make(map[string]string)
+	replied := make(map[int64]bool)
+	asked := map[int64]bool{request.Replier: true}
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+
+		case <-timer.C:
+			if !retry() {
+				return "", fmt.Errorf("no %d matching replies for request[%d]", quorum, request.TimeStamp)
+			}
+			timer.Reset(c.Timeout)
+
+		case reply, ok := <-c.replies:
+			if !ok {
+				return "", net.ErrClosed
+			}
+			if reply.ClientID != c.ID || reply.Timestamp != request.TimeStamp {
+				continue
+			}
+			if _, ok := c.replicas[reply.NodeID]; !ok {
+				continue
+			}
+
+			dig := reply.ResultDigest
+			if reply.Result != "" || dig == "" {
+				dig = message.ResultDigest(reply.Result)
+				results[dig] = reply.Result
+			}
+
+			replied[reply.NodeID] = true
+			voters := addVote(votes, dig, reply)
+			if !reply.Tentative {
+				addVote(committed, dig, reply)
+			}
+			if len(committed[dig]) < quorum && len(voters) < 2*message.MaxFaultyNode+1 {
+				best := 0
+				for _, v := range votes {
+					if len(v) > best {
+						best = len(v)
+					}
+				}
+				if request.ReadOnly && best+len(c.replicas)-len(replied) < quorum {
+					return "", fmt.Errorf("replies for request[%d] can't reach %d matching", request.TimeStamp, quorum)
+				}
+				continue
+			}
+
+			result, ok := results[dig]
+			if !ok {
+				c.askFullReply(request, voters, asked)
+				continue
+			}
+
+			// at least one of the agreeing replicas is correct, so it's safe to move to the smallest view they report
+			viewID := reply.ViewID
+			for _, r := range voters {
+				if r.ViewID < viewID {
+					viewID = r.ViewID
+				}
+			}
+			if viewID > c.View() {
+				c.SetView(viewID)
+			}
+			if result == message.RejectQueueFull || result == message.RejectDraining || result == message.RejectNotReadOnly {
+				return "", ErrRejected
+			}
+			return result, nil
+		}
+	}
+}
+
+func addVote(votes map[string]map[int64]*message.Reply, dig string, reply *message.Reply) map[int64]*message.Reply {
+	voters, ok := votes[dig]
+	if !ok {
+		voters = make(map[int64]*message.Reply)
+		votes[dig] = voters
+	}
+	voters[reply.NodeID] = reply
+	return voters
+}
+
+func (c *Client) askFullReply(request *message.Request, voters map[int64]*message.Reply, asked map[int64]bool) {
+	for id := range voters {
+		if asked[id] {
+			continue
+		}
+		asked[id] = true
+		request.Replier = id
+		c.Log.Info("ask replica for full result", logging.F("timestamp", request.TimeStamp), logging.F("peer", id))
+
+		data, err := c.encode(request)
+		if err != nil {
+			return
+		}
+		if err := c.send(id, data); err != nil {
+			c.Log.Error("send to replica failed", logging.F("peer", id), logging.Err(err))
+		}
+		return
+	}
+}
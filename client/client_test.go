@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+)
+
+// fakeReplicas listens on one loopback port per replica and hands every request it reads to serve.
+func fakeReplicas(t *testing.T, serve func(id int64, conn *net.UDPConn, from *net.UDPAddr, request *message.Request)) map[int64]*net.UDPAddr {
+	t.Helper()
+	replicas := make(map[int64]*net.UDPAddr)
+	for id := int64(0); id < message.TotalNodeNO; id++ {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		replicas[id] = conn.LocalAddr().(*net.UDPAddr)
+
+		go func(id int64) {
+			buf := make([]byte, 2048)
+			for {
+				n, from, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				request := &message.Request{}
+				if err := json.Unmarshal(buf[:n], request); err != nil {
+					continue
+				}
+				serve(id, conn, from, request)
+			}
+		}(id)
+	}
+	return replicas
+}
+
+func reply(conn *net.UDPConn, to *net.UDPAddr, r *message.Reply) {
+	data, _ := json.Marshal(r)
+	conn.WriteToUDP(data, to)
+}
+
+func newTestClient(t *testing.T, replicas map[int64]*net.UDPAddr) *Client {
+	t.Helper()
+	c, err := NewClient("client-0", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, replicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Log = logging.Nop()
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestInvokeSendsUnorderedRequestToPrimary(t *testing.T) {
+	got := make(chan int64, message.TotalNodeNO)
+	replicas := fakeReplicas(t, func(id int64, conn *net.UDPConn, from *net.UDPAddr, request *message.Request) {
+		if request.SeqID != 0 {
+			t.Errorf("client chose sequence no[%d]", request.SeqID)
+		}
+		got <- id
+		for i := int64(0); i < message.TotalNodeNO; i++ {
+			reply(conn, from, &message.Reply{
+				ViewID:    6,
+				Timestamp: request.TimeStamp,
+				ClientID:  request.ClientID,
+				NodeID:    i,
+				Result:    "ok",
+			})
+		}
+	})
+	c := newTestClient(t, replicas)
+	c.SetView(5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := c.Invoke(ctx, "op")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "ok" {
+		t.Fatalf("result %q", result)
+	}
+	if id := <-got; id != 5%message.TotalNodeNO {
+		t.Fatalf("request went to replica[%d], primary of view 5 is %d", id, 5%message.TotalNodeNO)
+	}
+	if c.View() != 6 {
+		t.Fatalf("client view %d after replies from view 6", c.View())
+	}
+}
+
+func TestViewIsReadableDuringInvoke(t *testing.T) {
+	replicas := fakeReplicas(t, func(int64, *net.UDPConn, *net.UDPAddr, *message.Request) {})
+	c := newTestClient(t, replicas)
+	c.Timeout = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Invoke(ctx, "op")
+		done <- err
+	}()
+
+	view := make(chan int64, 1)
+	go func() { view <- c.View() }()
+	select {
+	case <-view:
+	case <-time.After(5 * time.Second):
+		t.Fatal("View blocked behind a pending invocation")
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("invoke returned %v", err)
+	}
+}
+
+func TestUnspecifiedBindDeclaresConcreteEndpoint(t *testing.T) {
+	replicas := fakeReplicas(t, func(int64, *net.UDPConn, *net.UDPAddr, *message.Request) {})
+	c, err := NewClient("client-0", nil, replicas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	addr, err := net.ResolveUDPAddr("udp4", c.Endpoint)
+	if err != nil {
+		t.Fatalf("endpoint %q: %v", c.Endpoint, err)
+	}
+	if addr.IP.IsUnspecified() || addr.Port == 0 {
+		t.Fatalf("endpoint %q can't be replied to", c.Endpoint)
+	}
+}
+
+func TestInvokeWaitsForCommittedRepliesAfterTentativeOnesDisagree(t *testing.T) {
+	replicas := fakeReplicas(t, func(id int64, conn *net.UDPConn, from *net.UDPAddr, request *message.Request) {
+		if id != 0 {
+			return
+		}
+		// every replica executes tentatively on another state, then the request commits with one result
+		for i := int64(0); i < message.TotalNodeNO; i++ {
+			reply(conn, from, &message.Reply{Timestamp: request.TimeStamp, ClientID: request.ClientID, NodeID: i,
+				Result: "tentative-" + string(rune('a'+i)), Tentative: true})
+		}
+		for i := int64(0); i <= message.MaxFaultyNode; i++ {
+			reply(conn, from, &message.Reply{Timestamp: request.TimeStamp, ClientID: request.ClientID, NodeID: i,
+				Result: "ok"})
+		}
+	})
+	c := newTestClient(t, replicas)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := c.Invoke(ctx, "op")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "ok" {
+		t.Fatalf("result %q", result)
+	}
+}
@@ -0,0 +1,247 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+)
+
+type LogSummary struct {
+	Seq       int64  `json:"sequence"`
+	Stage     string `json:"stage"`
+	ClientID  string `json:"clientID"`
+	Digest    string `json:"digest,omitempty"`
+	Prepares  int    `json:"prepares"`
+	Commits   int    `json:"commits"`
+	Tentative bool   `json:"tentative,omitempty"`
+}
+
+type CheckPointSummary struct {
+	Seq      int64   `json:"sequence"`
+	Digest   string  `json:"digest"`
+	IsStable bool    `json:"isStable"`
+	ViewID   int64   `json:"viewID"`
+	Signers  []int64 `json:"signers"`
+}
+
+type StateSnapshot struct {
+	NodeID        int64                  `json:"nodeID"`
+	CurViewID     int64                  `json:"viewID"`
+	PrimaryID     int64                  `json:"primaryID"`
+	Status        string                 `json:"status"`
+	CurSequence   int64                  `json:"curSeq"`
+	LasExeSeq     int64                  `json:"lastExeSeq"`
+	MiniSeq       int64                  `json:"miniSeq"`
+	MaxSeq        int64                  `json:"maxSeq"`
+	TentativeExec bool                   `json:"tentativeExec"`
+	LastCP        *CheckPointSummary     `json:"lastCP"`
+	CheckPoints   []*CheckPointSummary   `json:"checkPoints"`
+	Logs          []*LogSummary          `json:"logs"`
+	ViewChanges   message.VMessage       `json:"viewChanges"`
+	NewViews      []int64                `json:"newViews"`
+	Clients       []*message.ClientEntry `json:"clients"`
+	Config        *message.Config        `json:"config"`
+	PendingConfig *message.Config        `json:"pendingConfig,omitempty"`
+	PendingAt     int64                  `json:"pendingAt,omitempty"`
+}
+
+func summaryOfCheckPoint(cp *CheckPoint) *CheckPointSummary {
+	if cp == nil {
+		return nil
+	}
+	sum := &CheckPointSummary{
+		Seq:      cp.Seq,
+		Digest:   cp.Digest,
+		IsStable: cp.IsStable,
+		ViewID:   cp.ViewID,
+		Signers:  make([]int64, 0, len(cp.CPMsg)),
+	}
+	for id := range cp.CPMsg {
+		sum.Signers = append(sum.Signers, id)
+	}
+	if len(sum.Signers) == 0 && cp.Cert != nil {
+		sum.Signers = cp.Cert.SignerIDs()
+	}
+	sort.Slice(sum.Signers, func(i, j int) bool { return sum.Signers[i] < sum.Signers[j] })
+	return sum
+}
+
+/*
+Snapshot dumps what an operator needs to see when a cluster stalls: the view, the watermarks, the last checkpoint, a
+summary of every log entry, the view changes the replica has cached and its client table. It is taken by the
+consensus loop between two events, so it is consistent.
+*/
+func (s *StateEngine) Snapshot() *StateSnapshot {
+	var snap *StateSnapshot
+	s.runOnEngine(func() error {
+		snap = s.snapshot()
+		return nil
+	})
+	return snap
+}
+
+func (s *StateEngine) snapshot() *StateSnapshot {
+	snap := &StateSnapshot{
+		NodeID:        s.NodeID,
+		CurViewID:     s.CurViewID,
+		PrimaryID:     s.PrimaryID,
+		Status:        s.nodeStatus.String(),
+		CurSequence:   s.CurSequence,
+		LasExeSeq:     s.LasExeSeq,
+		MiniSeq:       s.MiniSeq,
+		MaxSeq:        s.MaxSeq,
+		TentativeExec: s.tentativeExec,
+		LastCP:        summaryOfCheckPoint(s.lastCP),
+		CheckPoints:   make([]*CheckPointSummary, 0, len(s.checks)),
+		Logs:          make([]*LogSummary, 0, len(s.msgLogs)),
+		ViewChanges:   make(message.VMessage),
+		NewViews:      make([]int64, 0, len(s.sCache.nvMsg)),
+		Clients:       s.clientEntries(),
+		Config:        s.config.Copy(),
+	}
+	if s.pending != nil {
+		snap.PendingConfig = s.pending.config.Copy()
+		snap.PendingAt = s.pending.at
+	}
+
+	for _, cp := range s.checks {
+		snap.CheckPoints = append(snap.CheckPoints, summaryOfCheckPoint(cp))
+	}
+	sort.Slice(snap.CheckPoints, func(i, j int) bool { return snap.CheckPoints[i].Seq < snap.CheckPoints[j].Seq })
+
+	for seq, log := range s.msgLogs {
+		sum := &LogSummary{
+			Seq:       seq,
+			Stage:     log.Stage.String(),
+			ClientID:  log.clientID,
+			Prepares:  len(log.Prepare),
+			Commits:   len(log.Commit),
+			Tentative: log.tentative,
+		}
+		if log.PrePrepare != nil {
+			sum.Digest = log.PrePrepare.Digest
+		}
+		snap.Logs = append(snap.Logs, sum)
+	}
+	sort.Slice(snap.Logs, func(i, j int) bool { return snap.Logs[i].Seq < snap.Logs[j].Seq })
+
+	for id, vc := range s.sCache.vcMsg {
+		snap.ViewChanges[id] = vc
+	}
+	for vid := range s.sCache.nvMsg {
+		snap.NewViews = append(snap.NewViews, vid)
+	}
+	sort.Slice(snap.NewViews, func(i, j int) bool { return snap.NewViews[i] < snap.NewViews[j] })
+
+	return snap
+}
+
+/*
+Operator commands change the engine state, so they are run by the consensus loop like any message instead of from the
+admin server's goroutine.
+*/
+type adminCmd struct {
+	run  func() error
+	done chan error
+}
+
+func (s *StateEngine) runOnEngine(run func() error) error {
+	cmd := &adminCmd{
+		run:  run,
+		done: make(chan error, 1),
+	}
+	s.cmdChan <- cmd
+	return <-cmd.done
+}
+
+// ForceViewChange starts a view change and returns the view it changes to.
+func (s *StateEngine) ForceViewChange() (int64, error) {
+	var view int64
+	err := s.runOnEngine(func() error {
+		if s.nodeStatus == ViewChanging {
+			return fmt.Errorf("node[%d] is already changing view to %d", s.NodeID, s.CurViewID)
+		}
+		s.logger().Info("operator forced a view change")
+		s.ViewChange()
+		view = s.CurViewID
+		return nil
+	})
+	return view, err
+}
+
+// ForceCheckPoint creates a checkpoint at the last executed sequence and returns that sequence.
+func (s *StateEngine) ForceCheckPoint() (int64, error) {
+	var seq int64
+	err := s.runOnEngine(func() error {
+		seq = s.LasExeSeq
+		if s.lastCP != nil && seq <= s.lastCP.Seq {
+			return fmt.Errorf("node[%d] last executed seq[%d] is already checkpointed", s.NodeID, seq)
+		}
+		s.logger().Info("operator forced a checkpoint", logging.F("seq", seq))
+		s.createCheckPoint(seq, s.clientEntries(), s.appState, s.configAt(seq))
+		return nil
+	})
+	return seq, err
+}
+
+// InFlight counts the requests that have been assigned a sequence number but haven't executed yet.
+func (s *StateEngine) InFlight() int {
+	var n int
+	s.runOnEngine(func() error {
+		n = s.inFlight()
+		return nil
+	})
+	return n
+}
+
+// Replicas returns the replicas of the configuration in force, read on the consensus loop.
+func (s *StateEngine) Replicas() []int64 {
+	var replicas []int64
+	s.runOnEngine(func() error {
+		replicas = append(replicas, s.config.Replicas...)
+		return nil
+	})
+	return replicas
+}
+
+/*
+WaitIdle blocks until no request is in flight or ctx is done and returns the requests still in flight. The consensus
+loop checks after every event whether the engine went idle, so nothing polls.
+*/
+func (s *StateEngine) WaitIdle(ctx context.Context) int {
+	idle := make(chan struct{})
+	s.runOnEngine(func() error {
+		s.idle = append(s.idle, idle)
+		s.notifyIdle()
+		return nil
+	})
+	select {
+	case <-idle:
+		return 0
+	case <-ctx.Done():
+		return s.InFlight()
+	}
+}
+
+func (s *StateEngine) notifyIdle() {
+	if len(s.idle) == 0 || s.inFlight() > 0 {
+		return
+	}
+	for _, idle := range s.idle {
+		close(idle)
+	}
+	s.idle = nil
+}
+
+func (s *StateEngine) inFlight() int {
+	n := 0
+	for seq := range s.msgLogs {
+		if seq > s.LasExeSeq {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,114 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+func TestSnapshotIsTakenOnTheLoop(t *testing.T) {
+	te := newTestEngine(t, 0)
+	go te.StartConsensus(nil)
+
+	for i := int64(1); i <= 50; i++ {
+		i := i
+		te.Post(func() {
+			te.CurSequence = i
+			te.LasExeSeq = i
+			te.getOrCreateLog(i)
+		})
+		snap := te.Snapshot()
+		if snap.LasExeSeq != snap.CurSequence {
+			t.Fatalf("snapshot mixes two states: curSeq %d lastExeSeq %d", snap.CurSequence, snap.LasExeSeq)
+		}
+		if int64(len(snap.Logs)) != snap.CurSequence {
+			t.Fatalf("snapshot has %d logs at curSeq %d", len(snap.Logs), snap.CurSequence)
+		}
+	}
+	te.onLoop(func() {})
+	if snap := te.Snapshot(); snap.CurSequence != 50 {
+		t.Fatalf("snapshot after all posts at curSeq %d", snap.CurSequence)
+	}
+}
+
+func TestWaitIdleReturnsOnceInFlightRequestsExecute(t *testing.T) {
+	te := newTestEngine(t, 0)
+	go te.StartConsensus(nil)
+
+	te.onLoop(func() {
+		te.getOrCreateLog(1)
+		te.getOrCreateLog(2)
+	})
+	if n := te.InFlight(); n != 2 {
+		t.Fatalf("%d requests in flight, want 2", n)
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		done <- te.WaitIdle(context.Background())
+	}()
+	te.onLoop(func() { te.LasExeSeq = 1 })
+	select {
+	case n := <-done:
+		t.Fatalf("WaitIdle returned with %d in flight", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	te.Post(func() { te.LasExeSeq = 2 })
+	select {
+	case n := <-done:
+		if n != 0 {
+			t.Fatalf("WaitIdle returned %d in flight", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitIdle didn't return after the requests executed")
+	}
+}
+
+func TestWaitIdleGivesUpWithTheContext(t *testing.T) {
+	te := newTestEngine(t, 0)
+	go te.StartConsensus(nil)
+	te.onLoop(func() { te.getOrCreateLog(1) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if n := te.WaitIdle(ctx); n != 1 {
+		t.Fatalf("WaitIdle returned %d in flight, want 1", n)
+	}
+}
+
+func TestForceViewChangeFromInitialState(t *testing.T) {
+	te := newTestEngine(t, 1)
+	go te.StartConsensus(nil)
+
+	view, err := te.ForceViewChange()
+	if err != nil {
+		t.Fatalf("view change without a checkpoint refused: %v", err)
+	}
+	if view != 1 {
+		t.Fatalf("forced view change to view %d", view)
+	}
+	if snap := te.Snapshot(); snap.Status != ViewChanging.String() {
+		t.Fatalf("status %s after forced view change", snap.Status)
+	}
+	if _, err := te.ForceViewChange(); err == nil {
+		t.Fatal("second view change accepted while changing view")
+	}
+}
+
+func TestReplicasAreReadOnTheLoop(t *testing.T) {
+	te := newTestEngine(t, 0)
+	go te.StartConsensus(nil)
+
+	te.onLoop(func() {
+		config := te.config.Copy()
+		config.Epoch++
+		config.Replicas = append(config.Replicas, int64(len(config.Replicas)))
+		te.installConfig(config, NewCheckPoint(0, 0))
+	})
+	if replicas := te.Replicas(); len(replicas) != message.TotalNodeNO+1 {
+		t.Fatalf("replicas %v after one joined", replicas)
+	}
+}
@@ -0,0 +1,89 @@
+package consensus
+
+import (
+	"errors"
+
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/p2pnetwork"
+)
+
+/*
+Authenticator authenticates the consensus messages between the replicas, package auth implements it with session keys
+it refreshes itself. The engine only seals what it sends and verifies what it receives, the keys and the NEW-KEY
+messages that hand them out stay behind the interface. Without an Authenticator messages are taken as they come.
+*/
+type Authenticator interface {
+	// Seal puts an authenticator for the replicas in to on msg.
+	Seal(msg *message.ConMessage, to []int64)
+	// Verify checks msg was sent by msg.From and is meant for this replica.
+	Verify(msg *message.ConMessage) error
+	// HandleNewKey takes the session keys a peer hands out.
+	HandleNewKey(msg *message.ConMessage) error
+}
+
+// SetAuthenticator makes the engine seal every message it sends from now on and take only messages that verify.
+func (s *StateEngine) SetAuthenticator(a Authenticator) {
+	s.auth = a
+	s.p2pWire = s.sealed(s.p2pWire)
+	if s.bulkWire != nil {
+		s.bulkWire = s.sealed(s.bulkWire)
+	}
+}
+
+func (s *StateEngine) sealed(wire p2pnetwork.P2pNetwork) p2pnetwork.P2pNetwork {
+	if _, ok := wire.(*sealedP2p); ok || s.auth == nil {
+		return wire
+	}
+	return &sealedP2p{P2pNetwork: wire, engine: s}
+}
+
+// sealedP2p seals every message the engine sends for the replicas it is sent to.
+type sealedP2p struct {
+	p2pnetwork.P2pNetwork
+	engine *StateEngine
+}
+
+func (sp *sealedP2p) BroadCast(v interface{}) error {
+	if msg, ok := v.(*message.ConMessage); ok && msg != nil {
+		sp.engine.auth.Seal(msg, sp.engine.replicas())
+	}
+	return sp.P2pNetwork.BroadCast(v)
+}
+
+func (sp *sealedP2p) SendToNode(nodeID int64, v interface{}) error {
+	if msg, ok := v.(*message.ConMessage); ok && msg != nil {
+		sp.engine.auth.Seal(msg, []int64{nodeID})
+	}
+	return sp.P2pNetwork.SendToNode(nodeID, v)
+}
+
+func (sp *sealedP2p) SetPeers(ids []int64) {
+	if ps, ok := sp.P2pNetwork.(p2pnetwork.PeerSetter); ok {
+		ps.SetPeers(ids)
+	}
+}
+
+// authenticate hands a NEW-KEY to the authenticator and reports whether any other message verifies.
+func (s *StateEngine) authenticate(conMsg *message.ConMessage) bool {
+	if conMsg.Typ == message.MTNewKey {
+		if err := s.auth.HandleNewKey(conMsg); err != nil {
+			s.metrics.sigFailures.Inc()
+			s.logger().Warn("NEW-KEY refused", logging.F("peer", conMsg.From), logging.Err(err))
+		}
+		return false
+	}
+	err := s.auth.Verify(conMsg)
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, auth.ErrNotAddressed) {
+		s.logger().Debug("message for other replicas", logging.F("type", conMsg.Typ), logging.F("peer", conMsg.From))
+		return false
+	}
+	s.metrics.sigFailures.Inc()
+	s.logger().Debug("message doesn't authenticate", logging.F("type", conMsg.Typ), logging.F("peer", conMsg.From),
+		logging.Err(err))
+	return false
+}
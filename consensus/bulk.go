@@ -0,0 +1,122 @@
+package consensus
+
+import (
+	"fmt"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/p2pnetwork"
+)
+
+/*
+Request bodies travel on a transport of their own, the bulk wire, while pre-prepares carry only their digests, so a
+large operation doesn't hold up the protocol messages behind it. Without a bulk wire the bodies share the wire of the
+protocol messages.
+
+As the two wires don't keep order between them, a backup may see a request commit before its body arrives. It then
+asks its peers for the body by sequence number and digest; any replica that has the body answers on the bulk wire, the
+digest in the pre-prepare proves the body is the one that was ordered.
+*/
+func (s *StateEngine) SetBulkNetwork(p2p p2pnetwork.P2pNetwork, msgChan <-chan *message.ConMessage) {
+	s.bulkWire = s.sealed(&meteredP2p{P2pNetwork: p2p, sent: s.metrics.sent})
+	s.BulkChan = msgChan
+	s.setPeers()
+}
+
+func (s *StateEngine) bulk() p2pnetwork.P2pNetwork {
+	if s.bulkWire == nil {
+		return s.p2pWire
+	}
+	return s.bulkWire
+}
+
+/*
+executeCommitted hands the committed requests to the node in the order of their sequence numbers, from the one after
+the last executed up to the first that hasn't committed yet or whose body is still being fetched. Requests commit out
+of order when messages overtake each other, every replica still has to execute them in the same order. A null request,
+which a new view orders in a gap, has nothing to execute.
+*/
+func (s *StateEngine) executeCommitted() {
+	for seq := s.LasExeSeq + 1; ; seq++ {
+		log, ok := s.msgLogs[seq]
+		if !ok || log.Stage != Committed {
+			return
+		}
+		if log.PrePrepare.Digest == "" {
+			log.executed = true
+			continue
+		}
+		s.execute(seq, log)
+		if !log.executed {
+			return
+		}
+	}
+}
+
+// execute hands a committed request to the node, or fetches its body first when it hasn't arrived yet.
+func (s *StateEngine) execute(seq int64, log *NormalLog) {
+	if log.executed {
+		return
+	}
+	if log.request == nil {
+		log.request = s.requestBody(seq, log.PrePrepare.Digest)
+	}
+	if log.request == nil {
+		s.fetchRequest(seq, log.PrePrepare.Digest)
+		return
+	}
+	log.executed = true
+	if log.request.Reconfig != nil {
+		s.executeReconfig(seq, log.request)
+		return
+	}
+	//TODO::Check the reply whose sequence is smaller than current sequence.
+	s.nodeChan <- &message.RequestRecord{
+		Request:    log.request,
+		PrePrepare: log.PrePrepare,
+	}
+}
+
+/*
+requestBody is the body of the request ordered at seq with digest. A view change drops the log that held it, the
+request is then still kept with its client until it executes.
+*/
+func (s *StateEngine) requestBody(seq int64, digest string) *message.Request {
+	if log, ok := s.msgLogs[seq]; ok && log.request != nil && message.Digest(log.request) == digest {
+		return log.request
+	}
+	for _, client := range s.cliRecord {
+		if r, ok := client.getRequest(seq); ok && message.Digest(r) == digest {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *StateEngine) fetchRequest(seq int64, digest string) {
+	fetch := &message.FetchRequest{
+		SequenceID: seq,
+		Digest:     digest,
+		NodeID:     s.NodeID,
+	}
+	consMsg := message.CreateConMsg(message.MTFetchRequest, fetch)
+	consMsg.From = uint(s.NodeID)
+	s.logger().Info("fetch request body", logging.F("seq", seq), logging.F("digest", digest))
+	if err := s.p2pWire.BroadCast(consMsg); err != nil {
+		s.logger().Error("fetch request body failed", logging.F("seq", seq), logging.Err(err))
+	}
+}
+
+func (s *StateEngine) sendRequest(fetch *message.FetchRequest) error {
+	if fetch.NodeID == s.NodeID {
+		return nil
+	}
+	request := s.requestBody(fetch.SequenceID, fetch.Digest)
+	if request == nil {
+		return fmt.Errorf("======>[sendRequest] Node: %d has no request[%d] for node[%d]", s.NodeID, fetch.SequenceID, fetch.NodeID)
+	}
+	consMsg := message.CreateConMsg(message.MTRequest, request)
+	consMsg.From = uint(s.NodeID)
+	consMsg.TraceID = request.TraceID
+	return s.bulk().SendToNode(fetch.NodeID, consMsg)
+}
@@ -0,0 +1,62 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+func commitRequest(te *testEngine, seq int64, request *message.Request) {
+	log := te.getOrCreateLog(seq)
+	log.Stage = Committed
+	log.PrePrepare = &message.PrePrepare{SequenceID: seq}
+	if request != nil {
+		request.SeqID = seq
+		log.request = request
+		log.PrePrepare.Digest = message.Digest(request)
+	}
+}
+
+func executed(te *testEngine) []int64 {
+	var seqs []int64
+	for {
+		select {
+		case record := <-te.records:
+			seqs = append(seqs, record.Request.SeqID)
+		default:
+			return seqs
+		}
+	}
+}
+
+func TestCommittedRequestsExecuteInOrder(t *testing.T) {
+	te := newTestEngine(t, 1)
+	commitRequest(te, 3, &message.Request{TimeStamp: 3, ClientID: "client-0"})
+	commitRequest(te, 2, &message.Request{TimeStamp: 2, ClientID: "client-0"})
+	te.executeCommitted()
+	if seqs := executed(te); len(seqs) != 0 {
+		t.Fatalf("executed %v before seq 1 committed", seqs)
+	}
+
+	// seq 1 is a null request a new view ordered in a gap
+	commitRequest(te, 1, nil)
+	te.executeCommitted()
+	if seqs := executed(te); len(seqs) != 2 || seqs[0] != 2 || seqs[1] != 3 {
+		t.Fatalf("executed %v, want [2 3]", seqs)
+	}
+}
+
+func TestRequestBodyOutlivesTheLog(t *testing.T) {
+	te := newTestEngine(t, 1)
+	request := &message.Request{SeqID: 4, TimeStamp: 1, ClientID: "client-0", Operation: "op"}
+	client := NewClientRecord()
+	client.saveRequest(request)
+	te.cliRecord[request.ClientID] = client
+
+	if err := te.sendRequest(&message.FetchRequest{SequenceID: 4, Digest: message.Digest(request), NodeID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if to := sentTypes(te.sent)[message.MTRequest]; len(to) != 1 || to[0] != 2 {
+		t.Fatalf("body sent to %v, want [2]", to)
+	}
+}
@@ -0,0 +1,97 @@
+package consensus
+
+import (
+	"fmt"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+)
+
+/*
+Certifier signs the votes of the replica and aggregates the votes of a quorum into one certificate, package quorum
+implements it with BLS signatures. With a Certifier prepares, commits and checkpoints carry a vote, and a view change
+proves what prepared and which checkpoint is stable by certificates of constant size instead of the 2f prepares of
+every sequence number and the 2f+1 checkpoint messages. View changes without certificates are still taken.
+*/
+type Certifier interface {
+	// Vote signs the statement of qc.
+	Vote(qc *message.QuorumCert) []byte
+	// Certify aggregates the votes on the statement of qc into qc and returns the voters it left out.
+	Certify(qc *message.QuorumCert, votes map[int64][]byte) []int64
+	// Check verifies qc is signed by at least quorum replicas of the configuration.
+	Check(qc *message.QuorumCert, quorum int) error
+}
+
+// SetCertifier makes the engine vote and certify its quorums from now on.
+func (s *StateEngine) SetCertifier(c Certifier) {
+	s.cert = c
+}
+
+// vote is the vote of the replica for a statement, nil without a Certifier.
+func (s *StateEngine) vote(typ message.MType, view, seq int64, digest string) []byte {
+	if s.cert == nil {
+		return nil
+	}
+	return s.cert.Vote(&message.QuorumCert{Typ: typ, ViewID: view, SequenceID: seq, Digest: digest})
+}
+
+/*
+certify aggregates votes into a certificate of the statement typ, view, seq and digest. The voters left out are
+returned for the caller to drop their messages, the certificate only if at least need votes are in it.
+*/
+func (s *StateEngine) certify(typ message.MType, view, seq int64, digest string, votes map[int64][]byte,
+	need int) (*message.QuorumCert, []int64) {
+
+	qc := &message.QuorumCert{Typ: typ, ViewID: view, SequenceID: seq, Digest: digest}
+	bad := s.cert.Certify(qc, votes)
+	for _, id := range bad {
+		s.metrics.sigFailures.Inc()
+		s.logger().Warn("vote doesn't verify", logging.F("type", typ), logging.F("seq", seq), logging.F("peer", id))
+	}
+	if len(votes)-len(bad) < need {
+		return nil, bad
+	}
+	return qc, bad
+}
+
+// checkCert checks qc certifies the statement typ, view, seq and digest with at least need votes.
+func (s *StateEngine) checkCert(qc *message.QuorumCert, typ message.MType, view, seq int64, digest string,
+	need int) error {
+
+	if s.cert == nil {
+		return fmt.Errorf("no certifier to check the certificate of %s[%d]", typ, seq)
+	}
+	if qc.Typ != typ || qc.ViewID != view || qc.SequenceID != seq || qc.Digest != digest {
+		return fmt.Errorf("certificate of %s[%d-%d] is for %s[%d-%d]", typ, view, seq, qc.Typ, qc.ViewID,
+			qc.SequenceID)
+	}
+	if err := s.cert.Check(qc, need); err != nil {
+		return fmt.Errorf("certificate of %s[%d-%d]: %w", typ, view, seq, err)
+	}
+	return nil
+}
+
+/*
+certifyCheckPoint certifies digest as the state of the checkpoint cp from the checkpoint messages that vote for it and
+reports whether enough of them verify. Without a Certifier there is nothing to certify.
+*/
+func (s *StateEngine) certifyCheckPoint(cp *CheckPoint, digest string) bool {
+	if s.cert == nil {
+		return true
+	}
+	if cp.Cert != nil {
+		return cp.Cert.Digest == digest
+	}
+	votes := make(map[int64][]byte)
+	for id, msg := range cp.CPMsg {
+		if msg.Digest == digest {
+			votes[id] = msg.Sig
+		}
+	}
+	qc, bad := s.certify(message.MTCheckpoint, 0, cp.Seq, digest, votes, s.config.Quorum())
+	for _, id := range bad {
+		delete(cp.CPMsg, id)
+	}
+	cp.Cert = qc
+	return qc != nil
+}
@@ -2,7 +2,10 @@ package consensus
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
+	"github.com/sakesake/PBFT/logging"
 	"github.com/sakesake/PBFT/message"
 )
 
@@ -44,6 +47,11 @@ type CheckPoint struct {
 	IsStable bool                          `json:"isStable"`
 	ViewID   int64                         `json:"viewID"`
 	CPMsg    map[int64]*message.CheckPoint `json:"checks"`
+	Clients  []*message.ClientEntry        `json:"clients"`
+	Config   *message.Config               `json:"config"`
+	State    []byte                        `json:"state,omitempty"`
+	// Cert is the certificate of the checkpoint messages that made it stable, when the engine certifies quorums.
+	Cert *message.QuorumCert `json:"cert,omitempty"`
 }
 
 func NewCheckPoint(sq, vi int64) *CheckPoint {
@@ -73,34 +81,48 @@ func NewCheckPoint(sq, vi int64) *CheckPoint {
 	s.cliRecord[reply.ClientID].saveReply(reply)
 } */
 
-func (s *StateEngine) ResetState(reply *message.Reply) {
-	s.mu.Lock()
+/*
+ResetState records the execution of the request with reply.SeqID, which left the application in state, and creates a
+checkpoint when the state it produced is one. It runs on the consensus loop.
+*/
+func (s *StateEngine) ResetState(reply *message.Reply, state []byte) {
 	s.LasExeSeq = reply.SeqID
-	seq := s.CurSequence
-	shouldCheckpoint := (seq%CheckPointInterval == 0 || s.lastCP == nil)
-	s.mu.Unlock()
-
-	if shouldCheckpoint {
-		fmt.Printf("======>[ResetState] Node: %d creating checkpoint at seq=%d\n", s.NodeID, seq)
-		// Run checkpoint creation asynchronously, but not under lock
-		go func(seq int64) {
-			s.mu.Lock()
-			defer s.mu.Unlock()
-			s.createCheckPoint(seq)
-		}(seq)
-	} else {
-		fmt.Printf("======>[ResetState] Node: %d no checkpoint needed at seq=%d\n", s.NodeID, seq)
+	s.appState = state
+	digest := ""
+	if log, ok := s.msgLogs[reply.SeqID]; ok {
+		now := time.Now()
+		s.metrics.observePhase("execute", log.committed, now)
+		s.traceSpan(reply.SeqID, log, "execute", log.committed, now)
+		s.traceSpan(reply.SeqID, log, "request", log.start, now)
+		if log.PrePrepare != nil {
+			digest = log.PrePrepare.Digest
+		}
 	}
+	s.emitRequest(EventExecuted, reply.SeqID, digest, reply.ClientID, reply.Timestamp)
+	client, ok := s.cliRecord[reply.ClientID]
+	if !ok {
+		client = NewClientRecord()
+		s.cliRecord[reply.ClientID] = client
+	}
+	client.saveReply(reply)
 
-	s.cliRecord[reply.ClientID].saveReply(reply)
+	// the checkpoint is the state after the request that just executed, not after the last one the primary assigned
+	seq := reply.SeqID
+	if seq%CheckPointInterval == 0 || s.lastCP == nil {
+		s.logger().Debug("creating checkpoint", logging.F("seq", seq))
+		s.createCheckPoint(seq, s.clientEntries(), s.appState, s.configAt(seq))
+	}
 }
 
-func (s *StateEngine) createCheckPoint(sequence int64) {
+func (s *StateEngine) createCheckPoint(sequence int64, entries []*message.ClientEntry, state []byte,
+	config *message.Config) {
+	digest := stateDigest(sequence, entries, state, config)
 	msg := &message.CheckPoint{
 		SequenceID: sequence,
 		NodeID:     s.NodeID,
 		ViewID:     s.CurViewID,
-		Digest:     fmt.Sprintf("checkpoint message for [seq(%d)]", sequence),
+		Digest:     digest,
+		Sig:        s.vote(message.MTCheckpoint, 0, sequence, digest),
 	}
 
 	cp, ok := s.checks[sequence]
@@ -108,33 +130,45 @@ func (s *StateEngine) createCheckPoint(sequence int64) {
 		cp = NewCheckPoint(sequence, s.CurViewID)
 		// TODO: should it be locked?
 		s.checks[sequence] = cp
-	} else {
-		fmt.Println("TEMP LOG")
 	}
 
-	cp.Digest = fmt.Sprintf("check point message<%d, %d>", s.NodeID, sequence)
+	if cp.IsStable && cp.Digest != digest {
+		// the stable state is different from ours, it's fetched from the others instead
+		s.logger().Error("state differs from the stable checkpoint", logging.F("seq", sequence))
+		return
+	}
+	cp.Digest = digest
+	cp.Clients = entries
+	cp.Config = config
+	cp.State = state
 	cp.CPMsg[s.NodeID] = msg
 
-	fmt.Printf("======>[createCheckPoint] Broadcast check point message<%d, %d>\n", s.NodeID, sequence)
+	s.logger().Debug("broadcast checkpoint message", logging.F("seq", sequence), logging.F("digest", digest))
 	consMsg := message.CreateConMsg(message.MTCheckpoint, msg)
 	consMsg.From = uint(s.NodeID)
 
 	err := s.p2pWire.BroadCast(consMsg)
 	if err != nil {
-		fmt.Println(err)
+		s.logger().Error("broadcast checkpoint failed", logging.F("seq", sequence), logging.Err(err))
 	}
 }
 
 func (s *StateEngine) checkingPoint(msg *message.CheckPoint) error {
-	fmt.Printf("======>[checkingPoint] Node: %d Seq: %d\n", s.NodeID, msg.SequenceID)
+	s.logger().Debug("checkpoint message received", logging.F("seq", msg.SequenceID), logging.F("peer", msg.NodeID))
 	cp, ok := s.checks[msg.SequenceID]
 	if !ok {
 		cp = NewCheckPoint(msg.SequenceID, s.CurViewID)
 		// TODO: should it be locked?
 		s.checks[msg.SequenceID] = cp
 	}
+	if err := s.isMember(msg.NodeID); err != nil {
+		return err
+	}
 	cp.CPMsg[msg.NodeID] = msg
-	fmt.Printf("======>[checkingPoint] Node: %d CPMsg added from: %d\n", s.NodeID, msg.NodeID)
+	if s.recovering != nil {
+		// the checkpoint is run once the state is checked
+		return nil
+	}
 	s.runCheckPoint(msg.SequenceID)
 	return nil
 }
@@ -145,20 +179,35 @@ func (s *StateEngine) runCheckPoint(seq int64) {
 		return
 
 	}
-	if len(cp.CPMsg) < 2*message.MaxFaultyNode+1 {
-		fmt.Printf("======>[checkingPoint] Node: %d message counter:[%d]\n", s.NodeID, len(cp.CPMsg))
-		for key := range cp.CPMsg {
-			fmt.Printf("======>[checkingPoint] Node: %d CPMsg from: %d\n", s.NodeID, key)
+	counter := make(map[string]int)
+	stableDigest := ""
+	if cp.Cert != nil {
+		stableDigest = cp.Cert.Digest
+	}
+	for _, msg := range cp.CPMsg {
+		counter[msg.Digest]++
+		if counter[msg.Digest] >= s.config.Quorum() {
+			stableDigest = msg.Digest
 		}
+	}
+	if stableDigest == "" {
+		s.logger().Debug("not enough matching checkpoint messages", logging.F("seq", seq), logging.F("votes", len(cp.CPMsg)))
 		return
 	}
 	if cp.IsStable {
-		fmt.Printf("======>[checkingPoint] Node: %d Check Point for [%d] has confirmed\n", s.NodeID, cp.Seq)
+		s.logger().Debug("checkpoint has confirmed", logging.F("seq", cp.Seq))
+		return
+	}
+	if !s.certifyCheckPoint(cp, stableDigest) {
+		s.logger().Debug("not enough checkpoint votes verify", logging.F("seq", seq), logging.F("votes", len(cp.CPMsg)))
 		return
 	}
 
-	fmt.Printf("======>[checkingPoint] Node: %d Start to clean the old message data......\n", s.NodeID)
 	cp.IsStable = true
+	agreed := cp.Digest == stableDigest
+	if !agreed {
+		s.fetchState(cp, stableDigest)
+	}
 	for id, log := range s.msgLogs {
 		// TODO sara: should it be returned to `if id > cp.Seq {`?
 		if id >= cp.Seq {
@@ -167,7 +216,7 @@ func (s *StateEngine) runCheckPoint(seq int64) {
 		log.PrePrepare = nil
 		log.Commit = nil
 		delete(s.msgLogs, id)
-		fmt.Printf("======>[checkingPoint] Node: %d Delete log message:CPseq=%d  clientID=%s\n", s.NodeID, id, log.clientID)
+		s.logger().Debug("delete log message", logging.F("seq", id), logging.F("client", log.clientID))
 	}
 
 	for id, cps := range s.checks {
@@ -176,11 +225,170 @@ func (s *StateEngine) runCheckPoint(seq int64) {
 		}
 		cps.CPMsg = nil
 		delete(s.checks, id)
-		fmt.Printf("======>[checkingPoint] Node: %d Delete Checkpoint:seq=%d stable=%t\n", s.NodeID, id, cps.IsStable)
+		s.logger().Debug("delete checkpoint", logging.F("seq", id), logging.F("stable", cps.IsStable))
 	}
 
 	s.MiniSeq = cp.Seq
 	s.MaxSeq = s.MiniSeq + CheckPointK
 	s.lastCP = cp
-	fmt.Printf("======>[checkingPoint] Node: %d Success in Checkpoint forwarding[(%d, %d)]......\n", s.NodeID, s.MiniSeq, s.MaxSeq)
+	if s.pending != nil && agreed && cp.Seq >= s.pending.at {
+		s.installConfig(s.pending.config, cp)
+	}
+	if s.pending != nil && s.MaxSeq > s.pending.at {
+		s.MaxSeq = s.pending.at
+	}
+	s.logger().Info("checkpoint stable", logging.F("seq", cp.Seq), logging.F("digest", cp.Digest),
+		logging.F("low", s.MiniSeq), logging.F("high", s.MaxSeq))
+	s.emit(EventCheckpointStable, cp.Seq, cp.Digest)
+}
+
+/*
+A replica may learn about a stable checkpoint beyond the state it has, either because it is slow or because its
+state is different from the one 2f+1 replicas agree on. It then fetches the state with that digest from one of the
+replicas that vouched for it. The digest in the stable checkpoint proves the transferred state is correct.
+*/
+func (s *StateEngine) fetchState(cp *CheckPoint, digest string) {
+	cp.Digest = digest
+	cp.Clients = nil
+	cp.Config = nil
+	cp.State = nil
+
+	ids := make([]int64, 0, len(cp.CPMsg))
+	for id, msg := range cp.CPMsg {
+		if msg.Digest == digest {
+			ids = append(ids, id)
+		}
+	}
+	if cp.Cert != nil && cp.Cert.Digest == digest {
+		ids = append(ids, cp.Cert.SignerIDs()...)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		if id == s.NodeID {
+			continue
+		}
+		fetch := &message.FetchState{
+			SequenceID: cp.Seq,
+			Digest:     digest,
+			NodeID:     s.NodeID,
+		}
+		consMsg := message.CreateConMsg(message.MTFetchState, fetch)
+		consMsg.From = uint(s.NodeID)
+		s.logger().Info("fetch state", logging.F("seq", cp.Seq), logging.F("peer", id))
+		if err := s.p2pWire.SendToNode(id, consMsg); err != nil {
+			s.logger().Error("fetch state failed", logging.F("seq", cp.Seq), logging.F("peer", id), logging.Err(err))
+		}
+		return
+	}
+}
+
+func (s *StateEngine) sendState(fetch *message.FetchState) error {
+	cp, ok := s.checks[fetch.SequenceID]
+	if !ok || cp.Digest != fetch.Digest || cp.Clients == nil {
+		return fmt.Errorf("======>[sendState] Node: %d has no state[%d] for node[%d]", s.NodeID, fetch.SequenceID, fetch.NodeID)
+	}
+
+	st := &message.StateTransfer{
+		SequenceID: cp.Seq,
+		Digest:     cp.Digest,
+		NodeID:     s.NodeID,
+		Clients:    cp.Clients,
+		Config:     cp.Config,
+		State:      cp.State,
+	}
+	if len(fetch.Partitions) > 0 || len(fetch.Pages) > 0 {
+		wanted := make(map[int64]bool, len(fetch.Partitions))
+		for _, p := range fetch.Partitions {
+			wanted[p] = true
+		}
+		st.Clients = make([]*message.ClientEntry, 0)
+		for _, e := range cp.Clients {
+			if wanted[partitionOf(e.ClientID)] {
+				st.Clients = append(st.Clients, e)
+			}
+		}
+		st.Partitions = fetch.Partitions
+		st.State = nil
+		st.Pages = make(map[int64][]byte, len(fetch.Pages))
+		for _, p := range fetch.Pages {
+			if p >= 0 && int(p)*StatePageSize < len(cp.State) {
+				st.Pages[p] = page(cp.State, int(p))
+			}
+		}
+	}
+	consMsg := message.CreateConMsg(message.MTStateTransfer, st)
+	consMsg.From = uint(s.NodeID)
+	return s.p2pWire.SendToNode(fetch.NodeID, consMsg)
+}
+
+/*
+adoptView moves a replica that is behind, like one that just joined, to the view that f+1 of the replicas vouching for
+the checkpoint were in, at least one of them is correct.
+*/
+func (s *StateEngine) adoptView(cp *CheckPoint) {
+	views := make([]int64, 0, len(cp.CPMsg))
+	for _, msg := range cp.CPMsg {
+		if msg.Digest == cp.Digest {
+			views = append(views, msg.ViewID)
+		}
+	}
+	f := int(s.config.F)
+	if len(views) <= f {
+		return
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i] > views[j] })
+	if views[f] > s.CurViewID {
+		s.CurViewID = views[f]
+		s.PrimaryID = s.config.Primary(s.CurViewID)
+		s.logger().Info("view adopted from checkpoint", logging.F("seq", cp.Seq), logging.F("primary", s.PrimaryID))
+	}
+}
+
+/*
+restoreApplication makes the application state at the stable checkpoint cp the state the node executes on. The
+requests after cp execute again on top of it.
+*/
+func (s *StateEngine) restoreApplication(cp *CheckPoint) {
+	s.LasExeSeq = cp.Seq
+	s.appState = cp.State
+	for seq, log := range s.msgLogs {
+		if seq > cp.Seq {
+			log.executed = false
+			log.tentative = false
+		}
+	}
+	s.logger().Info("restore application state", logging.F("seq", cp.Seq), logging.F("size", len(cp.State)))
+	s.nodeChan <- &message.RequestRecord{
+		PrePrepare: &message.PrePrepare{ViewID: s.CurViewID, SequenceID: cp.Seq},
+		State:      cp.State,
+	}
+}
+
+func (s *StateEngine) installState(st *message.StateTransfer) error {
+	cp, ok := s.checks[st.SequenceID]
+	if !ok || !cp.IsStable || cp.Clients != nil {
+		return fmt.Errorf("======>[installState] Node: %d isn't waiting for state[%d]", s.NodeID, st.SequenceID)
+	}
+	if cp.Digest != st.Digest || stateDigest(st.SequenceID, st.Clients, st.State, st.Config) != cp.Digest {
+		return fmt.Errorf("======>[installState] Node: %d state[%d] from node[%d] doesn't match the stable checkpoint",
+			s.NodeID, st.SequenceID, st.NodeID)
+	}
+
+	s.installClientEntries(st.Clients)
+	cp.Clients = st.Clients
+	cp.Config = st.Config
+	cp.State = st.State
+	if st.SequenceID >= s.LasExeSeq {
+		s.restoreApplication(cp)
+	}
+	if st.SequenceID > s.CurSequence {
+		s.CurSequence = st.SequenceID
+	}
+	s.adoptView(cp)
+	if st.Config.Epoch > s.config.Epoch {
+		s.installConfig(st.Config.Copy(), cp)
+	}
+	s.logger().Info("state installed", logging.F("seq", st.SequenceID), logging.F("peer", st.NodeID))
+	return nil
 }
@@ -0,0 +1,96 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+func TestCheckpointIsTakenAtTheExecutedSequence(t *testing.T) {
+	te := newTestEngine(t, 1)
+	te.lastCP = NewCheckPoint(0, 0)
+	// the primary has already assigned sequence numbers beyond the one executing
+	te.CurSequence = CheckPointInterval + 3
+
+	te.ResetState(&message.Reply{SeqID: CheckPointInterval, Timestamp: 1, ClientID: "client-0", Result: "ok"}, nil)
+
+	if _, ok := te.checks[CheckPointInterval]; !ok {
+		t.Fatalf("no checkpoint at executed sequence %d", CheckPointInterval)
+	}
+	if _, ok := te.checks[te.CurSequence]; ok {
+		t.Fatalf("checkpoint taken at assigned sequence %d", te.CurSequence)
+	}
+	if te.LasExeSeq != CheckPointInterval {
+		t.Fatalf("last executed %d", te.LasExeSeq)
+	}
+
+	te.ResetState(&message.Reply{SeqID: CheckPointInterval + 1, Timestamp: 2, ClientID: "client-0", Result: "ok"}, nil)
+	if _, ok := te.checks[CheckPointInterval+1]; ok {
+		t.Fatal("checkpoint taken between intervals")
+	}
+}
+
+func TestCheckpointCoversTheApplicationState(t *testing.T) {
+	reply := &message.Reply{SeqID: CheckPointInterval, Timestamp: 1, ClientID: "client-0", Result: "ok"}
+	digests := make(map[string]bool)
+	for _, state := range [][]byte{nil, []byte("a"), []byte("b")} {
+		te := newTestEngine(t, 1)
+		te.lastCP = NewCheckPoint(0, 0)
+		te.ResetState(reply, state)
+		digests[te.checks[CheckPointInterval].Digest] = true
+	}
+	if len(digests) != 3 {
+		t.Fatalf("3 application states have %d checkpoint digests", len(digests))
+	}
+}
+
+func TestStateTransferRestoresTheApplicationState(t *testing.T) {
+	entries := []*message.ClientEntry{{
+		ClientID:  "client-0",
+		TimeStamp: 1,
+		Reply:     &message.Reply{SeqID: CheckPointInterval, Timestamp: 1, ClientID: "client-0", Result: "ok"},
+	}}
+	state := []byte("application state")
+
+	for _, tc := range []struct {
+		name  string
+		state []byte
+		ok    bool
+	}{
+		{"same state", state, true},
+		{"other state", []byte("forged state"), false},
+		{"no state", nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newTestEngine(t, 1)
+			config := te.configAt(CheckPointInterval)
+			cp := NewCheckPoint(CheckPointInterval, 0)
+			cp.IsStable = true
+			cp.Digest = stateDigest(CheckPointInterval, entries, state, config)
+			te.checks[cp.Seq] = cp
+
+			err := te.installState(&message.StateTransfer{SequenceID: cp.Seq, Digest: cp.Digest, NodeID: 2,
+				Clients: entries, Config: config, State: tc.state})
+			if !tc.ok {
+				if err == nil {
+					t.Fatal("state that doesn't match the checkpoint installed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case record := <-te.records:
+				if record.Request != nil || record.SequenceID != cp.Seq || string(record.State) != string(state) {
+					t.Fatalf("node told to restore %q at %d", record.State, record.SequenceID)
+				}
+			default:
+				t.Fatal("node wasn't told to restore the application state")
+			}
+			if te.LasExeSeq != cp.Seq || string(te.checks[cp.Seq].State) != string(state) {
+				t.Fatalf("last executed %d, checkpoint state %q", te.LasExeSeq, te.checks[cp.Seq].State)
+			}
+		})
+	}
+}
@@ -1,22 +1,34 @@
 package consensus
 
 import (
-	"time"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"sort"
 
 	"github.com/sakesake/PBFT/message"
 )
 
+/*
+Replicas discard requests whose timestamp is lower than the timestamp in the last reply they sent to the client to
+guarantee exactly-once semantics. Each replica keeps only the last reply sent to each client, when a client
+retransmits the request of its last reply the replica sends that reply again.
+
+The table of last replies is part of the service state: it is updated when a request executes, it is covered by
+the checkpoint digest and it is moved with the rest of the state during state transfer, so every correct replica
+answers a retransmitted request with the same cached reply.
+*/
 type ClientRecord struct {
-	LastReplyTime int64                      `json:"lastReply"`
-	Request       map[int64]*message.Request `json:"Request"`
-	Reply         map[int64]*message.Reply   `json:"Reply"`
+	LastTimeStamp int64                      `json:"lastTimestamp"`
+	LastReply     *message.Reply             `json:"lastReply"`
+	Request       map[int64]*message.Request `json:"-"`
 }
 
 func NewClientRecord() *ClientRecord {
 	cr := &ClientRecord{
-		LastReplyTime: -1,
+		LastTimeStamp: -1,
 		Request:       make(map[int64]*message.Request),
-		Reply:         make(map[int64]*message.Reply),
 	}
 
 	return cr
@@ -31,12 +43,143 @@ func (cr *ClientRecord) saveRequest(r *message.Request) {
 	cr.Request[r.SeqID] = r
 }
 
-func (cr *ClientRecord) getReply(time int64) (*message.Reply, bool) {
-	r, ok := cr.Reply[time]
-	return r, ok
+func (cr *ClientRecord) saveReply(reply *message.Reply) {
+	if reply.Timestamp < cr.LastTimeStamp {
+		return
+	}
+	cr.LastTimeStamp = reply.Timestamp
+	cr.LastReply = reply
+
+	for seq, req := range cr.Request {
+		if req.TimeStamp <= cr.LastTimeStamp {
+			delete(cr.Request, seq)
+		}
+	}
 }
 
-func (cr *ClientRecord) saveReply(reply *message.Reply) {
-	cr.Reply[reply.Timestamp] = reply
-	cr.LastReplyTime = time.Now().Unix()
+func (s *StateEngine) clientEntries() []*message.ClientEntry {
+	entries := make([]*message.ClientEntry, 0, len(s.cliRecord))
+	for cid, client := range s.cliRecord {
+		if client.LastReply == nil {
+			continue
+		}
+		entries = append(entries, &message.ClientEntry{
+			ClientID:  cid,
+			TimeStamp: client.LastTimeStamp,
+			Reply:     client.LastReply,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ClientID < entries[j].ClientID
+	})
+	return entries
+}
+
+/*
+The digest of the state at a checkpoint covers the state of the application, the last replies and the configuration
+in force after the checkpoint. It only covers what every correct replica computes the same way: the replica id and the
+view in a reply differ from replica to replica and are left out.
+
+The digest is a tree of two levels. The clients are split into StatePartitions partitions by a hash of their id, the
+application state into pages of StatePageSize bytes, every partition and every page has a digest of its own, and the
+digest of the state is computed from those digests, the sequence number and the configuration. A replica that checks
+its state against its peers compares the digests and only fetches the parts that differ; a part that didn't change
+between two checkpoints keeps its digest.
+*/
+const StatePartitions = 16
+
+const StatePageSize = 4096
+
+func partitionOf(clientID string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(clientID))
+	return int64(h.Sum32() % StatePartitions)
+}
+
+// partitionDigests returns the digest of every partition of entries, which are sorted by client id.
+func partitionDigests(entries []*message.ClientEntry) []string {
+	type entry struct {
+		ClientID  string `json:"c"`
+		TimeStamp int64  `json:"t"`
+		SeqID     int64  `json:"n"`
+		Result    string `json:"r"`
+	}
+
+	parts := make([][]entry, StatePartitions)
+	for _, e := range entries {
+		p := partitionOf(e.ClientID)
+		parts[p] = append(parts[p], entry{
+			ClientID:  e.ClientID,
+			TimeStamp: e.TimeStamp,
+			SeqID:     e.Reply.SeqID,
+			Result:    e.Reply.Result,
+		})
+	}
+	digests := make([]string, StatePartitions)
+	for i, part := range parts {
+		if part == nil {
+			part = []entry{}
+		}
+		data, _ := json.Marshal(part)
+		sum := sha256.Sum256(data)
+		digests[i] = hex.EncodeToString(sum[:])
+	}
+	return digests
+}
+
+// pageDigests returns the digest of every page of the application state.
+func pageDigests(state []byte) []string {
+	digests := make([]string, 0, (len(state)+StatePageSize-1)/StatePageSize)
+	for p := 0; p*StatePageSize < len(state); p++ {
+		sum := sha256.Sum256(page(state, p))
+		digests = append(digests, hex.EncodeToString(sum[:]))
+	}
+	return digests
+}
+
+// page returns page p of the application state.
+func page(state []byte, p int) []byte {
+	end := (p + 1) * StatePageSize
+	if end > len(state) {
+		end = len(state)
+	}
+	return state[p*StatePageSize : end]
+}
+
+func rootDigest(seq int64, partitions, pages []string, config *message.Config) string {
+	if pages == nil {
+		pages = []string{}
+	}
+	data, _ := json.Marshal(struct {
+		Seq        int64           `json:"seq"`
+		Partitions []string        `json:"partitions"`
+		Pages      []string        `json:"pages"`
+		Config     *message.Config `json:"config"`
+	}{seq, partitions, pages, config})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func stateDigest(seq int64, entries []*message.ClientEntry, state []byte, config *message.Config) string {
+	return rootDigest(seq, partitionDigests(entries), pageDigests(state), config)
+}
+
+func (s *StateEngine) installClientEntries(entries []*message.ClientEntry) {
+	for _, e := range entries {
+		if e.Reply == nil {
+			continue
+		}
+		client, ok := s.cliRecord[e.ClientID]
+		if !ok {
+			client = NewClientRecord()
+			s.cliRecord[e.ClientID] = client
+		}
+		if e.TimeStamp <= client.LastTimeStamp {
+			continue
+		}
+		reply := *e.Reply
+		reply.NodeID = s.NodeID
+		client.saveReply(&reply)
+	}
 }
@@ -0,0 +1,93 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/p2pnetwork"
+)
+
+type stoppedTicker struct{}
+
+func (stoppedTicker) Chan() <-chan time.Time { return nil }
+func (stoppedTicker) Reset(_ time.Duration)  {}
+func (stoppedTicker) Stop()                  {}
+
+// testEngine is an engine whose messages are kept in sent instead of going out, and whose timer never fires.
+type testEngine struct {
+	*StateEngine
+	sent    []*message.ConMessage
+	records chan *message.RequestRecord
+	replies chan *message.Reply
+}
+
+func newTestEngine(t *testing.T, id int64) *testEngine {
+	t.Helper()
+	te := &testEngine{
+		records: make(chan *message.RequestRecord, MaxStateMsgNO),
+		replies: make(chan *message.Reply, MaxStateMsgNO),
+	}
+	te.StateEngine = InitConsensus(id, te.records, te.replies, message.TotalNodeNO, nil)
+	te.Log = logging.Nop()
+	te.Timer = NewRequestTimer(stoppedTicker{})
+	te.SetP2pNetwork(&p2pnetwork.SimulationP2P{
+		TotalNodes:  message.TotalNodeNO,
+		Synchronous: true,
+		Send: func(v interface{}) {
+			if msg, ok := v.(*message.ConMessage); ok {
+				te.sent = append(te.sent, msg)
+			}
+		},
+	})
+	te.Ready()
+	return te
+}
+
+// onLoop runs fn on the running consensus loop and waits for it.
+func (te *testEngine) onLoop(fn func()) {
+	done := make(chan struct{})
+	te.Post(func() {
+		fn()
+		close(done)
+	})
+	<-done
+}
+
+func TestPostRunsOnTheLoopInOrder(t *testing.T) {
+	te := newTestEngine(t, 0)
+	go te.StartConsensus(nil)
+
+	var got []int
+	for i := 0; i < 100; i++ {
+		i := i
+		te.Post(func() { got = append(got, i) })
+	}
+	done := make(chan []int, 1)
+	te.Post(func() { done <- got })
+
+	select {
+	case got := <-done:
+		if len(got) != 100 {
+			t.Fatalf("ran %d of 100 posted functions", len(got))
+		}
+		for i, v := range got {
+			if v != i {
+				t.Fatalf("posted function %d ran as %d", v, i)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("posted functions didn't run")
+	}
+}
+
+func TestTentativeExecutionIsAnOption(t *testing.T) {
+	if newTestEngine(t, 0).tentativeExec {
+		t.Fatal("tentative execution is on by default")
+	}
+	se := InitConsensus(0, nil, nil, message.TotalNodeNO, nil, WithTentativeExecution())
+	if !se.tentativeExec {
+		t.Fatal("WithTentativeExecution didn't turn tentative execution on")
+	}
+}
@@ -0,0 +1,169 @@
+package consensus
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+The engine publishes what happens to requests, checkpoints and views on an event bus, so applications, indexers,
+auditors and tests can follow the protocol without parsing the log. Subscribers get the events on their own buffered
+channel; the engine never blocks on a slow subscriber, an event that doesn't fit in the buffer is dropped and counted
+on the subscription.
+*/
+type EventType int8
+
+const (
+	EventRequestReceived EventType = iota
+	EventPrePrepared
+	EventPrepared
+	EventCommitted
+	EventExecuted
+	EventCheckpointStable
+	EventViewChangeStarted
+	EventNewViewInstalled
+	EventReconfigured
+	EventRecoveryStarted
+	EventRecovered
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventRequestReceived:
+		return "RequestReceived"
+	case EventPrePrepared:
+		return "PrePrepared"
+	case EventPrepared:
+		return "Prepared"
+	case EventCommitted:
+		return "Committed"
+	case EventExecuted:
+		return "Executed"
+	case EventCheckpointStable:
+		return "CheckpointStable"
+	case EventViewChangeStarted:
+		return "ViewChangeStarted"
+	case EventNewViewInstalled:
+		return "NewViewInstalled"
+	case EventReconfigured:
+		return "Reconfigured"
+	case EventRecoveryStarted:
+		return "RecoveryStarted"
+	case EventRecovered:
+		return "Recovered"
+	}
+	return "Unknown"
+}
+
+/*
+Event carries the view, sequence number and digest the event is about. For a checkpoint the digest is the state
+digest, for a view change the sequence number is the last stable checkpoint. RequestReceived and Executed also name
+the request by its client and timestamp.
+*/
+type Event struct {
+	Type       EventType `json:"type"`
+	NodeID     int64     `json:"nodeID"`
+	ViewID     int64     `json:"viewID"`
+	SequenceID int64     `json:"sequenceID"`
+	Digest     string    `json:"digest"`
+	ClientID   string    `json:"clientID,omitempty"`
+	TimeStamp  int64     `json:"timestamp,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+const DefaultEventBuffer = 1 << 8
+
+type Subscription struct {
+	C       <-chan *Event
+	ch      chan *Event
+	types   map[EventType]bool
+	dropped uint64
+	bus     *eventBus
+}
+
+// Dropped returns how many events didn't fit in the subscription's buffer.
+func (sub *Subscription) Dropped() uint64 {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	return sub.dropped
+}
+
+// Unsubscribe stops the delivery of events and closes C.
+func (sub *Subscription) Unsubscribe() {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	if _, ok := sub.bus.subs[sub]; !ok {
+		return
+	}
+	delete(sub.bus.subs, sub)
+	close(sub.ch)
+}
+
+type eventBus struct {
+	subs map[*Subscription]struct{}
+
+	mu sync.Mutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+func (bus *eventBus) publish(ev *Event) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for sub := range bus.subs {
+		if len(sub.types) > 0 && !sub.types[ev.Type] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+/*
+Subscribe registers a subscriber for the given event types, or for every event when no type is given. buffer is the
+size of the subscription's channel, DefaultEventBuffer is used when it isn't positive.
+*/
+func (s *StateEngine) Subscribe(buffer int, types ...EventType) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultEventBuffer
+	}
+	ch := make(chan *Event, buffer)
+	sub := &Subscription{
+		C:     ch,
+		ch:    ch,
+		types: make(map[EventType]bool, len(types)),
+		bus:   s.events,
+	}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+
+	s.events.mu.Lock()
+	s.events.subs[sub] = struct{}{}
+	s.events.mu.Unlock()
+	return sub
+}
+
+func (s *StateEngine) emit(typ EventType, seq int64, digest string) {
+	s.emitRequest(typ, seq, digest, "", 0)
+}
+
+func (s *StateEngine) emitRequest(typ EventType, seq int64, digest, clientID string, timeStamp int64) {
+	s.events.publish(&Event{
+		Type:       typ,
+		NodeID:     s.NodeID,
+		ViewID:     s.CurViewID,
+		SequenceID: seq,
+		Digest:     digest,
+		ClientID:   clientID,
+		TimeStamp:  timeStamp,
+		Time:       time.Now(),
+	})
+}
@@ -0,0 +1,226 @@
+package consensus
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/sakesake/PBFT/bls"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/quorum"
+)
+
+/*
+The fuzz targets feed a replica one message after a prefix of a normal run of the protocol, so the message meets an
+engine in the middle of ordering a request, of a checkpoint or of a view change. The replica may refuse what it is
+sent, it must never crash on it. In certified mode the run carries votes and certificates signed with fuzzVotes.
+
+	go test ./consensus -run '^$' -fuzz FuzzManageMsg
+*/
+
+var fuzzVotes struct {
+	once   sync.Once
+	keys   []*bls.SecretKey
+	config *message.Config
+	runs   [2][]*message.ConMessage
+}
+
+// fuzzConfig returns the configuration with the vote keys of the replicas and the secret halves of the keys.
+func fuzzConfig() (*message.Config, []*bls.SecretKey) {
+	fuzzVotes.once.Do(func() {
+		r := rand.New(rand.NewSource(1))
+		fuzzVotes.config = message.DefaultConfig()
+		fuzzVotes.config.Votes = make(map[int64]string)
+		fuzzVotes.keys = make([]*bls.SecretKey, message.TotalNodeNO)
+		for i := range fuzzVotes.keys {
+			fuzzVotes.keys[i], _ = bls.GenerateKey(r)
+			fuzzVotes.config.Votes[int64(i)] = quorum.Public(fuzzVotes.keys[i])
+		}
+		fuzzVotes.runs[0] = newFuzzRun(false, fuzzVotes.keys)
+		fuzzVotes.runs[1] = newFuzzRun(true, fuzzVotes.keys)
+	})
+	return fuzzVotes.config, fuzzVotes.keys
+}
+
+// fuzzCert aggregates the votes of ids on the statement of qc into qc.
+func fuzzCert(keys []*bls.SecretKey, qc *message.QuorumCert, ids ...int64) *message.QuorumCert {
+	sigs := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		sigs = append(sigs, keys[id].Sign(qc.Statement()).Bytes())
+	}
+	agg, _ := bls.AggregateBytes(sigs...)
+	qc.SetSigners(ids)
+	qc.Sig = agg.Bytes()
+	return qc
+}
+
+func fuzzMsg(typ message.MType, from int64, v interface{}) *message.ConMessage {
+	m := message.CreateConMsg(typ, v)
+	m.From = uint(from)
+	return m
+}
+
+// fuzzRun returns what replica 1 receives while two requests commit, a checkpoint is taken and view 1 begins.
+func fuzzRun(certify bool) []*message.ConMessage {
+	fuzzConfig()
+	if certify {
+		return fuzzVotes.runs[1]
+	}
+	return fuzzVotes.runs[0]
+}
+
+func newFuzzRun(certify bool, keys []*bls.SecretKey) []*message.ConMessage {
+	vote := func(typ message.MType, view, seq int64, digest string, id int64) []byte {
+		if !certify {
+			return nil
+		}
+		qc := &message.QuorumCert{Typ: typ, ViewID: view, SequenceID: seq, Digest: digest}
+		return keys[id].Sign(qc.Statement()).Bytes()
+	}
+	const requests = 2
+	msgs := make([]*message.ConMessage, 0)
+	pMsg := make(map[int64]*message.PTuple)
+	for seq := int64(1); seq <= requests; seq++ {
+		request := &message.Request{SeqID: seq, TimeStamp: seq, ClientID: "client-0", Operation: "op"}
+		digest := message.Digest(request)
+		msgs = append(msgs, fuzzMsg(message.MTPrePrepare, 0, &message.PrePrepare{SequenceID: seq, Digest: digest}))
+		msgs = append(msgs, fuzzMsg(message.MTRequest, 0, request))
+		prepares := make(message.PrepareMsg)
+		for id := int64(0); id < message.TotalNodeNO; id++ {
+			prepares[id] = &message.Prepare{SequenceID: seq, Digest: digest, NodeID: id,
+				Sig: vote(message.MTPrepare, 0, seq, digest, id)}
+			msgs = append(msgs, fuzzMsg(message.MTPrepare, id, prepares[id]))
+		}
+		pMsg[seq] = &message.PTuple{PPMsg: &message.PrePrepare{SequenceID: seq, Digest: digest}, PMsg: prepares}
+		if certify {
+			pMsg[seq].PMsg = nil
+			pMsg[seq].Cert = fuzzCert(keys, &message.QuorumCert{Typ: message.MTPrepare, SequenceID: seq, Digest: digest}, 1, 2, 3)
+		}
+		for id := int64(0); id < message.TotalNodeNO; id++ {
+			msgs = append(msgs, fuzzMsg(message.MTCommit, id, &message.Commit{SequenceID: seq, Digest: digest, NodeID: id,
+				Sig: vote(message.MTCommit, 0, seq, digest, id)}))
+		}
+		msgs = append(msgs, fuzzMsg(message.MTFetchRequest, 2, &message.FetchRequest{SequenceID: seq, Digest: digest, NodeID: 2}))
+	}
+
+	cps := make(map[int64]*message.CheckPoint)
+	for id := int64(0); id < message.TotalNodeNO; id++ {
+		cps[id] = &message.CheckPoint{SequenceID: requests, Digest: "state", NodeID: id,
+			Sig: vote(message.MTCheckpoint, 0, requests, "state", id)}
+		msgs = append(msgs, fuzzMsg(message.MTCheckpoint, id, cps[id]))
+	}
+	msgs = append(msgs, fuzzMsg(message.MTFetchState, 2, &message.FetchState{SequenceID: requests, Digest: "state", NodeID: 2}))
+	msgs = append(msgs, fuzzMsg(message.MTFetchDigests, 2, &message.FetchState{NodeID: 2}))
+	msgs = append(msgs, fuzzMsg(message.MTStateDigests, 2, &message.StateDigests{
+		SequenceID: requests,
+		Digest:     "state",
+		NodeID:     2,
+		Partitions: []string{"partition-0", "partition-1"},
+		Config:     message.DefaultConfig(),
+		Checks:     cps,
+	}))
+	msgs = append(msgs, fuzzMsg(message.MTStateTransfer, 2, &message.StateTransfer{
+		SequenceID: requests,
+		Digest:     "state",
+		NodeID:     2,
+		Clients: []*message.ClientEntry{{
+			ClientID:  "client-0",
+			TimeStamp: requests,
+			Reply:     &message.Reply{SeqID: requests, Timestamp: requests, ClientID: "client-0", Result: "ok"},
+		}},
+		Config:     message.DefaultConfig(),
+		Partitions: []int64{0},
+	}))
+
+	vcs := make(message.VMessage)
+	for id := int64(0); id < message.TotalNodeNO; id++ {
+		vc := &message.ViewChange{NewViewID: 1, NodeID: id, CMsg: cps, PMsg: pMsg}
+		if certify {
+			vc.LastCPSeq = requests
+			vc.CMsg = nil
+			vc.CCert = fuzzCert(keys, &message.QuorumCert{Typ: message.MTCheckpoint, SequenceID: requests, Digest: "state"}, 0, 1, 2)
+			vc.PMsg = map[int64]*message.PTuple{}
+		}
+		vcs[id] = vc
+		msgs = append(msgs, fuzzMsg(message.MTViewChange, id, vc))
+	}
+	o := make(message.OMessage)
+	for seq, pt := range pMsg {
+		pp := *pt.PPMsg
+		pp.ViewID = 1
+		o[seq] = &pp
+	}
+	nv := &message.NewView{NewViewID: 1, VMsg: vcs, OMsg: o, NMsg: make(message.OMessage)}
+	if certify {
+		nv.VMsg = nil
+		nv.OMsg = make(message.OMessage)
+		nv.CCert = vcs[0].CCert
+	}
+	msgs = append(msgs, fuzzMsg(message.MTNewView, 1, nv))
+	return msgs
+}
+
+// fuzzEngine returns replica 1 after the first prefix messages of the run, throwing away what it executes.
+func fuzzEngine(t *testing.T, certify bool, prefix uint8) *testEngine {
+	te := newTestEngine(t, 1)
+	if certify {
+		config, keys := fuzzConfig()
+		te.SetConfig(config.Copy())
+		te.SetCertifier(quorum.NewSigner(keys[1], te.Config))
+	}
+	run := fuzzRun(certify)
+	for _, m := range run[:int(prefix)%(len(run)+1)] {
+		te.HandleMessage(m)
+		fuzzDrain(te)
+	}
+	te.sent = nil
+	return te
+}
+
+func fuzzDrain(te *testEngine) {
+	for {
+		select {
+		case <-te.records:
+		case <-te.replies:
+		default:
+			return
+		}
+	}
+}
+
+// fuzzSeeds adds every message of the run whose type accepts to f, after every prefix that comes before it.
+func fuzzSeeds(f *testing.F, accepts func(message.MType) bool) {
+	for _, certify := range []bool{false, true} {
+		for i, m := range fuzzRun(certify) {
+			if accepts(m.Typ) {
+				f.Add(certify, uint8(i), uint8(m.Typ), m.Payload)
+			}
+		}
+	}
+}
+
+func isConsensusMsg(typ message.MType) bool {
+	switch typ {
+	case message.MTRequest, message.MTPrePrepare, message.MTPrepare, message.MTCommit:
+		return true
+	}
+	return false
+}
+
+func FuzzConsensusMsg(f *testing.F) {
+	fuzzSeeds(f, isConsensusMsg)
+	f.Fuzz(func(t *testing.T, certify bool, prefix uint8, typ uint8, payload []byte) {
+		te := fuzzEngine(t, certify, prefix)
+		_ = te.procConsensusMsg(&message.ConMessage{Typ: message.MType(typ), From: 2, Payload: payload})
+		fuzzDrain(te)
+	})
+}
+
+func FuzzManageMsg(f *testing.F) {
+	fuzzSeeds(f, func(typ message.MType) bool { return !isConsensusMsg(typ) })
+	f.Fuzz(func(t *testing.T, certify bool, prefix uint8, typ uint8, payload []byte) {
+		te := fuzzEngine(t, certify, prefix)
+		_ = te.procManageMsg(&message.ConMessage{Typ: message.MType(typ), From: 2, Payload: payload})
+		fuzzDrain(te)
+	})
+}
@@ -0,0 +1,102 @@
+package consensus
+
+import (
+	"time"
+
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/metrics"
+	"github.com/sakesake/PBFT/p2pnetwork"
+)
+
+type engineMetrics struct {
+	received      *metrics.CounterVec
+	sent          *metrics.CounterVec
+	sigFailures   *metrics.Counter
+	committed     *metrics.Counter
+	commitLatency *metrics.Histogram
+	phaseLatency  *metrics.HistogramVec
+	recoveries    *metrics.Counter
+	repaired      *metrics.Counter
+
+	// the gauges are set by publish on the consensus loop, scraping them doesn't touch the engine
+	view      *metrics.Gauge
+	low       *metrics.Gauge
+	high      *metrics.Gauge
+	lastExec  *metrics.Gauge
+	logSize   *metrics.Gauge
+	connected *metrics.Gauge
+}
+
+func (s *StateEngine) initMetrics() {
+	reg := s.Metrics
+	s.metrics = &engineMetrics{
+		received:      reg.NewCounterVec("pbft_messages_received_total", "Consensus messages received by type.", "type"),
+		sent:          reg.NewCounterVec("pbft_messages_sent_total", "Consensus messages sent by type.", "type"),
+		sigFailures:   reg.NewCounter("pbft_signature_failures_total", "Consensus messages and votes dropped because their authenticator or signature didn't verify."),
+		committed:     reg.NewCounter("pbft_requests_committed_total", "Requests that committed locally."),
+		commitLatency: reg.NewHistogram("pbft_commit_latency_seconds", "Time from receiving a request to committing it.", nil),
+		phaseLatency: reg.NewHistogramVec("pbft_phase_latency_seconds",
+			"Time a request spends in each phase: pre-prepared to prepared, prepared to committed, committed to executed.",
+			nil, "phase"),
+		recoveries: reg.NewCounter("pbft_recoveries_total", "Proactive recoveries the replica started."),
+		repaired:   reg.NewCounter("pbft_partitions_repaired_total", "State partitions fetched because they were corrupt."),
+
+		view:      reg.NewGauge("pbft_view", "Current view number."),
+		low:       reg.NewGauge("pbft_low_water_mark", "Low water mark h (MiniSeq)."),
+		high:      reg.NewGauge("pbft_high_water_mark", "High water mark H (MaxSeq)."),
+		lastExec:  reg.NewGauge("pbft_last_executed_seq", "Sequence number of the last executed request (LasExeSeq)."),
+		logSize:   reg.NewGauge("pbft_log_size", "Sequence numbers kept in the message log."),
+		connected: reg.NewGauge("pbft_peers_connected", "Peers the replica is connected to."),
+	}
+}
+
+// publish copies the engine state the gauges show, the consensus loop calls it after every event.
+func (s *StateEngine) publish() {
+	s.metrics.view.Set(float64(s.CurViewID))
+	s.metrics.low.Set(float64(s.MiniSeq))
+	s.metrics.high.Set(float64(s.MaxSeq))
+	s.metrics.lastExec.Set(float64(s.LasExeSeq))
+	s.metrics.logSize.Set(float64(len(s.msgLogs)))
+	s.metrics.connected.Set(float64(s.p2pWire.PeerCount()))
+}
+
+func (m *engineMetrics) observePhase(phase string, from, to time.Time) {
+	if from.IsZero() || to.IsZero() {
+		return
+	}
+	m.phaseLatency.With(phase).Observe(to.Sub(from).Seconds())
+}
+
+// meteredP2p counts every consensus message the engine puts on the wire.
+type meteredP2p struct {
+	p2pnetwork.P2pNetwork
+	sent *metrics.CounterVec
+}
+
+func (mp *meteredP2p) count(v interface{}) {
+	if msg, ok := v.(*message.ConMessage); ok && msg != nil {
+		mp.sent.With(msg.Typ.String()).Inc()
+	}
+}
+
+func (mp *meteredP2p) BroadCast(v interface{}) error {
+	err := mp.P2pNetwork.BroadCast(v)
+	if err == nil {
+		mp.count(v)
+	}
+	return err
+}
+
+func (mp *meteredP2p) SetPeers(ids []int64) {
+	if ps, ok := mp.P2pNetwork.(p2pnetwork.PeerSetter); ok {
+		ps.SetPeers(ids)
+	}
+}
+
+func (mp *meteredP2p) SendToNode(nodeID int64, v interface{}) error {
+	err := mp.P2pNetwork.SendToNode(nodeID, v)
+	if err == nil {
+		mp.count(v)
+	}
+	return err
+}
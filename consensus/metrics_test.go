@@ -0,0 +1,54 @@
+package consensus
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+// rejectAll is an authenticator no message verifies with.
+type rejectAll struct{}
+
+func (rejectAll) Seal(*message.ConMessage, []int64)      {}
+func (rejectAll) Verify(*message.ConMessage) error       { return errors.New("bad authenticator") }
+func (rejectAll) HandleNewKey(*message.ConMessage) error { return errors.New("bad signature") }
+
+func TestSignatureFailuresCountMessagesThatDontVerify(t *testing.T) {
+	te := newTestEngine(t, 1)
+	te.SetAuthenticator(rejectAll{})
+
+	te.HandleMessage(message.CreateConMsg(message.MTPrepare, &message.Prepare{ViewID: 0, SequenceID: 1, NodeID: 0}))
+	te.HandleMessage(message.CreateConMsg(message.MTNewKey, &message.NewKey{NodeID: 0}))
+
+	if v := te.metrics.sigFailures.Value(); v != 2 {
+		t.Fatalf("%v signature failures, want 2", v)
+	}
+}
+
+func TestGaugesArePublishedByTheLoop(t *testing.T) {
+	te := newTestEngine(t, 0)
+	go te.StartConsensus(nil)
+
+	te.Post(func() {
+		te.CurViewID = 7
+		te.LasExeSeq = 3
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// scraping races with the loop unless the gauges are copies
+		var buf bytes.Buffer
+		te.Metrics.Write(&buf)
+		if strings.Contains(buf.String(), "pbft_view 7\n") && strings.Contains(buf.String(), "pbft_last_executed_seq 3\n") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gauges not published:\n%s", buf.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
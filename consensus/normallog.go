@@ -1,13 +1,32 @@
 package consensus
 
-import "github.com/sakesake/PBFT/message"
+import (
+	"time"
+
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/tracing"
+)
 
 type NormalLog struct {
-	clientID   string                    `json:"clientID"`
+	clientID   string
 	Stage      Stage                     `json:"Stage"`
 	PrePrepare *message.PrePrepare       `json:"PrePrepare"`
 	Prepare    message.PrepareMsg        `json:"Prepare"`
 	Commit     map[int64]*message.Commit `json:"Commit"`
+	tentative  bool
+	request    *message.Request
+	executed   bool
+	traceID    string
+	spanID     string
+
+	// prepareCert and commitCert are the quorums of Prepare and Commit aggregated, when the engine certifies them.
+	prepareCert *message.QuorumCert
+	commitCert  *message.QuorumCert
+
+	start       time.Time
+	prePrepared time.Time
+	prepared    time.Time
+	committed   time.Time
 }
 
 func NewNormalLog() *NormalLog {
@@ -16,6 +35,8 @@ func NewNormalLog() *NormalLog {
 		PrePrepare: nil,
 		Prepare:    make(message.PrepareMsg),
 		Commit:     make(map[int64]*message.Commit),
+		start:      time.Now(),
+		spanID:     tracing.NewSpanID(),
 	}
 	return nl
 }
@@ -0,0 +1,149 @@
+package consensus
+
+import (
+	"fmt"
+
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/p2pnetwork"
+)
+
+/*
+Membership changes are requests like any other: an operator sends a request with Reconfig set, signed with its client
+key, it is ordered and committed the usual way and executed by the engine instead of the service. A reconfiguration
+not signed by one of the operators of the configuration is answered with a rejection when it executes. Executing it
+only schedules the new configuration for the next checkpoint boundary; the high water mark is lowered to that boundary,
+so no request after it is ordered under the old configuration. The new configuration is part of the checkpoint state there and is installed when the checkpoint
+becomes stable: quorums and the primary of each view come from it from then on, and the water marks are raised again.
+
+A replica that joins is started with the configuration it joins (SetConfig). The replicas already in the configuration
+send it their checkpoint messages once they installed it; the checkpoint becomes stable at the new replica and it fetches
+the state, configuration included, by state transfer.
+*/
+type pendingConfig struct {
+	at     int64
+	config *message.Config
+}
+
+// SetConfig sets the configuration the engine starts from, before it handles any message.
+func (s *StateEngine) SetConfig(config *message.Config) {
+	s.configMu.Lock()
+	s.config = config.Copy()
+	s.configMu.Unlock()
+	s.PrimaryID = s.config.Primary(s.CurViewID)
+	s.setPeers()
+}
+
+// Config returns a copy of the configuration in force, it may be called from any goroutine.
+func (s *StateEngine) Config() *message.Config {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config.Copy()
+}
+
+// replicas returns the replicas of the configuration in force. The keyring broadcasts from a goroutine of its own.
+func (s *StateEngine) replicas() []int64 {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config.Replicas
+}
+
+// configAt returns the configuration in force after sequence number seq executed.
+func (s *StateEngine) configAt(seq int64) *message.Config {
+	if s.pending != nil && seq >= s.pending.at {
+		return s.pending.config
+	}
+	return s.config
+}
+
+func (s *StateEngine) isMember(id int64) error {
+	if !s.config.Contains(id) {
+		return fmt.Errorf("node[%d] isn't a replica of %s", id, s.config)
+	}
+	return nil
+}
+
+func (s *StateEngine) setPeers() {
+	for _, wire := range []p2pnetwork.P2pNetwork{s.p2pWire, s.bulkWire} {
+		if ps, ok := wire.(p2pnetwork.PeerSetter); ok {
+			ps.SetPeers(s.config.Replicas)
+		}
+	}
+}
+
+func (s *StateEngine) executeReconfig(seq int64, request *message.Request) {
+	base := s.config
+	if s.pending != nil {
+		base = s.pending.config
+	}
+	result := ""
+	// the service only hands on reconfigurations of operators, a faulty primary may still order one
+	var next *message.Config
+	err := auth.VerifyOperator(request, base)
+	if err == nil {
+		next, err = base.Apply(request.Reconfig)
+	}
+	if err != nil {
+		result = "rejected: " + err.Error()
+		s.logger().Warn("reconfiguration rejected", logging.F("seq", seq), logging.Err(err))
+	} else {
+		at := (seq/CheckPointInterval + 1) * CheckPointInterval
+		if s.pending != nil && s.pending.at > at {
+			at = s.pending.at
+		}
+		s.pending = &pendingConfig{at: at, config: next}
+		if s.MaxSeq > at {
+			s.MaxSeq = at
+		}
+		result = fmt.Sprintf("%s scheduled at seq[%d] for %s", request.Reconfig, at, next)
+		s.logger().Info("reconfiguration scheduled", logging.F("seq", seq), logging.F("at", at),
+			logging.F("config", next))
+	}
+
+	reply := &message.Reply{
+		SeqID:     seq,
+		ViewID:    s.CurViewID,
+		Timestamp: request.TimeStamp,
+		ClientID:  request.ClientID,
+		NodeID:    s.NodeID,
+		Result:    result,
+	}
+	s.ResetState(reply, s.appState)
+	s.directReplyChan <- reply.ForRequest(request)
+}
+
+// installConfig makes config the configuration in force, at the stable checkpoint cp.
+func (s *StateEngine) installConfig(config *message.Config, cp *CheckPoint) {
+	old := s.config
+	s.configMu.Lock()
+	s.config = config
+	s.configMu.Unlock()
+	if s.pending != nil && s.pending.config.Epoch <= config.Epoch {
+		s.pending = nil
+	}
+	s.PrimaryID = config.Primary(s.CurViewID)
+	s.setPeers()
+	s.logger().Info("configuration installed", logging.F("seq", cp.Seq), logging.F("config", config),
+		logging.F("primary", s.PrimaryID))
+	s.emit(EventReconfigured, cp.Seq, message.Digest(config))
+
+	if !config.Contains(s.NodeID) {
+		s.logger().Warn("replica was removed from the configuration", logging.F("seq", cp.Seq))
+		return
+	}
+	msg, ok := cp.CPMsg[s.NodeID]
+	if !ok {
+		return
+	}
+	for _, id := range config.Replicas {
+		if old.Contains(id) {
+			continue
+		}
+		consMsg := message.CreateConMsg(message.MTCheckpoint, msg)
+		consMsg.From = uint(s.NodeID)
+		if err := s.p2pWire.SendToNode(id, consMsg); err != nil {
+			s.logger().Error("send checkpoint to new replica failed", logging.F("peer", id), logging.Err(err))
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package consensus
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/message"
+)
+
+func TestOnlyOperatorsReconfigure(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &message.Reconfig{Op: message.RCAddReplica, NodeID: 4}
+	for _, tc := range []struct {
+		name   string
+		client string
+		key    ed25519.PrivateKey
+		ok     bool
+	}{
+		{"unsigned", "admin", nil, false},
+		{"signed by another key", "admin", other, false},
+		{"signed by a client that isn't an operator", "mallory", key, false},
+		{"signed by the operator", "admin", key, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newTestEngine(t, 1)
+			config := te.Config()
+			config.Operators = map[string]string{"admin": hex.EncodeToString(pub)}
+			te.SetConfig(config)
+
+			request := &message.Request{ClientID: tc.client, TimeStamp: 1, Reconfig: rc}
+			if tc.key != nil {
+				auth.SignRequest(request, tc.key)
+			}
+			te.executeReconfig(1, request)
+			reply := <-te.replies
+			if rejected := strings.HasPrefix(reply.Result, "rejected"); rejected == tc.ok {
+				t.Fatalf("reconfiguration answered %q", reply.Result)
+			}
+			if (te.pending != nil) != tc.ok {
+				t.Fatalf("pending configuration %v", te.pending)
+			}
+		})
+	}
+}
+
+// dropAll is a network that loses every message, it has no state of its own to race on.
+type dropAll struct{}
+
+func (dropAll) BroadCast(interface{}) error         { return nil }
+func (dropAll) SendToNode(int64, interface{}) error { return nil }
+func (dropAll) PeerCount() int                      { return 0 }
+
+func TestConfigIsReadOffTheLoopWhileItChanges(t *testing.T) {
+	te := newTestEngine(t, 0)
+	te.SetP2pNetwork(dropAll{})
+	te.SetAuthenticator(rejectAll{})
+	go te.StartConsensus(nil)
+
+	// the keyring reads the configuration and broadcasts its NEW-KEY from a goroutine of its own
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			te.Config()
+			te.Network().BroadCast(message.CreateConMsg(message.MTNewKey, &message.NewKey{NodeID: 0}))
+		}
+	}()
+	for epoch := int64(1); epoch <= 100; epoch++ {
+		te.onLoop(func() {
+			config := te.config.Copy()
+			config.Epoch = epoch
+			te.installConfig(config, NewCheckPoint(0, 0))
+		})
+	}
+	<-done
+}
@@ -0,0 +1,397 @@
+package consensus
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+)
+
+/*
+Proactive recovery lets the cluster tolerate any number of faults over its lifetime as long as at most f replicas are
+faulty within a window of vulnerability: every replica is recovered periodically, whether it is known to be faulty or
+not, and comes out of the recovery correct.
+
+A recovering replica reboots clean. It forgets what it only held in memory, the view changes and the requests it was
+waiting for, and keeps what it saves before the reboot: the message log, whose entries are certified by quorums of the
+others, the checkpoints and the configuration. It then checks its last stable checkpoint against its peers. Every peer
+answers with the digest tree of its last stable checkpoint; once f+1 of them agree on a tree, at least one of them is
+correct and the tree is the state of a stable checkpoint. The replica compares the tree to its own partition by
+partition and page by page and fetches only the partitions of the client table and the pages of the application state
+that differ, every fetched part is checked against its digest in the tree. The client table is rebuilt from the
+checked state, the application is restored to it when it differed, and the replica serves again.
+
+While it recovers the replica keeps ordering the requests of the others, so it doesn't fall behind, but it takes no
+new client requests and no part in view changes. The recoveries of the replicas are staggered, see package recovery, so
+no more than one replica recovers at a time. A recovery that doesn't complete in time is retried on the request timer,
+asking the digests again or fetching from the next peer.
+*/
+type recovery struct {
+	digests map[int64]*message.StateDigests
+	target  *message.StateDigests
+	peers   []int64
+	next    int
+	parts   map[int64][]*message.ClientEntry
+	missing map[int64]bool
+	// pages of the application state, missingPages are the ones that are still fetched
+	pages        map[int64][]byte
+	missingPages map[int64]bool
+	// restore is set when the application state at the checkpoint isn't the one the replica has
+	restore bool
+}
+
+/*
+BeginRecovery reboots the engine clean and starts checking its state against the peers. Like HandleTimeout it is
+called from the goroutine that drives the engine; Recover does it from any goroutine.
+*/
+func (s *StateEngine) BeginRecovery() {
+	s.sCache = NewVCCache()
+	for _, client := range s.cliRecord {
+		client.Request = make(map[int64]*message.Request)
+	}
+
+	s.recovering = &recovery{}
+	s.metrics.recoveries.Inc()
+	s.setStatus(Recovering)
+	s.logger().Info("proactive recovery started", logging.F("lastCP", s.stableCheckPoint().Seq))
+	s.emit(EventRecoveryStarted, s.stableCheckPoint().Seq, s.stableCheckPoint().Digest)
+	s.Timer.tack()
+	s.Timer.tick()
+	s.fetchDigests()
+}
+
+// Recover runs BeginRecovery on the consensus loop.
+func (s *StateEngine) Recover() error {
+	return s.runOnEngine(func() error {
+		s.BeginRecovery()
+		return nil
+	})
+}
+
+// Recovering reports from any goroutine whether a proactive recovery is in progress.
+func (s *StateEngine) Recovering() bool {
+	var recovering bool
+	s.runOnEngine(func() error {
+		recovering = s.recovering != nil
+		return nil
+	})
+	return recovering
+}
+
+func (s *StateEngine) fetchDigests() {
+	s.recovering.digests = make(map[int64]*message.StateDigests)
+	s.recovering.target = nil
+	fetch := &message.FetchState{
+		SequenceID: s.stableCheckPoint().Seq,
+		NodeID:     s.NodeID,
+	}
+	consMsg := message.CreateConMsg(message.MTFetchDigests, fetch)
+	consMsg.From = uint(s.NodeID)
+	if err := s.p2pWire.BroadCast(consMsg); err != nil {
+		s.logger().Error("fetch state digests failed", logging.Err(err))
+	}
+}
+
+// retryRecovery is called on a timeout while the engine recovers.
+func (s *StateEngine) retryRecovery() {
+	s.Timer.tack()
+	s.Timer.tick()
+	if s.recovering.target == nil || len(s.recovering.peers) == 0 {
+		s.logger().Warn("no agreed state digests yet, ask again")
+		s.fetchDigests()
+		return
+	}
+	s.recovering.next++
+	s.fetchPartitions()
+}
+
+func (s *StateEngine) sendDigests(fetch *message.FetchState) error {
+	if fetch.NodeID == s.NodeID {
+		return nil
+	}
+	if s.recovering != nil {
+		return fmt.Errorf("======>[sendDigests] Node: %d is recovering itself", s.NodeID)
+	}
+	sd := &message.StateDigests{
+		NodeID: s.NodeID,
+	}
+	if cp := s.lastCP; cp != nil && cp.Clients != nil {
+		sd.SequenceID = cp.Seq
+		sd.Digest = cp.Digest
+		sd.Partitions = partitionDigests(cp.Clients)
+		sd.Pages = pageDigests(cp.State)
+		sd.Config = cp.Config
+		sd.Checks = cp.CPMsg
+	}
+	consMsg := message.CreateConMsg(message.MTStateDigests, sd)
+	consMsg.From = uint(s.NodeID)
+	return s.p2pWire.SendToNode(fetch.NodeID, consMsg)
+}
+
+func sameDigests(a, b *message.StateDigests) bool {
+	return a.SequenceID == b.SequenceID && a.Digest == b.Digest
+}
+
+// collectDigests takes the digest tree of a peer and settles on a tree once f+1 peers sent the same one.
+func (s *StateEngine) collectDigests(sd *message.StateDigests) error {
+	rec := s.recovering
+	if rec == nil || rec.target != nil {
+		return nil
+	}
+	if err := s.isMember(sd.NodeID); err != nil {
+		return err
+	}
+	if sd.Digest != "" && rootDigest(sd.SequenceID, sd.Partitions, sd.Pages, sd.Config) != sd.Digest {
+		return fmt.Errorf("======>[collectDigests] Node: %d partition digests of node[%d] don't match its state digest",
+			s.NodeID, sd.NodeID)
+	}
+	rec.digests[sd.NodeID] = sd
+
+	ids := make([]int64, 0, len(rec.digests))
+	for id, other := range rec.digests {
+		if sameDigests(sd, other) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) <= int(s.config.F) {
+		return nil
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	rec.target = sd
+	rec.peers = ids
+	rec.next = 0
+	s.logger().Info("state digests agreed", logging.F("seq", sd.SequenceID), logging.F("digest", sd.Digest),
+		logging.F("peers", ids))
+	if sd.Digest == "" {
+		// nobody has a stable checkpoint yet, there is no state to check
+		s.finishRecovery(nil, nil)
+		return nil
+	}
+
+	var own []*message.ClientEntry
+	var state []byte
+	if cp := s.lastCP; cp != nil {
+		own = cp.Clients
+		state = cp.State
+		rec.restore = cp.Seq != sd.SequenceID
+	} else {
+		rec.restore = true
+	}
+	mine := partitionDigests(own)
+	rec.parts = make(map[int64][]*message.ClientEntry)
+	rec.missing = make(map[int64]bool)
+	for _, e := range own {
+		p := partitionOf(e.ClientID)
+		if mine[p] == sd.Partitions[p] {
+			rec.parts[p] = append(rec.parts[p], e)
+		}
+	}
+	for p := range mine {
+		if mine[p] != sd.Partitions[p] {
+			rec.missing[int64(p)] = true
+		}
+	}
+	pages := pageDigests(state)
+	rec.pages = make(map[int64][]byte)
+	rec.missingPages = make(map[int64]bool)
+	for p := range sd.Pages {
+		if p < len(pages) && pages[p] == sd.Pages[p] {
+			rec.pages[int64(p)] = page(state, p)
+		} else {
+			rec.missingPages[int64(p)] = true
+		}
+	}
+	if len(pages) != len(sd.Pages) || len(rec.missingPages) > 0 {
+		rec.restore = true
+	}
+	if len(rec.missing) == 0 && len(rec.missingPages) == 0 {
+		s.finishRecovery(own, rec.state())
+		return nil
+	}
+	s.fetchPartitions()
+	return nil
+}
+
+// state joins the pages of the application state in the agreed tree.
+func (rec *recovery) state() []byte {
+	var state []byte
+	for p := range rec.target.Pages {
+		state = append(state, rec.pages[int64(p)]...)
+	}
+	return state
+}
+
+func (s *StateEngine) fetchPartitions() {
+	rec := s.recovering
+	partitions := make([]int64, 0, len(rec.missing))
+	for p := range rec.missing {
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	pages := make([]int64, 0, len(rec.missingPages))
+	for p := range rec.missingPages {
+		pages = append(pages, p)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+
+	peer := rec.peers[rec.next%len(rec.peers)]
+	fetch := &message.FetchState{
+		SequenceID: rec.target.SequenceID,
+		Digest:     rec.target.Digest,
+		NodeID:     s.NodeID,
+		Partitions: partitions,
+		Pages:      pages,
+	}
+	consMsg := message.CreateConMsg(message.MTFetchState, fetch)
+	consMsg.From = uint(s.NodeID)
+	s.logger().Info("fetch corrupt partitions", logging.F("seq", fetch.SequenceID), logging.F("peer", peer),
+		logging.F("partitions", partitions), logging.F("pages", pages))
+	if err := s.p2pWire.SendToNode(peer, consMsg); err != nil {
+		s.logger().Error("fetch partitions failed", logging.F("peer", peer), logging.Err(err))
+	}
+}
+
+/*
+recoverPartitions takes the partitions and pages a peer sent, every one that matches its digest in the agreed tree is
+kept.
+*/
+func (s *StateEngine) recoverPartitions(st *message.StateTransfer) error {
+	rec := s.recovering
+	if rec.target == nil || st.SequenceID != rec.target.SequenceID || st.Digest != rec.target.Digest {
+		return fmt.Errorf("======>[recoverPartitions] Node: %d isn't waiting for partitions of state[%d]", s.NodeID, st.SequenceID)
+	}
+	parts := make(map[int64][]*message.ClientEntry)
+	for _, e := range st.Clients {
+		parts[partitionOf(e.ClientID)] = append(parts[partitionOf(e.ClientID)], e)
+	}
+	repaired := make([]int64, 0, len(st.Partitions))
+	for _, p := range st.Partitions {
+		if p < 0 || p >= StatePartitions || !rec.missing[p] {
+			continue
+		}
+		entries := parts[p]
+		sort.Slice(entries, func(i, j int) bool { return entries[i].ClientID < entries[j].ClientID })
+		if partitionDigests(entries)[p] != rec.target.Partitions[p] {
+			s.logger().Warn("partition doesn't match its digest", logging.F("partition", p), logging.F("peer", st.NodeID))
+			continue
+		}
+		rec.parts[p] = entries
+		delete(rec.missing, p)
+		repaired = append(repaired, p)
+	}
+	pages := make([]int64, 0, len(st.Pages))
+	for p := range st.Pages {
+		pages = append(pages, p)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	repairedPages := make([]int64, 0, len(pages))
+	for _, p := range pages {
+		if !rec.missingPages[p] {
+			continue
+		}
+		if digests := pageDigests(st.Pages[p]); len(digests) != 1 || digests[0] != rec.target.Pages[p] {
+			s.logger().Warn("page doesn't match its digest", logging.F("page", p), logging.F("peer", st.NodeID))
+			continue
+		}
+		rec.pages[p] = st.Pages[p]
+		delete(rec.missingPages, p)
+		repairedPages = append(repairedPages, p)
+	}
+	s.metrics.repaired.Add(float64(len(repaired) + len(repairedPages)))
+	s.logger().Info("partitions repaired", logging.F("peer", st.NodeID), logging.F("partitions", repaired),
+		logging.F("pages", repairedPages), logging.F("missing", len(rec.missing)+len(rec.missingPages)))
+	if len(rec.missing) > 0 || len(rec.missingPages) > 0 {
+		return nil
+	}
+
+	var entries []*message.ClientEntry
+	for _, part := range rec.parts {
+		entries = append(entries, part...)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ClientID < entries[j].ClientID })
+	s.finishRecovery(entries, rec.state())
+	return nil
+}
+
+/*
+rebuildClients makes the client table the checked state of cp again. Replies to requests executed after cp can't be
+checked yet and are kept, the next checkpoint covers them.
+*/
+func (s *StateEngine) rebuildClients(cp *CheckPoint) {
+	old := s.cliRecord
+	s.cliRecord = make(map[string]*ClientRecord)
+	s.installClientEntries(cp.Clients)
+	for cid, client := range old {
+		if client.LastReply != nil && client.LastReply.SeqID > cp.Seq {
+			s.cliRecord[cid] = client
+		}
+	}
+}
+
+/*
+finishRecovery makes the checked state the last stable checkpoint and serves again. The application is restored to the
+checked state before, when it had another.
+*/
+func (s *StateEngine) finishRecovery(entries []*message.ClientEntry, state []byte) {
+	target := s.recovering.target
+	restore := s.recovering.restore
+	s.recovering = nil
+	s.Timer.tack()
+
+	if target.Digest != "" {
+		cp, ok := s.checks[target.SequenceID]
+		if !ok {
+			cp = NewCheckPoint(target.SequenceID, s.CurViewID)
+			s.checks[cp.Seq] = cp
+		}
+		cp.Digest = target.Digest
+		cp.IsStable = true
+		cp.Clients = entries
+		cp.State = state
+		cp.Config = target.Config.Copy()
+		for id, msg := range target.Checks {
+			if _, ok := cp.CPMsg[id]; !ok && msg != nil && msg.SequenceID == cp.Seq && msg.Digest == cp.Digest {
+				cp.CPMsg[id] = msg
+			}
+		}
+		s.certifyCheckPoint(cp, cp.Digest)
+		s.rebuildClients(cp)
+		if s.lastCP == nil || cp.Seq >= s.lastCP.Seq {
+			s.lastCP = cp
+			s.MiniSeq = cp.Seq
+			s.MaxSeq = cp.Seq + CheckPointK
+			// the requests after cp are still in the log to execute again
+			if restore || cp.Seq > s.LasExeSeq {
+				s.restoreApplication(cp)
+			}
+		}
+		if cp.Seq > s.CurSequence {
+			s.CurSequence = cp.Seq
+		}
+
+		s.adoptView(cp)
+		if cp.Config.Epoch > s.config.Epoch {
+			s.installConfig(cp.Config.Copy(), cp)
+		}
+		if s.pending != nil && s.MaxSeq > s.pending.at {
+			s.MaxSeq = s.pending.at
+		}
+	}
+	s.logger().Info("proactive recovery completed", logging.F("seq", target.SequenceID), logging.F("digest", target.Digest))
+	s.emit(EventRecovered, target.SequenceID, target.Digest)
+	s.setStatus(Serving)
+
+	// the checkpoints that became stable while the state was checked
+	seqs := make([]int64, 0, len(s.checks))
+	for seq := range s.checks {
+		if seq > s.stableCheckPoint().Seq {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		s.runCheckPoint(seq)
+	}
+	s.executeCommitted()
+}
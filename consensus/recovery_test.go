@@ -0,0 +1,92 @@
+package consensus
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+// recoveringEngine is an engine whose stable checkpoint at CheckPointInterval has page 1 of the application state
+// corrupt, and which has started recovering. It returns the state the checkpoint digest is of.
+func recoveringEngine(t *testing.T) (*testEngine, []byte) {
+	t.Helper()
+	te := newTestEngine(t, 1)
+	state := bytes.Repeat([]byte("s"), 2*StatePageSize+10)
+	entries := []*message.ClientEntry{{
+		ClientID:  "client-0",
+		TimeStamp: 1,
+		Reply:     &message.Reply{SeqID: CheckPointInterval, Timestamp: 1, ClientID: "client-0", Result: "ok"},
+	}}
+	config := te.configAt(CheckPointInterval)
+
+	cp := NewCheckPoint(CheckPointInterval, 0)
+	cp.IsStable = true
+	cp.Clients = entries
+	cp.Config = config
+	cp.Digest = stateDigest(cp.Seq, entries, state, config)
+	cp.State = append([]byte(nil), state...)
+	cp.State[StatePageSize+1] = 'x'
+	te.checks[cp.Seq] = cp
+	te.lastCP = cp
+	te.LasExeSeq = cp.Seq
+
+	te.BeginRecovery()
+	for _, id := range []int64{2, 3} {
+		if err := te.collectDigests(&message.StateDigests{SequenceID: cp.Seq, Digest: cp.Digest, NodeID: id,
+			Partitions: partitionDigests(entries), Pages: pageDigests(state), Config: config}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return te, state
+}
+
+func TestRecoveryFetchesOnlyTheCorruptPages(t *testing.T) {
+	te, _ := recoveringEngine(t)
+
+	fetch := te.sent[len(te.sent)-1]
+	if fetch.Typ != message.MTFetchState {
+		t.Fatalf("sent %s instead of a fetch", fetch.Typ)
+	}
+	body, err := fetch.Body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := body.(*message.FetchState)
+	if len(fs.Partitions) != 0 || len(fs.Pages) != 1 || fs.Pages[0] != 1 {
+		t.Fatalf("fetched partitions %v and pages %v, only page 1 is corrupt", fs.Partitions, fs.Pages)
+	}
+}
+
+func TestRecoveryRestoresTheApplicationState(t *testing.T) {
+	te, state := recoveringEngine(t)
+	seq := te.lastCP.Seq
+
+	forged := bytes.Repeat([]byte("f"), StatePageSize)
+	if err := te.recoverPartitions(&message.StateTransfer{SequenceID: seq, Digest: te.lastCP.Digest, NodeID: 2,
+		Config: te.lastCP.Config, Pages: map[int64][]byte{1: forged}}); err != nil {
+		t.Fatal(err)
+	}
+	if te.recovering == nil || len(te.records) != 0 {
+		t.Fatal("recovered with a page that doesn't match its digest")
+	}
+
+	if err := te.recoverPartitions(&message.StateTransfer{SequenceID: seq, Digest: te.lastCP.Digest, NodeID: 3,
+		Config: te.lastCP.Config, Pages: map[int64][]byte{1: page(state, 1)}}); err != nil {
+		t.Fatal(err)
+	}
+	if te.recovering != nil || te.nodeStatus != Serving {
+		t.Fatal("still recovering with every page repaired")
+	}
+	select {
+	case record := <-te.records:
+		if record.Request != nil || record.SequenceID != seq || !bytes.Equal(record.State, state) {
+			t.Fatalf("node told to restore %d bytes at %d", len(record.State), record.SequenceID)
+		}
+	default:
+		t.Fatal("node wasn't told to restore the application state")
+	}
+	if !bytes.Equal(te.lastCP.State, state) {
+		t.Fatal("checkpoint kept the corrupt state")
+	}
+}
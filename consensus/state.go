@@ -1,13 +1,16 @@
 package consensus
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/sakesake/PBFT/logging"
 	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/metrics"
 	"github.com/sakesake/PBFT/p2pnetwork"
+	"github.com/sakesake/PBFT/tracing"
 )
 
 type Consensus interface {
@@ -44,16 +47,38 @@ const MaxStateMsgNO = 100
 const CheckPointInterval = 1 << 5          //32
 const CheckPointK = 2 * CheckPointInterval //64
 
-type RequestTimer struct {
+/*
+Ticker is the clock the request timer runs on: a time.Ticker by default. A driver that feeds the engine itself, like the
+simulator, supplies its own and calls HandleTimeout when it fires.
+*/
+type Ticker interface {
+	Chan() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+type wallTicker struct {
 	*time.Ticker
+}
+
+func (wt wallTicker) Chan() <-chan time.Time {
+	return wt.C
+}
+
+type RequestTimer struct {
+	Ticker
 	IsOk bool
 }
 
 func newRequestTimer() *RequestTimer {
 	tick := time.NewTicker(StateTimerOut)
 	tick.Stop()
+	return NewRequestTimer(wallTicker{tick})
+}
+
+func NewRequestTimer(t Ticker) *RequestTimer {
 	return &RequestTimer{
-		Ticker: tick,
+		Ticker: t,
 		IsOk:   false,
 	}
 }
@@ -81,6 +106,7 @@ const (
 	Syncing EngineStatus = iota
 	Serving
 	ViewChanging
+	Recovering
 )
 
 func (es EngineStatus) String() string {
@@ -91,11 +117,15 @@ func (es EngineStatus) String() string {
 		return "Server consensus......"
 	case ViewChanging:
 		return "Changing views......"
+	case Recovering:
+		return "Recovering state......"
 	}
 
 	return "Unknown"
 }
 
+var ErrNotServing = errors.New("consensus engine is not serving now")
+
 type StateEngine struct {
 	NodeID      int64 `json:"nodeID"`
 	CurViewID   int64 `json:"viewID"`
@@ -103,22 +133,64 @@ type StateEngine struct {
 	LasExeSeq   int64 `json:"lastExeSeq"`
 	PrimaryID   int64 `json:"primaryID"`
 	nodeStatus  EngineStatus
+	// tentativeExec is set by WithTentativeExecution
+	tentativeExec bool
 
 	Timer           *RequestTimer
 	p2pWire         p2pnetwork.P2pNetwork
+	bulkWire        p2pnetwork.P2pNetwork
 	MsgChan         <-chan *message.ConMessage
+	BulkChan        <-chan *message.ConMessage
+	StatusChan      <-chan EngineStatus
+	statusChan      chan EngineStatus
+	cmdChan         chan *adminCmd
+	wake            chan struct{}
+	posted          []func()
+	postMu          sync.Mutex
 	nodeChan        chan<- *message.RequestRecord
 	directReplyChan chan<- *message.Reply
 
-	MiniSeq   int64 `json:"miniSeq"`
-	MaxSeq    int64 `json:"maxSeq"`
-	msgLogs   map[int64]*NormalLog
-	checks    map[int64]*CheckPoint
-	lastCP    *CheckPoint
-	cliRecord map[string]*ClientRecord
-	sCache    *VCCache
+	MiniSeq    int64 `json:"miniSeq"`
+	MaxSeq     int64 `json:"maxSeq"`
+	msgLogs    map[int64]*NormalLog
+	prepared   map[int64]*message.PTuple
+	checks     map[int64]*CheckPoint
+	lastCP     *CheckPoint
+	config     *message.Config
+	pending    *pendingConfig
+	recovering *recovery
+	auth       Authenticator
+	cert       Certifier
+	cliRecord  map[string]*ClientRecord
+	sCache     *VCCache
+	events     *eventBus
+
+	Metrics *metrics.Registry
+	metrics *engineMetrics
+	Log     logging.Logger
+	Tracer  *tracing.Tracer
+
+	// appState is the application state after LasExeSeq, as the node reported it
+	appState []byte
+
+	// configMu guards config against the goroutines besides the loop, only the loop changes it
+	configMu sync.RWMutex
+
+	// idle are the WaitIdle callers waiting for the requests in flight to execute
+	idle []chan struct{}
+}
+
+// Option configures an engine when InitConsensus creates it.
+type Option func(*StateEngine)
 
-	mu sync.Mutex
+/*
+WithTentativeExecution makes the replica execute a request tentatively once it is prepared and all requests before it
+committed, see tentativeExecute. The service has to roll its state back when the engine reports a view change.
+*/
+func WithTentativeExecution() Option {
+	return func(s *StateEngine) {
+		s.tentativeExec = true
+	}
 }
 
 func InitConsensus(
@@ -127,9 +199,11 @@ func InitConsensus(
 	rChan chan<- *message.Reply,
 	totalNodes int,
 	sendFunc func(msg interface{}),
+	opts ...Option,
 ) *StateEngine {
 	ch := make(chan *message.ConMessage, MaxStateMsgNO)
-	//p2p := p2pnetwork.NewSimpleP2pLib(id, ch)
+	stCh := make(chan EngineStatus, MaxStateMsgNO)
+	//p2p := p2pnetwork.NewSimpleP2pLib(id, ch, logging.Default())
 	p2p := p2pnetwork.NewSimP2pLib(totalNodes, sendFunc, ch)
 	se := &StateEngine{
 		NodeID:          id,
@@ -141,19 +215,74 @@ func InitConsensus(
 		Timer:           newRequestTimer(),
 		p2pWire:         p2p,
 		MsgChan:         ch,
+		StatusChan:      stCh,
+		statusChan:      stCh,
+		cmdChan:         make(chan *adminCmd),
+		wake:            make(chan struct{}, 1),
 		nodeChan:        cChan,
 		directReplyChan: rChan,
 		msgLogs:         make(map[int64]*NormalLog),
+		prepared:        make(map[int64]*message.PTuple),
 		checks:          make(map[int64]*CheckPoint),
+		config:          message.DefaultConfig(),
 		cliRecord:       make(map[string]*ClientRecord),
 		sCache:          NewVCCache(),
+		events:          newEventBus(),
+		Metrics:         metrics.NewRegistry(),
+		Log:             logging.Default(),
+	}
+	for _, opt := range opts {
+		opt(se)
 	}
-	se.PrimaryID = se.CurViewID % message.TotalNodeNO
+	se.PrimaryID = se.config.Primary(se.CurViewID)
+	se.initMetrics()
+	se.SetP2pNetwork(p2p)
 	return se
 }
 
+// SetP2pNetwork replaces the transport the engine sends its messages through.
+func (s *StateEngine) SetP2pNetwork(p2p p2pnetwork.P2pNetwork) {
+	s.p2pWire = s.sealed(&meteredP2p{P2pNetwork: p2p, sent: s.metrics.sent})
+	s.setPeers()
+}
+
+// Network is the transport the engine sends its protocol messages through, for what else has to reach its peers.
+func (s *StateEngine) Network() p2pnetwork.P2pNetwork {
+	return s.p2pWire
+}
+
+func (s *StateEngine) logger() logging.Logger {
+	return s.Log.With(logging.F("node", s.NodeID), logging.F("view", s.CurViewID))
+}
+
+/*
+The node parks client requests that arrive while a view change is in progress. Every time the engine goes back
+to Serving or a new primary is installed the current status is pushed to StatusChan, so the parked requests can be
+retried. With tentative execution the start of a view change is pushed too, the node rolls back its tentative state
+then; so is the start of a recovery.
+*/
+func (s *StateEngine) setStatus(status EngineStatus) {
+	if s.nodeStatus != status {
+		s.logger().Info("engine status changed", logging.F("from", s.nodeStatus), logging.F("to", status))
+	}
+	s.nodeStatus = status
+	if status != Serving && status != Recovering && !(status == ViewChanging && s.tentativeExec) {
+		return
+	}
+	s.notifyStatus()
+}
+
+func (s *StateEngine) notifyStatus() {
+	select {
+	case s.statusChan <- s.nodeStatus:
+	default:
+		s.logger().Warn("status channel is full, drop status", logging.F("status", s.nodeStatus))
+	}
+}
+
 func (s *StateEngine) StartConsensus(sig chan interface{}) {
-	s.nodeStatus = Serving
+	s.Ready()
+	s.publish()
 	//defer func() {
 	//	if r := recover(); r != nil {
 	//		sig <- r
@@ -162,36 +291,110 @@ func (s *StateEngine) StartConsensus(sig chan interface{}) {
 
 	for {
 		select {
-		case <-s.Timer.C:
+		case cmd := <-s.cmdChan:
+			cmd.done <- cmd.run()
+		case <-s.wake:
+			s.runPosted()
+		case <-s.Timer.Chan():
 			// TODO sara: uncomment
-			s.ViewChange()
+			s.HandleTimeout()
 		case conMsg := <-s.MsgChan:
-			switch conMsg.Typ {
-			case message.MTRequest,
-				message.MTPrePrepare:
-				if s.nodeStatus != Serving {
-					fmt.Printf("[Node %d] node is not in service status now. Status: %s\n", s.NodeID, s.nodeStatus.String())
-					continue
-				}
-				if err := s.procConsensusMsg(conMsg); err != nil {
-					fmt.Printf("[Node %d] consensus error: %v\n", s.NodeID, err)
-				}
-			case message.MTPrepare,
-				message.MTCommit:
-				if s.nodeStatus != Serving && s.nodeStatus != ViewChanging {
-					fmt.Printf("[Node %d] node is not in service or view changing status now. Status: %s\n", s.NodeID, s.nodeStatus.String())
-					continue
-				}
-				if err := s.procConsensusMsg(conMsg); err != nil {
-					fmt.Printf("[Node %d] consensus error: %v\n", s.NodeID, err)
-				}
-			case message.MTCheckpoint,
-				message.MTViewChange,
-				message.MTNewView:
-				if err := s.procManageMsg(conMsg); err != nil {
-					fmt.Print(err)
-				}
-			}
+			s.HandleMessage(conMsg)
+		case conMsg := <-s.BulkChan:
+			s.HandleMessage(conMsg)
+		}
+		s.publish()
+		s.notifyIdle()
+	}
+}
+
+/*
+Post hands fn to the consensus loop, which runs what is posted in order. Unlike the operator commands it doesn't wait
+for fn to run, so the node's dispatcher, which the engine blocks on when it hands over a committed request, can post
+its client requests and executed replies without deadlocking.
+*/
+func (s *StateEngine) Post(fn func()) {
+	s.postMu.Lock()
+	s.posted = append(s.posted, fn)
+	s.postMu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *StateEngine) runPosted() {
+	s.postMu.Lock()
+	posted := s.posted
+	s.posted = nil
+	s.postMu.Unlock()
+	for _, fn := range posted {
+		fn()
+	}
+}
+
+/*
+StartConsensus drives the engine from MsgChan and the request timer. A driver that wants to decide itself when each
+message arrives, like the simulator, calls Ready once and then HandleMessage and HandleTimeout from a single goroutine.
+*/
+func (s *StateEngine) Ready() {
+	s.setStatus(Serving)
+}
+
+func (s *StateEngine) HandleTimeout() {
+	if s.recovering != nil {
+		s.retryRecovery()
+		return
+	}
+	s.ViewChange()
+}
+
+func (s *StateEngine) HandleMessage(conMsg *message.ConMessage) {
+	if conMsg == nil {
+		return
+	}
+	s.metrics.received.With(conMsg.Typ.String()).Inc()
+	if s.auth != nil && !s.authenticate(conMsg) {
+		return
+	}
+	switch conMsg.Typ {
+	case message.MTRequest,
+		message.MTPrePrepare:
+		if s.nodeStatus != Serving && s.nodeStatus != Recovering {
+			s.logger().Debug("node is not in service status now", logging.F("status", s.nodeStatus),
+				logging.F("type", conMsg.Typ), logging.F("peer", conMsg.From))
+			return
+		}
+		if err := s.procConsensusMsg(conMsg); err != nil {
+			s.logger().Error("consensus error", logging.F("type", conMsg.Typ), logging.F("peer", conMsg.From), logging.Err(err))
+		}
+	case message.MTPrepare,
+		message.MTCommit:
+		if s.nodeStatus != Serving && s.nodeStatus != ViewChanging && s.nodeStatus != Recovering {
+			s.logger().Debug("node is not in service or view changing status now", logging.F("status", s.nodeStatus),
+				logging.F("type", conMsg.Typ), logging.F("peer", conMsg.From))
+			return
+		}
+		if err := s.procConsensusMsg(conMsg); err != nil {
+			s.logger().Error("consensus error", logging.F("type", conMsg.Typ), logging.F("peer", conMsg.From), logging.Err(err))
+		}
+	case message.MTViewChange,
+		message.MTNewView:
+		if s.nodeStatus == Recovering {
+			s.logger().Debug("node is recovering now", logging.F("type", conMsg.Typ), logging.F("peer", conMsg.From))
+			return
+		}
+		if err := s.procManageMsg(conMsg); err != nil {
+			s.logger().Error("manage message error", logging.F("type", conMsg.Typ), logging.F("peer", conMsg.From), logging.Err(err))
+		}
+	case message.MTCheckpoint,
+		message.MTFetchState,
+		message.MTStateTransfer,
+		message.MTFetchRequest,
+		message.MTFetchDigests,
+		message.MTStateDigests:
+		if err := s.procManageMsg(conMsg); err != nil {
+			s.logger().Error("manage message error", logging.F("type", conMsg.Typ), logging.F("peer", conMsg.From), logging.Err(err))
 		}
 	}
 }
@@ -213,16 +416,16 @@ func (s *StateEngine) checkClientRecord(request *message.Request) (*ClientRecord
 	if !ok {
 		client = NewClientRecord()
 		s.cliRecord[request.ClientID] = client
-		fmt.Printf("======>[Primary] New Client ID:%s\n", request.ClientID)
+		s.logger().Debug("new client", logging.F("client", request.ClientID))
 	}
 
-	if request.TimeStamp < client.LastReplyTime {
-		rp, ok := client.Reply[request.TimeStamp]
-		if ok {
-			fmt.Printf("======>[Primary] direct reply:%d\n", rp.SeqID)
-			s.directReplyChan <- rp
-			return nil, nil
-		}
+	if request.TimeStamp == client.LastTimeStamp && client.LastReply != nil {
+		rp := client.LastReply
+		s.logger().Debug("direct reply", logging.F("client", request.ClientID), logging.F("seq", rp.SeqID))
+		s.directReplyChan <- rp.ForRequest(request)
+		return nil, nil
+	}
+	if request.TimeStamp <= client.LastTimeStamp {
 		return nil, fmt.Errorf("======>[Primary] it's a old operation Request")
 	}
 	return client, nil
@@ -237,24 +440,53 @@ func (s *StateEngine) getOrCreateLog(seq int64) *NormalLog {
 	return log
 }
 
+/*
+A client request comes without a sequence number, only the primary assigns one: the primary orders the request under
+the next sequence number, a backup relays it to the primary and starts its timer, so the primary is suspected if the
+request doesn't commit in time. A request that already carries a sequence number is refused, a client doesn't get to
+choose where its request is ordered. It runs on the consensus loop, a node posts its requests there.
+*/
 func (s *StateEngine) InspireConsensus(request *message.Request) error {
-	//s.CurSequence++
-	//newSeq := s.CurSequence
-	newSeq := request.SeqID
-	fmt.Printf("======>[InspireConsensus] Node: %d Current sequence (%d)\n", s.NodeID, newSeq)
-	//request.SeqID = newSeq
+	s.logger().Debug("inspire consensus", logging.F("seq", request.SeqID), logging.F("client", request.ClientID))
+	if request.SeqID != 0 {
+		return fmt.Errorf("======>[InspireConsensus] Node: %d request of client[%s] carries sequence no[%d]",
+			s.NodeID, request.ClientID, request.SeqID)
+	}
+	if s.nodeStatus != Serving {
+		return fmt.Errorf("======>[InspireConsensus] Node: %d status[%s]: %w", s.NodeID, s.nodeStatus, ErrNotServing)
+	}
 	client, err := s.checkClientRecord(request)
 	if err != nil || client == nil {
 		return err
 	}
+	if s.NodeID != s.PrimaryID {
+		return s.relayRequest(request)
+	}
+	for _, r := range client.Request {
+		if r.TimeStamp == request.TimeStamp {
+			s.logger().Debug("request is already ordered", logging.F("seq", r.SeqID), logging.F("client", request.ClientID))
+			return nil
+		}
+	}
+	if s.CurSequence >= s.MaxSeq {
+		return fmt.Errorf("======>[InspireConsensus] Node: %d sequence no[%d] reached the high water mark", s.NodeID, s.CurSequence)
+	}
+	s.CurSequence++
+	newSeq := s.CurSequence
+	request.SeqID = newSeq
+	if request.TraceID == "" {
+		request.TraceID = tracing.NewTraceID()
+	}
 	client.saveRequest(request)
+	dig := message.Digest(request)
+	s.emitRequest(EventRequestReceived, newSeq, dig, request.ClientID, request.TimeStamp)
 	cMsg := message.CreateConMsg(message.MTRequest, request)
 	cMsg.From = uint(s.NodeID)
+	cMsg.TraceID = request.TraceID
 
-	if err := s.p2pWire.BroadCast(cMsg); err != nil {
+	if err := s.bulk().BroadCast(cMsg); err != nil {
 		return err
 	}
-	dig := message.Digest(request)
 	ppMsg := &message.PrePrepare{
 		ViewID:     s.CurViewID,
 		SequenceID: newSeq,
@@ -264,17 +496,31 @@ func (s *StateEngine) InspireConsensus(request *message.Request) error {
 	log := s.getOrCreateLog(newSeq)
 	//log.PrePrepare = ppMsg
 	log.clientID = request.ClientID
+	log.request = request
+	log.traceID = request.TraceID
+	s.traceSpan(newSeq, log, "receive", log.start, time.Now())
 	cMsg = message.CreateConMsg(message.MTPrePrepare, ppMsg)
 	cMsg.From = uint(s.NodeID)
+	cMsg.TraceID = request.TraceID
 
 	if err := s.p2pWire.BroadCast(cMsg); err != nil {
 		return err
 	}
+	s.traceSpan(newSeq, log, "pre-prepare", log.start, time.Now())
 	//log.Stage = PrePrepared
-	fmt.Printf("======>[Primary]Consensus broadcast message(%d)\n", newSeq)
+	s.logger().Debug("primary broadcast pre-prepare", logging.F("seq", newSeq))
 	return nil
 }
 
+func (s *StateEngine) relayRequest(request *message.Request) error {
+	cMsg := message.CreateConMsg(message.MTRequest, request)
+	cMsg.From = uint(s.NodeID)
+	cMsg.TraceID = request.TraceID
+	s.Timer.tick()
+	s.logger().Debug("relay request to primary", logging.F("primary", s.PrimaryID), logging.F("client", request.ClientID))
+	return s.bulk().SendToNode(s.PrimaryID, cMsg)
+}
+
 func (s *StateEngine) SendToNode(nodeID int64, v interface{}) error {
 	return s.p2pWire.SendToNode(nodeID, v)
 }
@@ -294,17 +540,69 @@ The last condition prevents a faulty primary from exhausting the space of sequen
 
 func (s *StateEngine) rawRequest(request *message.Request) (err error) {
 	//TODO:: check signature of Request
+	if request.SeqID == 0 {
+		if s.NodeID != s.PrimaryID {
+			return fmt.Errorf("======>[rawRequest] Node: %d isn't the primary[%d] for relayed request", s.NodeID, s.PrimaryID)
+		}
+		return s.InspireConsensus(request)
+	}
+	if request.SeqID > s.MaxSeq || request.SeqID < s.MiniSeq {
+		return fmt.Errorf("======>[rawRequest] sequence no[%d] invalid[%d~%d]", request.SeqID, s.MiniSeq, s.MaxSeq)
+	}
+	digest := message.Digest(request)
+	if log, ok := s.msgLogs[request.SeqID]; ok && log.PrePrepare != nil && log.PrePrepare.Digest != digest {
+		return fmt.Errorf("======>[rawRequest] request[%d] doesn't match the digest of its pre-prepare", request.SeqID)
+	}
 	client, err := s.checkClientRecord(request)
 	if err != nil || client == nil {
 		return err
 	}
 	log := s.getOrCreateLog(request.SeqID)
 	log.clientID = request.ClientID
+	log.request = request
+	if request.TraceID != "" {
+		log.traceID = request.TraceID
+	}
 	client.saveRequest(request)
+	s.traceSpan(request.SeqID, log, "receive", log.start, time.Now())
+	s.emitRequest(EventRequestReceived, request.SeqID, digest, request.ClientID, request.TimeStamp)
+	if log.Stage == Committed {
+		// the body was fetched after the request committed
+		s.executeCommitted()
+		return nil
+	}
 	s.Timer.tick()
+	if log.Stage == Idle && log.PrePrepare != nil {
+		// the pre-prepare came first and waited for the request
+		pp := log.PrePrepare
+		log.PrePrepare = nil
+		return s.idle2PrePrepare(pp)
+	}
 	return nil
 }
 
+/*
+awaitRequest keeps a pre-prepare of the primary in the log until the replica has the request it orders, which is
+fetched from the others when the primary's copy was lost. A digest nobody has a request for never prepares. The
+pre-prepares of a new view aren't held back, they were prepared in an earlier view or are null requests, and a missing
+body is fetched once they commit.
+*/
+func (s *StateEngine) awaitRequest(ppMsg *message.PrePrepare) bool {
+	if ppMsg.Digest == "" || ppMsg.ViewID != s.CurViewID || ppMsg.SequenceID > s.MaxSeq || ppMsg.SequenceID < s.MiniSeq {
+		return false
+	}
+	if log, ok := s.msgLogs[ppMsg.SequenceID]; ok && (log.Stage != Idle || log.PrePrepare != nil) {
+		return false
+	}
+	if s.requestBody(ppMsg.SequenceID, ppMsg.Digest) != nil {
+		return false
+	}
+	s.getOrCreateLog(ppMsg.SequenceID).PrePrepare = ppMsg
+	s.logger().Debug("pre-prepare waits for its request", logging.F("seq", ppMsg.SequenceID))
+	s.fetchRequest(ppMsg.SequenceID, ppMsg.Digest)
+	return true
+}
+
 /*
 	Like PRE-PREPAREs, the PREPARE and COMMIT messages sent in the other phases also contain n and v. A replica
 
@@ -319,8 +617,10 @@ replicas; in addition, it adds both the PRE-PREPARE and PREPARE messages to its
 */
 func (s *StateEngine) idle2PrePrepare(ppMsg *message.PrePrepare) (err error) {
 	// TODO sara: check if the next line is needed
-	s.CurSequence = ppMsg.SequenceID
-	fmt.Printf("======>[idle2PrePrepare] Node: %d Current sequence[%d]\n", s.NodeID, ppMsg.SequenceID)
+	if ppMsg.SequenceID > s.CurSequence {
+		s.CurSequence = ppMsg.SequenceID
+	}
+	s.logger().Debug("pre-prepare received", logging.F("seq", ppMsg.SequenceID))
 
 	//TODO:: check signature of of pre-Prepare message
 	//TODO:: check digest of pre-Prepare message
@@ -342,18 +642,25 @@ func (s *StateEngine) idle2PrePrepare(ppMsg *message.PrePrepare) (err error) {
 		if log.PrePrepare.Digest != ppMsg.Digest {
 			return fmt.Errorf("pre-Prepare message in same v-n but not same digest")
 		} else {
-			fmt.Println("======>[idle2PrePrepare] duplicate pre-Prepare message")
+			s.logger().Debug("duplicate pre-prepare message", logging.F("seq", ppMsg.SequenceID))
 			return
 		}
 	}
+	if log.request != nil && message.Digest(log.request) != ppMsg.Digest {
+		// the body came before the pre-prepare and isn't the one ordered, the right one is fetched at commit
+		s.logger().Warn("request doesn't match pre-prepare", logging.F("seq", ppMsg.SequenceID))
+		log.request = nil
+	}
 	prepare := &message.Prepare{
 		ViewID:     s.CurViewID,
 		SequenceID: ppMsg.SequenceID,
 		Digest:     ppMsg.Digest,
 		NodeID:     s.NodeID,
+		Sig:        s.vote(message.MTPrepare, s.CurViewID, ppMsg.SequenceID, ppMsg.Digest),
 	}
 	cMsg := message.CreateConMsg(message.MTPrepare, prepare)
 	cMsg.From = uint(s.NodeID)
+	cMsg.TraceID = log.traceID
 
 	if err := s.p2pWire.BroadCast(cMsg); err != nil {
 		return err
@@ -361,8 +668,12 @@ func (s *StateEngine) idle2PrePrepare(ppMsg *message.PrePrepare) (err error) {
 	log.PrePrepare = ppMsg
 	log.Prepare[s.NodeID] = prepare
 	log.Stage = PrePrepared
-	fmt.Printf("======>[idle2PrePrepare] Node: %d, Consensus status is [%s] seq=%d\n", s.NodeID, log.Stage, ppMsg.SequenceID)
-	return nil
+	log.prePrepared = time.Now()
+	s.logger().Debug("stage changed", logging.F("seq", ppMsg.SequenceID), logging.F("stage", log.Stage))
+	s.emit(EventPrePrepared, ppMsg.SequenceID, ppMsg.Digest)
+	s.traceSpan(ppMsg.SequenceID, log, "pre-prepare", log.start, log.prePrepared)
+	// the prepares that came first are counted with the replica's own
+	return s.prePrepare2Prepare(prepare)
 }
 
 /*
@@ -381,7 +692,7 @@ are correct, their view number equals the replica’s current view, and their se
 
 func (s *StateEngine) prePrepare2Prepare(prepare *message.Prepare) (err error) {
 
-	fmt.Printf("======>[prePrepare2Prepare]Node: %d, Current sequence[%d], From: %d\n", s.NodeID, prepare.SequenceID, prepare.NodeID)
+	s.logger().Debug("prepare received", logging.F("seq", prepare.SequenceID), logging.F("peer", prepare.NodeID))
 
 	//TODO::signature check
 	//fmt.Printf("Verify Prepare message digest:%s\n", Prepare.Digest)
@@ -393,16 +704,19 @@ func (s *StateEngine) prePrepare2Prepare(prepare *message.Prepare) (err error) {
 		return fmt.Errorf("======>[prePrepare2Prepare]:=>sequence no[%d] invalid[%d~%d]\n", prepare.SequenceID, s.MiniSeq, s.MaxSeq)
 	}
 
-	log, ok := s.msgLogs[prepare.SequenceID]
-	if !ok {
-		return fmt.Errorf("======>[prePrepare2Prepare]:=>havn't got log for message(%d) yet", prepare.SequenceID)
+	if err := s.isMember(prepare.NodeID); err != nil {
+		return err
+	}
+	// a prepare may overtake its pre-prepare, it is logged and counted once the pre-prepare comes
+	log := s.getOrCreateLog(prepare.SequenceID)
+	if log.Stage == Idle {
+		log.Prepare[prepare.NodeID] = prepare
+		return nil
 	}
-
-	log.Prepare[prepare.NodeID] = prepare
-
 	if log.Stage != PrePrepared {
 		return fmt.Errorf("======>[prePrepare2Prepare] current[seq=%d] state isn't PrePrepared:[%s]\n", prepare.SequenceID, log.Stage)
 	}
+	log.Prepare[prepare.NodeID] = prepare
 
 	ppMsg := log.PrePrepare
 	if ppMsg == nil {
@@ -414,35 +728,95 @@ func (s *StateEngine) prePrepare2Prepare(prepare *message.Prepare) (err error) {
 			ppMsg.SequenceID != prepareLog.SequenceID ||
 			ppMsg.Digest != prepareLog.Digest {
 			delete(log.Prepare, nodeID)
-			fmt.Printf("[Prepare]:=>not same with pre-Prepare message. Node: {%d}", s.NodeID)
+			s.logger().Warn("prepare doesn't match pre-prepare", logging.F("seq", prepare.SequenceID), logging.F("peer", nodeID))
 		}
 	}
 
-	if len(log.Prepare) < 2*message.MaxFaultyNode { //not different replica, just simple no
-		fmt.Printf("======>[prePrepare2Prepare] Node: %d, Not enough votes: %d less than %d\n", s.NodeID, len(log.Prepare), 2*message.MaxFaultyNode)
-		for k, _ := range log.Prepare {
-			fmt.Printf("======>[prePrepare2Prepare] Node: %d, Prepare vote node id: %d\n", s.NodeID, k)
-		}
+	if len(log.Prepare) < 2*int(s.config.F) { //not different replica, just simple no
+		s.logger().Debug("not enough prepare votes", logging.F("seq", prepare.SequenceID),
+			logging.F("votes", len(log.Prepare)), logging.F("need", 2*s.config.F))
 		return nil
 	}
+	if s.cert != nil {
+		votes := make(map[int64][]byte, len(log.Prepare))
+		for id, p := range log.Prepare {
+			votes[id] = p.Sig
+		}
+		qc, bad := s.certify(message.MTPrepare, ppMsg.ViewID, ppMsg.SequenceID, ppMsg.Digest, votes, 2*int(s.config.F))
+		for _, id := range bad {
+			delete(log.Prepare, id)
+		}
+		if qc == nil {
+			return nil
+		}
+		log.prepareCert = qc
+	}
 
 	commit := &message.Commit{
 		ViewID:     s.CurViewID,
 		SequenceID: prepare.SequenceID,
 		Digest:     prepare.Digest,
 		NodeID:     s.NodeID,
+		Sig:        s.vote(message.MTCommit, s.CurViewID, prepare.SequenceID, prepare.Digest),
 	}
 	cMsg := message.CreateConMsg(message.MTCommit, commit)
 	cMsg.From = uint(s.NodeID)
+	cMsg.TraceID = log.traceID
 
 	if err := s.p2pWire.BroadCast(cMsg); err != nil {
 		return err
 	}
 	log.Commit[s.NodeID] = commit
 	log.Stage = Prepared
+	log.prepared = time.Now()
+	s.metrics.observePhase("prepare", log.prePrepared, log.prepared)
+
+	s.logger().Debug("stage changed", logging.F("seq", prepare.SequenceID), logging.F("stage", log.Stage))
+	s.emit(EventPrepared, prepare.SequenceID, ppMsg.Digest)
+	s.traceSpan(prepare.SequenceID, log, "prepare quorum", log.prePrepared, log.prepared)
+	s.tentativeExecute(prepare.SequenceID, log)
+	// the commits that came first are counted with the replica's own
+	return s.prepare2Commit(commit)
+}
 
-	fmt.Printf("======>[prePrepare2Prepare] Node: %d, Consensus status is [%s] seq=%d\n", s.NodeID, log.Stage, prepare.SequenceID)
-	return
+/*
+Replicas can execute requests tentatively as soon as the requests prepare and their state reflects the execution of
+all requests with lower sequence number and these requests are all known to have committed. After executing the
+request, the replicas send tentative replies to the client. The client waits for 2f+1 matching tentative replies. If it
+receives this many, the request is guaranteed to commit eventually. Otherwise, the client retransmits the request and
+waits for f+1 non-tentative replies.
+
+A request that has executed tentatively may abort if there is a view change and it is replaced by a null request.
+In this case the replica reverts its state to the last stable checkpoint in the new-view message or to its last
+checkpointed state (depending on which one has the higher sequence number).
+*/
+func (s *StateEngine) tentativeExecute(seq int64, log *NormalLog) {
+	if !s.tentativeExec || s.nodeStatus != Serving || log.tentative {
+		return
+	}
+	for i := s.LasExeSeq + 1; i < seq; i++ {
+		l, ok := s.msgLogs[i]
+		if !ok || l.Stage != Committed {
+			return
+		}
+	}
+
+	client, ok := s.cliRecord[log.clientID]
+	if !ok {
+		return
+	}
+	request, ok := client.Request[seq]
+	if !ok || request.Reconfig != nil {
+		return
+	}
+
+	log.tentative = true
+	s.logger().Debug("execute tentatively", logging.F("seq", seq))
+	s.nodeChan <- &message.RequestRecord{
+		Request:    request,
+		PrePrepare: log.PrePrepare,
+		Tentative:  true,
+	}
 }
 
 /*
@@ -466,7 +840,7 @@ corresponding Request can be executed.
 */
 
 func (s *StateEngine) prepare2Commit(commit *message.Commit) (err error) {
-	fmt.Printf("======>[prepare2Commit] Node: %d, Current sequence[%d]\n", s.NodeID, commit.SequenceID)
+	s.logger().Debug("commit received", logging.F("seq", commit.SequenceID), logging.F("peer", commit.NodeID))
 
 	//TODO:: Commit is properly signed
 	//fmt.Printf("Verify Commit message digest:%s\n", Commit.Digest)
@@ -479,17 +853,19 @@ func (s *StateEngine) prepare2Commit(commit *message.Commit) (err error) {
 			commit.SequenceID, s.MiniSeq, s.MaxSeq)
 	}
 
-	log, ok := s.msgLogs[commit.SequenceID]
-	if !ok {
-		return fmt.Errorf("======>[prepare2Commit]: Node: %d =>havn't got log for message(%d) yet", s.NodeID, commit.SequenceID)
+	if err := s.isMember(commit.NodeID); err != nil {
+		return err
+	}
+	// buffer commit messages, they may come before the replica prepared the request
+	log := s.getOrCreateLog(commit.SequenceID)
+	if log.Stage < Prepared {
+		log.Commit[commit.NodeID] = commit
+		return nil
 	}
-
-	// buffer commit messages
-	log.Commit[commit.NodeID] = commit
-
 	if log.Stage != Prepared {
 		return fmt.Errorf("======>[prepare2Commit] Node: %d, current[seq=%d] state isn't Prepared:[%s]\n", s.NodeID, commit.SequenceID, log.Stage)
 	}
+	log.Commit[commit.NodeID] = commit
 
 	ppMsg := log.PrePrepare
 	if ppMsg == nil {
@@ -501,104 +877,138 @@ func (s *StateEngine) prepare2Commit(commit *message.Commit) (err error) {
 			ppMsg.SequenceID != commitLog.SequenceID ||
 			ppMsg.Digest != commitLog.Digest {
 			delete(log.Commit, nodeID)
-			fmt.Printf("[Commit]:=>not same with pre-Prepare message. Node: {%d}", s.NodeID)
+			s.logger().Warn("commit doesn't match pre-prepare", logging.F("seq", commit.SequenceID), logging.F("peer", nodeID))
 		}
 	}
 
-	if len(log.Commit) < 2*message.MaxFaultyNode+1 {
+	if len(log.Commit) < s.config.Quorum() {
 		return nil
 	}
+	if s.cert != nil {
+		votes := make(map[int64][]byte, len(log.Commit))
+		for id, c := range log.Commit {
+			votes[id] = c.Sig
+		}
+		qc, bad := s.certify(message.MTCommit, ppMsg.ViewID, ppMsg.SequenceID, ppMsg.Digest, votes, s.config.Quorum())
+		for _, id := range bad {
+			delete(log.Commit, id)
+		}
+		if qc == nil {
+			return nil
+		}
+		log.commitCert = qc
+	}
 	log.Stage = Committed
+	log.committed = time.Now()
+	s.metrics.committed.Inc()
+	s.metrics.commitLatency.Observe(log.committed.Sub(log.start).Seconds())
+	s.metrics.observePhase("commit", log.prepared, log.committed)
 	s.Timer.tack()
-	fmt.Printf("======>[prepare2Commit] Node: %d, Consensus status is [%s] seq=%d and timer stop\n", s.NodeID, log.Stage, commit.SequenceID)
+	s.logger().Debug("stage changed, timer stop", logging.F("seq", commit.SequenceID), logging.F("stage", log.Stage))
+	s.emit(EventCommitted, commit.SequenceID, ppMsg.Digest)
+	s.traceSpan(commit.SequenceID, log, "commit quorum", log.prepared, log.committed)
 
 	if s.nodeStatus == Serving {
-		//TODO::should execute request with smallest  sequence no, current committed sequence may not be the smallest one.
-		_, ok := s.cliRecord[log.clientID]
-		if !ok {
-			fmt.Printf("======>[prepare2Commit] Node: %d,no cli record for client id [%s], seq: %d", s.NodeID, log.clientID, s.CurSequence)
-			return
-		}
-
-		request, ok := s.cliRecord[log.clientID].Request[commit.SequenceID]
-		if !ok {
-			return fmt.Errorf("no raw request for such seq[%d]", commit.SequenceID)
-		}
-		exeParam := &message.RequestRecord{
-			Request:    request,
-			PrePrepare: ppMsg,
-		}
-		//TODO::Check the reply whose sequence is smaller than current sequence.
-		s.nodeChan <- exeParam
+		s.executeCommitted()
 	} else if s.nodeStatus == ViewChanging {
-		fmt.Printf("======>[prepare2Commit] Node: %d, View changing commit done.\n", s.NodeID)
-		s.nodeStatus = Serving
+		s.logger().Info("view changing commit done", logging.F("seq", commit.SequenceID))
+		s.setStatus(Serving)
 	}
 
 	return
 }
 
 func (s *StateEngine) procConsensusMsg(msg *message.ConMessage) (err error) {
-	s.Timer.Reset(StateTimerOut)
+	// a running timer is pushed back while the protocol makes progress, an idle one stays stopped
+	if s.Timer.isRunning() {
+		s.Timer.Reset(StateTimerOut)
+	}
+
+	s.logger().Debug("consensus message", logging.F("type", msg.Typ), logging.F("peer", msg.From), logging.F("sig", msg.Sig))
 
-	fmt.Printf("\n======>[procConsensusMsg] Consesus message signature:(%s)\n", msg.Sig)
+	body, err := msg.Body()
+	if err != nil {
+		return fmt.Errorf("======>[procConsensusMsg] invalid[%s] %s message[%s]\n", err, msg.Typ, msg)
+	}
 
 	switch msg.Typ {
 
 	case message.MTRequest:
-		request := &message.Request{}
-		if err := json.Unmarshal(msg.Payload, request); err != nil {
-			return fmt.Errorf("======>[procConsensusMsg] Invalid[%s] request message[%s]\n", err, msg)
-		}
-		return s.rawRequest(request)
+		return s.rawRequest(body.(*message.Request))
 	case message.MTPrePrepare:
-		prePrepare := &message.PrePrepare{}
-		if err := json.Unmarshal(msg.Payload, prePrepare); err != nil {
-			return fmt.Errorf("======>[procConsensusMsg] Invalid[%s] pre-Prepare message[%s]\n", err, msg)
+		prePrepare := body.(*message.PrePrepare)
+		s.adoptTrace(prePrepare.SequenceID, msg.TraceID)
+		if s.awaitRequest(prePrepare) {
+			return nil
 		}
 		return s.idle2PrePrepare(prePrepare)
 
 	case message.MTPrepare:
-		prepare := &message.Prepare{}
-		fmt.Printf("Prepare received - From: %d, To: %d\n", msg.From, msg.To)
-		if err := json.Unmarshal(msg.Payload, prepare); err != nil {
-			return fmt.Errorf("======>[procConsensusMsg]invalid[%s] Prepare message[%s]\n", err, msg)
-		}
+		prepare := body.(*message.Prepare)
+		s.adoptTrace(prepare.SequenceID, msg.TraceID)
 		return s.prePrepare2Prepare(prepare)
 
 	case message.MTCommit:
-		commit := &message.Commit{}
-		if err := json.Unmarshal(msg.Payload, commit); err != nil {
-			return fmt.Errorf("======>[procConsensusMsg] invalid[%s] Commit message[%s]\n", err, msg)
-		}
+		commit := body.(*message.Commit)
+		s.adoptTrace(commit.SequenceID, msg.TraceID)
 		return s.prepare2Commit(commit)
 	}
 	return
 }
 
 func (s *StateEngine) procManageMsg(msg *message.ConMessage) (err error) {
+	body, err := msg.Body()
+	if err != nil {
+		return fmt.Errorf("======>[procManageMsg] invalid[%s] %s message[%s]\n", err, msg.Typ, msg)
+	}
+
 	switch msg.Typ {
 
 	case message.MTCheckpoint:
-		checkpoint := &message.CheckPoint{}
-		if err := json.Unmarshal(msg.Payload, checkpoint); err != nil {
-			return fmt.Errorf("======>[procConsensusMsg] invalid[%s]checkpoint message[%s]\n", err, msg)
-		}
-		return s.checkingPoint(checkpoint)
+		return s.checkingPoint(body.(*message.CheckPoint))
 
 	case message.MTViewChange:
-		vc := &message.ViewChange{}
-		if err := json.Unmarshal(msg.Payload, vc); err != nil {
-			return fmt.Errorf("======>[procConsensusMsg] invalid[%s]ViewChange message[%s]\n", err, msg)
+		vc := body.(*message.ViewChange)
+		if err := wellFormedViewChange(vc); err != nil {
+			return err
 		}
 		return s.procViewChange(vc)
 
 	case message.MTNewView:
-		vc := &message.NewView{}
-		if err := json.Unmarshal(msg.Payload, vc); err != nil {
-			return fmt.Errorf("======>[procConsensusMsg] invalid[%s] didiViewChange message[%s]\n", err, msg)
+		nv := body.(*message.NewView)
+		if err := wellFormedNewView(nv); err != nil {
+			return err
+		}
+		if primary := s.config.Primary(nv.NewViewID); int64(msg.From) != primary {
+			return fmt.Errorf("new view[%d] from node[%d] isn't from its primary[%d]", nv.NewViewID, msg.From, primary)
+		}
+		return s.didChangeView(nv)
+
+	case message.MTFetchState:
+		return s.sendState(body.(*message.FetchState))
+
+	case message.MTStateTransfer:
+		st := body.(*message.StateTransfer)
+		if err := wellFormedStateTransfer(st); err != nil {
+			return err
+		}
+		if s.recovering != nil && st.Partial() {
+			return s.recoverPartitions(st)
+		}
+		return s.installState(st)
+
+	case message.MTFetchRequest:
+		return s.sendRequest(body.(*message.FetchRequest))
+
+	case message.MTFetchDigests:
+		return s.sendDigests(body.(*message.FetchState))
+
+	case message.MTStateDigests:
+		sd := body.(*message.StateDigests)
+		if err := wellFormedStateDigests(sd); err != nil {
+			return err
 		}
-		return s.didChangeView(vc)
+		return s.collectDigests(sd)
 	}
 	return nil
 }
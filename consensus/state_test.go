@@ -0,0 +1,149 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+func sentTypes(sent []*message.ConMessage) map[message.MType][]uint {
+	types := make(map[message.MType][]uint)
+	for _, msg := range sent {
+		types[msg.Typ] = append(types[msg.Typ], msg.To)
+	}
+	return types
+}
+
+func TestPrimaryOrdersClientRequest(t *testing.T) {
+	te := newTestEngine(t, 0)
+	request := &message.Request{TimeStamp: 1, ClientID: "client-0", Operation: "op"}
+	if err := te.InspireConsensus(request); err != nil {
+		t.Fatal(err)
+	}
+	if request.SeqID != 1 || te.CurSequence != 1 {
+		t.Fatalf("request ordered at %d, current sequence %d", request.SeqID, te.CurSequence)
+	}
+	if got := len(sentTypes(te.sent)[message.MTPrePrepare]); got != message.TotalNodeNO {
+		t.Fatalf("primary sent %d pre-prepares", got)
+	}
+}
+
+func TestBackupRelaysClientRequest(t *testing.T) {
+	te := newTestEngine(t, 2)
+	request := &message.Request{TimeStamp: 1, ClientID: "client-0", Operation: "op"}
+	if err := te.InspireConsensus(request); err != nil {
+		t.Fatal(err)
+	}
+	if request.SeqID != 0 || te.CurSequence != 0 {
+		t.Fatalf("backup ordered the request at %d", request.SeqID)
+	}
+	types := sentTypes(te.sent)
+	if len(types[message.MTPrePrepare]) != 0 {
+		t.Fatal("backup sent a pre-prepare")
+	}
+	if to := types[message.MTRequest]; len(to) != 1 || int64(to[0]) != te.PrimaryID {
+		t.Fatalf("backup relayed the request to %v, primary is %d", to, te.PrimaryID)
+	}
+}
+
+func TestClientChosenSequenceIsRefused(t *testing.T) {
+	for _, id := range []int64{0, 2} {
+		te := newTestEngine(t, id)
+		request := &message.Request{SeqID: 5, TimeStamp: 1, ClientID: "client-0", Operation: "op"}
+		if err := te.InspireConsensus(request); err == nil {
+			t.Fatalf("node[%d] accepted a request with a sequence number", id)
+		}
+		if len(te.sent) != 0 || len(te.msgLogs) != 0 {
+			t.Fatalf("node[%d] acted on a request with a sequence number", id)
+		}
+	}
+}
+
+// withBody hands te the body of a request ordered at seq and returns its digest.
+func withBody(te *testEngine, seq int64) string {
+	request := &message.Request{SeqID: seq, TimeStamp: seq, ClientID: "client-0", Operation: "op"}
+	te.getOrCreateLog(seq).request = request
+	return message.Digest(request)
+}
+
+func TestVotesBeforeThePrePrepareAreCounted(t *testing.T) {
+	te := newTestEngine(t, 1)
+	d := withBody(te, 1)
+	for _, id := range []int64{2, 3} {
+		if err := te.prePrepare2Prepare(&message.Prepare{ViewID: 0, SequenceID: 1, Digest: d, NodeID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []int64{0, 2, 3} {
+		if err := te.prepare2Commit(&message.Commit{ViewID: 0, SequenceID: 1, Digest: d, NodeID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := te.idle2PrePrepare(&message.PrePrepare{ViewID: 0, SequenceID: 1, Digest: d}); err != nil {
+		t.Fatal(err)
+	}
+	if stage := te.msgLogs[1].Stage; stage != Committed {
+		t.Fatalf("request with every vote in is %s", stage)
+	}
+}
+
+func TestBinaryDecodedPrePrepareIsProcessed(t *testing.T) {
+	te := newTestEngine(t, 1)
+	d := withBody(te, 1)
+	pp := message.CreateConMsg(message.MTPrePrepare, &message.PrePrepare{ViewID: 0, SequenceID: 1, Digest: d})
+	data, err := message.BinaryCodec{}.Encode(pp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := message.BinaryCodec{}.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := te.procConsensusMsg(msg); err != nil {
+		t.Fatal(err)
+	}
+	if log, ok := te.msgLogs[1]; !ok || log.PrePrepare == nil || log.PrePrepare.Digest != d {
+		t.Fatal("pre-prepare that came in binary wasn't taken")
+	}
+	if len(sentTypes(te.sent)[message.MTPrepare]) == 0 {
+		t.Fatal("backup didn't prepare")
+	}
+}
+
+func TestBackupPreparesOnlyARequestItHas(t *testing.T) {
+	te := newTestEngine(t, 1)
+	request := &message.Request{SeqID: 1, TimeStamp: 1, ClientID: "client-0", Operation: "op"}
+	pp := message.CreateConMsg(message.MTPrePrepare, &message.PrePrepare{ViewID: 0, SequenceID: 1, Digest: message.Digest(request)})
+	pp.From = 0
+	if err := te.procConsensusMsg(pp); err != nil {
+		t.Fatal(err)
+	}
+	sent := sentTypes(te.sent)
+	if len(sent[message.MTPrepare]) != 0 {
+		t.Fatal("backup prepared a request it doesn't have")
+	}
+	if len(sent[message.MTFetchRequest]) == 0 {
+		t.Fatal("backup didn't fetch the request it waits for")
+	}
+
+	if err := te.rawRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	if to := sentTypes(te.sent)[message.MTPrepare]; len(to) == 0 {
+		t.Fatal("backup didn't prepare once the request came")
+	}
+	if stage := te.msgLogs[1].Stage; stage != PrePrepared {
+		t.Fatalf("request is %s", stage)
+	}
+}
+
+func TestReproposedRequestPreparesWithoutItsBody(t *testing.T) {
+	te := newTestEngine(t, 1)
+	// a new view orders again what prepared in an earlier view, the body is fetched once it commits
+	if err := te.idle2PrePrepare(&message.PrePrepare{ViewID: 0, SequenceID: 1, Digest: "prepared-before"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sentTypes(te.sent)[message.MTPrepare]) == 0 {
+		t.Fatal("backup didn't prepare the request of the new view")
+	}
+}
@@ -0,0 +1,49 @@
+package consensus
+
+import (
+	"time"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/tracing"
+)
+
+/*
+Each replica records one root span per request, from the moment the request or a message about it reaches the replica
+until the request executes, and a child span for every phase: receive, pre-prepare, prepare quorum, commit quorum and
+execute. The trace ID comes from the client request and travels in every consensus message derived from it, a replica
+that learns the request from a message adopts the ID of that message.
+*/
+func (s *StateEngine) adoptTrace(seq int64, traceID string) {
+	if traceID == "" {
+		return
+	}
+	if log, ok := s.msgLogs[seq]; ok && log.traceID == "" {
+		log.traceID = traceID
+	}
+}
+
+func (s *StateEngine) traceSpan(seq int64, log *NormalLog, name string, start, end time.Time) {
+	if !s.Tracer.Enabled() || log.traceID == "" {
+		return
+	}
+	span := &tracing.Span{
+		TraceID:      log.traceID,
+		ParentSpanID: log.spanID,
+		Name:         name,
+		Start:        start,
+		End:          end,
+		Attributes: map[string]interface{}{
+			"pbft.node":     s.NodeID,
+			"pbft.view":     s.CurViewID,
+			"pbft.sequence": seq,
+			"pbft.client":   log.clientID,
+		},
+	}
+	if name == "request" {
+		span.SpanID = log.spanID
+		span.ParentSpanID = ""
+	}
+	if err := s.Tracer.Record(span); err != nil {
+		s.logger().Warn("record span failed", logging.F("seq", seq), logging.F("span", name), logging.Err(err))
+	}
+}
@@ -3,22 +3,35 @@ package consensus
 import (
 	"fmt"
 
+	"github.com/sakesake/PBFT/logging"
 	"github.com/sakesake/PBFT/message"
 )
 
 type VCCache struct {
 	vcMsg message.VMessage
 	nvMsg map[int64]*message.NewView
+	// asked is the latest view every replica asked to change to
+	asked map[int64]int64
 }
 
 func NewVCCache() *VCCache {
 	return &VCCache{
 		vcMsg: make(message.VMessage),
 		nvMsg: make(map[int64]*message.NewView),
+		asked: make(map[int64]int64),
 	}
 }
 
+// pushVC keeps the view changes for the highest view, the ones for lower views can't make up its new view.
 func (vcc *VCCache) pushVC(vc *message.ViewChange) {
+	for id, old := range vcc.vcMsg {
+		if old.NewViewID > vc.NewViewID {
+			return
+		}
+		if old.NewViewID < vc.NewViewID {
+			delete(vcc.vcMsg, id)
+		}
+	}
 	vcc.vcMsg[vc.NodeID] = vc
 }
 
@@ -64,30 +77,41 @@ has sent a PRE-PREPARE or PREPARE message). Its entries are tuples ⟨n, d , v
 with digest d with number n in view v and that request did not pre-prepare at i in a later view with the same number.
 */
 
+/*
+computePMsg updates P with what prepared in the log and returns it. The log is dropped once the view change is sent, P
+is kept until a checkpoint covers it, so a view change that never completes doesn't lose what prepared before it.
+*/
 func (s *StateEngine) computePMsg() map[int64]*message.PTuple {
-	P := make(map[int64]*message.PTuple)
-
-	fmt.Printf("[computePMsg]Number of keys in s.msgLogs:%d\n", len(s.msgLogs))
+	s.logger().Debug("compute P message", logging.F("logs", len(s.msgLogs)), logging.F("prepared", len(s.prepared)))
 
-	for k, v := range s.msgLogs {
-		fmt.Printf("[computePMsg] Seq: %d, Stage: %s, prepare len: %d\n", k, v.Stage.String(), len(v.Prepare))
-	}
-
-	for seq := s.MiniSeq; seq < s.MaxSeq; seq++ {
+	for seq := s.MiniSeq; seq <= s.MaxSeq; seq++ {
 		log, ok := s.msgLogs[seq]
 		if !ok || log.Stage < Prepared {
 			continue
 		}
-
-		fmt.Printf("[computePMsg] Seq: %d, log.Prepare len: %d\n", seq, len(log.Prepare))
+		if pt, ok := s.prepared[seq]; ok && pt.PPMsg.ViewID > log.PrePrepare.ViewID {
+			continue
+		}
 
 		tuple := &message.PTuple{
 			PPMsg: log.PrePrepare,
 			PMsg:  log.Prepare,
 		}
-		P[seq] = tuple
+		if log.prepareCert != nil {
+			tuple.PMsg = nil
+			tuple.Cert = log.prepareCert
+		}
+		s.prepared[seq] = tuple
 	}
 
+	P := make(map[int64]*message.PTuple, len(s.prepared))
+	for seq, pt := range s.prepared {
+		if seq < s.MiniSeq || seq > s.MaxSeq {
+			delete(s.prepared, seq)
+			continue
+		}
+		P[seq] = pt
+	}
 	return P
 }
 
@@ -106,33 +130,52 @@ the size of the Q by a constant. It is interesting to note that VIEW-CHANGE mess
 or CHECKPOINT messages.
 */
 func (s *StateEngine) ViewChange() {
-
-	fmt.Printf("======>[ViewChange] Node: %d (%d, %d).....\n", s.NodeID, s.CurViewID, s.lastCP.Seq)
-	s.nodeStatus = ViewChanging
+	lastCP := s.stableCheckPoint()
+	s.logger().Info("view change started", logging.F("newView", s.CurViewID+1), logging.F("lastCP", lastCP.Seq))
+	s.setStatus(ViewChanging)
 	s.Timer.tack()
 
 	pMsg := s.computePMsg()
 
 	vc := &message.ViewChange{
 		NewViewID: s.CurViewID + 1,
-		LastCPSeq: s.lastCP.Seq,
+		LastCPSeq: lastCP.Seq,
 		NodeID:    s.NodeID,
-		CMsg:      s.lastCP.CPMsg,
+		CMsg:      lastCP.CPMsg,
 		PMsg:      pMsg,
 	}
+	if lastCP.Cert != nil {
+		vc.CMsg = nil
+		vc.CCert = lastCP.Cert
+	}
 
-	nextPrimaryID := vc.NewViewID % message.TotalNodeNO
+	nextPrimaryID := s.config.Primary(vc.NewViewID)
 	if s.NodeID == nextPrimaryID {
 		s.sCache.pushVC(vc) //[vc.NodeID] = vc
 	}
 
 	consMsg := message.CreateConMsg(message.MTViewChange, vc)
+	consMsg.From = uint(s.NodeID)
 	if err := s.p2pWire.BroadCast(consMsg); err != nil {
-		fmt.Println(err)
+		s.logger().Error("broadcast view change failed", logging.Err(err))
 		return
 	}
 	s.CurViewID = vc.NewViewID
 	s.msgLogs = make(map[int64]*NormalLog)
+	s.emit(EventViewChangeStarted, vc.LastCPSeq, lastCP.Digest)
+}
+
+/*
+stableCheckPoint is the last stable checkpoint, or before the first one the initial state at sequence number 0, which
+every replica starts from and which needs no certificate.
+*/
+func (s *StateEngine) stableCheckPoint() *CheckPoint {
+	if s.lastCP != nil {
+		return s.lastCP
+	}
+	cp := NewCheckPoint(0, 0)
+	cp.IsStable = true
+	return cp
 }
 
 /*
@@ -150,11 +193,17 @@ func (s Set) put(key interface{}) {
 	s[key] = true
 }
 func (s *StateEngine) checkViewChange(vc *message.ViewChange) error {
-	fmt.Printf("[checkViewChange] Node: %d\n", s.NodeID)
+	s.logger().Debug("check view change", logging.F("peer", vc.NodeID), logging.F("newView", vc.NewViewID))
 	if s.CurViewID > vc.NewViewID {
 		return fmt.Errorf("it's[%d] not for me[%d] view change\n", vc.NewViewID, s.CurViewID)
 	}
-	if len(vc.CMsg) <= message.MaxFaultyNode {
+	if err := s.isMember(vc.NodeID); err != nil {
+		return err
+	}
+	if vc.LastCPSeq < 0 {
+		return fmt.Errorf("view change message has a negative checkpoint h[%d]", vc.LastCPSeq)
+	}
+	if vc.LastCPSeq > 0 && vc.CCert == nil && len(vc.CMsg) <= int(s.config.F) {
 		return fmt.Errorf("view message checking C message failed")
 	}
 	var counter = make(map[int64]Set)
@@ -180,10 +229,17 @@ func (s *StateEngine) checkViewChange(vc *message.ViewChange) error {
 		counter[cp.ViewID].put(id)
 	}
 
-	CMsgIsOK := false
+	CMsgIsOK := vc.LastCPSeq == 0
+	if vc.CCert != nil {
+		if err := s.checkCert(vc.CCert, message.MTCheckpoint, 0, vc.LastCPSeq, vc.CCert.Digest,
+			s.config.Quorum()); err != nil {
+			return fmt.Errorf("view change message C certificate: %w", err)
+		}
+		CMsgIsOK = true
+	}
 	for vid, set := range counter {
-		if len(set) > message.MaxFaultyNode {
-			fmt.Printf("view change check C message success[%d]:\n", vid)
+		if len(set) > int(s.config.F) {
+			s.logger().Debug("view change check C message success", logging.F("cpView", vid))
 			CMsgIsOK = true
 			break
 		}
@@ -192,7 +248,7 @@ func (s *StateEngine) checkViewChange(vc *message.ViewChange) error {
 		return fmt.Errorf("no valid C message in view change msg")
 	}
 
-	counter = make(map[int64]Set)
+	// every request in P has to be prepared on its own, a replica that prepared nothing sends an empty P
 	for seq, pt := range vc.PMsg {
 
 		ppView := pt.PPMsg.ViewID
@@ -207,7 +263,15 @@ func (s *StateEngine) checkViewChange(vc *message.ViewChange) error {
 			return fmt.Errorf("view change message checking P message faild pre-prepare view=%d,"+
 				" new view id=%d", pt.PPMsg.ViewID, vc.NewViewID)
 		}
+		if pt.Cert != nil {
+			if err := s.checkCert(pt.Cert, message.MTPrepare, ppView, seq, pt.PPMsg.Digest,
+				2*int(s.config.F)); err != nil {
+				return fmt.Errorf("view change message P certificate: %w", err)
+			}
+			continue
+		}
 
+		prepared := make(Set)
 		for nid, prepare := range pt.PMsg {
 			if ppView != prepare.ViewID {
 				return fmt.Errorf("view change message checking view id[%d] in pre-prepare is not "+
@@ -217,34 +281,54 @@ func (s *StateEngine) checkViewChange(vc *message.ViewChange) error {
 				return fmt.Errorf("view change message checking seq id[%d] in pre-prepare"+
 					"is different from prepare's[%d]", seq, prepare.SequenceID)
 			}
-
-			fmt.Printf("[checkViewChange] View id: %d, node id: %d\n", ppView, nid)
-			if counter[ppView] == nil {
-				counter[ppView] = make(Set)
+			if pt.PPMsg.Digest != prepare.Digest {
+				return fmt.Errorf("view change message checking digest of seq[%d] in pre-prepare"+
+					" is different from prepare's", seq)
 			}
-			counter[ppView].put(nid)
+			prepared.put(nid)
+		}
+		if len(prepared) < 2*int(s.config.F) {
+			return fmt.Errorf("view change message checking P message failed, seq[%d] has %d prepares of %d",
+				seq, len(prepared), 2*s.config.F)
 		}
 	}
 
-	PMsgIsOk := false
-	for vid, set := range counter {
-		if len(set) >= 2*message.MaxFaultyNode {
-			fmt.Printf("view change check P message success[%d]:\n", vid)
-			PMsgIsOk = true
-			break
+	return nil
+}
+
+/*
+A replica that hasn't timed out itself may still have to change views: the replicas that did can't install a new view
+without it when only 2f of them suspect the primary. Once f+1 replicas ask for views above its own, at least one of them
+is correct, so the replica joins the smallest of these views without waiting for its timer.
+*/
+func (s *StateEngine) joinViewChange(vc *message.ViewChange) {
+	if vc.NewViewID <= s.CurViewID || s.isMember(vc.NodeID) != nil {
+		return
+	}
+	s.sCache.asked[vc.NodeID] = vc.NewViewID
+	next, n := int64(0), 0
+	for _, vid := range s.sCache.asked {
+		if vid <= s.CurViewID {
+			continue
+		}
+		if n == 0 || vid < next {
+			next = vid
 		}
+		n++
 	}
-	if !PMsgIsOk {
-		return fmt.Errorf("view change check p message failed\n")
+	if n <= int(s.config.F) {
+		return
 	}
-
-	return nil
+	s.logger().Info("joining view change", logging.F("newView", next), logging.F("replicas", n))
+	s.CurViewID = next - 1
+	s.ViewChange()
 }
 
 func (s *StateEngine) procViewChange(vc *message.ViewChange) error {
-	nextPrimaryID := vc.NewViewID % message.TotalNodeNO
+	s.joinViewChange(vc)
+	nextPrimaryID := s.config.Primary(vc.NewViewID)
 	if s.NodeID != nextPrimaryID {
-		fmt.Printf("I'm[%d] not the new[%d] primary node\n", s.NodeID, nextPrimaryID)
+		s.logger().Debug("not the new primary node", logging.F("primary", nextPrimaryID), logging.F("newView", vc.NewViewID))
 		return nil
 	}
 	if err := s.checkViewChange(vc); err != nil {
@@ -252,11 +336,11 @@ func (s *StateEngine) procViewChange(vc *message.ViewChange) error {
 	}
 
 	s.sCache.pushVC(vc)
-	if len(s.sCache.vcMsg) < message.MaxFaultyNode*2 {
+	if len(s.sCache.vcMsg) < s.config.Quorum() {
 		return nil
 	}
 	if s.sCache.hasNewViewYet(vc.NewViewID) {
-		fmt.Printf("view change[%d] is in processing......\n", vc.NewViewID)
+		s.logger().Debug("view change is in processing", logging.F("newView", vc.NewViewID))
 		return nil
 	}
 
@@ -295,13 +379,17 @@ consisting of the identifier of the sending replica and the digest of its VIEW-C
 checkpoint and request values selected. The VIEW-CHANGEs in V are the new-view certificate.
 */
 
-func (s *StateEngine) GetON(newVID int64) (int64, int64, message.OMessage, message.OMessage, *message.ViewChange) {
+func (s *StateEngine) GetON(newVID int64, vcs message.VMessage) (int64, int64, message.OMessage, message.OMessage,
+	*message.ViewChange) {
+
 	mergeP := make(map[int64]*message.PTuple)
 	var maxNinV int64 = 0
 	var maxNinO int64 = 0
 
+	// the view changes are taken in the order of their replicas, every replica picks the same ones
 	var cpVC *message.ViewChange = nil
-	for _, vc := range s.sCache.vcMsg {
+	for _, id := range vcs.IDs() {
+		vc := vcs[id]
 		if vc.LastCPSeq > maxNinV {
 			maxNinV = vc.LastCPSeq
 			cpVC = vc
@@ -317,13 +405,19 @@ func (s *StateEngine) GetON(newVID int64) (int64, int64, message.OMessage, messa
 		}
 	}
 
+	// requests below the checkpoint are executed, the new primary goes on after it
+	if maxNinO < maxNinV {
+		maxNinO = maxNinV
+	}
+
 	O := make(message.OMessage)
 	N := make(message.OMessage)
 	for i := maxNinV + 1; i <= maxNinO; i++ {
 		pt, ok := mergeP[i]
 		if ok {
-			O[i] = pt.PPMsg
-			O[i].ViewID = newVID
+			pp := *pt.PPMsg
+			pp.ViewID = newVID
+			O[i] = &pp
 		} else {
 			N[i] = &message.PrePrepare{
 				ViewID:     newVID,
@@ -336,27 +430,73 @@ func (s *StateEngine) GetON(newVID int64) (int64, int64, message.OMessage, messa
 	return maxNinV, maxNinO, O, N, cpVC
 }
 
+/*
+newViewCerts returns the certificates a NEW-VIEW carries in place of the view changes: the one of the checkpoint cpVC
+proves and the prepare certificate of every request in O, taken from the view changes in the order GetON takes them.
+There are none without a Certifier or when one of them was proved by messages instead.
+*/
+func (s *StateEngine) newViewCerts(o message.OMessage, cpVC *message.ViewChange) (*message.QuorumCert,
+	map[int64]*message.PTuple, bool) {
+
+	if s.cert == nil {
+		return nil, nil, false
+	}
+	var cCert *message.QuorumCert
+	if cpVC != nil {
+		if cpVC.CCert == nil {
+			return nil, nil, false
+		}
+		cCert = cpVC.CCert
+	}
+	pMsg := make(map[int64]*message.PTuple, len(o))
+	for _, id := range s.sCache.vcMsg.IDs() {
+		for seq, pt := range s.sCache.vcMsg[id].PMsg {
+			if _, ok := o[seq]; !ok {
+				continue
+			}
+			if _, ok := pMsg[seq]; ok {
+				continue
+			}
+			if pt.Cert == nil {
+				return nil, nil, false
+			}
+			pMsg[seq] = &message.PTuple{PPMsg: pt.PPMsg, Cert: pt.Cert}
+		}
+	}
+	return cCert, pMsg, true
+}
+
 func (s *StateEngine) createNewViewMsg(newVID int64) error {
 
 	s.CurViewID = newVID
-	newCP, newSeq, o, n, cpVC := s.GetON(newVID)
+	newCP, newSeq, o, n, cpVC := s.GetON(newVID, s.sCache.vcMsg)
 	nv := &message.NewView{
 		NewViewID: s.CurViewID,
-		VMsg:      s.sCache.vcMsg,
 		OMsg:      o,
 		NMsg:      n,
 	}
+	if cCert, pMsg, ok := s.newViewCerts(o, cpVC); ok {
+		nv.CCert, nv.PMsg = cCert, pMsg
+	} else {
+		nv.VMsg = s.sCache.vcMsg
+	}
 
 	s.sCache.addNewView(nv)
 
 	s.CurSequence = newSeq
 
 	msg := message.CreateConMsg(message.MTNewView, nv)
+	msg.From = uint(s.NodeID)
 	if err := s.p2pWire.BroadCast(msg); err != nil {
 		return err
 	}
 	s.updateStateNV(newCP, cpVC)
 	s.cleanRequest()
+	s.PrimaryID = s.config.Primary(s.CurViewID)
+	s.logger().Info("new view created", logging.F("primary", s.PrimaryID), logging.F("seq", s.CurSequence),
+		logging.F("O", len(o)), logging.F("N", len(n)))
+	s.emit(EventNewViewInstalled, s.CurSequence, message.Digest(nv))
+	s.setStatus(Serving)
 	return nil
 }
 
@@ -384,13 +524,19 @@ they mark as pre-prepared. Thereafter, normal case operation resumes.
 
 func (s *StateEngine) updateStateNV(maxNV int64, vc *message.ViewChange) {
 
-	if maxNV > s.lastCP.Seq {
+	if maxNV > s.stableCheckPoint().Seq {
 		cp := NewCheckPoint(maxNV, s.CurViewID)
-		cp.CPMsg = vc.CMsg
+		for id, msg := range vc.CMsg {
+			cp.CPMsg[id] = msg
+		}
+		if vc.CCert != nil && s.checkCert(vc.CCert, message.MTCheckpoint, 0, maxNV, vc.CCert.Digest,
+			s.config.Quorum()) == nil {
+			cp.Cert = vc.CCert
+		}
 		s.checks[maxNV] = cp
 		s.runCheckPoint(maxNV)
 
-		s.createCheckPoint(maxNV)
+		s.createCheckPoint(maxNV, s.clientEntries(), s.appState, s.configAt(maxNV))
 	}
 
 	if maxNV > s.LasExeSeq {
@@ -404,20 +550,64 @@ func (s *StateEngine) updateStateNV(maxNV int64, vc *message.ViewChange) {
 func (s *StateEngine) cleanRequest() {
 	for cid, client := range s.cliRecord {
 		for seq, req := range client.Request {
-			if req.TimeStamp < client.LastReplyTime {
+			if req.TimeStamp <= client.LastTimeStamp {
 				delete(client.Request, seq)
-				fmt.Printf("cleaning request[%d] when view changed for client[%s]\n", seq, cid)
+				s.logger().Debug("cleaning request when view changed", logging.F("seq", seq), logging.F("client", cid))
 			}
 		}
 	}
 	return
 }
 
+/*
+newViewChanges returns the view changes nv was decided from. A NEW-VIEW that carries certificates instead stands for
+them by one view change of its primary with these certificates, from which GetON picks the same checkpoint and requests.
+*/
+func (s *StateEngine) newViewChanges(nv *message.NewView) (message.VMessage, error) {
+	if len(nv.VMsg) == 0 && s.cert != nil {
+		vc := &message.ViewChange{
+			NewViewID: nv.NewViewID,
+			NodeID:    s.config.Primary(nv.NewViewID),
+			CCert:     nv.CCert,
+			PMsg:      nv.PMsg,
+		}
+		if nv.CCert != nil {
+			vc.LastCPSeq = nv.CCert.SequenceID
+		}
+		if err := s.checkViewChange(vc); err != nil {
+			return nil, fmt.Errorf("new view[%d] certificates: %w", nv.NewViewID, err)
+		}
+		return message.VMessage{vc.NodeID: vc}, nil
+	}
+	if len(nv.VMsg) < s.config.Quorum() {
+		return nil, fmt.Errorf("new view[%d] has %d view changes of %d", nv.NewViewID, len(nv.VMsg), s.config.Quorum())
+	}
+	vcs := make(message.VMessage, len(nv.VMsg))
+	for _, id := range nv.VMsg.IDs() {
+		vc := nv.VMsg[id]
+		if vc.NodeID != id || vc.NewViewID != nv.NewViewID {
+			return nil, fmt.Errorf("new view[%d] has the view change of node[%d] for view[%d] as node[%d]'s",
+				nv.NewViewID, vc.NodeID, vc.NewViewID, id)
+		}
+		if err := s.checkViewChange(vc); err != nil {
+			return nil, fmt.Errorf("new view[%d]: %w", nv.NewViewID, err)
+		}
+		vcs[id] = vc
+	}
+	return vcs, nil
+}
+
 func (s *StateEngine) didChangeView(nv *message.NewView) error {
-	fmt.Printf("[didChangeView] Node: %d NewView message received.\n", s.NodeID)
+	s.logger().Debug("new view message received", logging.F("newView", nv.NewViewID))
 	newVID := nv.NewViewID
-	s.sCache.vcMsg = nv.VMsg
-	newCP, newSeq, O, N, cpVC := s.GetON(newVID)
+	if newVID < s.CurViewID {
+		return fmt.Errorf("new view[%d] is older than view[%d]", newVID, s.CurViewID)
+	}
+	vcs, err := s.newViewChanges(nv)
+	if err != nil {
+		return err
+	}
+	newCP, newSeq, O, N, cpVC := s.GetON(newVID, vcs)
 	if !O.EQ(nv.OMsg) {
 		return fmt.Errorf("new view checking O message faliled")
 	}
@@ -425,31 +615,39 @@ func (s *StateEngine) didChangeView(nv *message.NewView) error {
 		return fmt.Errorf("new view checking N message faliled")
 	}
 
-	fmt.Printf("[didChangeView] Node: %d idle2PrePrepare O with len: %d\n", s.NodeID, len(O))
-	for _, ppMsg := range O {
-		if e := s.idle2PrePrepare(ppMsg); e != nil {
+	if newVID > s.CurViewID {
+		// the replica didn't time out itself, it joins the new view and drops its log as its own view change would
+		s.Timer.tack()
+		s.CurViewID = newVID
+		s.msgLogs = make(map[int64]*NormalLog)
+	}
+	s.sCache.vcMsg = vcs
+
+	for _, seq := range O.Seqs() {
+		if e := s.idle2PrePrepare(O[seq]); e != nil {
 			return e
 		}
 	}
 
-	fmt.Printf("[didChangeView] Node: %d idle2PrePrepare N with len: %d.\n", s.NodeID, len(N))
-	for _, ppMsg := range N {
-		if e := s.idle2PrePrepare(ppMsg); e != nil {
+	for _, seq := range N.Seqs() {
+		if e := s.idle2PrePrepare(N[seq]); e != nil {
 			return e
 		}
 	}
 
-	fmt.Printf("[didChangeView] Node: %d AFTER idle2PrePrepare.\n", s.NodeID)
-
 	s.sCache.addNewView(nv)
 	s.CurSequence = newSeq
 	s.updateStateNV(newCP, cpVC)
 	s.cleanRequest()
+	s.PrimaryID = s.config.Primary(newVID)
 
+	// with requests to reorder the replica serves again, and the parked requests are retried, once the first commits
 	if len(N) == 0 && len(O) == 0 {
-		s.nodeStatus = Serving
+		s.setStatus(Serving)
 	}
 
-	fmt.Printf("[didChangeView] Node: %d FINISHED. New view: %d, New curSeq: %d\n", s.NodeID, s.CurViewID, s.CurSequence)
+	s.logger().Info("new view installed", logging.F("primary", s.PrimaryID), logging.F("seq", s.CurSequence),
+		logging.F("O", len(O)), logging.F("N", len(N)))
+	s.emit(EventNewViewInstalled, s.CurSequence, message.Digest(nv))
 	return nil
 }
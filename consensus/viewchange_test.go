@@ -0,0 +1,274 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/quorum"
+)
+
+func TestViewChangeCarriesTheHighWaterMark(t *testing.T) {
+	te := newTestEngine(t, 1)
+	for _, seq := range []int64{te.MiniSeq + 1, te.MaxSeq} {
+		log := te.getOrCreateLog(seq)
+		log.Stage = Prepared
+		log.PrePrepare = &message.PrePrepare{ViewID: 0, SequenceID: seq, Digest: "d"}
+	}
+
+	P := te.computePMsg()
+	if _, ok := P[te.MaxSeq]; !ok {
+		t.Fatalf("request prepared at the high water mark %d is left out of P", te.MaxSeq)
+	}
+	if len(P) != 2 {
+		t.Fatalf("P has %d tuples, want 2", len(P))
+	}
+}
+
+func preparedTuple(seq int64, voters ...int64) *message.PTuple {
+	pt := &message.PTuple{
+		PPMsg: &message.PrePrepare{ViewID: 0, SequenceID: seq, Digest: "d"},
+		PMsg:  make(message.PrepareMsg),
+	}
+	for _, id := range voters {
+		pt.PMsg[id] = &message.Prepare{ViewID: 0, SequenceID: seq, Digest: "d", NodeID: id}
+	}
+	return pt
+}
+
+func TestViewChangeWithNothingPrepared(t *testing.T) {
+	te := newTestEngine(t, 1)
+	vc := &message.ViewChange{NewViewID: 1, NodeID: 2, PMsg: map[int64]*message.PTuple{}}
+	if err := te.checkViewChange(vc); err != nil {
+		t.Fatalf("view change with an empty P refused: %v", err)
+	}
+}
+
+func TestViewChangeChecksEveryPreparedRequest(t *testing.T) {
+	te := newTestEngine(t, 1)
+	vc := &message.ViewChange{NewViewID: 1, NodeID: 2, PMsg: map[int64]*message.PTuple{
+		1: preparedTuple(1, 1, 2, 3),
+		2: preparedTuple(2, 2, 3),
+	}}
+	if err := te.checkViewChange(vc); err != nil {
+		t.Fatalf("prepared requests refused: %v", err)
+	}
+
+	vc.PMsg[3] = preparedTuple(3, 2)
+	if err := te.checkViewChange(vc); err == nil {
+		t.Fatal("request with a single prepare passed as prepared next to prepared ones")
+	}
+}
+
+func TestReplicaJoinsTheViewChangeOfFPlusOne(t *testing.T) {
+	te := newTestEngine(t, 3)
+	if err := te.procViewChange(&message.ViewChange{NewViewID: 1, NodeID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if te.CurViewID != 0 {
+		t.Fatal("a single replica moved the view")
+	}
+	if err := te.procViewChange(&message.ViewChange{NewViewID: 1, NodeID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if te.CurViewID != 1 || len(sentTypes(te.sent)[message.MTViewChange]) == 0 {
+		t.Fatalf("replica in view %d after f+1 asked for view 1", te.CurViewID)
+	}
+}
+
+func TestViewChangesForLowerViewsDontCount(t *testing.T) {
+	cache := NewVCCache()
+	cache.pushVC(&message.ViewChange{NewViewID: 1, NodeID: 0})
+	cache.pushVC(&message.ViewChange{NewViewID: 2, NodeID: 1})
+	cache.pushVC(&message.ViewChange{NewViewID: 1, NodeID: 2})
+	if ids := cache.vcMsg.IDs(); len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("cache holds view changes of %v, want only node 1's for view 2", ids)
+	}
+}
+
+func TestBackupInstallsNewViewItDidntAskFor(t *testing.T) {
+	te := newTestEngine(t, 3)
+	te.getOrCreateLog(1).Stage = Prepared
+	nv := &message.NewView{NewViewID: 1, VMsg: message.VMessage{}}
+	for id := int64(0); id < 3; id++ {
+		nv.VMsg[id] = &message.ViewChange{NewViewID: 1, NodeID: id}
+	}
+	if err := te.didChangeView(nv); err != nil {
+		t.Fatal(err)
+	}
+	if te.CurViewID != 1 || te.PrimaryID != 1 {
+		t.Fatalf("replica in view %d with primary %d", te.CurViewID, te.PrimaryID)
+	}
+	if _, ok := te.msgLogs[1]; ok {
+		t.Fatal("log of the old view kept")
+	}
+}
+
+func TestViewChangeKeepsWhatPreparedBeforeAnIncompleteOne(t *testing.T) {
+	te := newTestEngine(t, 1)
+	log := te.getOrCreateLog(1)
+	log.Stage = Prepared
+	log.PrePrepare = &message.PrePrepare{ViewID: 0, SequenceID: 1, Digest: "d"}
+
+	// view 1 never begins, the replica moves on to view 2 with an empty log
+	te.ViewChange()
+	te.ViewChange()
+	var vc *message.ViewChange
+	for _, m := range te.sent {
+		if m.Typ != message.MTViewChange {
+			continue
+		}
+		body, err := m.Body()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vc = body.(*message.ViewChange)
+	}
+	if vc == nil || vc.NewViewID != 2 {
+		t.Fatal("replica didn't ask for view 2")
+	}
+	if pt, ok := vc.PMsg[1]; !ok || pt.PPMsg.Digest != "d" {
+		t.Fatal("request prepared in view 0 is missing from the view change to view 2")
+	}
+}
+
+func TestVotesAfterPreparedStayOutOfTheViewChange(t *testing.T) {
+	te := newTestEngine(t, 1)
+	d := withBody(te, 1)
+	if err := te.idle2PrePrepare(&message.PrePrepare{ViewID: 0, SequenceID: 1, Digest: d}); err != nil {
+		t.Fatal(err)
+	}
+	if err := te.prePrepare2Prepare(&message.Prepare{ViewID: 0, SequenceID: 1, Digest: d, NodeID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if stage := te.msgLogs[1].Stage; stage != Prepared {
+		t.Fatalf("request is %s", stage)
+	}
+	// an equivocating primary told replica 2 another story
+	_ = te.prePrepare2Prepare(&message.Prepare{ViewID: 0, SequenceID: 1, Digest: "other", NodeID: 2})
+
+	P := te.computePMsg()
+	vc := &message.ViewChange{NewViewID: 1, NodeID: 1, PMsg: P}
+	if err := te.checkViewChange(vc); err != nil {
+		t.Fatalf("replica refused its own view change: %v", err)
+	}
+}
+
+// certifiedEngine returns replica id voting with the keys of the fuzz runs.
+func certifiedEngine(t *testing.T, id int64) *testEngine {
+	te := newTestEngine(t, id)
+	config, keys := fuzzConfig()
+	te.SetConfig(config.Copy())
+	te.SetCertifier(quorum.NewSigner(keys[id], te.Config))
+	return te
+}
+
+func TestCertifiedNewViewCarriesCertificatesInsteadOfViewChanges(t *testing.T) {
+	_, keys := fuzzConfig()
+	primary := certifiedEngine(t, 1)
+	pt := &message.PTuple{
+		PPMsg: &message.PrePrepare{ViewID: 0, SequenceID: 1, Digest: "d"},
+		Cert:  fuzzCert(keys, &message.QuorumCert{Typ: message.MTPrepare, SequenceID: 1, Digest: "d"}, 1, 2, 3),
+	}
+	for _, id := range []int64{0, 2, 3} {
+		vc := &message.ViewChange{NewViewID: 1, NodeID: id, PMsg: map[int64]*message.PTuple{}}
+		if id == 0 {
+			vc.PMsg[1] = pt
+		}
+		if err := primary.procViewChange(vc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var nv *message.NewView
+	for _, m := range primary.sent {
+		if m.Typ == message.MTNewView {
+			body, err := m.Body()
+			if err != nil {
+				t.Fatal(err)
+			}
+			nv = body.(*message.NewView)
+		}
+	}
+	if nv == nil {
+		t.Fatal("primary sent no new view")
+	}
+	if len(nv.VMsg) != 0 || nv.PMsg[1] == nil || nv.PMsg[1].Cert == nil {
+		t.Fatalf("new view carries %d view changes and %d prepare certificates", len(nv.VMsg), len(nv.PMsg))
+	}
+
+	backup := certifiedEngine(t, 2)
+	if err := backup.didChangeView(nv); err != nil {
+		t.Fatal(err)
+	}
+	if log, ok := backup.msgLogs[1]; !ok || log.PrePrepare == nil || log.PrePrepare.Digest != "d" {
+		t.Fatal("backup didn't pre-prepare the request the certificate proves prepared")
+	}
+
+	forged := *nv
+	forged.PMsg = map[int64]*message.PTuple{1: {
+		PPMsg: &message.PrePrepare{ViewID: 0, SequenceID: 1, Digest: "other"},
+		Cert:  pt.Cert,
+	}}
+	if err := certifiedEngine(t, 3).didChangeView(&forged); err == nil {
+		t.Fatal("new view with a certificate of another request installed")
+	}
+}
+
+func newViewMsg(from int64, nv *message.NewView) *message.ConMessage {
+	m := message.CreateConMsg(message.MTNewView, nv)
+	m.From = uint(from)
+	return m
+}
+
+func TestBackupRefusesNewViewsItCantCheck(t *testing.T) {
+	emptyVCs := func() message.VMessage {
+		vcs := make(message.VMessage)
+		for id := int64(0); id < 3; id++ {
+			vcs[id] = &message.ViewChange{NewViewID: 1, NodeID: id, PMsg: map[int64]*message.PTuple{}}
+		}
+		return vcs
+	}
+	forgedO := message.OMessage{1: {ViewID: 1, SequenceID: 1, Digest: "forged"}}
+	for _, tc := range []struct {
+		name string
+		from int64
+		nv   func() *message.NewView
+	}{
+		{"not from the primary", 2, func() *message.NewView {
+			return &message.NewView{NewViewID: 1, VMsg: emptyVCs()}
+		}},
+		{"view change under another replica", 1, func() *message.NewView {
+			vcs := emptyVCs()
+			vcs[3] = vcs[0]
+			delete(vcs, 0)
+			return &message.NewView{NewViewID: 1, VMsg: vcs}
+		}},
+		{"view change for another view", 1, func() *message.NewView {
+			vcs := emptyVCs()
+			vcs[0].NewViewID = 2
+			return &message.NewView{NewViewID: 1, VMsg: vcs}
+		}},
+		{"view change that doesn't check", 1, func() *message.NewView {
+			vcs := emptyVCs()
+			vcs[0].PMsg[1] = preparedTuple(1, 2)
+			return &message.NewView{NewViewID: 1, VMsg: vcs}
+		}},
+		{"O the view changes don't give", 1, func() *message.NewView {
+			return &message.NewView{NewViewID: 1, VMsg: emptyVCs(), OMsg: forgedO}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			te := newTestEngine(t, 3)
+			if err := te.procManageMsg(newViewMsg(tc.from, tc.nv())); err == nil {
+				t.Fatal("new view installed")
+			}
+			if te.CurViewID != 0 {
+				t.Fatalf("replica moved to view %d", te.CurViewID)
+			}
+		})
+	}
+
+	te := newTestEngine(t, 3)
+	if err := te.procManageMsg(newViewMsg(1, &message.NewView{NewViewID: 1, VMsg: emptyVCs()})); err != nil {
+		t.Fatal(err)
+	}
+}
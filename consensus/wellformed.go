@@ -0,0 +1,91 @@
+package consensus
+
+import (
+	"fmt"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+/*
+Messages from the wire are decoded from JSON a peer wrote, so any pointer in them can be null and any number can be
+out of range. The nested messages of view changes, new views and state transfers are checked for shape here, before
+any handler looks inside them; whether they prove what they claim is still up to the handler.
+*/
+func wellFormedViewChange(vc *message.ViewChange) error {
+	if vc == nil {
+		return fmt.Errorf("empty view change")
+	}
+	for id, cp := range vc.CMsg {
+		if cp == nil {
+			return fmt.Errorf("view change of node[%d] has an empty checkpoint of node[%d]", vc.NodeID, id)
+		}
+	}
+	for seq, pt := range vc.PMsg {
+		if pt == nil || pt.PPMsg == nil {
+			return fmt.Errorf("view change of node[%d] has no pre-prepare for seq[%d]", vc.NodeID, seq)
+		}
+		if seq < vc.LastCPSeq || seq > vc.LastCPSeq+CheckPointK {
+			return fmt.Errorf("view change of node[%d] has seq[%d] out of [%d~%d]", vc.NodeID, seq,
+				vc.LastCPSeq, vc.LastCPSeq+CheckPointK)
+		}
+		for id, prepare := range pt.PMsg {
+			if prepare == nil {
+				return fmt.Errorf("view change of node[%d] has an empty prepare of node[%d] for seq[%d]", vc.NodeID, id, seq)
+			}
+		}
+	}
+	return nil
+}
+
+func wellFormedNewView(nv *message.NewView) error {
+	for id, vc := range nv.VMsg {
+		if err := wellFormedViewChange(vc); err != nil {
+			return fmt.Errorf("new view[%d] from node[%d]: %w", nv.NewViewID, id, err)
+		}
+	}
+	for seq, pt := range nv.PMsg {
+		if pt == nil || pt.PPMsg == nil {
+			return fmt.Errorf("new view[%d] has no pre-prepare for seq[%d]", nv.NewViewID, seq)
+		}
+	}
+	for _, o := range []message.OMessage{nv.OMsg, nv.NMsg} {
+		for seq, pp := range o {
+			if pp == nil {
+				return fmt.Errorf("new view[%d] has an empty pre-prepare for seq[%d]", nv.NewViewID, seq)
+			}
+		}
+	}
+	return nil
+}
+
+func wellFormedStateTransfer(st *message.StateTransfer) error {
+	if st.Config == nil {
+		return fmt.Errorf("state transfer[%d] from node[%d] has no configuration", st.SequenceID, st.NodeID)
+	}
+	if err := st.Config.Valid(); err != nil {
+		return fmt.Errorf("state transfer[%d] from node[%d]: %w", st.SequenceID, st.NodeID, err)
+	}
+	for i, e := range st.Clients {
+		if e == nil || e.Reply == nil {
+			return fmt.Errorf("state transfer[%d] from node[%d] has an empty client entry[%d]", st.SequenceID, st.NodeID, i)
+		}
+	}
+	return nil
+}
+
+func wellFormedStateDigests(sd *message.StateDigests) error {
+	if sd.Digest == "" {
+		return nil
+	}
+	if len(sd.Partitions) != StatePartitions {
+		return fmt.Errorf("state digests[%d] from node[%d] have %d partitions instead of %d", sd.SequenceID, sd.NodeID,
+			len(sd.Partitions), StatePartitions)
+	}
+	if sd.Config == nil {
+		return fmt.Errorf("state digests[%d] from node[%d] have no configuration", sd.SequenceID, sd.NodeID)
+	}
+	if err := sd.Config.Valid(); err != nil {
+		return fmt.Errorf("state digests[%d] from node[%d]: %w", sd.SequenceID, sd.NodeID, err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+module github.com/sakesake/PBFT
+
+go 1.22.0
+
+require github.com/cloudflare/circl v1.6.1
+
+require (
+	golang.org/x/crypto v0.33.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+)
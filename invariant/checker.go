@@ -0,0 +1,378 @@
+package invariant
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sakesake/PBFT/consensus"
+	"github.com/sakesake/PBFT/message"
+)
+
+/*
+Checker follows the event buses of the replicas of a cluster, simulated or local, and checks the properties PBFT
+promises as long as at most f replicas are faulty:
+
+	agreement	no two correct replicas execute different requests at the same sequence number
+	checkpoint	correct replicas agree on the digest of every stable checkpoint
+	view		the view of a correct replica never decreases
+	liveness	once the network is synchronous every submitted request executes within a bound
+
+Events of faulty replicas are kept in the trace but never checked. Every violation carries the events that led to it,
+so it can be read as a counterexample.
+*/
+type Checker struct {
+	// Label names the run in reports, the simulator seed for example.
+	Label string
+	// GST is the time from which the network is synchronous, Bound how long a request may take to execute after
+	// max(GST, submission) on f+1 correct replicas.
+	GST   time.Duration
+	Bound time.Duration
+
+	now         func() time.Duration
+	subs        []*watched
+	faulty      map[int64]bool
+	trace       []*Entry
+	executed    map[int64]map[int64]*Entry
+	checkpoints map[int64]map[int64]*Entry
+	views       map[int64]*Entry
+	requests    map[request]*submission
+	violations  []*Violation
+
+	mu sync.Mutex
+}
+
+type watched struct {
+	node    int64
+	sub     *consensus.Subscription
+	dropped uint64
+}
+
+// Entry is one event of the trace and the time the checker saw it.
+type Entry struct {
+	At    time.Duration
+	Event *consensus.Event
+}
+
+func (e *Entry) String() string {
+	ev := e.Event
+	s := fmt.Sprintf("[%12s] node %d view %d %-17s seq %d", e.At, ev.NodeID, ev.ViewID, ev.Type, ev.SequenceID)
+	if ev.ClientID != "" {
+		s += fmt.Sprintf(" request %s/%d", ev.ClientID, ev.TimeStamp)
+	}
+	if ev.Digest != "" {
+		s += " digest " + ev.Digest
+	}
+	return s
+}
+
+type request struct {
+	clientID  string
+	timeStamp int64
+}
+
+type submission struct {
+	at        time.Duration
+	submitted bool
+	executed  map[int64]bool
+	reported  bool
+}
+
+/*
+Violation is a property that didn't hold. The counterexample of a protocol invariant is Trace, the events that led to
+it; the counterexample of a client history is Linear, the longest prefix that could be linearized, and Candidate, the
+operations none of which could come next.
+*/
+type Violation struct {
+	Invariant string
+	Message   string
+	At        time.Duration
+	Trace     []*Entry
+	Linear    []*Operation
+	Candidate []*Operation
+	label     string
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("%s invariant violated: %s", v.Invariant, v.Message)
+}
+
+// String prints the violation with its counterexample trace, one event per line.
+func (v *Violation) String() string {
+	var b strings.Builder
+	if v.label != "" {
+		fmt.Fprintf(&b, "%s: ", v.label)
+	}
+	fmt.Fprintf(&b, "%s invariant violated at %s\n  %s\n", v.Invariant, v.At, v.Message)
+	if len(v.Trace) > 0 {
+		b.WriteString("  trace:\n")
+		for _, e := range v.Trace {
+			fmt.Fprintf(&b, "    %s\n", e)
+		}
+	}
+	if len(v.Linear) > 0 || len(v.Candidate) > 0 {
+		b.WriteString("  linearized:\n")
+		for _, op := range v.Linear {
+			fmt.Fprintf(&b, "    %s\n", op)
+		}
+		b.WriteString("  none of these can come next:\n")
+		for _, op := range v.Candidate {
+			fmt.Fprintf(&b, "    %s\n", op)
+		}
+	}
+	return b.String()
+}
+
+// NewChecker creates a checker that reads the time from now, the virtual clock of a simulator or the time since a
+// local cluster started.
+func NewChecker(now func() time.Duration) *Checker {
+	return &Checker{
+		now:         now,
+		faulty:      make(map[int64]bool),
+		executed:    make(map[int64]map[int64]*Entry),
+		checkpoints: make(map[int64]map[int64]*Entry),
+		views:       make(map[int64]*Entry),
+		requests:    make(map[request]*submission),
+	}
+}
+
+// Watch subscribes to the events of engine. The events of a faulty replica are traced but not checked.
+func (c *Checker) Watch(engine *consensus.StateEngine, faulty bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subs = append(c.subs, &watched{
+		node: engine.NodeID,
+		sub:  engine.Subscribe(1 << 12),
+	})
+	c.faulty[engine.NodeID] = faulty
+}
+
+// Submitted tells the checker a client sent a request, the liveness check waits for it to execute.
+func (c *Checker) Submitted(clientID string, timeStamp int64, at time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub := c.request(request{clientID, timeStamp})
+	if sub.submitted {
+		return
+	}
+	sub.submitted = true
+	sub.at = at
+}
+
+func (c *Checker) request(key request) *submission {
+	sub, ok := c.requests[key]
+	if !ok {
+		sub = &submission{
+			executed: make(map[int64]bool),
+		}
+		c.requests[key] = sub
+	}
+	return sub
+}
+
+/*
+Poll checks every event the replicas published since the last call. Replicas are read in the order they were watched,
+so a single-threaded simulation checks the same events in the same order on every replay.
+*/
+func (c *Checker) Poll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.subs {
+		for {
+			select {
+			case ev, ok := <-w.sub.C:
+				if ok {
+					c.observe(ev)
+					continue
+				}
+			default:
+			}
+			break
+		}
+		if d := w.sub.Dropped(); d > w.dropped {
+			c.violate("observation", fmt.Sprintf("lost %d events of node %d, the checks are incomplete", d-w.dropped, w.node), nil)
+			w.dropped = d
+		}
+	}
+}
+
+// Follow polls until ctx is done, for a cluster whose engines run in their own goroutines.
+func (c *Checker) Follow(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.Poll()
+			return
+		case <-ticker.C:
+			c.Poll()
+		}
+	}
+}
+
+func (c *Checker) observe(ev *consensus.Event) {
+	e := &Entry{At: c.now(), Event: ev}
+	c.trace = append(c.trace, e)
+	if c.faulty[ev.NodeID] {
+		return
+	}
+
+	if last, ok := c.views[ev.NodeID]; ok && ev.ViewID < last.Event.ViewID {
+		c.violate("view", fmt.Sprintf("node %d went back from view %d to view %d", ev.NodeID, last.Event.ViewID,
+			ev.ViewID), c.traceOf(func(o *consensus.Event) bool { return o.NodeID == ev.NodeID }))
+	}
+	c.views[ev.NodeID] = e
+
+	switch ev.Type {
+	case consensus.EventExecuted:
+		c.checkExecuted(e)
+	case consensus.EventCheckpointStable:
+		c.checkCheckpoint(e)
+	}
+}
+
+func (c *Checker) checkExecuted(e *Entry) {
+	ev := e.Event
+	bySeq, ok := c.executed[ev.SequenceID]
+	if !ok {
+		bySeq = make(map[int64]*Entry)
+		c.executed[ev.SequenceID] = bySeq
+	}
+	for _, other := range sortedEntries(bySeq) {
+		o := other.Event
+		if o.ClientID != ev.ClientID || o.TimeStamp != ev.TimeStamp || o.Digest != ev.Digest {
+			c.violate("agreement", fmt.Sprintf("seq %d executed as %s/%d by node %d and as %s/%d by node %d",
+				ev.SequenceID, o.ClientID, o.TimeStamp, o.NodeID, ev.ClientID, ev.TimeStamp, ev.NodeID),
+				c.traceOf(func(t *consensus.Event) bool {
+					return t.SequenceID == ev.SequenceID || isViewEvent(t)
+				}))
+			break
+		}
+	}
+	bySeq[ev.NodeID] = e
+
+	c.request(request{ev.ClientID, ev.TimeStamp}).executed[ev.NodeID] = true
+}
+
+func (c *Checker) checkCheckpoint(e *Entry) {
+	ev := e.Event
+	bySeq, ok := c.checkpoints[ev.SequenceID]
+	if !ok {
+		bySeq = make(map[int64]*Entry)
+		c.checkpoints[ev.SequenceID] = bySeq
+	}
+	for _, other := range sortedEntries(bySeq) {
+		if other.Event.Digest != ev.Digest {
+			c.violate("checkpoint", fmt.Sprintf("stable checkpoint %d has digest %s at node %d and %s at node %d",
+				ev.SequenceID, other.Event.Digest, other.Event.NodeID, ev.Digest, ev.NodeID),
+				c.traceOf(func(t *consensus.Event) bool {
+					return t.Type == consensus.EventCheckpointStable || (t.Type == consensus.EventExecuted && t.SequenceID <= ev.SequenceID)
+				}))
+			break
+		}
+	}
+	bySeq[ev.NodeID] = e
+}
+
+/*
+CheckLiveness reports the requests that should have executed on f+1 correct replicas by now and haven't. Call it after
+Poll, at the end of a run or periodically; a request is reported once.
+*/
+func (c *Checker) CheckLiveness() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Bound <= 0 {
+		return
+	}
+	now := c.now()
+
+	keys := make([]request, 0, len(c.requests))
+	for k := range c.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].clientID != keys[j].clientID {
+			return keys[i].clientID < keys[j].clientID
+		}
+		return keys[i].timeStamp < keys[j].timeStamp
+	})
+
+	for _, k := range keys {
+		sub := c.requests[k]
+		if !sub.submitted || sub.reported || len(sub.executed) >= message.MaxFaultyNode+1 {
+			continue
+		}
+		start := sub.at
+		if c.GST > start {
+			start = c.GST
+		}
+		if now < start+c.Bound {
+			continue
+		}
+		sub.reported = true
+		c.violate("liveness", fmt.Sprintf("request %s/%d submitted at %s executed on %d correct replicas by %s, want %d",
+			k.clientID, k.timeStamp, sub.at, len(sub.executed), start+c.Bound, message.MaxFaultyNode+1),
+			c.traceOf(func(t *consensus.Event) bool {
+				return (t.ClientID == k.clientID && t.TimeStamp == k.timeStamp) || isViewEvent(t)
+			}))
+	}
+}
+
+func (c *Checker) Violations() []*Violation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Violation(nil), c.violations...)
+}
+
+// Err returns the first violation, or nil if every invariant held.
+func (c *Checker) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.violations) == 0 {
+		return nil
+	}
+	return c.violations[0]
+}
+
+// MaxTrace bounds the counterexample kept with a violation to the last events that matter.
+const MaxTrace = 64
+
+func (c *Checker) traceOf(match func(*consensus.Event) bool) []*Entry {
+	out := make([]*Entry, 0)
+	for _, e := range c.trace {
+		if match(e.Event) {
+			out = append(out, e)
+		}
+	}
+	if len(out) > MaxTrace {
+		out = out[len(out)-MaxTrace:]
+	}
+	return out
+}
+
+func (c *Checker) violate(invariant, msg string, trace []*Entry) {
+	c.violations = append(c.violations, &Violation{
+		Invariant: invariant,
+		Message:   msg,
+		At:        c.now(),
+		Trace:     trace,
+		label:     c.Label,
+	})
+}
+
+func isViewEvent(ev *consensus.Event) bool {
+	return ev.Type == consensus.EventViewChangeStarted || ev.Type == consensus.EventNewViewInstalled
+}
+
+func sortedEntries(m map[int64]*Entry) []*Entry {
+	out := make([]*Entry, 0, len(m))
+	for _, e := range m {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Event.NodeID < out[j].Event.NodeID })
+	return out
+}
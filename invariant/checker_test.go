@@ -0,0 +1,74 @@
+package invariant
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sakesake/PBFT/consensus"
+)
+
+func executed(node, view, seq int64, timeStamp int64, digest string) *consensus.Event {
+	return &consensus.Event{Type: consensus.EventExecuted, NodeID: node, ViewID: view, SequenceID: seq,
+		Digest: digest, ClientID: "client-0", TimeStamp: timeStamp}
+}
+
+func stable(node, seq int64, digest string) *consensus.Event {
+	return &consensus.Event{Type: consensus.EventCheckpointStable, NodeID: node, SequenceID: seq, Digest: digest}
+}
+
+func TestCheckerReportsBrokenInvariants(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		faulty int64
+		submit bool
+		events []*consensus.Event
+		want   []string
+	}{
+		{"agreement holds", -1, true,
+			[]*consensus.Event{executed(0, 0, 1, 1, "d1"), executed(1, 0, 1, 1, "d1")}, nil},
+		{"two requests at one sequence number", -1, false,
+			[]*consensus.Event{executed(0, 0, 1, 1, "d1"), executed(1, 0, 1, 2, "d2")}, []string{"agreement"}},
+		{"same request with another digest", -1, false,
+			[]*consensus.Event{executed(0, 0, 1, 1, "d1"), executed(2, 0, 1, 1, "forged")}, []string{"agreement"}},
+		{"faulty replica executes something else", 1, false,
+			[]*consensus.Event{executed(0, 0, 1, 1, "d1"), executed(1, 0, 1, 2, "d2")}, nil},
+		{"stable checkpoints differ", -1, false,
+			[]*consensus.Event{stable(0, 10, "s1"), stable(3, 10, "s2")}, []string{"checkpoint"}},
+		{"view goes back", -1, false,
+			[]*consensus.Event{executed(0, 2, 1, 1, "d1"), executed(0, 1, 2, 2, "d2")}, []string{"view"}},
+		{"request executes on f replicas", -1, true,
+			[]*consensus.Event{executed(0, 0, 1, 1, "d1")}, []string{"liveness"}},
+		{"request never executes", -1, true, nil, []string{"liveness"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var now time.Duration
+			c := NewChecker(func() time.Duration { return now })
+			c.Bound = 10 * time.Second
+			c.faulty[tc.faulty] = true
+			if tc.submit {
+				c.Submitted("client-0", 1, 0)
+			}
+			for _, ev := range tc.events {
+				c.observe(ev)
+			}
+			now = time.Minute
+			c.CheckLiveness()
+
+			got := c.Violations()
+			if len(got) != len(tc.want) {
+				t.Fatalf("violations %v, want %v", got, tc.want)
+			}
+			for i, v := range got {
+				if v.Invariant != tc.want[i] {
+					t.Fatalf("violation %d is %s, want %s", i, v.Invariant, tc.want[i])
+				}
+				if len(tc.events) > 0 && len(v.Trace) == 0 {
+					t.Fatalf("%s violation without a counterexample", v.Invariant)
+				}
+			}
+			if (c.Err() == nil) != (len(tc.want) == 0) {
+				t.Fatalf("Err %v with violations %v", c.Err(), got)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package invariant
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Operation is one call a client made to the replicated service, as the client saw it. Call and Return are the times
+the client invoked it and accepted the result; a Pending operation never returned, it may or may not have taken effect
+and its output is unknown.
+*/
+type Operation struct {
+	ClientID string
+	Input    string
+	Output   string
+	Call     time.Duration
+	Return   time.Duration
+	Pending  bool
+}
+
+func (op *Operation) String() string {
+	if op.Pending {
+		return fmt.Sprintf("[%12s, %12s] %s: %s -> ?", op.Call, "pending", op.ClientID, op.Input)
+	}
+	return fmt.Sprintf("[%12s, %12s] %s: %s -> %q", op.Call, op.Return, op.ClientID, op.Input, op.Output)
+}
+
+/*
+Model is the sequential specification a history is checked against. States are strings so the search can remember
+which states it already tried; Step applies op to state and reports whether op's output is what the specification
+allows, for a pending operation any output is allowed. Partition splits a history into independent histories, the keys
+of a key-value store for example, which are checked one by one.
+*/
+type Model interface {
+	Init() string
+	Step(state string, op *Operation) (string, bool)
+	Partition(history []*Operation) [][]*Operation
+}
+
+/*
+KV is the specification of the simulator's key-value machine: put sets a key, append extends it, get returns it and
+the empty string for a key that was never set. Keys are independent, so the history is checked key by key.
+*/
+type KV struct{}
+
+const kvOk = "ok"
+
+func (KV) Init() string {
+	return ""
+}
+
+func (KV) Step(state string, op *Operation) (string, bool) {
+	f := strings.Fields(op.Input)
+	switch {
+	case len(f) == 3 && f[0] == "put":
+		return f[2], op.Pending || op.Output == kvOk
+	case len(f) == 3 && f[0] == "append":
+		return state + f[2], op.Pending || op.Output == kvOk
+	case len(f) == 2 && f[0] == "get":
+		return state, op.Pending || op.Output == state
+	}
+	return state, false
+}
+
+func (KV) Partition(history []*Operation) [][]*Operation {
+	byKey := make(map[string][]*Operation)
+	keys := make([]string, 0)
+	for _, op := range history {
+		f := strings.Fields(op.Input)
+		key := ""
+		if len(f) > 1 {
+			key = f[1]
+		}
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], op)
+	}
+	sort.Strings(keys)
+	parts := make([][]*Operation, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, byKey[k])
+	}
+	return parts
+}
+
+/*
+CheckHistory checks that the client history is linearizable with respect to model: every operation can be given a
+single point between its call and its return so that the operations, in the order of their points, are a legal
+sequential execution of the model. It is the check of Wing and Gong with the memoization of Lowe, as in Porcupine: the
+search tries the operations that may come next in call order, backtracks when a return can't be reached, and never
+tries the same set of linearized operations in the same state twice.
+
+An operation that returns at the instant another is called precedes it, in the simulator the second call is caused by
+the first return. A violation lists the longest linearizable prefix the search found and the operations that could
+not follow it.
+*/
+func (c *Checker) CheckHistory(model Model, history []*Operation) {
+	for _, part := range model.Partition(history) {
+		ok, prefix, stuck := linearize(model, part)
+		if ok {
+			continue
+		}
+		c.mu.Lock()
+		c.violations = append(c.violations, &Violation{
+			Invariant: "linearizability",
+			Message: fmt.Sprintf("no linearization of %d operations, the longest linearizable prefix has %d",
+				len(part), len(prefix)),
+			At:        c.now(),
+			Linear:    prefix,
+			Candidate: stuck,
+			label:     c.Label,
+		})
+		c.mu.Unlock()
+	}
+}
+
+type entry struct {
+	op         *Operation
+	id         int
+	call       bool
+	at         time.Duration
+	match      *entry
+	prev, next *entry
+}
+
+type frame struct {
+	e     *entry
+	state string
+}
+
+func linearize(model Model, history []*Operation) (bool, []*Operation, []*Operation) {
+	entries := make([]*entry, 0, 2*len(history))
+	for i, op := range history {
+		ret := op.Return
+		if op.Pending {
+			ret = math.MaxInt64
+		}
+		call := &entry{op: op, id: i, call: true, at: op.Call}
+		call.match = &entry{op: op, id: i, at: ret}
+		entries = append(entries, call, call.match)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].at != entries[j].at {
+			return entries[i].at < entries[j].at
+		}
+		return !entries[i].call && entries[j].call
+	})
+
+	head := &entry{}
+	prev := head
+	for _, e := range entries {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+
+	linearized := make([]uint64, len(history)/64+1)
+	cache := make(map[string]bool)
+	calls := make([]frame, 0, len(history))
+	best := make([]*Operation, 0)
+	var stuck []*Operation
+
+	state := model.Init()
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			next, ok := model.Step(state, e.op)
+			if ok {
+				linearized[e.id/64] |= 1 << uint(e.id%64)
+				key := cacheKey(linearized, next)
+				if !cache[key] {
+					cache[key] = true
+					calls = append(calls, frame{e: e, state: state})
+					state = next
+					lift(e)
+					e = head.next
+					continue
+				}
+				linearized[e.id/64] &^= 1 << uint(e.id%64)
+			}
+			e = e.next
+			continue
+		}
+
+		if len(calls) >= len(best) {
+			best = best[:0]
+			for _, f := range calls {
+				best = append(best, f.e.op)
+			}
+			stuck = stuck[:0]
+			for o := head.next; o != nil && o != e.next; o = o.next {
+				if o.call {
+					stuck = append(stuck, o.op)
+				}
+			}
+		}
+		if len(calls) == 0 {
+			return false, best, stuck
+		}
+		f := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		linearized[f.e.id/64] &^= 1 << uint(f.e.id%64)
+		state = f.state
+		unlift(f.e)
+		e = f.e.next
+	}
+	return true, nil, nil
+}
+
+// lift takes a linearized operation, its call and its return, out of the list of entries.
+func lift(call *entry) {
+	call.prev.next = call.next
+	call.next.prev = call.prev
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+func unlift(call *entry) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	call.next.prev = call
+}
+
+func cacheKey(linearized []uint64, state string) string {
+	var b strings.Builder
+	for _, w := range linearized {
+		fmt.Fprintf(&b, "%016x", w)
+	}
+	b.WriteByte('|')
+	b.WriteString(state)
+	return b.String()
+}
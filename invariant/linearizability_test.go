@@ -0,0 +1,96 @@
+package invariant
+
+import (
+	"testing"
+	"time"
+)
+
+func op(client, input, output string, call, ret time.Duration) *Operation {
+	return &Operation{ClientID: client, Input: input, Output: output, Call: call, Return: ret}
+}
+
+func pending(client, input string, call time.Duration) *Operation {
+	return &Operation{ClientID: client, Input: input, Call: call, Pending: true}
+}
+
+func TestLinearizabilityOfKVHistories(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		history []*Operation
+		want    int
+	}{
+		{"sequential", []*Operation{
+			op("a", "put x 1", "ok", 0, 1),
+			op("a", "append x 2", "ok", 2, 3),
+			op("b", "get x", "12", 4, 5),
+		}, 0},
+		{"concurrent read sees the write", []*Operation{
+			op("a", "put x 1", "ok", 0, 10),
+			op("b", "get x", "1", 1, 2),
+		}, 0},
+		{"concurrent read misses the write", []*Operation{
+			op("a", "put x 1", "ok", 0, 10),
+			op("b", "get x", "", 1, 2),
+		}, 0},
+		{"stale read", []*Operation{
+			op("a", "put x 1", "ok", 0, 1),
+			op("b", "get x", "", 2, 3),
+		}, 1},
+		{"read as the write returns", []*Operation{
+			op("a", "put x 1", "ok", 0, 1),
+			op("b", "get x", "", 1, 2),
+		}, 1},
+		{"appends reordered", []*Operation{
+			op("a", "append x 1", "ok", 0, 1),
+			op("a", "append x 2", "ok", 2, 3),
+			op("b", "get x", "21", 4, 5),
+		}, 1},
+		{"append executed twice", []*Operation{
+			op("a", "append x 1", "ok", 0, 1),
+			op("b", "get x", "11", 2, 3),
+		}, 1},
+		{"pending write took effect", []*Operation{
+			pending("a", "put x 1", 0),
+			op("b", "get x", "1", 5, 6),
+			op("b", "get x", "1", 7, 8),
+		}, 0},
+		{"pending write is undone", []*Operation{
+			pending("a", "put x 1", 0),
+			op("b", "get x", "1", 5, 6),
+			op("b", "get x", "", 7, 8),
+		}, 1},
+		{"keys are checked apart", []*Operation{
+			op("a", "put x 1", "ok", 0, 1),
+			op("a", "put y 2", "ok", 2, 3),
+			op("b", "get x", "1", 4, 5),
+			op("b", "get y", "1", 6, 7),
+		}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewChecker(func() time.Duration { return 0 })
+			c.CheckHistory(KV{}, tc.history)
+			if got := c.Violations(); len(got) != tc.want {
+				t.Fatalf("%d violations, want %d: %v", len(got), tc.want, got)
+			}
+		})
+	}
+}
+
+func TestLinearizabilityCounterexample(t *testing.T) {
+	put := op("a", "put x 1", "ok", 0, 1)
+	get := op("b", "get x", "", 2, 3)
+	c := NewChecker(func() time.Duration { return 0 })
+	c.CheckHistory(KV{}, []*Operation{put, get})
+
+	got := c.Violations()
+	if len(got) != 1 || got[0].Invariant != "linearizability" {
+		t.Fatalf("violations %v", got)
+	}
+	v := got[0]
+	if len(v.Linear) != 1 || v.Linear[0] != put {
+		t.Fatalf("linearized prefix %v, want the put", v.Linear)
+	}
+	if len(v.Candidate) != 1 || v.Candidate[0] != get {
+		t.Fatalf("stuck at %v, want the stale get", v.Candidate)
+	}
+}
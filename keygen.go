@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/quorum"
+)
+
+/*
+runKeygen writes the long-term keys and the vote keys of the replicas of the default configuration to a key directory,
+each replica is then started with PBFT_KEY_DIR pointing to a copy without the .key and .vote files of the others, and
+with PBFT_QUORUM_CERTS set if it certifies its quorums. Keys are written for the clients named after the directory,
+the replicas then only serve requests signed by one of them, and take reconfigurations from those of them listed in
+PBFT_OPERATORS, separated by commas:
+
+	PBFT keygen ./keys ["Client's address"...]
+*/
+func runKeygen(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: keygen <dir> [client id...]")
+	}
+	replicas := message.DefaultConfig().Replicas
+	if err := auth.WriteKeys(args[0], replicas); err != nil {
+		return err
+	}
+	if err := auth.WriteClientKeys(args[0], args[1:]); err != nil {
+		return err
+	}
+	return quorum.WriteKeys(args[0], replicas)
+}
@@ -0,0 +1,205 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Logger is what every layer of a replica logs through. Entries carry a level and a set of fields (node, view, seq, msg
+type, peer...) instead of being formatted into the message, so they can be filtered and parsed. A logger created by
+With carries its fields on every entry.
+*/
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	With(fields ...Field) Logger
+}
+
+type Level int8
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level[%s]", s)
+}
+
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Err(err error) Field {
+	return Field{Key: "err", Value: err}
+}
+
+type output struct {
+	w     io.Writer
+	level Level
+	json  bool
+
+	mu sync.Mutex
+}
+
+type logger struct {
+	out    *output
+	fields []Field
+}
+
+// New returns a logger writing entries of level or above to w, as JSON objects when asJSON is set and as
+// key=value text otherwise.
+func New(w io.Writer, level Level, asJSON bool) Logger {
+	return &logger{
+		out: &output{
+			w:     w,
+			level: level,
+			json:  asJSON,
+		},
+	}
+}
+
+// Default logs state transitions and errors as text to stdout.
+func Default() Logger {
+	return New(os.Stdout, LevelInfo, false)
+}
+
+func Nop() Logger {
+	return New(io.Discard, LevelError+1, false)
+}
+
+func (l *logger) With(fields ...Field) Logger {
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+	return &logger{
+		out:    l.out,
+		fields: all,
+	}
+}
+
+func (l *logger) Debug(msg string, fields ...Field) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *logger) Info(msg string, fields ...Field) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *logger) Warn(msg string, fields ...Field) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *logger) Error(msg string, fields ...Field) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *logger) log(level Level, msg string, fields []Field) {
+	if level < l.out.level {
+		return
+	}
+	now := time.Now()
+	all := append(append([]Field(nil), l.fields...), fields...)
+
+	var line []byte
+	if l.out.json {
+		line = jsonLine(now, level, msg, all)
+	} else {
+		line = textLine(now, level, msg, all)
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	_, _ = l.out.w.Write(line)
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case error:
+		return tv.Error()
+	case fmt.Stringer:
+		return tv.String()
+	}
+	return v
+}
+
+func textLine(now time.Time, level Level, msg string, fields []Field) []byte {
+	var b strings.Builder
+	b.WriteString(now.Format(time.RFC3339Nano))
+	b.WriteByte(' ')
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for _, f := range fields {
+		v := fmt.Sprint(fieldValue(f.Value))
+		if strings.ContainsAny(v, " \t\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		b.WriteByte(' ')
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		b.WriteString(v)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func jsonLine(now time.Time, level Level, msg string, fields []Field) []byte {
+	entry := make(map[string]interface{}, len(fields)+3)
+	for _, f := range fields {
+		entry[f.Key] = fieldValue(f.Value)
+	}
+	entry["time"] = now.Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{
+			"time":  entry["time"],
+			"level": entry["level"],
+			"msg":   msg,
+			"err":   err.Error(),
+		})
+	}
+	return append(data, '\n')
+}
@@ -1,22 +1,114 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"fmt"
-	"github.com/didchain/PBFT/node"
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/consensus"
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/node"
+	"github.com/sakesake/PBFT/quorum"
+	"github.com/sakesake/PBFT/service"
+	"github.com/sakesake/PBFT/tracing"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
 	if len(os.Args) < 2 {
 		panic("usage: input id")
 	}
+	if os.Args[1] == "keygen" {
+		if err := runKeygen(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if os.Args[1] == "admin" {
+		if err := runAdmin(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	id, _ := strconv.Atoi(os.Args[1])
-	node := node.NewNode(int64(id))
-	go node.Run()
+	level, err := logging.ParseLevel(os.Getenv("PBFT_LOG_LEVEL"))
+	if err != nil {
+		panic(err)
+	}
+	log := logging.New(os.Stdout, level, os.Getenv("PBFT_LOG_FORMAT") == "json")
+	var opts []consensus.Option
+	if os.Getenv("PBFT_TENTATIVE") != "" {
+		opts = append(opts, consensus.WithTentativeExecution())
+	}
+	node := node.NewNode(int64(id), service.Nop(), log, opts...)
+	node.AdminToken = os.Getenv("PBFT_ADMIN_TOKEN")
+	if period := os.Getenv("PBFT_RECOVERY_PERIOD"); period != "" {
+		d, err := time.ParseDuration(period)
+		if err != nil {
+			panic(err)
+		}
+		node.EnableRecovery(d)
+	}
+	if dir := os.Getenv("PBFT_KEY_DIR"); dir != "" {
+		key, pubs, err := auth.LoadKeys(dir, int64(id), message.DefaultConfig().Replicas)
+		if err != nil {
+			panic(err)
+		}
+		interval := auth.DefaultInterval
+		if refresh := os.Getenv("PBFT_KEY_REFRESH"); refresh != "" {
+			if interval, err = time.ParseDuration(refresh); err != nil {
+				panic(err)
+			}
+		}
+		node.EnableAuth(key, pubs, interval)
+		clients, err := auth.LoadClientKeys(dir)
+		if err != nil {
+			panic(err)
+		}
+		if len(clients) > 0 {
+			node.EnableClientAuth(clients)
+		}
+		if ids := os.Getenv("PBFT_OPERATORS"); ids != "" {
+			operators := make(map[string]ed25519.PublicKey)
+			for _, cid := range strings.Split(ids, ",") {
+				pub, ok := clients[cid]
+				if !ok {
+					panic(fmt.Sprintf("no key for operator %s", cid))
+				}
+				operators[cid] = pub
+			}
+			node.EnableOperators(operators)
+		}
+		if os.Getenv("PBFT_QUORUM_CERTS") != "" {
+			key, votes, err := quorum.LoadKeys(dir, int64(id), message.DefaultConfig().Replicas)
+			if err != nil {
+				panic(err)
+			}
+			node.EnableCertificates(key, votes)
+		}
+	}
+	if path := os.Getenv("PBFT_TRACE_FILE"); path != "" {
+		exp, err := tracing.NewFileExporter(path, fmt.Sprintf("pbft-replica-%d", id))
+		if err != nil {
+			panic(err)
+		}
+		tracer := tracing.NewTracer(exp)
+		defer tracer.Close()
+		node.SetTracer(tracer)
+	}
+	done := make(chan struct{})
+	go func() {
+		node.Run()
+		close(done)
+	}()
 
 	sigCh := make(chan os.Signal, 1)
 
@@ -38,6 +130,10 @@ func main() {
 	fmt.Println("<==============================================")
 	fmt.Println()
 	fmt.Println()
-	sig := <-sigCh
-	fmt.Printf("Finish by signal:===>[%s]\n", sig.String())
+	select {
+	case sig := <-sigCh:
+		fmt.Printf("Finish by signal:===>[%s]\n", sig.String())
+	case <-done:
+		fmt.Println("Finish by node shutdown")
+	}
 }
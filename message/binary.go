@@ -0,0 +1,997 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+/*
+The binary encoding is canonical: a value has exactly one encoding, so a digest or a signature over it is the same on
+every implementation. Fields are written in the order they are declared, without names or tags:
+
+	int64		zig-zag varint
+	uint, MType	varint
+	bool		one byte, 0 or 1
+	string, []byte	varint length, then the bytes
+	pointer		one byte, 0 for nil, then the value when it is 1
+	slice		varint count, then the elements
+	map		varint count, then key and value of every entry by ascending key
+
+A nil and an empty map or slice encode the same, they decode as empty. Decoding refuses trailing bytes, non-canonical
+varints and bools, enums out of the range of their type, and maps whose keys are not strictly ascending, so only
+canonical input is accepted.
+*/
+
+// MaxDecodeLen bounds every length and count the decoder accepts, so a few bytes can't make it allocate gigabytes.
+const MaxDecodeLen = 1 << 24
+
+var ErrNotCanonical = errors.New("binary encoding is not canonical")
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *encoder) uint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+		return
+	}
+	e.buf = append(e.buf, 0)
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) str(v string) {
+	e.uint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// present writes the presence byte of a pointer and reports whether the value follows.
+func (e *encoder) present(isNil bool) bool {
+	e.bool(!isNil)
+	return !isNil
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) int() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail(fmt.Errorf("invalid varint"))
+		return 0
+	}
+	if n != len(binary.AppendVarint(nil, v)) {
+		d.fail(ErrNotCanonical)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail(fmt.Errorf("invalid uvarint"))
+		return 0
+	}
+	if n != len(binary.AppendUvarint(nil, v)) {
+		d.fail(ErrNotCanonical)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bool() bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.buf) == 0 {
+		d.fail(fmt.Errorf("unexpected end of data"))
+		return false
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	if b > 1 {
+		d.fail(ErrNotCanonical)
+		return false
+	}
+	return b == 1
+}
+
+// mType reads an MType, a value the type can't hold would be truncated and encode differently.
+func (d *decoder) mType() MType {
+	v := d.uint()
+	if v > math.MaxInt16 {
+		d.fail(ErrNotCanonical)
+		return 0
+	}
+	return MType(v)
+}
+
+// reconfigOp reads a ReconfigOp, refusing what the type can't hold like mType.
+func (d *decoder) reconfigOp() ReconfigOp {
+	v := d.int()
+	if v < math.MinInt8 || v > math.MaxInt8 {
+		d.fail(ErrNotCanonical)
+		return 0
+	}
+	return ReconfigOp(v)
+}
+
+// count reads a length or an element count and checks it against what can possibly follow.
+func (d *decoder) count() int {
+	n := d.uint()
+	if d.err != nil {
+		return 0
+	}
+	if n > MaxDecodeLen || n > uint64(len(d.buf)) {
+		d.fail(fmt.Errorf("length %d exceeds the %d bytes left", n, len(d.buf)))
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.count()
+	if d.err != nil {
+		return nil
+	}
+	v := append([]byte(nil), d.buf[:n]...)
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) str() string {
+	n := d.count()
+	if d.err != nil {
+		return ""
+	}
+	v := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) present() bool {
+	return d.bool()
+}
+
+// key reads the next map key and checks the keys ascend.
+func (d *decoder) key(i int, prev int64) int64 {
+	k := d.int()
+	if d.err == nil && i > 0 && k <= prev {
+		d.fail(ErrNotCanonical)
+	}
+	return k
+}
+
+func (d *decoder) done() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail(fmt.Errorf("%d trailing bytes", len(d.buf)))
+	}
+	return d.err
+}
+
+func sortedKeys(n int, each func(func(int64))) []int64 {
+	keys := make([]int64, 0, n)
+	each(func(k int64) {
+		keys = append(keys, k)
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func (e *encoder) request(r *Request) {
+	e.int(r.SeqID)
+	e.int(r.TimeStamp)
+	e.str(r.ClientID)
+	e.str(r.Operation)
+	e.str(r.Endpoint)
+	e.bool(r.ReadOnly)
+	e.bool(r.DigestReply)
+	e.int(r.Replier)
+	e.str(r.TraceID)
+	if e.present(r.Reconfig == nil) {
+		e.reconfig(r.Reconfig)
+	}
+	e.str(r.Sig)
+}
+
+func (d *decoder) request(r *Request) {
+	r.SeqID = d.int()
+	r.TimeStamp = d.int()
+	r.ClientID = d.str()
+	r.Operation = d.str()
+	r.Endpoint = d.str()
+	r.ReadOnly = d.bool()
+	r.DigestReply = d.bool()
+	r.Replier = d.int()
+	r.TraceID = d.str()
+	if d.present() {
+		r.Reconfig = &Reconfig{}
+		d.reconfig(r.Reconfig)
+	}
+	r.Sig = d.str()
+}
+
+func (e *encoder) reconfig(rc *Reconfig) {
+	e.int(int64(rc.Op))
+	e.int(rc.NodeID)
+	e.int(rc.F)
+	e.str(rc.Key)
+	e.str(rc.Vote)
+}
+
+func (d *decoder) reconfig(rc *Reconfig) {
+	rc.Op = d.reconfigOp()
+	rc.NodeID = d.int()
+	rc.F = d.int()
+	rc.Key = d.str()
+	rc.Vote = d.str()
+}
+
+func (e *encoder) config(c *Config) {
+	e.int(c.Epoch)
+	e.int(c.F)
+	e.uint(uint64(len(c.Replicas)))
+	for _, id := range c.Replicas {
+		e.int(id)
+	}
+	e.uint(uint64(len(c.Keys)))
+	for _, k := range sortedKeys(len(c.Keys), func(f func(int64)) {
+		for k := range c.Keys {
+			f(k)
+		}
+	}) {
+		e.int(k)
+		e.str(c.Keys[k])
+	}
+	e.uint(uint64(len(c.Votes)))
+	for _, k := range sortedKeys(len(c.Votes), func(f func(int64)) {
+		for k := range c.Votes {
+			f(k)
+		}
+	}) {
+		e.int(k)
+		e.str(c.Votes[k])
+	}
+	ids := make([]string, 0, len(c.Operators))
+	for id := range c.Operators {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	e.uint(uint64(len(ids)))
+	for _, id := range ids {
+		e.str(id)
+		e.str(c.Operators[id])
+	}
+}
+
+func (d *decoder) config(c *Config) {
+	c.Epoch = d.int()
+	c.F = d.int()
+	n := d.count()
+	c.Replicas = make([]int64, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		c.Replicas = append(c.Replicas, d.int())
+	}
+	n = d.count()
+	c.Keys = make(map[int64]string, n)
+	var prev int64
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		c.Keys[k] = d.str()
+	}
+	if n = d.count(); n > 0 {
+		c.Votes = make(map[int64]string, n)
+	}
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		c.Votes[k] = d.str()
+	}
+	if n = d.count(); n > 0 {
+		c.Operators = make(map[string]string, n)
+	}
+	var prevID string
+	for i := 0; i < n && d.err == nil; i++ {
+		id := d.str()
+		if d.err == nil && i > 0 && id <= prevID {
+			d.fail(ErrNotCanonical)
+		}
+		prevID = id
+		c.Operators[id] = d.str()
+	}
+}
+
+func (e *encoder) reply(r *Reply) {
+	e.int(r.SeqID)
+	e.int(r.ViewID)
+	e.int(r.Timestamp)
+	e.str(r.ClientID)
+	e.int(r.NodeID)
+	e.str(r.Result)
+	e.bool(r.Tentative)
+	e.str(r.ResultDigest)
+}
+
+func (d *decoder) reply(r *Reply) {
+	r.SeqID = d.int()
+	r.ViewID = d.int()
+	r.Timestamp = d.int()
+	r.ClientID = d.str()
+	r.NodeID = d.int()
+	r.Result = d.str()
+	r.Tentative = d.bool()
+	r.ResultDigest = d.str()
+}
+
+func (e *encoder) prePrepare(pp *PrePrepare) {
+	e.int(pp.ViewID)
+	e.int(pp.SequenceID)
+	e.str(pp.Digest)
+}
+
+func (d *decoder) prePrepare(pp *PrePrepare) {
+	pp.ViewID = d.int()
+	pp.SequenceID = d.int()
+	pp.Digest = d.str()
+}
+
+func (e *encoder) prepare(p *Prepare) {
+	e.int(p.ViewID)
+	e.int(p.SequenceID)
+	e.str(p.Digest)
+	e.int(p.NodeID)
+	e.bytes(p.Sig)
+}
+
+func (d *decoder) prepare(p *Prepare) {
+	p.ViewID = d.int()
+	p.SequenceID = d.int()
+	p.Digest = d.str()
+	p.NodeID = d.int()
+	p.Sig = d.bytes()
+}
+
+func (e *encoder) commit(c *Commit) {
+	e.int(c.ViewID)
+	e.int(c.SequenceID)
+	e.str(c.Digest)
+	e.int(c.NodeID)
+	e.bytes(c.Sig)
+}
+
+func (d *decoder) commit(c *Commit) {
+	c.ViewID = d.int()
+	c.SequenceID = d.int()
+	c.Digest = d.str()
+	c.NodeID = d.int()
+	c.Sig = d.bytes()
+}
+
+func (e *encoder) checkPoint(cp *CheckPoint) {
+	e.int(cp.SequenceID)
+	e.str(cp.Digest)
+	e.int(cp.ViewID)
+	e.int(cp.NodeID)
+	e.bytes(cp.Sig)
+}
+
+func (e *encoder) quorumCert(qc *QuorumCert) {
+	e.uint(uint64(qc.Typ))
+	e.int(qc.ViewID)
+	e.int(qc.SequenceID)
+	e.str(qc.Digest)
+	e.bytes(qc.Signers)
+	e.bytes(qc.Sig)
+}
+
+func (d *decoder) quorumCert(qc *QuorumCert) {
+	qc.Typ = d.mType()
+	qc.ViewID = d.int()
+	qc.SequenceID = d.int()
+	qc.Digest = d.str()
+	qc.Signers = d.bytes()
+	qc.Sig = d.bytes()
+}
+
+// Statement is what every signer of qc signed: the canonical encoding of qc without Signers and Sig.
+func (qc *QuorumCert) Statement() []byte {
+	e := &encoder{}
+	e.quorumCert(&QuorumCert{Typ: qc.Typ, ViewID: qc.ViewID, SequenceID: qc.SequenceID, Digest: qc.Digest})
+	return e.buf
+}
+
+func (d *decoder) checkPoint(cp *CheckPoint) {
+	cp.SequenceID = d.int()
+	cp.Digest = d.str()
+	cp.ViewID = d.int()
+	cp.NodeID = d.int()
+	cp.Sig = d.bytes()
+}
+
+func (e *encoder) clientEntry(ce *ClientEntry) {
+	e.str(ce.ClientID)
+	e.int(ce.TimeStamp)
+	if e.present(ce.Reply == nil) {
+		e.reply(ce.Reply)
+	}
+}
+
+func (d *decoder) clientEntry(ce *ClientEntry) {
+	ce.ClientID = d.str()
+	ce.TimeStamp = d.int()
+	if d.present() {
+		ce.Reply = &Reply{}
+		d.reply(ce.Reply)
+	}
+}
+
+func (e *encoder) ints(v []int64) {
+	e.uint(uint64(len(v)))
+	for _, i := range v {
+		e.int(i)
+	}
+}
+
+func (d *decoder) ints() []int64 {
+	n := d.count()
+	v := make([]int64, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		v = append(v, d.int())
+	}
+	return v
+}
+
+func (e *encoder) fetchState(fs *FetchState) {
+	e.int(fs.SequenceID)
+	e.str(fs.Digest)
+	e.int(fs.NodeID)
+	e.ints(fs.Partitions)
+	e.ints(fs.Pages)
+}
+
+func (d *decoder) fetchState(fs *FetchState) {
+	fs.SequenceID = d.int()
+	fs.Digest = d.str()
+	fs.NodeID = d.int()
+	fs.Partitions = d.ints()
+	fs.Pages = d.ints()
+}
+
+func (e *encoder) fetchRequest(fr *FetchRequest) {
+	e.int(fr.SequenceID)
+	e.str(fr.Digest)
+	e.int(fr.NodeID)
+}
+
+func (d *decoder) fetchRequest(fr *FetchRequest) {
+	fr.SequenceID = d.int()
+	fr.Digest = d.str()
+	fr.NodeID = d.int()
+}
+
+func (e *encoder) stateTransfer(st *StateTransfer) {
+	e.int(st.SequenceID)
+	e.str(st.Digest)
+	e.int(st.NodeID)
+	e.uint(uint64(len(st.Clients)))
+	for _, ce := range st.Clients {
+		if e.present(ce == nil) {
+			e.clientEntry(ce)
+		}
+	}
+	if e.present(st.Config == nil) {
+		e.config(st.Config)
+	}
+	e.ints(st.Partitions)
+	e.bytes(st.State)
+	e.uint(uint64(len(st.Pages)))
+	for _, k := range sortedKeys(len(st.Pages), func(f func(int64)) {
+		for k := range st.Pages {
+			f(k)
+		}
+	}) {
+		e.int(k)
+		e.bytes(st.Pages[k])
+	}
+}
+
+func (d *decoder) stateTransfer(st *StateTransfer) {
+	st.SequenceID = d.int()
+	st.Digest = d.str()
+	st.NodeID = d.int()
+	n := d.count()
+	st.Clients = make([]*ClientEntry, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		var ce *ClientEntry
+		if d.present() {
+			ce = &ClientEntry{}
+			d.clientEntry(ce)
+		}
+		st.Clients = append(st.Clients, ce)
+	}
+	if d.present() {
+		st.Config = &Config{}
+		d.config(st.Config)
+	}
+	st.Partitions = d.ints()
+	st.State = d.bytes()
+	if n = d.count(); n > 0 {
+		st.Pages = make(map[int64][]byte, n)
+	}
+	var prev int64
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		st.Pages[k] = d.bytes()
+	}
+}
+
+func (e *encoder) stateDigests(sd *StateDigests) {
+	e.int(sd.SequenceID)
+	e.str(sd.Digest)
+	e.int(sd.NodeID)
+	e.uint(uint64(len(sd.Partitions)))
+	for _, p := range sd.Partitions {
+		e.str(p)
+	}
+	e.uint(uint64(len(sd.Pages)))
+	for _, p := range sd.Pages {
+		e.str(p)
+	}
+	if e.present(sd.Config == nil) {
+		e.config(sd.Config)
+	}
+	e.uint(uint64(len(sd.Checks)))
+	for _, k := range sortedKeys(len(sd.Checks), func(f func(int64)) {
+		for k := range sd.Checks {
+			f(k)
+		}
+	}) {
+		e.int(k)
+		if e.present(sd.Checks[k] == nil) {
+			e.checkPoint(sd.Checks[k])
+		}
+	}
+}
+
+func (d *decoder) stateDigests(sd *StateDigests) {
+	sd.SequenceID = d.int()
+	sd.Digest = d.str()
+	sd.NodeID = d.int()
+	n := d.count()
+	sd.Partitions = make([]string, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		sd.Partitions = append(sd.Partitions, d.str())
+	}
+	if n = d.count(); n > 0 {
+		sd.Pages = make([]string, 0, n)
+	}
+	for i := 0; i < n && d.err == nil; i++ {
+		sd.Pages = append(sd.Pages, d.str())
+	}
+	if d.present() {
+		sd.Config = &Config{}
+		d.config(sd.Config)
+	}
+	n = d.count()
+	sd.Checks = make(map[int64]*CheckPoint, n)
+	var prev int64
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		var cp *CheckPoint
+		if d.present() {
+			cp = &CheckPoint{}
+			d.checkPoint(cp)
+		}
+		sd.Checks[k] = cp
+	}
+}
+
+func (e *encoder) prepareMsg(pm PrepareMsg) {
+	e.uint(uint64(len(pm)))
+	for _, k := range sortedKeys(len(pm), func(f func(int64)) {
+		for k := range pm {
+			f(k)
+		}
+	}) {
+		e.int(k)
+		if e.present(pm[k] == nil) {
+			e.prepare(pm[k])
+		}
+	}
+}
+
+func (d *decoder) prepareMsg() PrepareMsg {
+	n := d.count()
+	pm := make(PrepareMsg, n)
+	var prev int64
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		var p *Prepare
+		if d.present() {
+			p = &Prepare{}
+			d.prepare(p)
+		}
+		pm[k] = p
+	}
+	return pm
+}
+
+func (e *encoder) pTuple(pt *PTuple) {
+	if e.present(pt.PPMsg == nil) {
+		e.prePrepare(pt.PPMsg)
+	}
+	e.prepareMsg(pt.PMsg)
+	if e.present(pt.Cert == nil) {
+		e.quorumCert(pt.Cert)
+	}
+}
+
+func (d *decoder) pTuple(pt *PTuple) {
+	if d.present() {
+		pt.PPMsg = &PrePrepare{}
+		d.prePrepare(pt.PPMsg)
+	}
+	pt.PMsg = d.prepareMsg()
+	if d.present() {
+		pt.Cert = &QuorumCert{}
+		d.quorumCert(pt.Cert)
+	}
+}
+
+func (e *encoder) viewChange(vc *ViewChange) {
+	e.int(vc.NewViewID)
+	e.int(vc.LastCPSeq)
+	e.int(vc.NodeID)
+	e.uint(uint64(len(vc.CMsg)))
+	for _, k := range sortedKeys(len(vc.CMsg), func(f func(int64)) {
+		for k := range vc.CMsg {
+			f(k)
+		}
+	}) {
+		e.int(k)
+		if e.present(vc.CMsg[k] == nil) {
+			e.checkPoint(vc.CMsg[k])
+		}
+	}
+	e.uint(uint64(len(vc.PMsg)))
+	for _, k := range sortedKeys(len(vc.PMsg), func(f func(int64)) {
+		for k := range vc.PMsg {
+			f(k)
+		}
+	}) {
+		e.int(k)
+		if e.present(vc.PMsg[k] == nil) {
+			e.pTuple(vc.PMsg[k])
+		}
+	}
+	if e.present(vc.CCert == nil) {
+		e.quorumCert(vc.CCert)
+	}
+}
+
+func (d *decoder) viewChange(vc *ViewChange) {
+	vc.NewViewID = d.int()
+	vc.LastCPSeq = d.int()
+	vc.NodeID = d.int()
+	n := d.count()
+	vc.CMsg = make(map[int64]*CheckPoint, n)
+	var prev int64
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		var cp *CheckPoint
+		if d.present() {
+			cp = &CheckPoint{}
+			d.checkPoint(cp)
+		}
+		vc.CMsg[k] = cp
+	}
+	n = d.count()
+	vc.PMsg = make(map[int64]*PTuple, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		var pt *PTuple
+		if d.present() {
+			pt = &PTuple{}
+			d.pTuple(pt)
+		}
+		vc.PMsg[k] = pt
+	}
+	if d.present() {
+		vc.CCert = &QuorumCert{}
+		d.quorumCert(vc.CCert)
+	}
+}
+
+func (e *encoder) oMessage(om OMessage) {
+	e.uint(uint64(len(om)))
+	for _, k := range om.Seqs() {
+		e.int(k)
+		if e.present(om[k] == nil) {
+			e.prePrepare(om[k])
+		}
+	}
+}
+
+func (d *decoder) oMessage() OMessage {
+	n := d.count()
+	om := make(OMessage, n)
+	var prev int64
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		var pp *PrePrepare
+		if d.present() {
+			pp = &PrePrepare{}
+			d.prePrepare(pp)
+		}
+		om[k] = pp
+	}
+	return om
+}
+
+func (e *encoder) newView(nv *NewView) {
+	e.int(nv.NewViewID)
+	e.uint(uint64(len(nv.VMsg)))
+	for _, k := range nv.VMsg.IDs() {
+		e.int(k)
+		if e.present(nv.VMsg[k] == nil) {
+			e.viewChange(nv.VMsg[k])
+		}
+	}
+	e.oMessage(nv.OMsg)
+	e.oMessage(nv.NMsg)
+	if e.present(nv.CCert == nil) {
+		e.quorumCert(nv.CCert)
+	}
+	e.uint(uint64(len(nv.PMsg)))
+	for _, k := range sortedKeys(len(nv.PMsg), func(f func(int64)) {
+		for k := range nv.PMsg {
+			f(k)
+		}
+	}) {
+		e.int(k)
+		if e.present(nv.PMsg[k] == nil) {
+			e.pTuple(nv.PMsg[k])
+		}
+	}
+}
+
+func (d *decoder) newView(nv *NewView) {
+	nv.NewViewID = d.int()
+	n := d.count()
+	nv.VMsg = make(VMessage, n)
+	var prev int64
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		var vc *ViewChange
+		if d.present() {
+			vc = &ViewChange{}
+			d.viewChange(vc)
+		}
+		nv.VMsg[k] = vc
+	}
+	nv.OMsg = d.oMessage()
+	nv.NMsg = d.oMessage()
+	if d.present() {
+		nv.CCert = &QuorumCert{}
+		d.quorumCert(nv.CCert)
+	}
+	n = d.count()
+	nv.PMsg = make(map[int64]*PTuple, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		var pt *PTuple
+		if d.present() {
+			pt = &PTuple{}
+			d.pTuple(pt)
+		}
+		nv.PMsg[k] = pt
+	}
+}
+
+func (e *encoder) conMessage(cm *ConMessage) {
+	e.uint(uint64(cm.Typ))
+	e.str(cm.Sig)
+	e.uint(uint64(cm.From))
+	e.uint(uint64(cm.To))
+	e.bytes(cm.Payload)
+	e.str(cm.TraceID)
+	e.uint(uint64(len(cm.Auth)))
+	for _, k := range sortedKeys(len(cm.Auth), func(f func(int64)) {
+		for k := range cm.Auth {
+			f(k)
+		}
+	}) {
+		e.int(k)
+		if e.present(cm.Auth[k] == nil) {
+			e.int(cm.Auth[k].KeyTime)
+			e.bytes(cm.Auth[k].Sum)
+		}
+	}
+}
+
+func (d *decoder) conMessage(cm *ConMessage) {
+	cm.Typ = d.mType()
+	cm.Sig = d.str()
+	cm.From = uint(d.uint())
+	cm.To = uint(d.uint())
+	cm.Payload = d.bytes()
+	cm.TraceID = d.str()
+	n := d.count()
+	if n == 0 {
+		return
+	}
+	cm.Auth = make(map[int64]*MAC, n)
+	var prev int64
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		var mac *MAC
+		if d.present() {
+			mac = &MAC{KeyTime: d.int(), Sum: d.bytes()}
+		}
+		cm.Auth[k] = mac
+	}
+}
+
+func (e *encoder) newKey(nk *NewKey) {
+	e.int(nk.NodeID)
+	e.int(nk.Timestamp)
+	e.bytes(nk.Ephemeral)
+	e.uint(uint64(len(nk.Keys)))
+	for _, k := range sortedKeys(len(nk.Keys), func(f func(int64)) {
+		for k := range nk.Keys {
+			f(k)
+		}
+	}) {
+		e.int(k)
+		e.bytes(nk.Keys[k])
+	}
+	e.bytes(nk.Sig)
+}
+
+func (d *decoder) newKey(nk *NewKey) {
+	nk.NodeID = d.int()
+	nk.Timestamp = d.int()
+	nk.Ephemeral = d.bytes()
+	n := d.count()
+	nk.Keys = make(map[int64][]byte, n)
+	var prev int64
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.key(i, prev)
+		prev = k
+		nk.Keys[k] = d.bytes()
+	}
+	nk.Sig = d.bytes()
+}
+
+/*
+Marshal returns the canonical binary encoding of v, a pointer to any message type of this package. A ConMessage is
+encoded as it is, its payload as opaque bytes; BinaryCodec is what turns the payload into binary too.
+*/
+func Marshal(v interface{}) ([]byte, error) {
+	e := &encoder{}
+	switch m := v.(type) {
+	case *Request:
+		e.request(m)
+	case *Reply:
+		e.reply(m)
+	case *PrePrepare:
+		e.prePrepare(m)
+	case *Prepare:
+		e.prepare(m)
+	case *Commit:
+		e.commit(m)
+	case *CheckPoint:
+		e.checkPoint(m)
+	case *ClientEntry:
+		e.clientEntry(m)
+	case *FetchState:
+		e.fetchState(m)
+	case *FetchRequest:
+		e.fetchRequest(m)
+	case *StateTransfer:
+		e.stateTransfer(m)
+	case *StateDigests:
+		e.stateDigests(m)
+	case *NewKey:
+		e.newKey(m)
+	case *Config:
+		e.config(m)
+	case *PTuple:
+		e.pTuple(m)
+	case *ViewChange:
+		e.viewChange(m)
+	case *NewView:
+		e.newView(m)
+	case *ConMessage:
+		e.conMessage(m)
+	default:
+		return nil, fmt.Errorf("no binary encoding for %T", v)
+	}
+	return e.buf, nil
+}
+
+// Unmarshal decodes the canonical binary encoding in data into v, which must be of the type data was encoded from.
+func Unmarshal(data []byte, v interface{}) error {
+	d := &decoder{buf: data}
+	switch m := v.(type) {
+	case *Request:
+		d.request(m)
+	case *Reply:
+		d.reply(m)
+	case *PrePrepare:
+		d.prePrepare(m)
+	case *Prepare:
+		d.prepare(m)
+	case *Commit:
+		d.commit(m)
+	case *CheckPoint:
+		d.checkPoint(m)
+	case *ClientEntry:
+		d.clientEntry(m)
+	case *FetchState:
+		d.fetchState(m)
+	case *FetchRequest:
+		d.fetchRequest(m)
+	case *StateTransfer:
+		d.stateTransfer(m)
+	case *StateDigests:
+		d.stateDigests(m)
+	case *NewKey:
+		d.newKey(m)
+	case *Config:
+		d.config(m)
+	case *PTuple:
+		d.pTuple(m)
+	case *ViewChange:
+		d.viewChange(m)
+	case *NewView:
+		d.newView(m)
+	case *ConMessage:
+		d.conMessage(m)
+	default:
+		return fmt.Errorf("no binary encoding for %T", v)
+	}
+	return d.done()
+}
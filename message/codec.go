@@ -0,0 +1,160 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+A Codec turns ConMessages into bytes on the wire and back. A replica builds the payload of a ConMessage as the JSON of
+its message and reads it with Body, whatever codec carried it; the codec decides how the message travels. Peers announce the codec versions they support when
+they connect and use the highest one they have in common, so a replica that speaks a newer codec still talks to one that
+doesn't.
+
+	1	json	the ConMessage as JSON with the payload embedded as base64, what replicas have always sent
+	2	binary	the canonical binary encoding of the ConMessage and of its payload
+*/
+type Codec interface {
+	Version() uint8
+	Name() string
+	Encode(msg *ConMessage) ([]byte, error)
+	Decode(data []byte) (*ConMessage, error)
+}
+
+const (
+	CodecJSON   uint8 = 1
+	CodecBinary uint8 = 2
+)
+
+// SupportedCodecs lists the codec versions this build speaks, the preferred one last.
+var SupportedCodecs = []uint8{CodecJSON, CodecBinary}
+
+func CodecByVersion(version uint8) (Codec, error) {
+	switch version {
+	case CodecJSON:
+		return JSONCodec{}, nil
+	case CodecBinary:
+		return BinaryCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown codec version[%d]", version)
+}
+
+// Negotiate picks the highest codec version both sides support, both sides get the same answer.
+func Negotiate(local, remote []uint8) (uint8, error) {
+	var best uint8
+	for _, l := range local {
+		for _, r := range remote {
+			if l == r && l > best {
+				best = l
+			}
+		}
+	}
+	if best == 0 {
+		return 0, fmt.Errorf("no common codec in %v and %v", local, remote)
+	}
+	return best, nil
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Version() uint8 {
+	return CodecJSON
+}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Encode(msg *ConMessage) ([]byte, error) {
+	if !msg.decoded() {
+		return json.Marshal(msg)
+	}
+	// a message that came in binary goes on in JSON
+	cp := *msg
+	if err := cp.SetBody(msg.body); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&cp)
+}
+
+func (JSONCodec) Decode(data []byte) (*ConMessage, error) {
+	msg := &ConMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+/*
+BinaryCodec sends the payload in the binary encoding of its message type instead of JSON. A payload that doesn't decode
+as the message its type says can't be encoded, the sender gets an error instead of its peers. Decode hands the message
+on decoded, the replica takes it from Body without decoding the payload again.
+*/
+type BinaryCodec struct{}
+
+func (BinaryCodec) Version() uint8 {
+	return CodecBinary
+}
+
+func (BinaryCodec) Name() string {
+	return "binary"
+}
+
+func (BinaryCodec) Encode(msg *ConMessage) ([]byte, error) {
+	payload, err := msg.CanonicalPayload()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s payload: %w", msg.Typ, err)
+	}
+	cp := *msg
+	cp.Payload = payload
+	return Marshal(&cp)
+}
+
+func (BinaryCodec) Decode(data []byte) (*ConMessage, error) {
+	msg := &ConMessage{}
+	if err := Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	v, err := NewPayload(msg.Typ)
+	if err != nil {
+		return nil, err
+	}
+	if err := Unmarshal(msg.Payload, v); err != nil {
+		return nil, fmt.Errorf("invalid %s payload: %w", msg.Typ, err)
+	}
+	msg.body, msg.bodyTyp = v, msg.Typ
+	return msg, nil
+}
+
+// NewPayload returns a pointer to an empty message of the type a ConMessage of type t carries.
+func NewPayload(t MType) (interface{}, error) {
+	switch t {
+	case MTPrePrepare:
+		return &PrePrepare{}, nil
+	case MTRequest:
+		return &Request{}, nil
+	case MTPrepare:
+		return &Prepare{}, nil
+	case MTCommit:
+		return &Commit{}, nil
+	case MTCheckpoint:
+		return &CheckPoint{}, nil
+	case MTViewChange:
+		return &ViewChange{}, nil
+	case MTNewView:
+		return &NewView{}, nil
+	case MTFetchState:
+		return &FetchState{}, nil
+	case MTStateTransfer:
+		return &StateTransfer{}, nil
+	case MTFetchRequest:
+		return &FetchRequest{}, nil
+	case MTFetchDigests:
+		return &FetchState{}, nil
+	case MTStateDigests:
+		return &StateDigests{}, nil
+	case MTNewKey:
+		return &NewKey{}, nil
+	}
+	return nil, fmt.Errorf("unknown message type[%d]", t)
+}
@@ -0,0 +1,108 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestBinaryCodecHandsOnTheDecodedMessage(t *testing.T) {
+	prepare := &Prepare{ViewID: 1, SequenceID: 7, Digest: "d", NodeID: 2, Sig: []byte{1}}
+	data, err := BinaryCodec{}.Encode(CreateConMsg(MTPrepare, prepare))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := BinaryCodec{}.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canonical, _ := Marshal(prepare); !bytes.Equal(msg.Payload, canonical) {
+		t.Fatal("decoded payload isn't the binary encoding of the message")
+	}
+	if json.Valid(msg.Payload) {
+		t.Fatal("binary codec turned the payload into JSON")
+	}
+	body, err := msg.Body()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(body, prepare) {
+		t.Fatalf("body %+v, want %+v", body, prepare)
+	}
+
+	// relayed to a peer that only speaks JSON
+	data, err = JSONCodec{}.Encode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayed, err := JSONCodec{}.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := relayed.Body(); err != nil || !reflect.DeepEqual(body, prepare) {
+		t.Fatalf("relayed body %+v (%v), want %+v", body, err, prepare)
+	}
+}
+
+func TestViewChangeDigestCoversTheMessage(t *testing.T) {
+	vc := &ViewChange{NewViewID: 1, LastCPSeq: 2, NodeID: 3, PMsg: map[int64]*PTuple{}}
+	other := &ViewChange{NewViewID: 1, LastCPSeq: 2, NodeID: 3, PMsg: map[int64]*PTuple{
+		3: {PPMsg: &PrePrepare{SequenceID: 3, Digest: "d"}},
+	}}
+	if vc.Digest() != Digest(vc) {
+		t.Fatal("view change digest isn't the digest of its canonical encoding")
+	}
+	if vc.Digest() == other.Digest() {
+		t.Fatal("view changes with different prepared requests have the same digest")
+	}
+}
+
+func TestOMessagesAreEqualOnlyWithTheSamePrePrepares(t *testing.T) {
+	o := OMessage{1: {ViewID: 1, SequenceID: 1, Digest: "d"}, 2: {ViewID: 1, SequenceID: 2}}
+	same := OMessage{1: {ViewID: 1, SequenceID: 1, Digest: "d"}, 2: {ViewID: 1, SequenceID: 2}}
+	if !o.EQ(same) {
+		t.Fatal("equal pre-prepares differ")
+	}
+	for _, other := range []OMessage{
+		{1: {ViewID: 1, SequenceID: 1, Digest: "d"}},
+		{1: {ViewID: 1, SequenceID: 1, Digest: "forged"}, 2: {ViewID: 1, SequenceID: 2}},
+		{1: {ViewID: 1, SequenceID: 1, Digest: "d"}, 3: {ViewID: 1, SequenceID: 2}},
+		{1: {ViewID: 2, SequenceID: 1, Digest: "d"}, 2: {ViewID: 1, SequenceID: 2}},
+	} {
+		if o.EQ(other) {
+			t.Fatalf("%v equals %v", other, o)
+		}
+	}
+}
+
+func TestDecodingRefusesEnumsTheirTypeCantHold(t *testing.T) {
+	wire, err := Marshal(&ConMessage{Typ: MTPrepare})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the type is the first field of a ConMessage
+	typ := append(binary.AppendUvarint(nil, math.MaxInt16+1), wire[1:]...)
+	if err := Unmarshal(typ, &ConMessage{}); !errors.Is(err, ErrNotCanonical) {
+		t.Fatalf("message type out of range decoded: %v", err)
+	}
+
+	plain, _ := Marshal(&Request{})
+	request, err := Marshal(&Request{Reconfig: &Reconfig{Op: RCAddReplica}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the operation follows the presence byte of the reconfiguration, one byte before the end of a plain request
+	at := len(plain) - 1
+	op := append(append(append([]byte(nil), request[:at]...), binary.AppendVarint(nil, math.MaxInt8+1)...),
+		request[at+1:]...)
+	if err := Unmarshal(op, &Request{}); !errors.Is(err, ErrNotCanonical) {
+		t.Fatalf("reconfiguration op out of range decoded: %v", err)
+	}
+	if err := Unmarshal(request, &Request{}); err != nil {
+		t.Fatal(err)
+	}
+}
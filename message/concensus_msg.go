@@ -11,6 +11,20 @@ type ConMessage struct {
 	From    uint   `json:"from"`
 	To      uint   `json:"to"`
 	Payload []byte `json:"payload"`
+	TraceID string `json:"traceID,omitempty"`
+	// Auth is the authenticator: a MAC for every replica the message is sent to, see package auth.
+	Auth map[int64]*MAC `json:"auth,omitempty"`
+
+	// body is the message a codec decoded the payload into when the message was of type bodyTyp, Payload then holds
+	// the encoding of that codec instead of JSON.
+	body    interface{}
+	bodyTyp MType
+}
+
+// MAC authenticates a ConMessage to one receiver, under the session key that receiver handed out at KeyTime.
+type MAC struct {
+	KeyTime int64  `json:"t"`
+	Sum     []byte `json:"sum"`
 }
 
 func (cm *ConMessage) String() string {
@@ -30,6 +44,51 @@ func (cm *ConMessage) Verify() bool {
 	return true
 }
 
+func (cm *ConMessage) decoded() bool {
+	return cm.body != nil && cm.bodyTyp == cm.Typ
+}
+
+/*
+Body returns the message cm carries, a pointer of the type NewPayload returns for cm.Typ: the one the codec decoded when
+cm came off the wire in binary, its JSON payload decoded otherwise.
+*/
+func (cm *ConMessage) Body() (interface{}, error) {
+	if cm.decoded() {
+		return cm.body, nil
+	}
+	v, err := NewPayload(cm.Typ)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(cm.Payload, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// SetBody makes v, a message of the type cm.Typ carries, the payload of cm.
+func (cm *ConMessage) SetBody(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	cm.Payload = data
+	cm.body = nil
+	return nil
+}
+
+// CanonicalPayload returns the canonical binary encoding of the message cm carries, the same whatever codec carried it.
+func (cm *ConMessage) CanonicalPayload() ([]byte, error) {
+	if cm.decoded() {
+		return cm.Payload, nil
+	}
+	v, err := cm.Body()
+	if err != nil {
+		return nil, err
+	}
+	return Marshal(v)
+}
+
 func CreateConMsg(t MType, msg interface{}) *ConMessage {
 	data, e := json.Marshal(msg)
 	if e != nil {
@@ -48,6 +107,10 @@ func CreateConMsg(t MType, msg interface{}) *ConMessage {
 type RequestRecord struct {
 	*PrePrepare
 	*Request
+	Tentative bool
+	// State, in a record without a Request, is the application state at SequenceID the replica installed with a stable
+	// checkpoint instead of executing the requests up to it. The executor restores it.
+	State []byte
 }
 
 type PrePrepare struct {
@@ -56,12 +119,14 @@ type PrePrepare struct {
 	Digest     string `json:"digest"`
 }
 
+// Sig of Prepare, Commit and CheckPoint is the vote of NodeID when the replicas certify quorums, see QuorumCert.
 type PrepareMsg map[int64]*Prepare
 type Prepare struct {
 	ViewID     int64  `json:"viewID"`
 	SequenceID int64  `json:"sequenceID"`
 	Digest     string `json:"digest"`
 	NodeID     int64  `json:"nodeID"`
+	Sig        []byte `json:"sig,omitempty"`
 }
 
 type Commit struct {
@@ -69,6 +134,7 @@ type Commit struct {
 	SequenceID int64  `json:"sequenceID"`
 	Digest     string `json:"digest"`
 	NodeID     int64  `json:"nodeID"`
+	Sig        []byte `json:"sig,omitempty"`
 }
 
 type CheckPoint struct {
@@ -76,35 +142,195 @@ type CheckPoint struct {
 	Digest     string `json:"digest"`
 	ViewID     int64  `json:"viewID"`
 	NodeID     int64  `json:"nodeID"`
+	Sig        []byte `json:"sig,omitempty"`
 }
+
+/*
+QuorumCert proves a quorum of replicas voted for one statement: the Typ, ViewID, SequenceID and Digest of a prepare,
+commit or checkpoint. Sig is the aggregate of the votes of the replicas in Signers, a bitmap by node id, so the
+certificate has the same size however many replicas signed. Checkpoints are voted for without a view, ViewID is 0 in
+their certificates.
+*/
+type QuorumCert struct {
+	Typ        MType  `json:"type"`
+	ViewID     int64  `json:"viewID"`
+	SequenceID int64  `json:"sequenceID"`
+	Digest     string `json:"digest"`
+	Signers    []byte `json:"signers"`
+	Sig        []byte `json:"sig"`
+}
+
+// SignerIDs lists the replicas in Signers by ascending id.
+func (qc *QuorumCert) SignerIDs() []int64 {
+	var ids []int64
+	for i, b := range qc.Signers {
+		for j := 0; j < 8; j++ {
+			if b&(1<<j) != 0 {
+				ids = append(ids, int64(i*8+j))
+			}
+		}
+	}
+	return ids
+}
+
+// SetSigners sets the bitmap of Signers to ids, which aren't negative.
+func (qc *QuorumCert) SetSigners(ids []int64) {
+	qc.Signers = nil
+	for _, id := range ids {
+		for int64(len(qc.Signers)) <= id/8 {
+			qc.Signers = append(qc.Signers, 0)
+		}
+		qc.Signers[id/8] |= 1 << (id % 8)
+	}
+}
+
+type ClientEntry struct {
+	ClientID  string `json:"clientID"`
+	TimeStamp int64  `json:"timestamp"`
+	Reply     *Reply `json:"reply"`
+}
+
+/*
+FetchState asks a peer for the state at the stable checkpoint SequenceID with digest Digest. A recovering replica only
+asks for the Partitions of the client table and the Pages of the application state it found corrupt, without either
+the whole state is sent. MTFetchDigests carries a FetchState too, to ask every peer for the StateDigests of its last
+stable checkpoint.
+*/
+type FetchState struct {
+	SequenceID int64   `json:"sequenceID"`
+	Digest     string  `json:"digest"`
+	NodeID     int64   `json:"nodeID"`
+	Partitions []int64 `json:"partitions,omitempty"`
+	Pages      []int64 `json:"pages,omitempty"`
+}
+
+// FetchRequest asks the peers for the body of the request with digest Digest that was ordered at SequenceID.
+type FetchRequest struct {
+	SequenceID int64  `json:"sequenceID"`
+	Digest     string `json:"digest"`
+	NodeID     int64  `json:"nodeID"`
+}
+
+/*
+StateTransfer is the state at the stable checkpoint SequenceID: the client table, the configuration and the application
+State. The answer to a FetchState that asked for Partitions and Pages only has the clients of those partitions and
+those pages of the application state.
+*/
+type StateTransfer struct {
+	SequenceID int64            `json:"sequenceID"`
+	Digest     string           `json:"digest"`
+	NodeID     int64            `json:"nodeID"`
+	Clients    []*ClientEntry   `json:"clients"`
+	Config     *Config          `json:"config,omitempty"`
+	Partitions []int64          `json:"partitions,omitempty"`
+	State      []byte           `json:"state,omitempty"`
+	Pages      map[int64][]byte `json:"pages,omitempty"`
+}
+
+// Partial reports whether the transfer only has the parts of the state a recovering replica asked for.
+func (st *StateTransfer) Partial() bool {
+	return len(st.Partitions) > 0 || len(st.Pages) > 0
+}
+
+/*
+StateDigests is the digest tree of the state at a replica's last stable checkpoint: the digest of every partition of
+the client table, the digest of every page of the application state, the configuration, and the checkpoint messages
+that made it stable. Digest is computed from the partition and page digests and the configuration, so they are checked
+against it before anything else. A replica without a stable checkpoint answers with SequenceID 0 and no digest.
+*/
+type StateDigests struct {
+	SequenceID int64                 `json:"sequenceID"`
+	Digest     string                `json:"digest"`
+	NodeID     int64                 `json:"nodeID"`
+	Partitions []string              `json:"partitions"`
+	Pages      []string              `json:"pages,omitempty"`
+	Config     *Config               `json:"config,omitempty"`
+	Checks     map[int64]*CheckPoint `json:"checks,omitempty"`
+}
+
+/*
+NewKey hands out the session keys of replica NodeID: Keys[j] is the key replica j authenticates its messages to NodeID
+with from now on, encrypted under the public key of j and Ephemeral. Timestamp only grows, a NEW-KEY that isn't newer
+than the last one taken from NodeID is a replay. Sig is the signature of NodeID over the message without Sig.
+*/
+type NewKey struct {
+	NodeID    int64            `json:"nodeID"`
+	Timestamp int64            `json:"timestamp"`
+	Ephemeral []byte           `json:"ephemeral"`
+	Keys      map[int64][]byte `json:"keys"`
+	Sig       []byte           `json:"sig,omitempty"`
+}
+
+// PTuple proves the pre-prepare PPMsg prepared, by the prepares in PMsg or, when quorums are certified, by Cert.
 type PTuple struct {
 	PPMsg *PrePrepare `json:"pre-prepare"`
 	PMsg  PrepareMsg  `json:"prepare"`
+	Cert  *QuorumCert `json:"cert,omitempty"`
 }
 
+// ViewChange proves its checkpoint is stable by the checkpoint messages in CMsg or, when quorums are certified, by CCert.
 type ViewChange struct {
 	NewViewID int64                 `json:"newViewID"`
 	LastCPSeq int64                 `json:"lastCPSeq"`
 	NodeID    int64                 `json:"nodeID"`
 	CMsg      map[int64]*CheckPoint `json:"cMsg"`
 	PMsg      map[int64]*PTuple     `json:"pMsg"`
+	CCert     *QuorumCert           `json:"cCert,omitempty"`
 }
 
 func (vc *ViewChange) Digest() string {
-	return fmt.Sprintf("this is digest for[%d-%d]", vc.NewViewID, vc.LastCPSeq)
+	return Digest(vc)
 }
 
 type OMessage map[int64]*PrePrepare
 
+// Seqs returns the sequence numbers in m in increasing order.
+func (m OMessage) Seqs() []int64 {
+	return sortedKeys(len(m), func(f func(int64)) {
+		for k := range m {
+			f(k)
+		}
+	})
+}
+
+// EQ reports whether m and msg pre-prepare the same requests at the same sequence numbers in the same view.
 func (m OMessage) EQ(msg OMessage) bool {
-	//return HASH(m) == HASH(msg)
+	if len(m) != len(msg) {
+		return false
+	}
+	for seq, pp := range m {
+		other, ok := msg[seq]
+		if !ok || (pp == nil) != (other == nil) {
+			return false
+		}
+		if pp != nil && *pp != *other {
+			return false
+		}
+	}
 	return true
 }
 
 type VMessage map[int64]*ViewChange
+
+// IDs returns the replicas in m in increasing order.
+func (m VMessage) IDs() []int64 {
+	return sortedKeys(len(m), func(f func(int64)) {
+		for k := range m {
+			f(k)
+		}
+	})
+}
+
+/*
+NewView justifies O and N by the view changes in VMsg or, when quorums are certified, by the certificates they were
+taken from: CCert of the checkpoint the new view starts at and in PMsg the prepare certificate of every request O
+orders again, so its size doesn't grow with the number of replicas.
+*/
 type NewView struct {
-	NewViewID int64    `json:"newViewID"`
-	VMsg      VMessage `json:"vMSG"`
-	OMsg      OMessage `json:"oMSG"`
-	NMsg      OMessage `json:"nMSG"`
+	NewViewID int64             `json:"newViewID"`
+	VMsg      VMessage          `json:"vMSG"`
+	OMsg      OMessage          `json:"oMSG"`
+	NMsg      OMessage          `json:"nMSG"`
+	CCert     *QuorumCert       `json:"cCert,omitempty"`
+	PMsg      map[int64]*PTuple `json:"pMsg,omitempty"`
 }
@@ -0,0 +1,206 @@
+package message
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+Config is the membership of the cluster: the replicas, the number of faults f it tolerates and the public key of every
+replica. Epoch counts the reconfigurations that led to it. A quorum is 2f+1 replicas whatever the number of replicas,
+the primary of view v is the replica at v modulo the number of replicas in ascending order of ids.
+*/
+type Config struct {
+	Epoch    int64            `json:"epoch"`
+	F        int64            `json:"f"`
+	Replicas []int64          `json:"replicas"`
+	Keys     map[int64]string `json:"keys,omitempty"`
+	// Votes is the public key every replica signs its votes with when quorums are certified, see package quorum.
+	Votes map[int64]string `json:"votes,omitempty"`
+	// Operators are the clients that may reconfigure the cluster, by client id the ed25519 key they sign requests with.
+	Operators map[string]string `json:"operators,omitempty"`
+}
+
+// DefaultConfig is the membership replicas start with: TotalNodeNO replicas with ids from 0 tolerating MaxFaultyNode.
+func DefaultConfig() *Config {
+	c := &Config{
+		F:        MaxFaultyNode,
+		Replicas: make([]int64, TotalNodeNO),
+		Keys:     make(map[int64]string),
+	}
+	for i := range c.Replicas {
+		c.Replicas[i] = int64(i)
+	}
+	return c
+}
+
+func (c *Config) N() int64 {
+	return int64(len(c.Replicas))
+}
+
+func (c *Config) Quorum() int {
+	return int(2*c.F + 1)
+}
+
+func (c *Config) Primary(view int64) int64 {
+	i := view % c.N()
+	if i < 0 {
+		i += c.N()
+	}
+	return c.Replicas[i]
+}
+
+func (c *Config) Contains(id int64) bool {
+	i := sort.Search(len(c.Replicas), func(i int) bool { return c.Replicas[i] >= id })
+	return i < len(c.Replicas) && c.Replicas[i] == id
+}
+
+// Valid reports whether c is a configuration replicas can run with, a configuration from a peer is checked with it.
+func (c *Config) Valid() error {
+	if c.F < 0 || c.N() < 3*c.F+1 {
+		return fmt.Errorf("%s can't tolerate %d faults", c, c.F)
+	}
+	for i := 1; i < len(c.Replicas); i++ {
+		if c.Replicas[i] <= c.Replicas[i-1] {
+			return fmt.Errorf("replicas of %s aren't strictly ascending", c)
+		}
+	}
+	return nil
+}
+
+func (c *Config) Copy() *Config {
+	cp := &Config{
+		Epoch:    c.Epoch,
+		F:        c.F,
+		Replicas: append([]int64(nil), c.Replicas...),
+		Keys:     make(map[int64]string, len(c.Keys)),
+	}
+	for id, key := range c.Keys {
+		cp.Keys[id] = key
+	}
+	if c.Votes != nil {
+		cp.Votes = make(map[int64]string, len(c.Votes))
+		for id, key := range c.Votes {
+			cp.Votes[id] = key
+		}
+	}
+	if c.Operators != nil {
+		cp.Operators = make(map[string]string, len(c.Operators))
+		for id, key := range c.Operators {
+			cp.Operators[id] = key
+		}
+	}
+	return cp
+}
+
+func (c *Config) String() string {
+	return fmt.Sprintf("epoch[%d] f[%d] replicas%v", c.Epoch, c.F, c.Replicas)
+}
+
+type ReconfigOp int8
+
+const (
+	RCAddReplica ReconfigOp = iota + 1
+	RCRemoveReplica
+	RCChangeF
+	RCRotateKey
+)
+
+func (op ReconfigOp) String() string {
+	switch op {
+	case RCAddReplica:
+		return "AddReplica"
+	case RCRemoveReplica:
+		return "RemoveReplica"
+	case RCChangeF:
+		return "ChangeF"
+	case RCRotateKey:
+		return "RotateKey"
+	}
+	return "Unknown"
+}
+
+/*
+Reconfig is a change of membership a client asks for in Request.Reconfig. It is ordered like any other request; NodeID
+names the replica added, removed or given a new Key or Vote key, F is the new number of tolerated faults.
+*/
+type Reconfig struct {
+	Op     ReconfigOp `json:"op"`
+	NodeID int64      `json:"nodeID,omitempty"`
+	F      int64      `json:"f,omitempty"`
+	Key    string     `json:"key,omitempty"`
+	Vote   string     `json:"vote,omitempty"`
+}
+
+func (rc *Reconfig) String() string {
+	switch rc.Op {
+	case RCChangeF:
+		return fmt.Sprintf("%s[%d]", rc.Op, rc.F)
+	}
+	return fmt.Sprintf("%s[%d]", rc.Op, rc.NodeID)
+}
+
+// Apply returns the configuration of the next epoch with rc applied, or why rc can't be applied to c.
+func (c *Config) Apply(rc *Reconfig) (*Config, error) {
+	next := c.Copy()
+	next.Epoch++
+	switch rc.Op {
+	case RCAddReplica:
+		if rc.NodeID < 0 || c.Contains(rc.NodeID) {
+			return nil, fmt.Errorf("replica[%d] can't be added to %s", rc.NodeID, c)
+		}
+		next.Replicas = append(next.Replicas, rc.NodeID)
+		sort.Slice(next.Replicas, func(i, j int) bool { return next.Replicas[i] < next.Replicas[j] })
+		if rc.Key != "" {
+			next.Keys[rc.NodeID] = rc.Key
+		}
+		next.setVote(rc.NodeID, rc.Vote)
+	case RCRemoveReplica:
+		if !c.Contains(rc.NodeID) {
+			return nil, fmt.Errorf("replica[%d] isn't in %s", rc.NodeID, c)
+		}
+		replicas := next.Replicas[:0]
+		for _, id := range next.Replicas {
+			if id != rc.NodeID {
+				replicas = append(replicas, id)
+			}
+		}
+		next.Replicas = replicas
+		delete(next.Keys, rc.NodeID)
+		delete(next.Votes, rc.NodeID)
+	case RCChangeF:
+		if rc.F < 0 {
+			return nil, fmt.Errorf("invalid f[%d]", rc.F)
+		}
+		next.F = rc.F
+	case RCRotateKey:
+		if !c.Contains(rc.NodeID) || rc.Key == "" && rc.Vote == "" {
+			return nil, fmt.Errorf("no new key for replica[%d] in %s", rc.NodeID, c)
+		}
+		if rc.Key != "" {
+			next.Keys[rc.NodeID] = rc.Key
+		}
+		next.setVote(rc.NodeID, rc.Vote)
+	default:
+		return nil, fmt.Errorf("unknown reconfiguration[%d]", rc.Op)
+	}
+	if next.N() < 3*next.F+1 {
+		return nil, fmt.Errorf("%s needs at least %d replicas to tolerate %d faults", rc, 3*next.F+1, next.F)
+	}
+	// fewer faults than the replicas can tolerate make quorums smaller than a third of them plus one can be trusted
+	if (rc.Op == RCChangeF || rc.Op == RCRemoveReplica) && next.F < (next.N()-1)/3 {
+		return nil, fmt.Errorf("%s leaves %d replicas tolerating %d faults instead of %d", rc, next.N(), next.F,
+			(next.N()-1)/3)
+	}
+	return next, nil
+}
+
+func (c *Config) setVote(id int64, vote string) {
+	if vote == "" {
+		return
+	}
+	if c.Votes == nil {
+		c.Votes = make(map[int64]string)
+	}
+	c.Votes[id] = vote
+}
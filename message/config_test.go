@@ -0,0 +1,44 @@
+package message
+
+import "testing"
+
+func TestApplyKeepsTheFaultsTheReplicasCanTolerate(t *testing.T) {
+	eight := DefaultConfig()
+	for id := int64(4); id < 8; id++ {
+		next, err := eight.Apply(&Reconfig{Op: RCAddReplica, NodeID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		eight = next
+	}
+	for _, tc := range []struct {
+		name   string
+		config *Config
+		rc     *Reconfig
+		ok     bool
+	}{
+		{"f lowered to 0", DefaultConfig(), &Reconfig{Op: RCChangeF, F: 0}, false},
+		{"f raised past the replicas", DefaultConfig(), &Reconfig{Op: RCChangeF, F: 2}, false},
+		{"replica removed below 3f+1", DefaultConfig(), &Reconfig{Op: RCRemoveReplica, NodeID: 3}, false},
+		{"replica removed leaving f too low", eight, &Reconfig{Op: RCRemoveReplica, NodeID: 7}, false},
+		{"f raised to what the replicas tolerate", eight, &Reconfig{Op: RCChangeF, F: 2}, true},
+		{"replica added", DefaultConfig(), &Reconfig{Op: RCAddReplica, NodeID: 4}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.config.Apply(tc.rc)
+			if (err == nil) != tc.ok {
+				t.Fatalf("%s applied to %s: %v", tc.rc, tc.config, err)
+			}
+		})
+	}
+}
+
+func TestConfigCopyKeepsTheOperators(t *testing.T) {
+	c := DefaultConfig()
+	c.Operators = map[string]string{"admin": "key"}
+	cp := c.Copy()
+	cp.Operators["admin"] = "other"
+	if c.Operators["admin"] != "key" {
+		t.Fatal("copy shares the operators of the original")
+	}
+}
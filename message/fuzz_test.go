@@ -0,0 +1,202 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+/*
+The fuzz targets hand every decoder of the package bytes from a peer. A decoder may refuse them, it must never crash,
+and what it accepts has to encode again and decode to the same message.
+
+	go test ./message -run '^$' -fuzz FuzzBinaryCodec
+*/
+
+// samples returns a well-formed message of every type with a binary encoding.
+func samples() []interface{} {
+	request := &Request{SeqID: 1, TimeStamp: 1, ClientID: "client-0", Operation: "op",
+		Reconfig: &Reconfig{Op: 1, NodeID: 4, F: 1, Key: "key"}}
+	digest := Digest(request)
+	reply := &Reply{SeqID: 1, ViewID: 0, Timestamp: 1, ClientID: "client-0", NodeID: 1, Result: "ok"}
+	cp := &CheckPoint{SequenceID: 2, Digest: "state", NodeID: 1, Sig: []byte{1, 2}}
+	pt := &PTuple{
+		PPMsg: &PrePrepare{SequenceID: 1, Digest: digest},
+		PMsg:  PrepareMsg{2: {SequenceID: 1, Digest: digest, NodeID: 2}, 3: {SequenceID: 1, Digest: digest, NodeID: 3}},
+	}
+	config := DefaultConfig()
+	config.Operators = map[string]string{"admin": "key", "ops": "other"}
+	qc := &QuorumCert{Typ: MTCheckpoint, SequenceID: 2, Digest: "state", Sig: []byte{3}}
+	qc.SetSigners([]int64{0, 1, 2})
+	vc := &ViewChange{NewViewID: 1, LastCPSeq: 2, NodeID: 1, CCert: qc, PMsg: map[int64]*PTuple{1: pt},
+		CMsg: map[int64]*CheckPoint{1: cp}}
+	return []interface{}{
+		request,
+		reply,
+		&PrePrepare{ViewID: 0, SequenceID: 1, Digest: digest},
+		&Prepare{ViewID: 0, SequenceID: 1, Digest: digest, NodeID: 2, Sig: []byte{4}},
+		&Commit{ViewID: 0, SequenceID: 1, Digest: digest, NodeID: 3},
+		cp,
+		&ClientEntry{ClientID: "client-0", TimeStamp: 1, Reply: reply},
+		&FetchState{SequenceID: 2, Digest: "state", NodeID: 2, Pages: []int64{1}},
+		&FetchRequest{SequenceID: 1, Digest: digest, NodeID: 2},
+		&StateTransfer{SequenceID: 2, Digest: "state", NodeID: 2, Config: DefaultConfig(), Partitions: []int64{0, 3},
+			Clients: []*ClientEntry{{ClientID: "client-0", TimeStamp: 1, Reply: reply}}, State: []byte("app"),
+			Pages: map[int64][]byte{0: []byte("page0"), 2: []byte("page2")}},
+		&StateDigests{SequenceID: 2, Digest: "state", NodeID: 2, Config: DefaultConfig(), Partitions: []string{"p0"},
+			Pages: []string{"page0"}, Checks: map[int64]*CheckPoint{1: cp}},
+		&NewKey{NodeID: 1, Timestamp: 5, Ephemeral: []byte{5}, Keys: map[int64][]byte{0: {6}, 2: {7}}, Sig: []byte{8}},
+		config,
+		pt,
+		vc,
+		&NewView{NewViewID: 1, VMsg: VMessage{1: vc}, OMsg: OMessage{1: {ViewID: 1, SequenceID: 1, Digest: digest}},
+			NMsg: OMessage{}, CCert: qc, PMsg: map[int64]*PTuple{1: pt}},
+		&ConMessage{Typ: MTPrepare, Sig: "sig", From: 2, Payload: []byte("{}"), TraceID: "trace",
+			Auth: map[int64]*MAC{0: {KeyTime: 1, Sum: []byte{9}}, 1: nil}},
+	}
+}
+
+// newSample returns an empty message of the type of samples()[i % 17].
+func newSample(i uint8) interface{} {
+	switch i % 17 {
+	case 0:
+		return &Request{}
+	case 1:
+		return &Reply{}
+	case 2:
+		return &PrePrepare{}
+	case 3:
+		return &Prepare{}
+	case 4:
+		return &Commit{}
+	case 5:
+		return &CheckPoint{}
+	case 6:
+		return &ClientEntry{}
+	case 7:
+		return &FetchState{}
+	case 8:
+		return &FetchRequest{}
+	case 9:
+		return &StateTransfer{}
+	case 10:
+		return &StateDigests{}
+	case 11:
+		return &NewKey{}
+	case 12:
+		return &Config{}
+	case 13:
+		return &PTuple{}
+	case 14:
+		return &ViewChange{}
+	case 15:
+		return &NewView{}
+	}
+	return &ConMessage{}
+}
+
+// conMessages returns the samples that travel in a ConMessage, wrapped in one of every type that carries them.
+func conMessages() []*ConMessage {
+	msgs := make([]*ConMessage, 0)
+	for _, v := range samples() {
+		for t := MTPrePrepare; t <= MTNewKey; t++ {
+			if p, err := NewPayload(t); err == nil && fmt.Sprintf("%T", p) == fmt.Sprintf("%T", v) {
+				msgs = append(msgs, CreateConMsg(t, v))
+			}
+		}
+	}
+	return msgs
+}
+
+func TestSamplesCoverEveryType(t *testing.T) {
+	for i, v := range samples() {
+		if want := newSample(uint8(i)); fmt.Sprintf("%T", want) != fmt.Sprintf("%T", v) {
+			t.Fatalf("sample %d is a %T, newSample(%d) a %T", i, v, i, want)
+		}
+	}
+	if n := len(conMessages()); n != 13 {
+		t.Fatalf("%d message types travel in a ConMessage, want 13", n)
+	}
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for i, v := range samples() {
+		data, err := Marshal(v)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(uint8(i), data)
+	}
+	f.Fuzz(func(t *testing.T, typ uint8, data []byte) {
+		v := newSample(typ)
+		if Unmarshal(data, v) != nil {
+			return
+		}
+		enc, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("decoded %T doesn't encode: %v", v, err)
+		}
+		if !bytes.Equal(enc, data) {
+			t.Fatalf("%T decoded from an encoding that isn't canonical", v)
+		}
+		again := newSample(typ)
+		if err := Unmarshal(enc, again); err != nil {
+			t.Fatalf("encoding of a decoded %T doesn't decode: %v", v, err)
+		}
+		if enc2, _ := Marshal(again); !bytes.Equal(enc, enc2) {
+			t.Fatalf("%T changed on the way through the encoding", v)
+		}
+	})
+}
+
+func FuzzJSONCodec(f *testing.F) {
+	for _, m := range conMessages() {
+		data, err := JSONCodec{}.Encode(m)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		roundTrip(t, JSONCodec{}, data)
+	})
+}
+
+func FuzzBinaryCodec(f *testing.F) {
+	for _, m := range conMessages() {
+		data, err := BinaryCodec{}.Encode(m)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		roundTrip(t, BinaryCodec{}, data)
+		m, err := BinaryCodec{}.Decode(data)
+		if err != nil {
+			return
+		}
+		if enc, err := (BinaryCodec{}).Encode(m); err != nil || !bytes.Equal(enc, data) {
+			t.Fatal("binary codec decoded an encoding that isn't canonical")
+		}
+	})
+}
+
+// roundTrip decodes data with c and checks that what decodes encodes again to a message that decodes the same.
+func roundTrip(t *testing.T, c Codec, data []byte) {
+	m, err := c.Decode(data)
+	if err != nil {
+		return
+	}
+	enc, err := c.Encode(m)
+	if err != nil {
+		t.Fatalf("decoded message doesn't encode with the %s codec: %v", c.Name(), err)
+	}
+	again, err := c.Decode(enc)
+	if err != nil {
+		t.Fatalf("%s encoding of a decoded message doesn't decode: %v", c.Name(), err)
+	}
+	if enc2, err := c.Encode(again); err != nil || !bytes.Equal(enc, enc2) {
+		t.Fatalf("message changed on the way through the %s codec", c.Name())
+	}
+}
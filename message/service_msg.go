@@ -1,6 +1,9 @@
 package message
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 )
 
@@ -14,18 +17,54 @@ const (
 	MTCheckpoint
 	MTViewChange
 	MTNewView
+	MTFetchState
+	MTStateTransfer
+	MTFetchRequest
+	MTFetchDigests
+	MTStateDigests
+	MTNewKey
 )
 const MaxFaultyNode = 1
 const TotalNodeNO = 3*MaxFaultyNode + 1
 
+const (
+	// RejectQueueFull is the Reply.Result a replica sends when it has to drop a
+	// request because its wait queue is full.
+	RejectQueueFull = "rejected: wait queue is full"
+	// RejectDraining is the Reply.Result a replica sends for new requests once an
+	// operator has started draining it.
+	RejectDraining = "rejected: replica is draining"
+	// RejectNotReadOnly is the Reply.Result a replica sends for a read-only request
+	// whose operation the service doesn't know to leave its state untouched.
+	RejectNotReadOnly = "rejected: operation isn't read-only"
+)
+
+/*
+Digest is the SHA-256 of the canonical binary encoding of v, so every implementation computes the same digest for the
+same message. A value without a binary encoding is digested as JSON.
+*/
 func Digest(v interface{}) string {
-	return "0x111111"
+	data, err := Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(v)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
 func PortByID(id int64) int {
 	return 30000 + int(id)
 }
 
+func HTTPPortByID(id int64) int {
+	return 31000 + int(id)
+}
+
+// BulkPortByID is where a replica takes request bodies from its peers, apart from the consensus messages on PortByID.
+func BulkPortByID(id int64) int {
+	return 32000 + int(id)
+}
+
 func (mt MType) String() string {
 	switch mt {
 	case MTPrePrepare:
@@ -48,6 +87,24 @@ func (mt MType) String() string {
 
 	case MTNewView:
 		return "NewView"
+
+	case MTFetchState:
+		return "FetchState"
+
+	case MTStateTransfer:
+		return "StateTransfer"
+
+	case MTFetchRequest:
+		return "FetchRequest"
+
+	case MTFetchDigests:
+		return "FetchDigests"
+
+	case MTStateDigests:
+		return "StateDigests"
+
+	case MTNewKey:
+		return "NewKey"
 	}
 	return "Unknown"
 }
@@ -57,15 +114,37 @@ type Request struct {
 	TimeStamp int64  `json:"timestamp"`
 	ClientID  string `json:"clientID"`
 	Operation string `json:"operation"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+
+	DigestReply bool  `json:"digestReply,omitempty"`
+	Replier     int64 `json:"replier,omitempty"`
+
+	TraceID string `json:"traceID,omitempty"`
+
+	// Reconfig makes the request a change of membership, the engine executes it instead of the service.
+	Reconfig *Reconfig `json:"reconfig,omitempty"`
+
+	// Sig is the client's signature of the request, see auth.SignRequest.
+	Sig string `json:"sig,omitempty"`
 }
 
 func (r *Request) String() string {
 	return fmt.Sprintf("\n clientID:%20s"+
 		"\n time:%d"+
-		"\n operation:%s",
+		"\n operation:%s"+
+		"\n endpoint:%s"+
+		"\n read only:%t"+
+		"\n digest reply:%t replier:%d"+
+		"\n trace:%s",
 		r.ClientID,
 		r.TimeStamp,
-		r.Operation)
+		r.Operation,
+		r.Endpoint,
+		r.ReadOnly,
+		r.DigestReply,
+		r.Replier,
+		r.TraceID)
 }
 
 type Reply struct {
@@ -75,4 +154,27 @@ type Reply struct {
 	ClientID  string `json:"clientID"`
 	NodeID    int64  `json:"nodeID"`
 	Result    string `json:"result"`
+	Tentative bool   `json:"tentative,omitempty"`
+
+	ResultDigest string `json:"resultDigest,omitempty"`
+}
+
+func ResultDigest(result string) string {
+	sum := sha256.Sum256([]byte(result))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+A client may ask a designated replica to send the result and all the others to send only its digest, this saves
+network bandwidth when the result is large. ForRequest returns the reply the replica sends for r: the reply itself if it
+is the designated replier, otherwise a copy carrying only the digest of the result.
+*/
+func (rp *Reply) ForRequest(r *Request) *Reply {
+	if r == nil || !r.DigestReply || r.Replier == rp.NodeID {
+		return rp
+	}
+	dr := *rp
+	dr.ResultDigest = ResultDigest(rp.Result)
+	dr.Result = ""
+	return &dr
 }
@@ -0,0 +1,317 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+A minimal registry of counters, gauges and histograms that is rendered in the Prometheus text exposition format, so
+a replica can be scraped without pulling in the Prometheus client library.
+*/
+
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	collectors []collector
+	names      map[string]bool
+
+	mu sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make([]collector, 0),
+		names:      make(map[string]bool),
+	}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric[%s] registered twice", name))
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+func labelString(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", n, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+type Counter struct {
+	value float64
+
+	mu sync.Mutex
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	c.mu.Lock()
+	c.value += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) Value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+type CounterVec struct {
+	desc
+	children map[string]*Counter
+	values   map[string][]string
+
+	mu sync.Mutex
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{
+		desc:     desc{name: name, help: help, typ: "counter", labels: labels},
+		children: make(map[string]*Counter),
+		values:   make(map[string][]string),
+	}
+	r.register(name, cv)
+	return cv
+}
+
+func (cv *CounterVec) With(values ...string) *Counter {
+	if len(values) != len(cv.labels) {
+		panic(fmt.Sprintf("metric[%s] wants %d label values, got %d", cv.name, len(cv.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	c, ok := cv.children[key]
+	if !ok {
+		c = &Counter{}
+		cv.children[key] = c
+		cv.values[key] = values
+	}
+	return c
+}
+
+func (cv *CounterVec) write(w io.Writer) {
+	cv.header(w)
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	for _, key := range sortedKeys(cv.values) {
+		fmt.Fprintf(w, "%s%s %s\n", cv.name, labelString(cv.labels, cv.values[key]), formatFloat(cv.children[key].Value()))
+	}
+}
+
+type Gauge struct {
+	desc
+	value float64
+	fn    func() float64
+
+	mu sync.Mutex
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{
+		desc: desc{name: name, help: help, typ: "gauge"},
+	}
+	r.register(name, g)
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn every time the registry is scraped.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) *Gauge {
+	g := r.NewGauge(name, help)
+	g.fn = fn
+	return g
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.value = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(v float64) {
+	g.mu.Lock()
+	g.value += v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Value() float64 {
+	if g.fn != nil {
+		return g.fn()
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.header(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.Value()))
+}
+
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+
+	mu sync.Mutex
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type HistogramVec struct {
+	desc
+	buckets  []float64
+	children map[string]*Histogram
+	values   map[string][]string
+
+	mu sync.Mutex
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	hv := &HistogramVec{
+		desc:     desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets:  b,
+		children: make(map[string]*Histogram),
+		values:   make(map[string][]string),
+	}
+	r.register(name, hv)
+	return hv
+}
+
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	if len(values) != len(hv.labels) {
+		panic(fmt.Sprintf("metric[%s] wants %d label values, got %d", hv.name, len(hv.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	h, ok := hv.children[key]
+	if !ok {
+		h = &Histogram{
+			buckets: hv.buckets,
+			counts:  make([]uint64, len(hv.buckets)),
+		}
+		hv.children[key] = h
+		hv.values[key] = values
+	}
+	return h
+}
+
+func (hv *HistogramVec) write(w io.Writer) {
+	hv.header(w)
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	for _, key := range sortedKeys(hv.values) {
+		h := hv.children[key]
+		values := hv.values[key]
+
+		h.mu.Lock()
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, labelString(hv.labels, values, "le", formatFloat(b)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, labelString(hv.labels, values, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, labelString(hv.labels, values), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, labelString(hv.labels, values), h.count)
+		h.mu.Unlock()
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
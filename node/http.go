@@ -0,0 +1,147 @@
+package node
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+)
+
+const ShutdownTimeout = 10 * time.Second
+
+/*
+Every node serves on its HTTP port:
+
+	/metrics				metrics in the Prometheus text format
+	/admin/state			a read-only JSON dump of the replica's consensus state
+	/admin/view-change		POST, start a view change now
+	/admin/checkpoint		POST, create a checkpoint at the last executed sequence
+	/admin/recover			POST, recover the replica now, out of its turn
+	/admin/drain			POST, stop accepting new client requests
+	/admin/shutdown			POST, drain, wait for the in-flight requests and exit
+
+The operator commands change what the replica does, so they need the node's admin token as a bearer token. A node
+without a token refuses them all.
+*/
+func (n *Node) RunHTTP() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", n.consensus.Metrics)
+	mux.HandleFunc("/admin/state", n.adminState)
+	mux.HandleFunc("/admin/view-change", n.adminCommand(n.adminViewChange))
+	mux.HandleFunc("/admin/checkpoint", n.adminCommand(n.adminCheckPoint))
+	mux.HandleFunc("/admin/recover", n.adminCommand(n.adminRecover))
+	mux.HandleFunc("/admin/drain", n.adminCommand(n.adminDrain))
+	mux.HandleFunc("/admin/shutdown", n.adminCommand(n.adminShutdown))
+
+	addr := fmt.Sprintf(":%d", message.HTTPPortByID(n.NodeID))
+	n.log.Info("HTTP listening", logging.F("addr", addr))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		n.log.Error("HTTP server failed", logging.Err(err))
+	}
+}
+
+func (n *Node) adminState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n.writeJSON(w, n.consensus.Snapshot())
+}
+
+func (n *Node) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		n.log.Error("admin response encode failed", logging.Err(err))
+	}
+}
+
+func (n *Node) authorized(r *http.Request) bool {
+	if n.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(n.AdminToken)) == 1
+}
+
+func (n *Node) adminCommand(cmd func() (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !n.authorized(r) {
+			n.log.Warn("unauthorized admin command", logging.F("path", r.URL.Path), logging.F("peer", r.RemoteAddr))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		n.log.Info("admin command", logging.F("path", r.URL.Path), logging.F("peer", r.RemoteAddr))
+		result, err := cmd()
+		if err != nil {
+			n.log.Warn("admin command failed", logging.F("path", r.URL.Path), logging.Err(err))
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		n.writeJSON(w, result)
+	}
+}
+
+func (n *Node) adminViewChange() (interface{}, error) {
+	view, err := n.consensus.ForceViewChange()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"viewID": view}, nil
+}
+
+func (n *Node) adminCheckPoint() (interface{}, error) {
+	seq, err := n.consensus.ForceCheckPoint()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"sequence": seq}, nil
+}
+
+func (n *Node) adminRecover() (interface{}, error) {
+	var err error
+	if n.watchdog != nil {
+		err = n.watchdog.RecoverNow()
+	} else {
+		err = n.Recover()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"recovering": n.consensus.Recovering()}, nil
+}
+
+func (n *Node) adminDrain() (interface{}, error) {
+	n.Drain()
+	return map[string]interface{}{"draining": true, "inFlight": n.consensus.InFlight()}, nil
+}
+
+func (n *Node) adminShutdown() (interface{}, error) {
+	n.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	inFlight := n.consensus.WaitIdle(ctx)
+	if inFlight > 0 {
+		n.log.Warn("shutdown with requests in flight", logging.F("inFlight", inFlight))
+	}
+
+	go func() {
+		// let the response go out before the process exits
+		time.Sleep(100 * time.Millisecond)
+		n.signal <- "admin shutdown"
+	}()
+	return map[string]interface{}{"inFlight": inFlight}, nil
+}
@@ -1,14 +1,26 @@
 package node
 
 import (
-	"fmt"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"sync/atomic"
+	"time"
 
-	"github.com/didchain/PBFT/consensus"
-	"github.com/didchain/PBFT/service"
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/bls"
+	"github.com/sakesake/PBFT/consensus"
+	"github.com/sakesake/PBFT/logging"
 	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/p2pnetwork"
+	"github.com/sakesake/PBFT/quorum"
+	"github.com/sakesake/PBFT/recovery"
+	"github.com/sakesake/PBFT/service"
+	"github.com/sakesake/PBFT/tracing"
 )
 
 const MaxMsgNO = 100
+const MaxWaitQueue = 1 << 10
 
 type Node struct {
 	NodeID          int64
@@ -19,16 +31,31 @@ type Node struct {
 	waitQueue       []*message.Request
 	consensus       *consensus.StateEngine
 	service         *service.Service
+	log             logging.Logger
+	AdminToken      string
+	draining        int32
+	watchdog        *recovery.Watchdog
+	keyring         *auth.Keyring
+	// parked takes back the requests the engine refused because it isn't serving
+	parked chan *message.Request
 }
 
-func NewNode(id int64) *Node {
+// NewNode creates replica id of the service that replicates app, opts configure its consensus engine.
+func NewNode(id int64, app service.Application, log logging.Logger, opts ...consensus.Option) *Node {
 
 	srvChan := make(chan interface{}, MaxMsgNO)
 	conChan := make(chan *message.RequestRecord, MaxMsgNO)
 	rChan := make(chan *message.Reply, MaxMsgNO)
 
-	c := consensus.InitConsensus(id, conChan, rChan)
-	sr := service.InitService(message.PortByID(id), srvChan)
+	nodeLog := log.With(logging.F("node", id))
+	c := consensus.InitConsensus(id, conChan, rChan, message.TotalNodeNO, nil, opts...)
+	c.Log = log
+	msgChan := make(chan *message.ConMessage, consensus.MaxStateMsgNO)
+	c.MsgChan = msgChan
+	c.SetP2pNetwork(p2pnetwork.NewSimpleP2pLib(id, msgChan, nodeLog))
+	bulkChan := make(chan *message.ConMessage, consensus.MaxStateMsgNO)
+	c.SetBulkNetwork(p2pnetwork.NewBulkP2pLib(id, bulkChan, nodeLog), bulkChan)
+	sr := service.InitService(message.PortByID(id), app, srvChan, nodeLog)
 
 	n := &Node{
 		NodeID:          id,
@@ -39,19 +66,126 @@ func NewNode(id int64) *Node {
 		signal:          make(chan interface{}),
 		conChan:         conChan,
 		directReplyChan: rChan,
+		log:             nodeLog,
+		parked:          make(chan *message.Request, MaxMsgNO),
 	}
 	return n
 }
 
+// SetTracer makes the consensus engine record a span for every phase of a request.
+func (n *Node) SetTracer(t *tracing.Tracer) {
+	n.consensus.Tracer = t
+}
+
+/*
+EnableRecovery makes the node recover proactively in its slot of every period, see package recovery. It is called
+before Run; the returned watchdog can be given a KeyRefresher.
+*/
+func (n *Node) EnableRecovery(period time.Duration) *recovery.Watchdog {
+	n.watchdog = recovery.NewWatchdog(n.NodeID, n, n.consensus.Replicas, period)
+	n.watchdog.Log = n.log
+	if n.keyring != nil {
+		n.watchdog.Keys = n.keyring
+	}
+	return n.watchdog
+}
+
+/*
+EnableAuth makes the node authenticate its consensus messages with session keys it refreshes every interval and on
+every proactive recovery, see package auth. key is the key pair of the replica and pubs the public keys of the
+replicas, for those the configuration doesn't have yet. It is called before Run.
+*/
+func (n *Node) EnableAuth(key *auth.KeyPair, pubs map[int64]string, interval time.Duration) *auth.Keyring {
+	config := n.consensus.Config()
+	for id, pub := range pubs {
+		if config.Keys[id] == "" {
+			config.Keys[id] = pub
+		}
+	}
+	n.consensus.SetConfig(config)
+
+	n.keyring = auth.NewKeyring(n.NodeID, key, n.consensus.Config, n.consensus.Network())
+	n.keyring.Interval = interval
+	n.keyring.Log = n.log
+	n.consensus.SetAuthenticator(n.keyring)
+	if n.watchdog != nil {
+		n.watchdog.Keys = n.keyring
+	}
+	return n.keyring
+}
+
+/*
+EnableClientAuth makes the node serve only requests signed by their client, keys are the public keys of the clients.
+The address replies go to is then only taken from authentic requests. It is called before Run.
+*/
+func (n *Node) EnableClientAuth(keys map[string]ed25519.PublicKey) {
+	n.service.SetClientKeys(keys)
+}
+
+/*
+EnableOperators lets the clients in keys reconfigure the cluster, each with reconfigurations it signs with its key.
+Without operators every reconfiguration is refused. It is called before Run.
+*/
+func (n *Node) EnableOperators(keys map[string]ed25519.PublicKey) {
+	config := n.consensus.Config()
+	config.Operators = make(map[string]string, len(keys))
+	for id, pub := range keys {
+		config.Operators[id] = hex.EncodeToString(pub)
+	}
+	n.consensus.SetConfig(config)
+	n.service.SetOperatorKeys(keys)
+}
+
+/*
+EnableCertificates makes the node aggregate the quorums of prepares, commits and checkpoints into certificates of
+constant size, see package quorum. key is the vote key of the replica and votes the public vote keys of the replicas,
+for those the configuration doesn't have yet. It is called before Run.
+*/
+func (n *Node) EnableCertificates(key *bls.SecretKey, votes map[int64]string) {
+	config := n.consensus.Config()
+	for id, vote := range votes {
+		if config.Votes[id] == "" {
+			if config.Votes == nil {
+				config.Votes = make(map[int64]string)
+			}
+			config.Votes[id] = vote
+		}
+	}
+	n.consensus.SetConfig(config)
+	n.consensus.SetCertifier(quorum.NewSigner(key, n.consensus.Config))
+}
+
+/*
+Recover reboots the replica clean: the consensus engine checks its state against its peers and, once it reports it is
+recovering, the tentative state of the service is rolled back. Client requests are parked until the engine serves again.
+*/
+func (n *Node) Recover() error {
+	n.log.Info("node recovering", logging.F("inFlight", n.consensus.InFlight()))
+	return n.consensus.Recover()
+}
+
 func (n *Node) Run() {
 
-	fmt.Printf("\nConsensus node[%d] start primary[%t]......\n", n.NodeID, n.NodeID == n.consensus.PrimaryID)
+	n.log.Info("consensus node start", logging.F("primary", n.NodeID == n.consensus.PrimaryID))
 
 	go n.consensus.StartConsensus(n.signal)
 	go n.service.WaitRequest(n.signal)
 	go n.Dispatch()
+	go n.RunHTTP()
+	if n.keyring != nil {
+		go n.keyring.Run()
+	}
+	if n.watchdog != nil {
+		go n.watchdog.Run()
+	}
 	s := <-n.signal
-	fmt.Printf("Node[%d] exit because of:%s", n.NodeID, s)
+	if n.watchdog != nil {
+		n.watchdog.Stop()
+	}
+	if n.keyring != nil {
+		n.keyring.Stop()
+	}
+	n.log.Info("node exit", logging.F("reason", s))
 }
 
 func (n *Node) Dispatch() {
@@ -63,23 +197,150 @@ func (n *Node) Dispatch() {
 				return
 			}
 
-			if err := n.consensus.InspireConsensus(opMsg); err != nil {
-				fmt.Printf("consesus layer err:%s", err)
-				n.waitQueue = append(n.waitQueue, opMsg)
+			if n.Draining() {
+				n.reject(opMsg, message.RejectDraining)
+				continue
+			}
+
+			if opMsg.ReadOnly {
+				n.executeReadOnly(opMsg)
+				continue
 			}
 
+			n.submit(opMsg)
+
+		case request := <-n.parked:
+			n.park(request)
+
+		case status := <-n.consensus.StatusChan:
+			if status == consensus.ViewChanging || status == consensus.Recovering {
+				n.service.Rollback()
+			}
+			n.log.Info("consensus status changed, retry waiting requests", logging.F("status", status),
+				logging.F("waiting", len(n.waitQueue)))
+			n.retryWaitQueue()
+
 		case record := <-n.conChan:
+			if record.Request == nil {
+				n.service.Restore(record.SequenceID, record.State)
+				continue
+			}
+			if record.Tentative {
+				if _, err := n.service.ExecuteTentative(record.ViewID, n.NodeID, record.SequenceID, record.Request); err != nil {
+					n.log.Error("service layer tentative execution failed", logging.F("seq", record.SequenceID), logging.Err(err))
+				}
+				continue
+			}
 			reply, err := n.service.Execute(record.ViewID, n.NodeID, record.SequenceID, record.Request)
 			if err != nil {
-				fmt.Printf("service layer err:%s", err)
+				n.log.Error("service layer execution failed", logging.F("seq", record.SequenceID), logging.Err(err))
 				continue
 			}
-			n.consensus.ResetState(reply)
+			state := n.service.Snapshot()
+			n.consensus.Post(func() {
+				n.consensus.ResetState(reply, state)
+			})
 		case reply := <-n.directReplyChan:
 			if err := n.service.DirectReply(reply); err != nil {
-				fmt.Println(err)
+				n.log.Error("direct reply failed", logging.F("seq", reply.SeqID), logging.F("client", reply.ClientID), logging.Err(err))
 				continue
 			}
 		}
 	}
 }
+
+/*
+A client multicasts a read-only request to all replicas. Replicas execute it immediately in their tentative state
+after checking that the request is properly authenticated, that the client has access, and that the request is in
+fact read-only. They send the reply only after all requests reflected in the tentative state have committed. The client
+waits for 2f+1 replies from different replicas with the same result; if it can't collect them it retransmits the
+request as a regular read-write request. A request whose operation the service doesn't know to be read-only is
+rejected, which makes the client retransmit it right away.
+*/
+func (n *Node) executeReadOnly(request *message.Request) {
+	err := n.service.ExecuteReadOnly(n.NodeID, request)
+	if errors.Is(err, service.ErrNotReadOnly) {
+		n.log.Warn("read-only request changes the state, reject it", logging.F("client", request.ClientID))
+		n.reject(request, message.RejectNotReadOnly)
+		return
+	}
+	if err != nil {
+		n.log.Error("service layer read-only execution failed", logging.F("client", request.ClientID), logging.Err(err))
+	}
+}
+
+/*
+Requests that arrive while a view change is in progress are parked in the wait queue and retried as soon as the
+consensus layer is serving again. A request is identified by its client and timestamp, so a client retransmitting the
+same request is only queued once. When the queue is full the request is rejected and the client is told so.
+*/
+func (n *Node) park(request *message.Request) {
+	for _, r := range n.waitQueue {
+		if r.ClientID == request.ClientID && r.TimeStamp == request.TimeStamp {
+			n.log.Debug("request is already waiting", logging.F("client", request.ClientID), logging.F("timestamp", request.TimeStamp))
+			return
+		}
+	}
+
+	if len(n.waitQueue) >= MaxWaitQueue {
+		n.log.Warn("wait queue is full, reject request", logging.F("client", request.ClientID), logging.F("timestamp", request.TimeStamp))
+		n.reject(request, message.RejectQueueFull)
+		return
+	}
+
+	n.waitQueue = append(n.waitQueue, request)
+}
+
+func (n *Node) reject(request *message.Request, reason string) {
+	reply := &message.Reply{
+		SeqID:     request.SeqID,
+		ViewID:    n.service.View(),
+		Timestamp: request.TimeStamp,
+		ClientID:  request.ClientID,
+		NodeID:    n.NodeID,
+		Result:    reason,
+	}
+	if err := n.service.DirectReply(reply); err != nil {
+		n.log.Error("reject reply failed", logging.F("client", request.ClientID), logging.Err(err))
+	}
+}
+
+/*
+A draining node stops accepting new client requests, the requests that already have a sequence number keep going
+through the protocol and execute. The node keeps taking part in consensus for the other replicas.
+*/
+func (n *Node) Drain() {
+	if atomic.CompareAndSwapInt32(&n.draining, 0, 1) {
+		n.log.Info("node draining", logging.F("inFlight", n.consensus.InFlight()))
+	}
+}
+
+func (n *Node) Draining() bool {
+	return atomic.LoadInt32(&n.draining) == 1
+}
+
+func (n *Node) retryWaitQueue() {
+	pending := n.waitQueue
+	n.waitQueue = make([]*message.Request, 0, len(pending))
+
+	for _, request := range pending {
+		n.submit(request)
+	}
+}
+
+/*
+submit hands request to the consensus loop. The engine state belongs to that loop, so the dispatcher doesn't call the
+engine itself; a request the engine refuses because it isn't serving comes back on parked.
+*/
+func (n *Node) submit(request *message.Request) {
+	n.consensus.Post(func() {
+		err := n.consensus.InspireConsensus(request)
+		if err == nil {
+			return
+		}
+		n.log.Error("consensus layer failed", logging.F("client", request.ClientID), logging.Err(err))
+		if errors.Is(err, consensus.ErrNotServing) {
+			n.parked <- request
+		}
+	})
+}
@@ -0,0 +1,397 @@
+package p2pnetwork
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+)
+
+/*
+BulkP2p carries request bodies between replicas on connections of their own, so a multi-megabyte operation never
+sits in front of the small protocol messages on the consensus connections. It starts with the same hello as
+SimpleP2p; after it every frame is a chunk of a message or a credit:
+
+	chunk  = 1 | uvarint transfer | uvarint index | uvarint count | data
+	credit = 2 | uvarint chunks
+
+A message is encoded in the negotiated codec and cut into chunks of BulkChunkSize. The chunks of all messages queued
+for a peer are sent in turns, so a small body overtakes a large one instead of waiting behind it. A sender has at most
+BulkWindow chunks the peer hasn't read yet; the peer returns a credit for every chunk it reads and stops reading while
+the engine doesn't take the messages it has, so a slow replica slows its senders instead of filling their memory.
+A peer whose queue is full refuses new messages with ErrBulkBusy.
+*/
+const (
+	BulkChunkSize = 64 << 10
+	BulkWindow    = 16
+	BulkQueue     = 64
+	// MaxBulkTransfers bounds the messages a peer may have half sent at the same time.
+	MaxBulkTransfers = 64
+	MaxBulkSize      = 64 << 20
+
+	bulkChunk  byte = 1
+	bulkCredit byte = 2
+)
+
+var ErrBulkBusy = errors.New("bulk queue of peer is full")
+
+type BulkP2p struct {
+	SrvBub   *net.TCPListener
+	Peers    map[int64]*bulkPeer
+	MsgChan  chan<- *message.ConMessage
+	nodeID   int64
+	versions []uint8
+	log      logging.Logger
+
+	mu sync.Mutex
+}
+
+type bulkPeer struct {
+	*peer
+	queue   chan []byte
+	credits chan struct{}
+	done    chan struct{}
+}
+
+// outgoing is a message being sent to a peer, next is the index of its next chunk.
+type outgoing struct {
+	id    uint64
+	data  []byte
+	next  int
+	count int
+}
+
+// incoming is a message being received from a peer.
+type incoming struct {
+	chunks [][]byte
+	got    int
+	size   int
+}
+
+// NewBulkP2pLib connects to the bulk ports of the other replicas. versions are the codec versions offered to peers,
+// all supported codecs when none is given.
+func NewBulkP2pLib(id int64, msgChan chan<- *message.ConMessage, log logging.Logger, versions ...uint8) P2pNetwork {
+	s, err := net.ListenTCP("tcp4", &net.TCPAddr{
+		Port: message.BulkPortByID(id),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if len(versions) == 0 {
+		versions = message.SupportedCodecs
+	}
+	bp := &BulkP2p{
+		SrvBub:   s,
+		Peers:    make(map[int64]*bulkPeer),
+		MsgChan:  msgChan,
+		nodeID:   id,
+		versions: versions,
+		log:      log.With(logging.F("node", id), logging.F("transport", "bulk")),
+	}
+	go bp.monitor()
+	for _, pid := range nodeList {
+		if pid == id {
+			continue
+		}
+		bp.dial(pid)
+	}
+	return bp
+}
+
+func (bp *BulkP2p) dial(pid int64) {
+	conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: message.BulkPortByID(pid)})
+	if err != nil {
+		bp.log.Warn("peer node is not valid currently", logging.F("peer", pid), logging.Err(err))
+		return
+	}
+	go bp.serve(conn)
+}
+
+// SetPeers connects to the replicas in ids it has no connection to and closes the connections to the others.
+func (bp *BulkP2p) SetPeers(ids []int64) {
+	want := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	connected := make(map[int64]bool)
+	bp.mu.Lock()
+	for id, bpr := range bp.Peers {
+		connected[id] = true
+		if !want[id] {
+			bpr.conn.Close()
+		}
+	}
+	bp.mu.Unlock()
+	for _, id := range ids {
+		if id != bp.nodeID && !connected[id] {
+			bp.dial(id)
+		}
+	}
+}
+
+func (bp *BulkP2p) monitor() {
+	bp.log.Info("p2p node is waiting", logging.F("addr", bp.SrvBub.Addr()))
+	for {
+		conn, err := bp.SrvBub.AcceptTCP()
+		if err != nil {
+			bp.log.Error("p2p network accept failed", logging.Err(err))
+			continue
+		}
+		go bp.serve(conn)
+	}
+}
+
+func (bp *BulkP2p) serve(conn *net.TCPConn) {
+	p, err := handshake(conn, bp.nodeID, bp.versions)
+	if err != nil {
+		bp.log.Error("handshake failed", logging.F("peer", conn.RemoteAddr()), logging.Err(err))
+		conn.Close()
+		return
+	}
+	bpr := &bulkPeer{
+		peer:    p,
+		queue:   make(chan []byte, BulkQueue),
+		credits: make(chan struct{}, BulkWindow),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < BulkWindow; i++ {
+		bpr.credits <- struct{}{}
+	}
+
+	bp.mu.Lock()
+	if old, ok := bp.Peers[p.nodeID]; ok {
+		old.conn.Close()
+	}
+	bp.Peers[p.nodeID] = bpr
+	bp.mu.Unlock()
+	bp.log.Info("codec negotiated", logging.F("peer", p.nodeID), logging.F("codec", p.codec.Name()))
+
+	go bp.send(bpr)
+	err = bp.receive(bpr)
+	if err != nil && err != io.EOF {
+		bp.log.Error("p2p network capture data failed", logging.F("peer", p.nodeID), logging.Err(err))
+	}
+
+	close(bpr.done)
+	conn.Close()
+	bp.mu.Lock()
+	if bp.Peers[p.nodeID] == bpr {
+		delete(bp.Peers, p.nodeID)
+	}
+	bp.mu.Unlock()
+	bp.log.Info("remove peer node", logging.F("peer", p.nodeID))
+}
+
+// send writes the queued messages of a peer chunk by chunk, one chunk of every message in turn, as credits allow.
+func (bp *BulkP2p) send(bpr *bulkPeer) {
+	var nextID uint64
+	active := make([]*outgoing, 0)
+	add := func(data []byte) {
+		nextID++
+		count := (len(data) + BulkChunkSize - 1) / BulkChunkSize
+		if count == 0 {
+			count = 1
+		}
+		active = append(active, &outgoing{id: nextID, data: data, count: count})
+	}
+
+	for {
+		if len(active) == 0 {
+			select {
+			case data := <-bpr.queue:
+				add(data)
+			case <-bpr.done:
+				return
+			}
+		}
+		for more := true; more && len(active) < MaxBulkTransfers; {
+			select {
+			case data := <-bpr.queue:
+				add(data)
+			default:
+				more = false
+			}
+		}
+
+		select {
+		case <-bpr.credits:
+		case <-bpr.done:
+			return
+		}
+		out := active[0]
+		start := out.next * BulkChunkSize
+		end := start + BulkChunkSize
+		if end > len(out.data) {
+			end = len(out.data)
+		}
+		frame := []byte{bulkChunk}
+		frame = binary.AppendUvarint(frame, out.id)
+		frame = binary.AppendUvarint(frame, uint64(out.next))
+		frame = binary.AppendUvarint(frame, uint64(out.count))
+		if err := writeFrame(bpr.conn, append(frame, out.data[start:end]...)); err != nil {
+			bp.log.Error("write to peer failed", logging.F("peer", bpr.nodeID), logging.Err(err))
+			bpr.conn.Close()
+			return
+		}
+
+		out.next++
+		active = active[1:]
+		if out.next < out.count {
+			active = append(active, out)
+		}
+	}
+}
+
+// receive reads the frames of a peer, puts chunks back together and hands every complete message to the engine.
+func (bp *BulkP2p) receive(bpr *bulkPeer) error {
+	transfers := make(map[uint64]*incoming)
+	for {
+		data, err := readFrame(bpr.conn)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("empty bulk frame")
+		}
+
+		switch data[0] {
+		case bulkCredit:
+			n, size := binary.Uvarint(data[1:])
+			if size <= 0 || n > BulkWindow {
+				return fmt.Errorf("invalid credit frame")
+			}
+			for i := uint64(0); i < n; i++ {
+				select {
+				case bpr.credits <- struct{}{}:
+				default:
+					return fmt.Errorf("peer returned more credits than the window")
+				}
+			}
+
+		case bulkChunk:
+			id, index, count, chunk, err := decodeChunk(data[1:])
+			if err != nil {
+				return err
+			}
+			in, ok := transfers[id]
+			if !ok {
+				if len(transfers) >= MaxBulkTransfers || count*BulkChunkSize > MaxBulkSize+BulkChunkSize {
+					return fmt.Errorf("transfer[%d] of %d chunks refused", id, count)
+				}
+				in = &incoming{chunks: make([][]byte, count)}
+				transfers[id] = in
+			}
+			if count != len(in.chunks) || index >= count || in.chunks[index] != nil {
+				return fmt.Errorf("invalid chunk[%d/%d] of transfer[%d]", index, count, id)
+			}
+			in.chunks[index] = chunk
+			in.got++
+			in.size += len(chunk)
+			if err := writeFrame(bpr.conn, binary.AppendUvarint([]byte{bulkCredit}, 1)); err != nil {
+				return err
+			}
+			if in.got < count {
+				continue
+			}
+
+			delete(transfers, id)
+			body := make([]byte, 0, in.size)
+			for _, c := range in.chunks {
+				body = append(body, c...)
+			}
+			conMsg, err := bpr.codec.Decode(body)
+			if err != nil {
+				bp.log.Error("invalid consensus message", logging.F("peer", bpr.nodeID),
+					logging.F("codec", bpr.codec.Name()), logging.F("size", len(body)), logging.Err(err))
+				continue
+			}
+			bp.MsgChan <- conMsg
+
+		default:
+			return fmt.Errorf("unknown bulk frame kind[%d]", data[0])
+		}
+	}
+}
+
+func decodeChunk(data []byte) (uint64, int, int, []byte, error) {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return 0, 0, 0, nil, fmt.Errorf("invalid chunk header")
+		}
+		fields[i] = v
+		data = data[n:]
+	}
+	if fields[2] == 0 || fields[2] > MaxBulkSize/BulkChunkSize+1 || len(data) > BulkChunkSize {
+		return 0, 0, 0, nil, fmt.Errorf("invalid chunk of %d bytes in %d chunks", len(data), fields[2])
+	}
+	return fields[0], int(fields[1]), int(fields[2]), data, nil
+}
+
+func (bp *BulkP2p) enqueue(bpr *bulkPeer, msg *message.ConMessage, encoded map[uint8][]byte) error {
+	data, ok := encoded[bpr.codec.Version()]
+	if !ok {
+		var err error
+		if data, err = bpr.codec.Encode(msg); err != nil {
+			return err
+		}
+		if len(data) > MaxBulkSize {
+			return fmt.Errorf("message of %d bytes exceeds %d", len(data), MaxBulkSize)
+		}
+		encoded[bpr.codec.Version()] = data
+	}
+	select {
+	case bpr.queue <- data:
+		return nil
+	default:
+		return fmt.Errorf("node[%d]: %w", bpr.nodeID, ErrBulkBusy)
+	}
+}
+
+func (bp *BulkP2p) BroadCast(v interface{}) error {
+	msg, ok := v.(*message.ConMessage)
+	if !ok || msg == nil {
+		return fmt.Errorf("BroadCast: expected *message.ConMessage, got %T", v)
+	}
+	bp.mu.Lock()
+	peers := make([]*bulkPeer, 0, len(bp.Peers))
+	for _, bpr := range bp.Peers {
+		peers = append(peers, bpr)
+	}
+	bp.mu.Unlock()
+
+	encoded := make(map[uint8][]byte)
+	for _, bpr := range peers {
+		if err := bp.enqueue(bpr, msg, encoded); err != nil {
+			bp.log.Warn("bulk message dropped", logging.F("peer", bpr.nodeID), logging.F("type", msg.Typ), logging.Err(err))
+		}
+	}
+	return nil
+}
+
+func (bp *BulkP2p) SendToNode(nodeID int64, v interface{}) error {
+	msg, ok := v.(*message.ConMessage)
+	if !ok || msg == nil {
+		return fmt.Errorf("SendToNode: expected *message.ConMessage, got %T", v)
+	}
+	bp.mu.Lock()
+	bpr, ok := bp.Peers[nodeID]
+	bp.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no bulk connection to node[%d]", nodeID)
+	}
+	return bp.enqueue(bpr, msg, make(map[uint8][]byte))
+}
+
+func (bp *BulkP2p) PeerCount() int {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return len(bp.Peers)
+}
@@ -0,0 +1,115 @@
+package p2pnetwork
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+/*
+Every message on a connection between replicas is a frame: its length as 4 bytes big endian, then its bytes. The first
+frame each side sends is a hello naming the replica and the codec versions it supports; both sides read the other's
+hello and pick the highest common version with message.Negotiate, every later frame is a message in that codec. A
+connection without a common codec is closed.
+
+	hello = "PBFT" | uvarint node id | uvarint count | count version bytes
+*/
+const (
+	handshakeMagic   = "PBFT"
+	MaxFrameSize     = 1 << 24
+	HandshakeTimeout = 5 * time.Second
+)
+
+type peer struct {
+	conn   *net.TCPConn
+	nodeID int64
+	codec  message.Codec
+}
+
+func writeFrame(w io.Writer, data []byte) error {
+	if len(data) > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds %d", len(data), MaxFrameSize)
+	}
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	// one Write per frame, so frames written by different goroutines never interleave
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds %d", size, MaxFrameSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func encodeHello(nodeID int64, versions []uint8) []byte {
+	data := []byte(handshakeMagic)
+	data = binary.AppendUvarint(data, uint64(nodeID))
+	data = binary.AppendUvarint(data, uint64(len(versions)))
+	return append(data, versions...)
+}
+
+func decodeHello(data []byte) (int64, []uint8, error) {
+	if len(data) < len(handshakeMagic) || string(data[:len(handshakeMagic)]) != handshakeMagic {
+		return 0, nil, fmt.Errorf("not a hello")
+	}
+	data = data[len(handshakeMagic):]
+	nodeID, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("invalid node id in hello")
+	}
+	data = data[n:]
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count != uint64(len(data)-n) {
+		return 0, nil, fmt.Errorf("invalid codec versions in hello")
+	}
+	return int64(nodeID), append([]uint8(nil), data[n:]...), nil
+}
+
+// handshake exchanges hellos on a new connection and returns the peer with the codec both sides agreed on.
+func handshake(conn *net.TCPConn, localID int64, local []uint8) (*peer, error) {
+	if err := conn.SetDeadline(time.Now().Add(HandshakeTimeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	if err := writeFrame(conn, encodeHello(localID, local)); err != nil {
+		return nil, err
+	}
+	data, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	nodeID, versions, err := decodeHello(data)
+	if err != nil {
+		return nil, err
+	}
+	version, err := message.Negotiate(local, versions)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := message.CodecByVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	return &peer{
+		conn:   conn,
+		nodeID: nodeID,
+		codec:  codec,
+	}, nil
+}
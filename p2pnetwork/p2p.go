@@ -1,12 +1,13 @@
 package p2pnetwork
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/sakesake/PBFT/logging"
 	"github.com/sakesake/PBFT/message"
 )
 
@@ -15,15 +16,29 @@ var nodeList = []int64{0, 1, 2, 3}
 type P2pNetwork interface {
 	BroadCast(v interface{}) error
 	SendToNode(nodeID int64, v interface{}) error
+	PeerCount() int
+}
+
+// PeerSetter is implemented by networks whose replicas can change while they run, the engine calls it when the
+// configuration changes. ids include the local replica.
+type PeerSetter interface {
+	SetPeers(ids []int64)
 }
 
 type SimpleP2p struct {
-	SrvBub  *net.TCPListener
-	Peers   map[string]*net.TCPConn
-	MsgChan chan<- *message.ConMessage
+	SrvBub   *net.TCPListener
+	Peers    map[string]*peer
+	MsgChan  chan<- *message.ConMessage
+	nodeID   int64
+	versions []uint8
+	log      logging.Logger
+
+	mu sync.Mutex
 }
 
-func NewSimpleP2pLib(id int64, msgChan chan<- *message.ConMessage) P2pNetwork {
+// NewSimpleP2pLib connects to the other replicas. versions are the codec versions offered to peers, all supported
+// codecs when none is given.
+func NewSimpleP2pLib(id int64, msgChan chan<- *message.ConMessage, log logging.Logger, versions ...uint8) P2pNetwork {
 
 	port := message.PortByID(id)
 	s, err := net.ListenTCP("tcp4", &net.TCPAddr{
@@ -34,67 +49,109 @@ func NewSimpleP2pLib(id int64, msgChan chan<- *message.ConMessage) P2pNetwork {
 		panic(err)
 	}
 
+	if len(versions) == 0 {
+		versions = message.SupportedCodecs
+	}
 	sp := &SimpleP2p{
-		SrvBub:  s,
-		Peers:   make(map[string]*net.TCPConn),
-		MsgChan: msgChan,
+		SrvBub:   s,
+		Peers:    make(map[string]*peer),
+		MsgChan:  msgChan,
+		nodeID:   id,
+		versions: versions,
+		log:      log.With(logging.F("node", id)),
 	}
 	go sp.monitor()
 	for _, pid := range nodeList {
 		if pid == id {
 			continue
 		}
+		sp.dial(pid)
+	}
+	return sp
+}
 
-		rPort := message.PortByID(pid)
-		conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: rPort})
-		if err != nil {
-			fmt.Printf("\nnode [%d] is not valid currently\n", pid)
-			continue
+func (sp *SimpleP2p) dial(pid int64) {
+	rPort := message.PortByID(pid)
+	conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: rPort})
+	if err != nil {
+		sp.log.Warn("peer node is not valid currently", logging.F("peer", pid), logging.Err(err))
+		return
+	}
+	sp.log.Info("peer node connected", logging.F("peer", pid), logging.F("local", conn.LocalAddr()),
+		logging.F("remote", conn.RemoteAddr()))
+	go sp.serve(conn)
+}
+
+// SetPeers connects to the replicas in ids it has no connection to and closes the connections to the others.
+func (sp *SimpleP2p) SetPeers(ids []int64) {
+	want := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	connected := make(map[int64]bool)
+	sp.mu.Lock()
+	for _, p := range sp.Peers {
+		connected[p.nodeID] = true
+		if !want[p.nodeID] {
+			p.conn.Close()
+		}
+	}
+	sp.mu.Unlock()
+	for _, id := range ids {
+		if id != sp.nodeID && !connected[id] {
+			sp.dial(id)
 		}
-		sp.Peers[conn.RemoteAddr().String()] = conn
-		fmt.Printf("node [%d] connected=[%s=>%s]\n", pid, conn.LocalAddr().String(), conn.RemoteAddr().String())
-		go sp.waitData(conn)
 	}
-	return sp
 }
 
 func (sp *SimpleP2p) monitor() {
-	fmt.Printf("===>P2p node is waiting at:%s\n", sp.SrvBub.Addr().String())
+	sp.log.Info("p2p node is waiting", logging.F("addr", sp.SrvBub.Addr()))
 	for {
 		conn, err := sp.SrvBub.AcceptTCP()
 		if err != nil {
-			fmt.Printf("P2p network accept err:%s\n", err)
-			if err == io.EOF {
-				fmt.Printf("Remove peer node%s\n", conn.RemoteAddr().String())
-				delete(sp.Peers, conn.RemoteAddr().String())
-			}
+			sp.log.Error("p2p network accept failed", logging.Err(err))
 			continue
 		}
 
-		sp.Peers[conn.RemoteAddr().String()] = conn
-		fmt.Printf("connection create [%s->%s]\n", conn.RemoteAddr().String(), conn.LocalAddr().String())
-		go sp.waitData(conn)
+		sp.log.Info("connection created", logging.F("peer", conn.RemoteAddr()), logging.F("local", conn.LocalAddr()))
+		go sp.serve(conn)
 	}
 }
 
-func (sp *SimpleP2p) waitData(conn *net.TCPConn) {
-	buf := make([]byte, 2048)
+// serve runs the handshake on a new connection, then hands every message the peer sends to the engine.
+func (sp *SimpleP2p) serve(conn *net.TCPConn) {
+	name := conn.RemoteAddr().String()
+	p, err := handshake(conn, sp.nodeID, sp.versions)
+	if err != nil {
+		sp.log.Error("handshake failed", logging.F("peer", name), logging.Err(err))
+		conn.Close()
+		return
+	}
+	sp.mu.Lock()
+	sp.Peers[name] = p
+	sp.mu.Unlock()
+	sp.log.Info("codec negotiated", logging.F("peer", p.nodeID), logging.F("codec", p.codec.Name()))
+
+	defer func() {
+		sp.mu.Lock()
+		delete(sp.Peers, name)
+		sp.mu.Unlock()
+		conn.Close()
+		sp.log.Info("remove peer node", logging.F("peer", name))
+	}()
 	for {
-		n, err := conn.Read(buf)
+		data, err := readFrame(conn)
 		if err != nil {
-			fmt.Printf("P2p network capture data err:%s\n", err)
-			if err == io.EOF {
-				fmt.Printf("Remove peer node%s\n", conn.RemoteAddr().String())
-				delete(sp.Peers, conn.RemoteAddr().String())
-				return
-
+			if err != io.EOF {
+				sp.log.Error("p2p network capture data failed", logging.F("peer", name), logging.Err(err))
 			}
-			continue
+			return
 		}
-		conMsg := &message.ConMessage{}
-		if err := json.Unmarshal(buf[:n], conMsg); err != nil {
-			fmt.Println(string(buf[:n]))
-			panic(err)
+		conMsg, err := p.codec.Decode(data)
+		if err != nil {
+			sp.log.Error("invalid consensus message", logging.F("peer", name), logging.F("codec", p.codec.Name()),
+				logging.F("size", len(data)), logging.Err(err))
+			continue
 		}
 		sp.MsgChan <- conMsg
 	}
@@ -104,14 +161,30 @@ func (sp *SimpleP2p) BroadCast(v interface{}) error {
 	if v == nil {
 		return fmt.Errorf("empty msg body")
 	}
-	data, err := json.Marshal(v)
-	if err != nil {
-		return err
+	msg, ok := v.(*message.ConMessage)
+	if !ok {
+		return fmt.Errorf("BroadCast: expected *message.ConMessage, got %T", v)
 	}
-	for name, conn := range sp.Peers {
-		_, err := conn.Write(data)
-		if err != nil {
-			fmt.Printf("write to node[%s] err:%s\n", name, err)
+
+	sp.mu.Lock()
+	peers := make(map[string]*peer, len(sp.Peers))
+	for name, p := range sp.Peers {
+		peers[name] = p
+	}
+	sp.mu.Unlock()
+
+	encoded := make(map[uint8][]byte)
+	for name, p := range peers {
+		data, ok := encoded[p.codec.Version()]
+		if !ok {
+			var err error
+			if data, err = p.codec.Encode(msg); err != nil {
+				return err
+			}
+			encoded[p.codec.Version()] = data
+		}
+		if err := writeFrame(p.conn, data); err != nil {
+			sp.log.Error("write to peer failed", logging.F("peer", name), logging.Err(err))
 		}
 	}
 	time.Sleep(300 * time.Millisecond)
@@ -122,3 +195,9 @@ func (sp *SimpleP2p) SendToNode(nodeID int64, v interface{}) error {
 	//TODO:: single point message
 	return sp.BroadCast(v)
 }
+
+func (sp *SimpleP2p) PeerCount() int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return len(sp.Peers)
+}
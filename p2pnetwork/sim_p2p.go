@@ -6,10 +6,17 @@ import (
 	"github.com/sakesake/PBFT/message"
 )
 
+/*
+SimulationP2P hands every message to Send. By default each call runs in its own goroutine so Send may block; a driver
+that orders the deliveries itself sets Synchronous and Send is called in order before BroadCast or SendToNode return.
+The peers are the nodes 0 to TotalNodes-1 until SetPeers names them.
+*/
 type SimulationP2P struct {
-	Send       func(msg interface{})
-	MsgChan    chan<- *message.ConMessage
-	TotalNodes int
+	Send        func(msg interface{})
+	MsgChan     chan<- *message.ConMessage
+	TotalNodes  int
+	Peers       []int64
+	Synchronous bool
 }
 
 func NewSimP2pLib(
@@ -30,12 +37,16 @@ func (sp *SimulationP2P) BroadCast(v interface{}) error {
 		return fmt.Errorf("BroadCast: expected *message.ConMessage, got %T", v)
 	}
 
-	for i := 0; i < sp.TotalNodes; i++ {
-		to := uint(i)
+	for _, id := range sp.peers() {
+		to := uint(id)
 		// Copy the message so each goroutine gets its own copy
 		msgCopy := *conMsg
 		msgCopy.To = to
 
+		if sp.Synchronous {
+			sp.Send(&msgCopy)
+			continue
+		}
 		go func(m message.ConMessage) {
 			sp.Send(&m)
 		}(msgCopy)
@@ -44,16 +55,42 @@ func (sp *SimulationP2P) BroadCast(v interface{}) error {
 	return nil
 }
 
+// SendToNode hands Send one copy of the message addressed to nodeID, the way BroadCast does for every peer.
 func (sp *SimulationP2P) SendToNode(nodeID int64, v interface{}) error {
-	for i := 0; i < sp.TotalNodes; i++ {
-		if i == int(nodeID) {
+	for _, id := range sp.peers() {
+		if id == nodeID {
 			conMsg, ok := v.(*message.ConMessage)
 			if !ok {
 				return fmt.Errorf("SendToNode: expected *message.ConMessage, got %T", v)
 			}
-			sp.MsgChan <- conMsg
+			msgCopy := *conMsg
+			msgCopy.To = uint(nodeID)
+			if sp.Synchronous {
+				sp.Send(&msgCopy)
+				return nil
+			}
+			go sp.Send(&msgCopy)
 			return nil
 		}
 	}
 	return fmt.Errorf("Send to node failed. Node ID: {%d}", nodeID)
 }
+
+func (sp *SimulationP2P) PeerCount() int {
+	return len(sp.peers()) - 1
+}
+
+func (sp *SimulationP2P) SetPeers(ids []int64) {
+	sp.Peers = append([]int64(nil), ids...)
+}
+
+func (sp *SimulationP2P) peers() []int64 {
+	if sp.Peers != nil {
+		return sp.Peers
+	}
+	ids := make([]int64, sp.TotalNodes)
+	for i := range ids {
+		ids[i] = int64(i)
+	}
+	return ids
+}
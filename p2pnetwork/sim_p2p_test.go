@@ -0,0 +1,37 @@
+package p2pnetwork
+
+import (
+	"testing"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+func TestSimulationSendToNodeReachesThePeer(t *testing.T) {
+	inbox := make(chan *message.ConMessage, 1)
+	var sent []*message.ConMessage
+	sp := &SimulationP2P{
+		TotalNodes:  message.TotalNodeNO,
+		MsgChan:     inbox,
+		Synchronous: true,
+		Send: func(v interface{}) {
+			sent = append(sent, v.(*message.ConMessage))
+		},
+	}
+
+	msg := &message.ConMessage{Typ: message.MTRequest, From: 1}
+	if err := sp.SendToNode(2, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(inbox) != 0 {
+		t.Fatal("message addressed to a peer was delivered to the sender")
+	}
+	if len(sent) != 1 || sent[0].To != 2 {
+		t.Fatalf("sent %+v, want one message to node 2", sent)
+	}
+	if msg.To != 0 {
+		t.Fatal("SendToNode changed the caller's message")
+	}
+	if err := sp.SendToNode(message.TotalNodeNO, msg); err == nil {
+		t.Fatal("sent to a node that isn't a peer")
+	}
+}
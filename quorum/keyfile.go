@@ -0,0 +1,74 @@
+package quorum
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sakesake/PBFT/bls"
+)
+
+/*
+Vote keys live in the key directory of package auth: <id>.vote is the secret vote key of replica id and only belongs on
+that replica, <id>.vpub is its public vote key with the proof of possession.
+*/
+func keyFile(dir string, id int64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%d.%s", id, ext))
+}
+
+// WriteKeys generates a vote key for every replica in ids and writes it to dir.
+func WriteKeys(dir string, ids []int64) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		key, err := bls.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyFile(dir, id, "vote"), []byte(hex.EncodeToString(key.Bytes())+"\n"), 0o600); err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyFile(dir, id, "vpub"), []byte(Public(key)+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadKeys reads the vote key of replica id and the public vote keys of the replicas in ids from dir.
+func LoadKeys(dir string, id int64, ids []int64) (*bls.SecretKey, map[int64]string, error) {
+	data, err := os.ReadFile(keyFile(dir, id, "vote"))
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", keyFile(dir, id, "vote"), err)
+	}
+	key, err := bls.SecretKeyFromBytes(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", keyFile(dir, id, "vote"), err)
+	}
+	pubs := make(map[int64]string, len(ids))
+	for _, r := range ids {
+		data, err := os.ReadFile(keyFile(dir, r, "vpub"))
+		if err != nil {
+			return nil, nil, err
+		}
+		pub := strings.TrimSpace(string(data))
+		if _, err := ParsePublic(pub); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", keyFile(dir, r, "vpub"), err)
+		}
+		pubs[r] = pub
+	}
+	if pub, ok := pubs[id]; ok {
+		if pk, _ := ParsePublic(pub); !pk.Equal(key.PublicKey()) {
+			return nil, nil, fmt.Errorf("%s doesn't match %s", keyFile(dir, id, "vpub"), keyFile(dir, id, "vote"))
+		}
+	}
+	return key, pubs, nil
+}
@@ -0,0 +1,172 @@
+/*
+Package quorum certifies the quorums of the consensus with BLS signatures. Every replica signs its prepares, commits and
+checkpoints with its vote key; 2f or 2f+1 matching votes aggregate into a message.QuorumCert with one signature and a
+bitmap of the signers, which is what view changes carry instead of the messages of the quorum. The public vote keys are
+the Votes of the configuration, each with the proof of possession that keeps a replica from choosing its key so that an
+aggregate verifies without the votes of the others.
+*/
+package quorum
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/sakesake/PBFT/bls"
+	"github.com/sakesake/PBFT/message"
+)
+
+var (
+	ErrNoQuorum      = errors.New("not enough signers")
+	ErrUnknownSigner = errors.New("signer has no vote key")
+	ErrBadCert       = errors.New("certificate doesn't verify")
+)
+
+// Public is the public vote key of key as it goes into message.Config.Votes: the hex of the key and of its proof.
+func Public(key *bls.SecretKey) string {
+	return hex.EncodeToString(append(key.PublicKey().Bytes(), key.Prove().Bytes()...))
+}
+
+// ParsePublic reads a public vote key Public wrote and checks its proof of possession.
+func ParsePublic(s string) (*bls.PublicKey, error) {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vote key: %w", err)
+	}
+	if len(data) != bls.PublicKeySize+bls.SignatureSize {
+		return nil, fmt.Errorf("invalid vote key: %d bytes", len(data))
+	}
+	pk, err := bls.PublicKeyFromBytes(data[:bls.PublicKeySize])
+	if err != nil {
+		return nil, err
+	}
+	proof, err := bls.SignatureFromBytes(data[bls.PublicKeySize:])
+	if err != nil {
+		return nil, err
+	}
+	if !bls.VerifyPossession(pk, proof) {
+		return nil, fmt.Errorf("invalid vote key: no proof of possession")
+	}
+	return pk, nil
+}
+
+// Signer votes with key and certifies quorums against the Votes of the configuration config returns.
+type Signer struct {
+	key    *bls.SecretKey
+	config func() *message.Config
+
+	mu   sync.Mutex
+	keys map[string]*bls.PublicKey
+}
+
+func NewSigner(key *bls.SecretKey, config func() *message.Config) *Signer {
+	return &Signer{
+		key:    key,
+		config: config,
+		keys:   make(map[string]*bls.PublicKey),
+	}
+}
+
+// Vote signs the statement of qc.
+func (s *Signer) Vote(qc *message.QuorumCert) []byte {
+	return s.key.Sign(qc.Statement()).Bytes()
+}
+
+/*
+Certify aggregates the votes on the statement of qc into qc and returns the voters it left out. All votes are added up
+and checked at once; only when the sum doesn't verify is every vote checked on its own to find the bad ones.
+*/
+func (s *Signer) Certify(qc *message.QuorumCert, votes map[int64][]byte) []int64 {
+	config := s.config()
+	msg := qc.Statement()
+
+	ids := make([]int64, 0, len(votes))
+	for id := range votes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var bad, good []int64
+	var pks []*bls.PublicKey
+	var sigs [][]byte
+	for _, id := range ids {
+		pk, err := s.publicKey(config, id)
+		if err != nil || len(votes[id]) != bls.SignatureSize {
+			bad = append(bad, id)
+			continue
+		}
+		good = append(good, id)
+		pks = append(pks, pk)
+		sigs = append(sigs, votes[id])
+	}
+
+	agg, err := bls.AggregateBytes(sigs...)
+	if err != nil || !bls.Verify(bls.AggregatePublicKeys(pks...), msg, agg) {
+		checked := good[:0:0]
+		sigs = sigs[:0]
+		for i, id := range good {
+			sig, err := bls.SignatureFromBytes(votes[id])
+			if err != nil || !bls.Verify(pks[i], msg, sig) {
+				bad = append(bad, id)
+				continue
+			}
+			checked = append(checked, id)
+			sigs = append(sigs, votes[id])
+		}
+		good = checked
+		agg, _ = bls.AggregateBytes(sigs...)
+	}
+
+	qc.SetSigners(good)
+	qc.Sig = nil
+	if agg != nil && len(good) > 0 {
+		qc.Sig = agg.Bytes()
+	}
+	return bad
+}
+
+// Check verifies qc is signed by at least quorum replicas of the configuration.
+func (s *Signer) Check(qc *message.QuorumCert, quorum int) error {
+	config := s.config()
+	ids := qc.SignerIDs()
+	if len(ids) < quorum {
+		return fmt.Errorf("%w: %d of %d", ErrNoQuorum, len(ids), quorum)
+	}
+	pks := make([]*bls.PublicKey, 0, len(ids))
+	for _, id := range ids {
+		pk, err := s.publicKey(config, id)
+		if err != nil {
+			return err
+		}
+		pks = append(pks, pk)
+	}
+	sig, err := bls.SignatureFromBytes(qc.Sig)
+	if err != nil {
+		return err
+	}
+	if !bls.Verify(bls.AggregatePublicKeys(pks...), qc.Statement(), sig) {
+		return ErrBadCert
+	}
+	return nil
+}
+
+// publicKey is the vote key of replica id in config, parsed and checked once for every key.
+func (s *Signer) publicKey(config *message.Config, id int64) (*bls.PublicKey, error) {
+	vote, ok := config.Votes[id]
+	if !ok || id < 0 || !config.Contains(id) {
+		return nil, fmt.Errorf("%w: replica[%d]", ErrUnknownSigner, id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pk, ok := s.keys[vote]; ok {
+		return pk, nil
+	}
+	pk, err := ParsePublic(vote)
+	if err != nil {
+		return nil, fmt.Errorf("vote key of replica[%d]: %w", id, err)
+	}
+	s.keys[vote] = pk
+	return pk, nil
+}
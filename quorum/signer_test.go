@@ -0,0 +1,85 @@
+package quorum
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/sakesake/PBFT/bls"
+	"github.com/sakesake/PBFT/message"
+)
+
+// signers returns a signer for every replica of the default configuration, the vote keys drawn from seed.
+func signers(seed int64) []*Signer {
+	r := rand.New(rand.NewSource(seed))
+	config := message.DefaultConfig()
+	config.Votes = make(map[int64]string)
+	keys := make([]*bls.SecretKey, message.TotalNodeNO)
+	for i := range keys {
+		keys[i], _ = bls.GenerateKey(r)
+		config.Votes[int64(i)] = Public(keys[i])
+	}
+	s := make([]*Signer, len(keys))
+	for i := range keys {
+		s[i] = NewSigner(keys[i], config.Copy)
+	}
+	return s
+}
+
+func TestCertifyLeavesOutBadVotes(t *testing.T) {
+	s := signers(1)
+	qc := &message.QuorumCert{Typ: message.MTCommit, SequenceID: 1, Digest: "d"}
+	other := &message.QuorumCert{Typ: message.MTCommit, SequenceID: 1, Digest: "other"}
+	votes := map[int64][]byte{
+		0: s[0].Vote(qc),
+		1: s[1].Vote(other),
+		2: s[2].Vote(qc),
+		3: s[3].Vote(qc),
+	}
+	bad := s[0].Certify(qc, votes)
+	if len(bad) != 1 || bad[0] != 1 {
+		t.Fatalf("bad votes %v, want [1]", bad)
+	}
+	if ids := qc.SignerIDs(); len(ids) != 3 {
+		t.Fatalf("certificate signed by %v", ids)
+	}
+	if err := s[1].Check(qc, 3); err != nil {
+		t.Fatalf("certificate doesn't check: %v", err)
+	}
+	if err := s[1].Check(qc, 4); err == nil {
+		t.Fatal("certificate of 3 checks as a quorum of 4")
+	}
+
+	qc.SetSigners([]int64{0, 1, 2})
+	if err := s[1].Check(qc, 3); err == nil {
+		t.Fatal("certificate checks with a signer that didn't vote")
+	}
+}
+
+func TestParsePublicNeedsTheProofOfTheKey(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	a, _ := bls.GenerateKey(r)
+	b, _ := bls.GenerateKey(r)
+	if _, err := ParsePublic(Public(a)); err != nil {
+		t.Fatal(err)
+	}
+	// the key of a with the proof of b
+	forged := Public(a)[:2*bls.PublicKeySize] + Public(b)[2*bls.PublicKeySize:]
+	if _, err := ParsePublic(forged); err == nil {
+		t.Fatal("vote key with another key's proof accepted")
+	}
+}
+
+func TestKeysRoundTripThroughTheKeyDirectory(t *testing.T) {
+	dir := t.TempDir()
+	ids := []int64{0, 1, 2, 3}
+	if err := WriteKeys(dir, ids); err != nil {
+		t.Fatal(err)
+	}
+	key, pubs, err := LoadKeys(dir, 2, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pubs) != len(ids) || pubs[2] != Public(key) {
+		t.Fatal("public vote keys don't match the secret ones")
+	}
+}
@@ -0,0 +1,116 @@
+package recovery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sakesake/PBFT/logging"
+)
+
+/*
+Proactive recovery recovers every replica periodically, faulty or not, so the cluster stays correct as long as at most
+f replicas are faulty within a window of vulnerability instead of over its whole lifetime. The Watchdog is the timer of
+a replica that starts its recoveries; it can't be stopped by the replica it watches, so in a real deployment it runs
+out of the replica's reach, a coprocessor or a separate process.
+
+The replicas take turns: every Period is split into one slot per replica of the configuration in ascending order of
+ids and a replica recovers at the start of its slot, so as long as a recovery completes within its slot no two replicas
+recover at the same time and the others still form quorums. The window of vulnerability is then about two periods.
+The slots are computed from the wall clock, the clocks of the replicas have to be loosely synchronized.
+*/
+type Replica interface {
+	// Recover reboots the replica clean and checks its state against its peers.
+	Recover() error
+}
+
+// KeyRefresher gives the replica new session keys, so keys an attacker may have learned are useless after a recovery.
+type KeyRefresher interface {
+	RefreshKeys() error
+}
+
+type Watchdog struct {
+	Period time.Duration
+	// Keys, when set, is asked for new session keys before every recovery.
+	Keys KeyRefresher
+	Log  logging.Logger
+
+	id       int64
+	replica  Replica
+	replicas func() []int64
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// NewWatchdog watches replica id, replicas returns the replicas of the configuration in force in ascending order.
+func NewWatchdog(id int64, replica Replica, replicas func() []int64, period time.Duration) *Watchdog {
+	return &Watchdog{
+		Period:   period,
+		Log:      logging.Default(),
+		id:       id,
+		replica:  replica,
+		replicas: replicas,
+		stop:     make(chan struct{}),
+	}
+}
+
+/*
+Offset is when in every period replica id recovers. A replica that isn't in replicas, like one that was just removed,
+shares the slot of the next replica by id.
+*/
+func Offset(id int64, replicas []int64, period time.Duration) time.Duration {
+	if len(replicas) == 0 {
+		return 0
+	}
+	slot := len(replicas)
+	for i, r := range replicas {
+		if r >= id {
+			slot = i
+			break
+		}
+	}
+	return period / time.Duration(len(replicas)) * time.Duration(slot%len(replicas))
+}
+
+// Next returns the first time after now replica id is due to recover.
+func Next(now time.Time, id int64, replicas []int64, period time.Duration) time.Time {
+	next := now.Truncate(period).Add(Offset(id, replicas, period))
+	if !next.After(now) {
+		next = next.Add(period)
+	}
+	return next
+}
+
+// Run recovers the replica in its slot of every period until Stop is called.
+func (w *Watchdog) Run() {
+	log := w.Log.With(logging.F("node", w.id))
+	for {
+		next := Next(time.Now(), w.id, w.replicas(), w.Period)
+		log.Debug("next proactive recovery", logging.F("at", next))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-w.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := w.RecoverNow(); err != nil {
+			log.Error("proactive recovery failed", logging.Err(err))
+		}
+	}
+}
+
+// RecoverNow refreshes the keys and recovers the replica right away, out of turn.
+func (w *Watchdog) RecoverNow() error {
+	if w.Keys != nil {
+		if err := w.Keys.RefreshKeys(); err != nil {
+			w.Log.Error("session key refresh failed", logging.F("node", w.id), logging.Err(err))
+		}
+	}
+	return w.replica.Recover()
+}
+
+func (w *Watchdog) Stop() {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+}
@@ -1,10 +1,15 @@
 package service
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/logging"
 	"github.com/sakesake/PBFT/message"
 )
 
@@ -16,27 +21,110 @@ invoke operations and block waiting for a reply. The replicated service is imple
 replicas are non-faulty if they follow the algorithm in Section 4 and if no attacker can forge their signature.
 */
 
+/*
+Application is the deterministic state machine the service replicates, it sees the operations in the order they
+execute. IsReadOnly tells the operations that leave the state untouched, only those run for read-only requests.
+Snapshot copies the state and Restore brings a copy back, which is how requests executed tentatively are undone.
+*/
+type Application interface {
+	Execute(op string) string
+	IsReadOnly(op string) bool
+	Snapshot() []byte
+	Restore(state []byte)
+}
+
+// Nop is an application without state that accepts every operation, none of them is known to be read-only.
+func Nop() Application {
+	return nopApplication{}
+}
+
+type nopApplication struct{}
+
+func (nopApplication) Execute(string) string  { return "success" }
+func (nopApplication) IsReadOnly(string) bool { return false }
+func (nopApplication) Snapshot() []byte       { return nil }
+func (nopApplication) Restore([]byte)         {}
+
+var ErrNotReadOnly = errors.New("operation isn't read-only")
+
 type Service struct {
-	SrvHub   *net.UDPConn
-	nodeChan chan interface{}
+	SrvHub    *net.UDPConn
+	nodeChan  chan interface{}
+	clients   map[string]*net.UDPAddr
+	tentative map[int64]*tentative
+	app       Application
+	log       logging.Logger
+	// view and seq are those of the last request executed, read-only replies report them
+	view, seq int64
+	// reads are the read-only replies held back until the tentative requests commit
+	reads []heldRead
+	// clientKeys are the public keys of the clients, nil when requests aren't authenticated
+	clientKeys map[string]ed25519.PublicKey
+	// operatorKeys are the public keys of the clients that may reconfigure the cluster
+	operatorKeys map[string]ed25519.PublicKey
+
+	mu sync.RWMutex
+}
+
+// tentative is a request executed tentatively, before is the state of the application it executed on.
+type tentative struct {
+	reply  *message.Reply
+	before []byte
 }
 
-func InitService(port int, msgChan chan interface{}) *Service {
+type heldRead struct {
+	request *message.Request
+	reply   *message.Reply
+}
+
+func InitService(port int, app Application, msgChan chan interface{}, log logging.Logger) *Service {
 	locAddr := net.UDPAddr{
 		Port: port,
 	}
 	srv, err := net.ListenUDP("udp4", &locAddr)
 	if err != nil {
+		log.Error("service listen failed", logging.F("port", port), logging.Err(err))
 		return nil
 	}
-	fmt.Printf("\n===>Service Listening at[%d]", port)
+	log.Info("service listening", logging.F("port", port))
 	s := &Service{
-		SrvHub:   srv,
-		nodeChan: msgChan,
+		SrvHub:    srv,
+		nodeChan:  msgChan,
+		clients:   make(map[string]*net.UDPAddr),
+		tentative: make(map[int64]*tentative),
+		app:       app,
+		log:       log,
 	}
 	return s
 }
 
+// SetClientKeys makes the service drop every request that isn't signed by its client. It is called before WaitRequest.
+func (s *Service) SetClientKeys(keys map[string]ed25519.PublicKey) {
+	s.clientKeys = keys
+}
+
+func (s *Service) authentic(op *message.Request) bool {
+	pub, ok := s.clientKeys[op.ClientID]
+	return ok && auth.VerifyRequest(op, pub) == nil
+}
+
+/*
+SetOperatorKeys makes the service take reconfigurations signed by one of the operators in keys, there are none taken
+without operators. The replicas check it again when a reconfiguration executes. It is called before WaitRequest.
+*/
+func (s *Service) SetOperatorKeys(keys map[string]ed25519.PublicKey) {
+	s.operatorKeys = keys
+}
+
+// authorized reports whether the client of op may ask for it, a reconfiguration has to come from an operator.
+func (s *Service) authorized(op *message.Request) bool {
+	if op.Reconfig == nil {
+		return true
+	}
+	pub, ok := s.operatorKeys[op.ClientID]
+	return ok && auth.VerifyRequest(op, pub) == nil
+}
+
 func (s *Service) WaitRequest(sig chan interface{}) {
 
 	defer func() {
@@ -49,19 +137,72 @@ func (s *Service) WaitRequest(sig chan interface{}) {
 	for {
 		n, rAddr, err := s.SrvHub.ReadFromUDP(buf)
 		if err != nil {
-			fmt.Printf("Service received err:%s\n", err)
+			s.log.Error("service receive failed", logging.Err(err))
 			continue
 		}
-		fmt.Printf("\nService message[%d] from[%s]\n", n, rAddr.String())
+		s.log.Debug("service message", logging.F("size", n), logging.F("peer", rAddr))
 		bo := &message.Request{}
 		if err := json.Unmarshal(buf[:n], bo); err != nil {
-			fmt.Printf("\nService message parse err:%s", err)
+			s.log.Error("service message parse failed", logging.F("peer", rAddr), logging.Err(err))
+			continue
+		}
+		authentic := s.authentic(bo)
+		if s.clientKeys != nil && !authentic {
+			s.log.Warn("service request not authentic", logging.F("client", bo.ClientID), logging.F("peer", rAddr))
+			continue
+		}
+		if !s.authorized(bo) {
+			s.log.Warn("reconfiguration not from an operator", logging.F("client", bo.ClientID), logging.F("peer", rAddr))
+			continue
+		}
+		if err := s.rememberClient(bo, rAddr, authentic); err != nil {
+			s.log.Error("service client address invalid", logging.F("client", bo.ClientID), logging.Err(err))
 			continue
 		}
 		go s.process(bo)
 	}
 }
 
+/*
+Replies are sent to the endpoint the client declares inside its request. Only the replica that got the request
+straight from the client knows its source address, so that one is used when no endpoint is declared. The last address
+of every client is remembered for replies that are sent without the request at hand.
+
+Anyone can send a request in the name of a client, so only a request signed by the client can move its address.
+Without client keys nothing is authentic and a client keeps the first address the service learned for it.
+*/
+func (s *Service) rememberClient(op *message.Request, src *net.UDPAddr, authentic bool) error {
+	addr := src
+	if op.Endpoint != "" {
+		ep, err := net.ResolveUDPAddr("udp4", op.Endpoint)
+		if err != nil {
+			return err
+		}
+		addr = ep
+	}
+	if addr == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[op.ClientID]; ok && !authentic {
+		return nil
+	}
+	s.clients[op.ClientID] = addr
+	return nil
+}
+
+func (s *Service) clientAddr(clientID string) (*net.UDPAddr, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addr, ok := s.clients[clientID]
+	if !ok {
+		return nil, fmt.Errorf("no address for client[%s]", clientID)
+	}
+	return addr, nil
+}
+
 func (s *Service) process(op *message.Request) {
 
 	/*
@@ -87,39 +228,179 @@ corresponding request can be executed.
 */
 func (s *Service) Execute(v, n, seq int64, o *message.Request) (reply *message.Reply, err error) {
 
-	fmt.Printf("Service is executing opertion[%s]......\n", o.Operation)
+	var r *message.Reply
+	t, ok := s.tentative[seq]
+	if ok && t.reply.ClientID == o.ClientID && t.reply.Timestamp == o.TimeStamp {
+		s.log.Debug("commit tentative operation", logging.F("seq", seq), logging.F("client", o.ClientID))
+		delete(s.tentative, seq)
+		r = t.reply
+		r.ViewID = v
+		r.Tentative = false
+	} else {
+		if ok {
+			// another request committed with the sequence number, the tentative state went astray
+			s.Rollback()
+		}
+		s.log.Debug("execute operation", logging.F("seq", seq), logging.F("client", o.ClientID))
+		r = s.execute(v, n, seq, o)
+	}
+	s.view, s.seq = v, seq
+
+	if err := s.sendReply(o, r); err != nil {
+		return nil, err
+	}
+	if len(s.tentative) == 0 {
+		s.releaseReads()
+	}
+	return r, nil
+}
+
+/*
+A read-only request executes right away against the state of the service, which includes the requests executed
+tentatively. Its reply is held back until all those requests have committed and is dropped when they are rolled
+back; the client then falls back to a read-write request.
+*/
+func (s *Service) ExecuteReadOnly(n int64, o *message.Request) error {
+	if !s.app.IsReadOnly(o.Operation) {
+		return ErrNotReadOnly
+	}
 	r := &message.Reply{
+		SeqID:     s.seq,
+		ViewID:    s.view,
+		Timestamp: o.TimeStamp,
+		ClientID:  o.ClientID,
+		NodeID:    n,
+		Result:    s.app.Execute(o.Operation),
+	}
+	if len(s.tentative) > 0 {
+		s.log.Debug("hold read-only reply", logging.F("client", o.ClientID), logging.F("tentative", len(s.tentative)))
+		s.reads = append(s.reads, heldRead{request: o, reply: r})
+		return nil
+	}
+	return s.sendReply(o, r)
+}
+
+// View is the view of the last request the service executed.
+func (s *Service) View() int64 {
+	return s.view
+}
+
+func (s *Service) releaseReads() {
+	for _, read := range s.reads {
+		read.reply.SeqID, read.reply.ViewID = s.seq, s.view
+		if err := s.sendReply(read.request, read.reply); err != nil {
+			s.log.Error("read-only reply failed", logging.F("client", read.request.ClientID), logging.Err(err))
+		}
+	}
+	s.reads = nil
+}
+
+/*
+A request executed tentatively only changes the tentative state and its reply is marked as tentative. The result is
+kept until the request commits, or thrown away by Rollback when a view change aborts it. The state the request
+executed on is kept with it, so it can be restored.
+*/
+func (s *Service) ExecuteTentative(v, n, seq int64, o *message.Request) (reply *message.Reply, err error) {
+	s.log.Debug("execute operation tentatively", logging.F("seq", seq), logging.F("client", o.ClientID))
+	before := s.app.Snapshot()
+	r := s.execute(v, n, seq, o)
+	r.Tentative = true
+	s.tentative[seq] = &tentative{reply: r, before: before}
+
+	tr := *r
+	if err := s.sendReply(o, &tr); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/*
+Rollback undoes every request that executed tentatively and hasn't committed: the application gets back the state the
+first of them executed on, which reflects exactly the committed requests.
+*/
+func (s *Service) Rollback() {
+	var first *tentative
+	for seq, t := range s.tentative {
+		s.log.Info("rollback tentative operation", logging.F("seq", seq))
+		if first == nil || t.reply.SeqID < first.reply.SeqID {
+			first = t
+		}
+		delete(s.tentative, seq)
+	}
+	if first != nil {
+		s.app.Restore(first.before)
+	}
+	s.reads = nil
+}
+
+// Snapshot is the state of the application that reflects exactly the committed requests, the one checkpoints cover.
+func (s *Service) Snapshot() []byte {
+	var first *tentative
+	for _, t := range s.tentative {
+		if first == nil || t.reply.SeqID < first.reply.SeqID {
+			first = t
+		}
+	}
+	if first != nil {
+		return first.before
+	}
+	return s.app.Snapshot()
+}
+
+/*
+Restore makes state, which the replica fetched with the stable checkpoint at seq, the state of the application. The
+requests executed tentatively are undone first, they executed on the state the replica had.
+*/
+func (s *Service) Restore(seq int64, state []byte) {
+	s.log.Info("restore application state", logging.F("seq", seq), logging.F("size", len(state)))
+	s.Rollback()
+	s.app.Restore(state)
+	s.seq = seq
+}
+
+func (s *Service) execute(v, n, seq int64, o *message.Request) *message.Reply {
+	return &message.Reply{
 		SeqID:     seq,
 		ViewID:    v,
 		Timestamp: o.TimeStamp,
 		ClientID:  o.ClientID,
 		NodeID:    n,
-		Result:    "success",
+		Result:    s.app.Execute(o.Operation),
 	}
+}
 
-	bs, _ := json.Marshal(r)
-	cAddr := net.UDPAddr{
-		Port: 8088,
+func (s *Service) sendReply(o *message.Request, r *message.Reply) error {
+	if err := s.rememberClient(o, nil, s.authentic(o)); err != nil {
+		s.log.Error("client endpoint invalid", logging.F("client", o.ClientID), logging.Err(err))
 	}
-	no, err := s.SrvHub.WriteToUDP(bs, &cAddr)
+	cAddr, err := s.clientAddr(o.ClientID)
 	if err != nil {
-		fmt.Printf("Reply client failed:%s\n", err)
-		return nil, err
+		s.log.Error("reply client failed", logging.F("seq", r.SeqID), logging.F("client", o.ClientID), logging.Err(err))
+		return nil
 	}
-	fmt.Printf("Reply Success!:%d seq=%d\n", no, seq)
-	return r, nil
+
+	bs, _ := json.Marshal(r.ForRequest(o))
+	no, err := s.SrvHub.WriteToUDP(bs, cAddr)
+	if err != nil {
+		s.log.Error("reply client failed", logging.F("seq", r.SeqID), logging.F("client", o.ClientID), logging.Err(err))
+		return err
+	}
+	s.log.Debug("reply success", logging.F("seq", r.SeqID), logging.F("client", o.ClientID), logging.F("size", no))
+	return nil
 }
 
 func (s *Service) DirectReply(r *message.Reply) error {
-	bs, _ := json.Marshal(r)
-	cAddr := net.UDPAddr{
-		Port: 8088,
+	cAddr, err := s.clientAddr(r.ClientID)
+	if err != nil {
+		return err
 	}
-	no, err := s.SrvHub.WriteToUDP(bs, &cAddr)
+
+	bs, _ := json.Marshal(r)
+	no, err := s.SrvHub.WriteToUDP(bs, cAddr)
 	if err != nil {
-		fmt.Printf("Reply client failed:%s\n", err)
+		s.log.Error("reply client failed", logging.F("seq", r.SeqID), logging.F("client", r.ClientID), logging.Err(err))
 		return err
 	}
-	fmt.Printf("Reply Directly Success!:%d seq=%d\n", no, r.SeqID)
+	s.log.Debug("reply directly success", logging.F("seq", r.SeqID), logging.F("client", r.ClientID), logging.F("size", no))
 	return nil
 }
@@ -0,0 +1,296 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+)
+
+// counter is an application whose state is a number, "inc" adds one and "get" reads it.
+type counter struct {
+	n int
+}
+
+func (c *counter) Execute(op string) string {
+	if op == "inc" {
+		c.n++
+	}
+	return strings.Repeat("|", c.n)
+}
+
+func (c *counter) IsReadOnly(op string) bool {
+	return op == "get"
+}
+
+func (c *counter) Snapshot() []byte {
+	return []byte(strconv.Itoa(c.n))
+}
+
+func (c *counter) Restore(state []byte) {
+	c.n, _ = strconv.Atoi(string(state))
+}
+
+func newTestService(keys map[string]ed25519.PublicKey) *Service {
+	return &Service{
+		clients:    make(map[string]*net.UDPAddr),
+		tentative:  make(map[int64]*tentative),
+		app:        &counter{},
+		log:        logging.Nop(),
+		clientKeys: keys,
+	}
+}
+
+// listen binds the service and a client named alice to loopback ports and returns the replies alice gets.
+func listen(t *testing.T, s *Service) <-chan *message.Reply {
+	t.Helper()
+	hub, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hub.Close() })
+	s.SrvHub = hub
+
+	cli, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	s.clients["alice"] = cli.LocalAddr().(*net.UDPAddr)
+
+	replies := make(chan *message.Reply, 16)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, err := cli.Read(buf)
+			if err != nil {
+				return
+			}
+			r := &message.Reply{}
+			if json.Unmarshal(buf[:n], r) == nil {
+				replies <- r
+			}
+		}
+	}()
+	return replies
+}
+
+func expectReply(t *testing.T, replies <-chan *message.Reply) *message.Reply {
+	t.Helper()
+	select {
+	case r := <-replies:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+		return nil
+	}
+}
+
+func expectNoReply(t *testing.T, replies <-chan *message.Reply) {
+	t.Helper()
+	select {
+	case r := <-replies:
+		t.Fatalf("unexpected reply %+v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	s := newTestService(nil)
+	err := s.ExecuteReadOnly(1, &message.Request{ClientID: "alice", Operation: "inc", ReadOnly: true})
+	if !errors.Is(err, ErrNotReadOnly) {
+		t.Fatalf("write executed as read-only: %v", err)
+	}
+	if s.app.(*counter).n != 0 {
+		t.Fatal("rejected read-only request changed the state")
+	}
+}
+
+func TestReadOnlyReplyWaitsForTentativeCommit(t *testing.T) {
+	s := newTestService(nil)
+	replies := listen(t, s)
+
+	inc := &message.Request{ClientID: "alice", TimeStamp: 1, Operation: "inc"}
+	if _, err := s.ExecuteTentative(0, 1, 1, inc); err != nil {
+		t.Fatal(err)
+	}
+	if r := expectReply(t, replies); !r.Tentative {
+		t.Fatal("tentative execution sent a committed reply")
+	}
+
+	get := &message.Request{ClientID: "alice", TimeStamp: 2, Operation: "get", ReadOnly: true}
+	if err := s.ExecuteReadOnly(1, get); err != nil {
+		t.Fatal(err)
+	}
+	expectNoReply(t, replies)
+
+	if _, err := s.Execute(0, 1, 1, inc); err != nil {
+		t.Fatal(err)
+	}
+	if r := expectReply(t, replies); r.Timestamp != 1 || r.Tentative {
+		t.Fatalf("commit reply %+v", r)
+	}
+	r := expectReply(t, replies)
+	if r.Timestamp != 2 || r.Result != "|" || r.SeqID != 1 {
+		t.Fatalf("read-only reply %+v", r)
+	}
+}
+
+func TestRollbackDropsHeldReads(t *testing.T) {
+	s := newTestService(nil)
+	replies := listen(t, s)
+
+	if _, err := s.ExecuteTentative(0, 1, 1, &message.Request{ClientID: "alice", TimeStamp: 1, Operation: "inc"}); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, replies)
+	if err := s.ExecuteReadOnly(1, &message.Request{ClientID: "alice", TimeStamp: 2, Operation: "get", ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	s.Rollback()
+	expectNoReply(t, replies)
+	if len(s.reads) != 0 {
+		t.Fatal("rollback kept the held read-only replies")
+	}
+}
+
+func TestUnauthenticatedRequestDoesNotMoveClient(t *testing.T) {
+	s := newTestService(nil)
+	home := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	evil := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6666}
+
+	r := &message.Request{ClientID: "alice"}
+	if err := s.rememberClient(r, home, s.authentic(r)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.rememberClient(r, evil, s.authentic(r)); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := s.clientAddr("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != home.String() {
+		t.Fatalf("unauthenticated request moved the client to %s", addr)
+	}
+}
+
+func TestAuthenticRequestMovesClient(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(map[string]ed25519.PublicKey{"alice": pub})
+	s.clients["alice"] = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+	forged := &message.Request{ClientID: "alice", Endpoint: "127.0.0.1:6666", Sig: "00"}
+	if s.authentic(forged) {
+		t.Fatal("forged request is authentic")
+	}
+	if err := s.rememberClient(forged, nil, s.authentic(forged)); err != nil {
+		t.Fatal(err)
+	}
+	if addr, _ := s.clientAddr("alice"); addr.Port != 9000 {
+		t.Fatalf("forged request moved the client to %s", addr)
+	}
+
+	moved := &message.Request{ClientID: "alice", Endpoint: "127.0.0.1:9001"}
+	auth.SignRequest(moved, key)
+	if err := s.rememberClient(moved, nil, s.authentic(moved)); err != nil {
+		t.Fatal(err)
+	}
+	if addr, _ := s.clientAddr("alice"); addr.Port != 9001 {
+		t.Fatalf("signed request didn't move the client, it is at %s", addr)
+	}
+}
+
+func TestOnlyOperatorsAskForReconfigurations(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(nil)
+	s.SetOperatorKeys(map[string]ed25519.PublicKey{"admin": pub})
+
+	rc := &message.Reconfig{Op: message.RCChangeF, F: 0}
+	if !s.authorized(&message.Request{ClientID: "alice", Operation: "inc"}) {
+		t.Fatal("ordinary request refused")
+	}
+	unsigned := &message.Request{ClientID: "admin", Reconfig: rc}
+	if s.authorized(unsigned) {
+		t.Fatal("unsigned reconfiguration taken")
+	}
+	mallory := &message.Request{ClientID: "mallory", Reconfig: rc}
+	auth.SignRequest(mallory, key)
+	if s.authorized(mallory) {
+		t.Fatal("reconfiguration of a client that isn't an operator taken")
+	}
+	signed := &message.Request{ClientID: "admin", Reconfig: rc}
+	auth.SignRequest(signed, key)
+	if !s.authorized(signed) {
+		t.Fatal("reconfiguration of the operator refused")
+	}
+}
+
+func TestRollbackRestoresCommittedState(t *testing.T) {
+	s := newTestService(nil)
+	replies := listen(t, s)
+	app := s.app.(*counter)
+
+	for seq := int64(1); seq <= 3; seq++ {
+		r := &message.Request{ClientID: "alice", TimeStamp: seq, Operation: "inc"}
+		if _, err := s.ExecuteTentative(0, 1, seq, r); err != nil {
+			t.Fatal(err)
+		}
+		expectReply(t, replies)
+		if seq == 1 {
+			if _, err := s.Execute(0, 1, seq, r); err != nil {
+				t.Fatal(err)
+			}
+			expectReply(t, replies)
+		}
+	}
+	if app.n != 3 {
+		t.Fatalf("state %d after three increments", app.n)
+	}
+
+	s.Rollback()
+	if app.n != 1 {
+		t.Fatalf("state %d after rollback, only one increment committed", app.n)
+	}
+	if len(s.tentative) != 0 {
+		t.Fatal("rollback kept tentative requests")
+	}
+}
+
+func TestSnapshotReflectsOnlyCommittedRequests(t *testing.T) {
+	s := newTestService(nil)
+	replies := listen(t, s)
+
+	commit := &message.Request{ClientID: "alice", TimeStamp: 1, Operation: "inc"}
+	if _, err := s.Execute(0, 1, 1, commit); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, replies)
+	if _, err := s.ExecuteTentative(0, 1, 2, &message.Request{ClientID: "alice", TimeStamp: 2, Operation: "inc"}); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, replies)
+
+	if state := string(s.Snapshot()); state != "1" {
+		t.Fatalf("snapshot %q with one committed and one tentative increment", state)
+	}
+
+	s.Restore(10, []byte("7"))
+	if app := s.app.(*counter); app.n != 7 || len(s.tentative) != 0 || s.seq != 10 {
+		t.Fatalf("state %d, %d tentative requests and seq %d after restore", app.n, len(s.tentative), s.seq)
+	}
+}
@@ -0,0 +1,250 @@
+package simulation
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+)
+
+/*
+Operation is one client operation as the client saw it: when it was invoked and when, and with which result, it
+returned. The history of operations is what a linearizability check works on. ReadOnly is cleared when a read-only
+operation times out and is sent again as a read-write request, TimeStamp is then the timestamp of the second request.
+*/
+type Operation struct {
+	ClientID  string
+	TimeStamp int64
+	Op        string
+	ReadOnly  bool
+	Result    string
+	Invoke    time.Duration
+	Return    time.Duration
+	Done      bool
+}
+
+/*
+Client behaves like client.Client on the virtual clock: one request outstanding at a time, sent to the primary of the
+view it believes is current and multicast to all replicas every time its timeout expires. A result is accepted once
+f+1 replicas agree on it. A read-only operation is multicast to all replicas and needs 2f+1 matching results; when it
+times out it is sent again as a read-write request.
+*/
+type Client struct {
+	ID     string
+	ViewID int64
+
+	sim      *Simulator
+	lastTime int64
+	queue    []queued
+	reconfig *message.Reconfig
+	pending  *pendingOp
+	gen      uint64
+	// key signs the requests of an operator, see SetOperator
+	key ed25519.PrivateKey
+}
+
+type queued struct {
+	op       string
+	readOnly bool
+	reconfig *message.Reconfig
+}
+
+type pendingOp struct {
+	request *message.Request
+	op      *Operation
+	votes   map[string]map[int64]int64
+}
+
+func (s *Simulator) client(id string) *Client {
+	c, ok := s.clients[id]
+	if !ok {
+		c = &Client{
+			ID:  id,
+			sim: s,
+		}
+		s.clients[id] = c
+	}
+	return c
+}
+
+// Submit queues op for client id at the current virtual time, a client sends its next operation when the previous
+// one returned.
+func (s *Simulator) Submit(id, op string) {
+	s.submit(id, queued{op: op})
+}
+
+// SubmitReadOnly queues op for client id like Submit, but sends it through the read-only path.
+func (s *Simulator) SubmitReadOnly(id, op string) {
+	s.submit(id, queued{op: op, readOnly: true})
+}
+
+// SubmitReconfig queues the reconfiguration rc for client id like Submit.
+func (s *Simulator) SubmitReconfig(id string, rc *message.Reconfig) {
+	s.submit(id, queued{op: rc.String(), reconfig: rc})
+}
+
+// SetOperator makes client id an operator of every replica, it signs its requests with key. It is called before Run.
+func (s *Simulator) SetOperator(id string, key ed25519.PrivateKey) {
+	s.client(id).key = key
+	for _, r := range s.Replicas {
+		config := r.Engine.Config()
+		if config.Operators == nil {
+			config.Operators = make(map[string]string)
+		}
+		config.Operators[id] = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+		r.Engine.SetConfig(config)
+	}
+}
+
+func (s *Simulator) submit(id string, q queued) {
+	c := s.client(id)
+	c.queue = append(c.queue, q)
+	if c.pending == nil {
+		c.next()
+	}
+}
+
+// SubmitAt queues op for client id at virtual time at.
+func (s *Simulator) SubmitAt(at time.Duration, id, op string) {
+	s.schedule(at, &event{kind: evTask, to: -1, fn: func() {
+		s.Submit(id, op)
+	}})
+}
+
+// History returns every operation submitted so far, in the order they were invoked.
+func (s *Simulator) History() []*Operation {
+	return s.history
+}
+
+func (c *Client) primaryID() int64 {
+	return c.ViewID % message.TotalNodeNO
+}
+
+func (c *Client) next() {
+	if len(c.queue) == 0 {
+		return
+	}
+	q := c.queue[0]
+	c.queue = c.queue[1:]
+
+	s := c.sim
+	op := &Operation{
+		ClientID: c.ID,
+		Op:       q.op,
+		ReadOnly: q.readOnly,
+		Invoke:   s.now,
+	}
+	s.history = append(s.history, op)
+	c.reconfig = q.reconfig
+	c.send(op, q.readOnly)
+}
+
+// send starts a new request for op, the first one or the read-write retry of a read-only one.
+func (c *Client) send(op *Operation, readOnly bool) {
+	s := c.sim
+	ts := int64(s.now) + 1
+	if ts <= c.lastTime {
+		ts = c.lastTime + 1
+	}
+	c.lastTime = ts
+	op.TimeStamp = ts
+
+	c.pending = &pendingOp{
+		request: &message.Request{
+			TimeStamp: ts,
+			ClientID:  c.ID,
+			Operation: op.Op,
+			ReadOnly:  readOnly,
+			TraceID:   fmt.Sprintf("%016x%016x", s.rand.Uint64(), s.rand.Uint64()),
+			Reconfig:  c.reconfig,
+		},
+		op:    op,
+		votes: make(map[string]map[int64]int64),
+	}
+	if c.key != nil {
+		auth.SignRequest(c.pending.request, c.key)
+	}
+
+	if readOnly {
+		c.multicast()
+	} else {
+		c.sendTo(c.primaryID())
+	}
+	c.startTimer()
+}
+
+func (c *Client) sendTo(id int64) {
+	s := c.sim
+	s.schedule(s.now+s.latency(), &event{kind: evRequest, to: id, client: c.ID, request: c.pending.request})
+}
+
+func (c *Client) startTimer() {
+	c.gen++
+	s := c.sim
+	s.schedule(s.now+s.cfg.ClientTimeout, &event{kind: evClientTimeout, client: c.ID, gen: c.gen})
+}
+
+func (c *Client) onTimeout(gen uint64) {
+	if c.pending == nil || gen != c.gen {
+		return
+	}
+	if c.pending.request.ReadOnly {
+		c.sim.log.Debug("read-only request timeout, retry as read-write", logging.F("client", c.ID),
+			logging.F("timestamp", c.pending.request.TimeStamp))
+		c.pending.op.ReadOnly = false
+		c.send(c.pending.op, false)
+		return
+	}
+	c.sim.log.Debug("client timeout, multicast request", logging.F("client", c.ID),
+		logging.F("timestamp", c.pending.request.TimeStamp))
+	c.multicast()
+	c.startTimer()
+}
+
+// multicast sends the pending request to every replica the simulator runs, the ones that joined later included.
+func (c *Client) multicast() {
+	for _, r := range c.sim.Replicas {
+		c.sendTo(r.ID)
+	}
+}
+
+func (c *Client) onReply(reply *message.Reply) {
+	p := c.pending
+	if p == nil || reply.Timestamp != p.request.TimeStamp || reply.ClientID != c.ID {
+		return
+	}
+	voters, ok := p.votes[reply.Result]
+	if !ok {
+		voters = make(map[int64]int64)
+		p.votes[reply.Result] = voters
+	}
+	voters[reply.NodeID] = reply.ViewID
+	quorum := message.MaxFaultyNode + 1
+	if p.request.ReadOnly {
+		quorum = 2*message.MaxFaultyNode + 1
+	}
+	if len(voters) < quorum {
+		return
+	}
+
+	viewID := reply.ViewID
+	for _, v := range voters {
+		if v < viewID {
+			viewID = v
+		}
+	}
+	if viewID > c.ViewID {
+		c.ViewID = viewID
+	}
+
+	p.op.Result = reply.Result
+	p.op.Return = c.sim.now
+	p.op.Done = true
+	c.pending = nil
+	c.gen++
+	c.next()
+}
@@ -0,0 +1,200 @@
+package simulation
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+)
+
+/*
+Fault policies make the simulated network as asynchronous as PBFT claims to tolerate: messages between replicas can be
+dropped, delayed by any distribution, duplicated and reordered, and groups of replicas can be cut from each other for a
+while. Every decision is drawn from the simulator's seeded generator, so a faulty run replays like any other. A replica
+always reaches itself, and the links to clients are never faulty.
+*/
+type Distribution interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+type fixed time.Duration
+
+func Fixed(d time.Duration) Distribution {
+	return fixed(d)
+}
+
+func (f fixed) Sample(_ *rand.Rand) time.Duration {
+	return time.Duration(f)
+}
+
+type uniform struct {
+	min, max time.Duration
+}
+
+func Uniform(min, max time.Duration) Distribution {
+	return uniform{min: min, max: max}
+}
+
+func (u uniform) Sample(r *rand.Rand) time.Duration {
+	if u.max <= u.min {
+		return u.min
+	}
+	return u.min + time.Duration(r.Int63n(int64(u.max-u.min)))
+}
+
+type exponential struct {
+	min, mean time.Duration
+}
+
+// Exponential delays by min plus an exponentially distributed time with the given mean, a long tail of slow messages.
+func Exponential(min, mean time.Duration) Distribution {
+	return exponential{min: min, mean: mean}
+}
+
+func (e exponential) Sample(r *rand.Rand) time.Duration {
+	return e.min + time.Duration(r.ExpFloat64()*float64(e.mean))
+}
+
+type LinkPolicy struct {
+	// probability that a message is lost
+	Drop float64
+	// probability that a message is delivered twice
+	Duplicate float64
+	// probability that a message is held back by ReorderDelay, so later messages overtake it
+	Reorder      float64
+	ReorderDelay Distribution
+	// nil keeps the simulator's Latency and Jitter
+	Latency Distribution
+}
+
+type link struct {
+	from, to int64
+}
+
+type partition struct {
+	start, end time.Duration
+	group      map[int64]int
+}
+
+type FaultStats struct {
+	Dropped    int
+	Duplicated int
+	Reordered  int
+}
+
+type faults struct {
+	def        LinkPolicy
+	links      map[link]LinkPolicy
+	partitions []*partition
+	stats      FaultStats
+}
+
+// SetDefaultPolicy applies p to every link between replicas that has no policy of its own.
+func (s *Simulator) SetDefaultPolicy(p LinkPolicy) {
+	s.faults.def = p
+}
+
+// SetLinkPolicy applies p to the messages from replica from to replica to.
+func (s *Simulator) SetLinkPolicy(from, to int64, p LinkPolicy) {
+	s.faults.links[link{from, to}] = p
+}
+
+/*
+Partition splits the replicas into groups from virtual time start until end. Messages between replicas of different
+groups are lost, whether they are sent or due to arrive while the partition lasts. Replicas missing from groups keep
+talking to everyone.
+*/
+func (s *Simulator) Partition(start, end time.Duration, groups ...[]int64) {
+	p := &partition{
+		start: start,
+		end:   end,
+		group: make(map[int64]int),
+	}
+	for i, g := range groups {
+		for _, id := range g {
+			p.group[id] = i
+		}
+	}
+	s.faults.partitions = append(s.faults.partitions, p)
+}
+
+// Isolate cuts replica id from all the others between start and end.
+func (s *Simulator) Isolate(id int64, start, end time.Duration) {
+	others := make([]int64, 0, message.TotalNodeNO-1)
+	for i := int64(0); i < message.TotalNodeNO; i++ {
+		if i != id {
+			others = append(others, i)
+		}
+	}
+	s.Partition(start, end, []int64{id}, others)
+}
+
+func (s *Simulator) FaultStats() FaultStats {
+	return s.faults.stats
+}
+
+func (s *Simulator) policy(from, to int64) LinkPolicy {
+	if p, ok := s.faults.links[link{from, to}]; ok {
+		return p
+	}
+	return s.faults.def
+}
+
+func (s *Simulator) partitioned(from, to int64, at time.Duration) bool {
+	if from == to {
+		return false
+	}
+	for _, p := range s.faults.partitions {
+		if at < p.start || at >= p.end {
+			continue
+		}
+		gf, okf := p.group[from]
+		gt, okt := p.group[to]
+		if okf && okt && gf != gt {
+			return true
+		}
+	}
+	return false
+}
+
+// chance draws from the generator only for a real probability, so a run without faults draws the same numbers as
+// one on a simulator that has no fault policies at all.
+func (s *Simulator) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	return s.rand.Float64() < math.Min(p, 1)
+}
+
+func (s *Simulator) send(from, to int64, msg *message.ConMessage) {
+	if from == to {
+		s.schedule(s.now+s.latency(), &event{kind: evDeliver, from: from, to: to, msg: msg})
+		return
+	}
+
+	p := s.policy(from, to)
+	if s.partitioned(from, to, s.now) || s.chance(p.Drop) {
+		s.faults.stats.Dropped++
+		s.log.Debug("message dropped", logging.F("from", from), logging.F("to", to), logging.F("type", msg.Typ))
+		return
+	}
+
+	copies := 1
+	if s.chance(p.Duplicate) {
+		copies++
+		s.faults.stats.Duplicated++
+	}
+	for i := 0; i < copies; i++ {
+		d := s.latency()
+		if p.Latency != nil {
+			d = p.Latency.Sample(s.rand)
+		}
+		if p.ReorderDelay != nil && s.chance(p.Reorder) {
+			d += p.ReorderDelay.Sample(s.rand)
+			s.faults.stats.Reordered++
+		}
+		s.schedule(s.now+d, &event{kind: evDeliver, from: from, to: to, msg: msg})
+	}
+}
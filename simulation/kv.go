@@ -0,0 +1,75 @@
+package simulation
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+/*
+ReadOnlyMachine is a machine that can answer an operation without changing its state, which is what a replica does
+for a read-only request. Read reports false for an operation that isn't read-only, the replica then ignores the
+request and the client falls back to a read-write request.
+*/
+type ReadOnlyMachine interface {
+	StateMachine
+	Read(op string) (string, bool)
+}
+
+/*
+The KV machine is a map of strings with three operations:
+
+	put <key> <value>	sets key, returns ok
+	append <key> <value>	appends value to key, returns ok
+	get <key>		returns the value of key, empty if it was never set
+
+An append executed twice or out of order shows up in every later get, which is what the linearizability check of a
+history looks for.
+*/
+type kvMachine struct {
+	data map[string]string
+}
+
+func NewKVMachine() StateMachine {
+	return &kvMachine{
+		data: make(map[string]string),
+	}
+}
+
+const (
+	KVOk    = "ok"
+	KVError = "error"
+)
+
+func (m *kvMachine) Execute(op string) string {
+	f := strings.Fields(op)
+	switch {
+	case len(f) == 3 && f[0] == "put":
+		m.data[f[1]] = f[2]
+		return KVOk
+	case len(f) == 3 && f[0] == "append":
+		m.data[f[1]] += f[2]
+		return KVOk
+	case len(f) == 2 && f[0] == "get":
+		return m.data[f[1]]
+	}
+	return KVError
+}
+
+// Snapshot encodes the map with its keys sorted, replicas with the same data have the same snapshot.
+func (m *kvMachine) Snapshot() []byte {
+	data, _ := json.Marshal(m.data)
+	return data
+}
+
+func (m *kvMachine) Restore(state []byte) {
+	m.data = make(map[string]string)
+	json.Unmarshal(state, &m.data)
+}
+
+func (m *kvMachine) Read(op string) (string, bool) {
+	f := strings.Fields(op)
+	if len(f) != 2 || f[0] != "get" {
+		return "", false
+	}
+	return m.data[f[1]], true
+}
@@ -0,0 +1,43 @@
+package simulation
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+/*
+StateMachine is the deterministic service every simulated replica runs, each replica gets its own instance. Snapshot
+and Restore take and install the whole state, which checkpoints cover and state transfer moves between replicas.
+*/
+type StateMachine interface {
+	Execute(op string) string
+	Snapshot() []byte
+	Restore(state []byte)
+}
+
+/*
+The default machine appends every operation to a log and returns the log length, so a replica that executes requests in
+a different order or executes one twice answers differently from the others.
+*/
+type logMachine struct {
+	ops []string
+}
+
+func NewLogMachine() StateMachine {
+	return &logMachine{}
+}
+
+func (m *logMachine) Execute(op string) string {
+	m.ops = append(m.ops, op)
+	return strconv.Itoa(len(m.ops))
+}
+
+func (m *logMachine) Snapshot() []byte {
+	data, _ := json.Marshal(m.ops)
+	return data
+}
+
+func (m *logMachine) Restore(state []byte) {
+	m.ops = nil
+	json.Unmarshal(state, &m.ops)
+}
@@ -0,0 +1,93 @@
+package simulation
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/sakesake/PBFT/message"
+)
+
+type eventKind int8
+
+const (
+	evDeliver eventKind = iota
+	evTimeout
+	evTask
+	evRequest
+	evReply
+	evClientTimeout
+)
+
+func (ek eventKind) String() string {
+	switch ek {
+	case evDeliver:
+		return "deliver"
+	case evTimeout:
+		return "timeout"
+	case evTask:
+		return "task"
+	case evRequest:
+		return "request"
+	case evReply:
+		return "reply"
+	case evClientTimeout:
+		return "client-timeout"
+	}
+	return "unknown"
+}
+
+/*
+Events are ordered by their virtual time and, for events at the same time, by the order they were scheduled in, so the
+order never depends on the Go runtime.
+*/
+type event struct {
+	at   time.Duration
+	seq  uint64
+	kind eventKind
+
+	from    int64
+	to      int64
+	client  string
+	gen     uint64
+	msg     *message.ConMessage
+	request *message.Request
+	reply   *message.Reply
+	fn      func()
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int {
+	return len(q)
+}
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *eventQueue) Push(x interface{}) {
+	*q = append(*q, x.(*event))
+}
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	ev := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return ev
+}
+
+func (s *Simulator) schedule(at time.Duration, ev *event) {
+	s.seq++
+	ev.at = at
+	ev.seq = s.seq
+	heap.Push(&s.queue, ev)
+}
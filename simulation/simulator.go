@@ -0,0 +1,574 @@
+package simulation
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/rand"
+	"time"
+
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/bls"
+	"github.com/sakesake/PBFT/byzantine"
+	"github.com/sakesake/PBFT/consensus"
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/p2pnetwork"
+	"github.com/sakesake/PBFT/quorum"
+	"github.com/sakesake/PBFT/recovery"
+)
+
+/*
+Simulator runs a whole cluster of StateEngines in one goroutine. Every message, timer and client request becomes an
+event in a priority queue ordered by a virtual clock, and every random choice is drawn from one generator seeded with
+Config.Seed. Nothing depends on the Go scheduler or the wall clock, so a run is replayed exactly by creating a new
+simulator with the same configuration: TraceDigest is the same for both runs.
+*/
+type Config struct {
+	Seed int64
+	// every message takes Latency plus a random share of Jitter to arrive
+	Latency       time.Duration
+	Jitter        time.Duration
+	ClientTimeout time.Duration
+	NewMachine    func() StateMachine
+	Log           logging.Logger
+}
+
+func DefaultConfig(seed int64) Config {
+	return Config{
+		Seed:          seed,
+		Latency:       time.Millisecond,
+		Jitter:        4 * time.Millisecond,
+		ClientTimeout: 2 * time.Second,
+		NewMachine:    NewLogMachine,
+		Log:           logging.Nop(),
+	}
+}
+
+const chanSize = 1 << 10
+
+type Execution struct {
+	Seq       int64
+	ViewID    int64
+	ClientID  string
+	TimeStamp int64
+	Operation string
+	Result    string
+	At        time.Duration
+}
+
+type Replica struct {
+	ID       int64
+	Engine   *consensus.StateEngine
+	Machine  StateMachine
+	Executed []*Execution
+	Faulty   bool
+	// Key is the long-term key pair of the replica once the simulator authenticates messages.
+	Key *auth.KeyPair
+	// Vote is the vote key of the replica once the simulator certifies quorums.
+	Vote *bls.SecretKey
+
+	byz       *byzantine.Node
+	keyring   *auth.Keyring
+	wire      p2pnetwork.P2pNetwork
+	ticker    *virtualTicker
+	nodeChan  chan *message.RequestRecord
+	replyChan chan *message.Reply
+}
+
+type Simulator struct {
+	Replicas []*Replica
+	// AfterStep, when set, is called after every event, to check the cluster while it runs.
+	AfterStep func()
+
+	cfg     Config
+	now     time.Duration
+	rand    *rand.Rand
+	queue   eventQueue
+	seq     uint64
+	steps   uint64
+	clients map[string]*Client
+	history []*Operation
+	faults  *faults
+	trace   hash.Hash
+	log     logging.Logger
+
+	recoverEvery time.Duration
+	refreshEvery time.Duration
+	certifies    bool
+}
+
+func New(cfg Config) *Simulator {
+	if cfg.NewMachine == nil {
+		cfg.NewMachine = NewLogMachine
+	}
+	if cfg.Log == nil {
+		cfg.Log = logging.Nop()
+	}
+	if cfg.ClientTimeout <= 0 {
+		cfg.ClientTimeout = DefaultConfig(cfg.Seed).ClientTimeout
+	}
+
+	s := &Simulator{
+		cfg:     cfg,
+		rand:    rand.New(rand.NewSource(cfg.Seed)),
+		queue:   make(eventQueue, 0),
+		clients: make(map[string]*Client),
+		trace:   sha256.New(),
+		faults: &faults{
+			links: make(map[link]LinkPolicy),
+		},
+		log: cfg.Log.With(logging.F("seed", cfg.Seed)),
+	}
+	for id := int64(0); id < message.TotalNodeNO; id++ {
+		s.Replicas = append(s.Replicas, s.newReplica(id))
+	}
+	for _, r := range s.Replicas {
+		r.Engine.Ready()
+		s.drain(r)
+	}
+	return s
+}
+
+func (s *Simulator) newReplica(id int64) *Replica {
+	r := &Replica{
+		ID:        id,
+		Machine:   s.cfg.NewMachine(),
+		nodeChan:  make(chan *message.RequestRecord, chanSize),
+		replyChan: make(chan *message.Reply, chanSize),
+	}
+	r.ticker = &virtualTicker{sim: s, node: id}
+
+	engine := consensus.InitConsensus(id, r.nodeChan, r.replyChan, message.TotalNodeNO, nil)
+	engine.Log = s.cfg.Log
+	engine.Timer = consensus.NewRequestTimer(r.ticker)
+	r.wire = &p2pnetwork.SimulationP2P{
+		TotalNodes:  message.TotalNodeNO,
+		Synchronous: true,
+		Send: func(msg interface{}) {
+			conMsg, ok := msg.(*message.ConMessage)
+			if !ok {
+				return
+			}
+			s.send(id, int64(conMsg.To), conMsg)
+		},
+	}
+	engine.SetP2pNetwork(r.wire)
+	r.Engine = engine
+	return r
+}
+
+/*
+AddReplica starts a new replica with the next free id that joins the cluster with config, the configuration a
+reconfiguration request adding it installs. It catches up by state transfer once the others installed config.
+*/
+func (s *Simulator) AddReplica(config *message.Config) *Replica {
+	r := s.newReplica(int64(len(s.Replicas)))
+	r.Engine.SetConfig(config)
+	s.Replicas = append(s.Replicas, r)
+	if s.refreshEvery > 0 {
+		s.authenticate(r)
+	}
+	if s.certifies {
+		s.certify(r)
+	}
+	r.Engine.Ready()
+	s.drain(r)
+	if s.recoverEvery > 0 {
+		s.scheduleRecovery(r, s.recoverEvery)
+	}
+	return r
+}
+
+/*
+ProactiveRecovery recovers every replica in its slot of every period of virtual time, as a recovery.Watchdog does on
+the wall clock. A replica added later recovers from its first slot after it joined.
+*/
+func (s *Simulator) ProactiveRecovery(period time.Duration) {
+	s.recoverEvery = period
+	for _, r := range s.Replicas {
+		s.scheduleRecovery(r, period)
+	}
+}
+
+func (s *Simulator) scheduleRecovery(r *Replica, period time.Duration) {
+	replicas := r.Engine.Config().Replicas
+	at := s.now.Truncate(period) + recovery.Offset(r.ID, replicas, period)
+	if at <= s.now {
+		at += period
+	}
+	s.schedule(at, &event{kind: evTask, to: r.ID, fn: func() {
+		s.log.Debug("proactive recovery", logging.F("node", r.ID))
+		if r.keyring != nil {
+			if err := r.keyring.RefreshKeys(); err != nil {
+				s.log.Error("session key refresh failed", logging.F("node", r.ID), logging.Err(err))
+			}
+		}
+		r.Engine.BeginRecovery()
+		s.scheduleRecovery(r, period)
+	}})
+}
+
+/*
+Authenticate makes the replicas authenticate their messages with session keys they refresh every interval of virtual
+time, see package auth. The keys are drawn from the generator of the run, so it still replays exactly. A replica added
+later gets a key pair too; the reconfiguration that adds it has to carry Key.Public() for the others to take its
+messages.
+*/
+func (s *Simulator) Authenticate(interval time.Duration) {
+	s.refreshEvery = interval
+	for _, r := range s.Replicas {
+		s.newKey(r)
+	}
+	for _, r := range s.Replicas {
+		config := r.Engine.Config()
+		for _, other := range s.Replicas {
+			config.Keys[other.ID] = other.Key.Public()
+		}
+		r.Engine.SetConfig(config)
+	}
+	for _, r := range s.Replicas {
+		s.authenticate(r)
+	}
+}
+
+func (s *Simulator) newKey(r *Replica) {
+	key, err := auth.GenerateKey(s.rand)
+	if err != nil {
+		panic(err)
+	}
+	r.Key = key
+}
+
+func (s *Simulator) authenticate(r *Replica) {
+	if r.Key == nil {
+		s.newKey(r)
+		config := r.Engine.Config()
+		config.Keys[r.ID] = r.Key.Public()
+		r.Engine.SetConfig(config)
+	}
+	r.keyring = auth.NewKeyring(r.ID, r.Key, r.Engine.Config, r.wire)
+	r.keyring.Interval = s.refreshEvery
+	r.keyring.Rand = s.rand
+	r.keyring.Now = func() time.Time {
+		return time.Unix(0, 0).Add(s.now)
+	}
+	r.keyring.Log = s.cfg.Log
+	r.Engine.SetAuthenticator(r.keyring)
+	if r.byz != nil {
+		r.byz.Auth = r.keyring
+	}
+	s.scheduleRefresh(r, s.now)
+}
+
+func (s *Simulator) scheduleRefresh(r *Replica, at time.Duration) {
+	s.schedule(at, &event{kind: evTask, to: r.ID, fn: func() {
+		if err := r.keyring.RefreshKeys(); err != nil {
+			s.log.Error("session key refresh failed", logging.F("node", r.ID), logging.Err(err))
+		}
+		s.scheduleRefresh(r, s.now+s.refreshEvery)
+	}})
+}
+
+/*
+CertifyQuorums makes the replicas aggregate their quorums into certificates, see package quorum. The vote keys are drawn
+from the generator of the run like the session keys. A replica added later gets a vote key too; the reconfiguration
+that adds it has to carry quorum.Public(Vote) for the others to count its votes.
+*/
+func (s *Simulator) CertifyQuorums() {
+	s.certifies = true
+	votes := make(map[int64]string, len(s.Replicas))
+	for _, r := range s.Replicas {
+		s.newVoteKey(r)
+		votes[r.ID] = quorum.Public(r.Vote)
+	}
+	for _, r := range s.Replicas {
+		config := r.Engine.Config()
+		config.Votes = make(map[int64]string, len(votes))
+		for id, vote := range votes {
+			config.Votes[id] = vote
+		}
+		r.Engine.SetConfig(config)
+		s.certify(r)
+	}
+}
+
+func (s *Simulator) newVoteKey(r *Replica) {
+	key, err := bls.GenerateKey(s.rand)
+	if err != nil {
+		panic(err)
+	}
+	r.Vote = key
+}
+
+func (s *Simulator) certify(r *Replica) {
+	if r.Vote == nil {
+		s.newVoteKey(r)
+		config := r.Engine.Config()
+		if config.Votes == nil {
+			config.Votes = make(map[int64]string)
+		}
+		config.Votes[r.ID] = quorum.Public(r.Vote)
+		r.Engine.SetConfig(config)
+	}
+	r.Engine.SetCertifier(quorum.NewSigner(r.Vote, r.Engine.Config))
+}
+
+/*
+MakeByzantine turns replica id into a faulty one that behaves as strategy says. PBFT only promises agreement while at
+most f replicas are faulty, the checks on a run leave faulty replicas out.
+*/
+func (s *Simulator) MakeByzantine(id int64, strategy byzantine.Strategy) {
+	r := s.Replicas[id]
+	r.Faulty = true
+	r.byz = byzantine.Wrap(r.Engine, r.wire, strategy)
+	if r.keyring != nil {
+		r.byz.Auth = r.keyring
+	}
+}
+
+func (s *Simulator) Seed() int64 {
+	return s.cfg.Seed
+}
+
+// Now is the virtual time since the simulation started.
+func (s *Simulator) Now() time.Duration {
+	return s.now
+}
+
+func (s *Simulator) Steps() uint64 {
+	return s.steps
+}
+
+// TraceDigest covers every event the simulator has processed, two runs with the same seed have the same digest.
+func (s *Simulator) TraceDigest() string {
+	return hex.EncodeToString(s.trace.Sum(nil))
+}
+
+func (s *Simulator) latency() time.Duration {
+	d := s.cfg.Latency
+	if s.cfg.Jitter > 0 {
+		d += time.Duration(s.rand.Int63n(int64(s.cfg.Jitter)))
+	}
+	return d
+}
+
+var ErrIdle = errors.New("no more events")
+
+/*
+Step processes the next event. A panic inside an engine is turned into an error that names the seed, so the failing
+run can be replayed.
+*/
+func (s *Simulator) Step() (err error) {
+	if s.queue.Len() == 0 {
+		return ErrIdle
+	}
+	ev := heap.Pop(&s.queue).(*event)
+	s.now = ev.at
+	s.steps++
+	s.record(ev)
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("seed[%d] step[%d] at %s: %s panicked: %v", s.cfg.Seed, s.steps, s.now, ev.kind, r)
+		}
+	}()
+	s.dispatch(ev)
+	if s.AfterStep != nil {
+		s.AfterStep()
+	}
+	return nil
+}
+
+// Run processes events until the virtual clock passes until or nothing is left to do.
+func (s *Simulator) Run(until time.Duration) error {
+	for s.queue.Len() > 0 && s.queue[0].at <= until {
+		if err := s.Step(); err != nil {
+			return err
+		}
+	}
+	if s.now < until {
+		s.now = until
+	}
+	return nil
+}
+
+func (s *Simulator) record(ev *event) {
+	line := fmt.Sprintf("%d %s %d>%d %s", ev.at, ev.kind, ev.from, ev.to, ev.client)
+	if ev.msg != nil {
+		line += " " + ev.msg.Typ.String() + " " + string(ev.msg.Payload)
+	}
+	s.trace.Write([]byte(line + "\n"))
+	s.log.Debug("simulation event", logging.F("at", ev.at), logging.F("kind", ev.kind), logging.F("from", ev.from),
+		logging.F("to", ev.to))
+}
+
+func (s *Simulator) dispatch(ev *event) {
+	switch ev.kind {
+	case evDeliver:
+		if s.partitioned(ev.from, ev.to, s.now) {
+			s.faults.stats.Dropped++
+			return
+		}
+		r := s.Replicas[ev.to]
+		if r.byz != nil {
+			r.byz.HandleMessage(ev.msg)
+		} else {
+			r.Engine.HandleMessage(ev.msg)
+		}
+		s.drain(r)
+
+	case evTimeout:
+		r := s.Replicas[ev.to]
+		if ev.gen != r.ticker.gen {
+			return
+		}
+		s.schedule(s.now+r.ticker.period, &event{kind: evTimeout, to: ev.to, gen: ev.gen})
+		r.Engine.HandleTimeout()
+		s.drain(r)
+
+	case evTask:
+		ev.fn()
+		if ev.to >= 0 {
+			s.drain(s.Replicas[ev.to])
+		}
+
+	case evRequest:
+		r := s.Replicas[ev.to]
+		request := *ev.request
+		if request.ReadOnly {
+			s.executeReadOnly(r, &request)
+			return
+		}
+		if err := r.Engine.InspireConsensus(&request); err != nil {
+			s.log.Debug("request refused", logging.F("node", ev.to), logging.F("client", request.ClientID), logging.Err(err))
+		}
+		s.drain(r)
+
+	case evReply:
+		if c, ok := s.clients[ev.client]; ok {
+			c.onReply(ev.reply)
+		}
+
+	case evClientTimeout:
+		if c, ok := s.clients[ev.client]; ok {
+			c.onTimeout(ev.gen)
+		}
+	}
+}
+
+/*
+drain plays the node: it executes what the engine committed and forwards the replies to the clients. Channels are read
+one after the other instead of in a select, which would pick among ready channels at random.
+*/
+func (s *Simulator) drain(r *Replica) {
+	for {
+		select {
+		case record := <-r.nodeChan:
+			s.execute(r, record)
+			continue
+		default:
+		}
+		select {
+		case reply := <-r.replyChan:
+			s.replyTo(reply)
+			continue
+		default:
+		}
+		select {
+		case <-r.Engine.StatusChan:
+			continue
+		default:
+		}
+		return
+	}
+}
+
+func (s *Simulator) execute(r *Replica, record *message.RequestRecord) {
+	if record.Request == nil {
+		s.log.Info("restore machine state", logging.F("node", r.ID), logging.F("seq", record.SequenceID))
+		r.Machine.Restore(record.State)
+		return
+	}
+	if record.Tentative {
+		return
+	}
+	request := record.Request
+	result := r.Machine.Execute(request.Operation)
+	r.Executed = append(r.Executed, &Execution{
+		Seq:       record.SequenceID,
+		ViewID:    record.ViewID,
+		ClientID:  request.ClientID,
+		TimeStamp: request.TimeStamp,
+		Operation: request.Operation,
+		Result:    result,
+		At:        s.now,
+	})
+
+	reply := &message.Reply{
+		SeqID:     record.SequenceID,
+		ViewID:    record.ViewID,
+		Timestamp: request.TimeStamp,
+		ClientID:  request.ClientID,
+		NodeID:    r.ID,
+		Result:    result,
+	}
+	r.Engine.ResetState(reply, r.Machine.Snapshot())
+	s.replyTo(reply.ForRequest(request))
+}
+
+/*
+A read-only request is answered right away from the replica's current state, without going through consensus. A
+byzantine replica answers like a correct one, its strategy only sees protocol messages.
+*/
+func (s *Simulator) executeReadOnly(r *Replica, request *message.Request) {
+	m, ok := r.Machine.(ReadOnlyMachine)
+	if !ok {
+		return
+	}
+	result, ok := m.Read(request.Operation)
+	if !ok {
+		s.log.Debug("operation isn't read-only", logging.F("node", r.ID), logging.F("client", request.ClientID))
+		return
+	}
+	s.replyTo(&message.Reply{
+		SeqID:     r.Engine.LasExeSeq,
+		ViewID:    r.Engine.CurViewID,
+		Timestamp: request.TimeStamp,
+		ClientID:  request.ClientID,
+		NodeID:    r.ID,
+		Result:    result,
+	})
+}
+
+func (s *Simulator) replyTo(reply *message.Reply) {
+	s.schedule(s.now+s.latency(), &event{kind: evReply, from: reply.NodeID, client: reply.ClientID, reply: reply})
+}
+
+/*
+virtualTicker is the request timer of a simulated replica. Every Reset or Stop starts a new generation, a timeout event
+of an older generation is ignored when it comes up.
+*/
+type virtualTicker struct {
+	sim    *Simulator
+	node   int64
+	period time.Duration
+	gen    uint64
+}
+
+func (vt *virtualTicker) Chan() <-chan time.Time {
+	return nil
+}
+
+func (vt *virtualTicker) Reset(d time.Duration) {
+	vt.gen++
+	vt.period = d
+	vt.sim.schedule(vt.sim.now+d, &event{kind: evTimeout, to: vt.node, gen: vt.gen})
+}
+
+func (vt *virtualTicker) Stop() {
+	vt.gen++
+}
@@ -1,90 +1,48 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
-	"sync"
-	"time"
 
-	"github.com/sakesake/PBFT/message"
+	"github.com/sakesake/PBFT/auth"
+	"github.com/sakesake/PBFT/client"
 )
 
-func request(conn *net.UDPConn, wg *sync.RWMutex) {
-	for {
-		wg.Lock()
-		primaryID, _ := strconv.Atoi(os.Args[1])
-		rAddr := net.UDPAddr{
-			Port: message.PortByID(int64(primaryID)),
-		}
-
-		r := &message.Request{
-			TimeStamp: time.Now().Unix(),
-			ClientID:  "Client's address",
-			Operation: "<READ TX FROM POOL>",
-		}
-
-		bs, err := json.Marshal(r)
-		if err != nil {
-			panic(err)
-		}
-
-		n, err := conn.WriteToUDP(bs, &rAddr)
-		if err != nil || n == 0 {
-			panic(err)
-		}
-		fmt.Println("Send request success!:=>")
-	}
-}
+const clientID = "Client's address"
 
 func normalCaseOperation(roundSize int) {
 	fmt.Println("start test.....")
-	lclAddr := net.UDPAddr{
+	lclAddr := &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
 		Port: 8088,
 	}
-	conn, err := net.ListenUDP("udp4", &lclAddr)
+	cli, err := client.NewClient(clientID, lclAddr, client.LocalReplicas())
 	if err != nil {
 		panic(err)
 	}
-
-	defer conn.Close()
-
-	locker := &sync.RWMutex{}
-	go request(conn, locker)
-	waitBuffer := make([]byte, 1024)
-	var counter = 0
-	var curSeq int64 = 0
-	for {
-		n, _, err := conn.ReadFromUDP(waitBuffer)
-		if err != nil {
-			panic(err)
-		}
-		//fmt.Printf("Client Read[%d] Reply from[%s]:\n", n, rAddr.String())
-
-		re := &message.Reply{}
-		if err := json.Unmarshal(waitBuffer[:n], re); err != nil {
+	defer cli.Close()
+	if dir := os.Getenv("PBFT_KEY_DIR"); dir != "" {
+		if cli.Key, err = auth.LoadClientKey(dir, clientID); err != nil {
 			panic(err)
 		}
+	}
 
-		if curSeq > re.SeqID {
-			continue
-		}
+	if len(os.Args) > 1 {
+		primaryID, _ := strconv.Atoi(os.Args[1])
+		cli.SetView(int64(primaryID))
+	}
 
-		counter++
-		if counter >= 2 {
-			fmt.Printf("Consensus(seq=%d) operation(%d) success!\n", curSeq, roundSize)
-			locker.Unlock()
-			counter = 0
-			roundSize--
-			curSeq = re.SeqID + 1
-		}
-		if roundSize <= 0 {
-			fmt.Println("Test case finished")
-			os.Exit(0)
+	for i := roundSize; i > 0; i-- {
+		result, err := cli.Invoke(context.Background(), "<READ TX FROM POOL>")
+		if err != nil {
+			panic(err)
 		}
+		fmt.Printf("Consensus operation(%d) success! view=%d result=%s\n", i, cli.View(), result)
 	}
+	fmt.Println("Test case finished")
 }
 
 func main() {
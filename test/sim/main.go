@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/sakesake/PBFT/byzantine"
+	"github.com/sakesake/PBFT/invariant"
+	"github.com/sakesake/PBFT/logging"
+	"github.com/sakesake/PBFT/simulation"
+)
+
+/*
+Runs the simulated cluster for a range of seeds. A failing seed is printed and can be replayed alone with -seed and
+-v to see every event:
+
+	go run ./test/sim -seed 42 -v
+
+With -workload kv the replicas run a key-value store, the clients put, append and get a few keys, some of the gets
+through the read-only path, and the history the clients saw is checked for linearizability.
+
+The default run passes for every seed, and so do runs with reordered or duplicated messages. A lost message is only
+made up for by the retransmissions of the clients and by view changes: the replicas don't retransmit protocol messages
+or exchange their status, so with -drop a lost pre-prepare or checkpoint can hold requests back past -bound and the run
+reports liveness violations. Any other violation is a bug, whatever the flags.
+*/
+func main() {
+	seed := flag.Int64("seed", 1, "first seed")
+	runs := flag.Int("runs", 1, "number of seeds to run")
+	ops := flag.Int("ops", 50, "operations per client")
+	clients := flag.Int("clients", 2, "number of clients")
+	duration := flag.Duration("duration", time.Minute, "virtual time to run")
+	verbose := flag.Bool("v", false, "log every event")
+	drop := flag.Float64("drop", 0, "probability a message between replicas is lost")
+	dup := flag.Float64("dup", 0, "probability a message between replicas is duplicated")
+	reorder := flag.Float64("reorder", 0, "probability a message between replicas is held back")
+	slow := flag.Duration("slow", 0, "mean extra latency of every message between replicas")
+	isolate := flag.Int64("isolate", -1, "replica to cut from the others")
+	from := flag.Duration("from", 5*time.Second, "virtual time the isolation starts")
+	to := flag.Duration("to", 20*time.Second, "virtual time the isolation heals")
+	strategy := flag.String("byzantine", "", "strategy of the faulty replica: equivocate, vote-all, silent, forge-from, replay, fabricate-pmsg,"+
+		" forge-new-view")
+	faulty := flag.Int64("faulty", 0, "replica that runs the byzantine strategy")
+	gst := flag.Duration("gst", 0, "virtual time from which the network is synchronous")
+	bound := flag.Duration("bound", 30*time.Second, "time a request may take to execute after GST, 0 skips the liveness check")
+	workload := flag.String("workload", "log", "service the replicas run: log or kv")
+	keys := flag.Int("keys", 3, "number of keys of the kv workload")
+	reads := flag.Float64("reads", 0.5, "share of the kv gets sent through the read-only path")
+	recoverEvery := flag.Duration("recovery", 0, "period of the proactive recovery of every replica, 0 disables it")
+	refresh := flag.Duration("auth", 0, "interval of the session key refresh when messages are authenticated, 0 disables it")
+	certify := flag.Bool("certify", false, "aggregate the quorums into certificates")
+	flag.Parse()
+
+	if *workload != "log" && *workload != "kv" {
+		fmt.Printf("unknown workload[%s]\n", *workload)
+		os.Exit(2)
+	}
+
+	failed := 0
+	for i := 0; i < *runs; i++ {
+		cfg := simulation.DefaultConfig(*seed + int64(i))
+		if *verbose {
+			cfg.Log = logging.New(os.Stdout, logging.LevelDebug, false)
+		}
+		if *workload == "kv" {
+			cfg.NewMachine = simulation.NewKVMachine
+		}
+		sim := simulation.New(cfg)
+		policy := simulation.LinkPolicy{
+			Drop:         *drop,
+			Duplicate:    *dup,
+			Reorder:      *reorder,
+			ReorderDelay: simulation.Uniform(10*time.Millisecond, 100*time.Millisecond),
+		}
+		if *slow > 0 {
+			policy.Latency = simulation.Exponential(cfg.Latency, *slow)
+		}
+		sim.SetDefaultPolicy(policy)
+		if *isolate >= 0 {
+			sim.Isolate(*isolate, *from, *to)
+		}
+		if *recoverEvery > 0 {
+			sim.ProactiveRecovery(*recoverEvery)
+		}
+		if *refresh > 0 {
+			sim.Authenticate(*refresh)
+		}
+		if *certify {
+			sim.CertifyQuorums()
+		}
+		if *strategy != "" {
+			st, err := byzantine.ByName(*strategy)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			sim.MakeByzantine(*faulty, st)
+		}
+		gen := rand.New(rand.NewSource(cfg.Seed))
+		for c := 0; c < *clients; c++ {
+			id := fmt.Sprintf("client-%d", c)
+			for o := 0; o < *ops; o++ {
+				if *workload == "log" {
+					sim.Submit(id, fmt.Sprintf("op-%d-%d", c, o))
+					continue
+				}
+				key := fmt.Sprintf("k%d", gen.Intn(*keys))
+				switch n := gen.Float64(); {
+				case n < 0.4 && gen.Float64() < *reads:
+					sim.SubmitReadOnly(id, "get "+key)
+				case n < 0.4:
+					sim.Submit(id, "get "+key)
+				case n < 0.7:
+					sim.Submit(id, fmt.Sprintf("put %s c%do%d", key, c, o))
+				default:
+					sim.Submit(id, fmt.Sprintf("append %s c%do%d", key, c, o))
+				}
+			}
+		}
+
+		checker := invariant.NewChecker(sim.Now)
+		checker.Label = fmt.Sprintf("seed=%d", cfg.Seed)
+		checker.GST = *gst
+		checker.Bound = *bound
+		for _, r := range sim.Replicas {
+			checker.Watch(r.Engine, r.Faulty)
+		}
+		sim.AfterStep = checker.Poll
+
+		err := sim.Run(*duration)
+		history := make([]*invariant.Operation, 0, len(sim.History()))
+		for _, op := range sim.History() {
+			if !op.ReadOnly {
+				checker.Submitted(op.ClientID, op.TimeStamp, op.Invoke)
+			}
+			history = append(history, &invariant.Operation{
+				ClientID: op.ClientID,
+				Input:    op.Op,
+				Output:   op.Result,
+				Call:     op.Invoke,
+				Return:   op.Return,
+				Pending:  !op.Done,
+			})
+		}
+		checker.Poll()
+		checker.CheckLiveness()
+		if *workload == "kv" {
+			checker.CheckHistory(invariant.KV{}, history)
+		}
+		done := 0
+		for _, op := range sim.History() {
+			if op.Done {
+				done++
+			}
+		}
+		stats := sim.FaultStats()
+		fmt.Printf("seed=%d steps=%d done=%d/%d dropped=%d duplicated=%d reordered=%d trace=%s\n", cfg.Seed, sim.Steps(),
+			done, *clients**ops, stats.Dropped, stats.Duplicated, stats.Reordered, sim.TraceDigest())
+		if err != nil {
+			failed++
+			fmt.Printf("seed=%d failed: %s\n", cfg.Seed, err)
+		}
+		if vs := checker.Violations(); len(vs) > 0 {
+			failed++
+			for _, v := range vs {
+				fmt.Print(v.String())
+			}
+		}
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
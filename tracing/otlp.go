@@ -0,0 +1,135 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+/*
+FileExporter writes every span as one OTLP/JSON ExportTraceServiceRequest per line, the format of the OpenTelemetry
+collector's file exporter, so the file can be replayed into a collector or loaded by a trace viewer. The file is opened
+for appending: the replicas of a local cluster can share one file and a request shows up as a single trace.
+*/
+type FileExporter struct {
+	service string
+	f       *os.File
+
+	mu sync.Mutex
+}
+
+func NewFileExporter(path, service string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{
+		service: service,
+		f:       f,
+	}, nil
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// OTLP's SPAN_KIND_INTERNAL
+const spanKindInternal = 1
+
+func attribute(key string, v interface{}) otlpAttribute {
+	attr := otlpAttribute{Key: key}
+	switch tv := v.(type) {
+	case string:
+		attr.Value.StringValue = &tv
+	case bool:
+		attr.Value.BoolValue = &tv
+	case int:
+		s := strconv.FormatInt(int64(tv), 10)
+		attr.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(tv, 10)
+		attr.Value.IntValue = &s
+	case float64:
+		attr.Value.DoubleValue = &tv
+	default:
+		s := fmt.Sprint(tv)
+		attr.Value.StringValue = &s
+	}
+	return attr
+}
+
+func (fe *FileExporter) Export(span *Span) error {
+	sp := otlpSpan{
+		TraceID:           span.TraceID,
+		SpanID:            span.SpanID,
+		ParentSpanID:      span.ParentSpanID,
+		Name:              span.Name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+	for k, v := range span.Attributes {
+		sp.Attributes = append(sp.Attributes, attribute(k, v))
+	}
+
+	rs := otlpResourceSpans{}
+	rs.Resource.Attributes = []otlpAttribute{attribute("service.name", fe.service)}
+	ss := otlpScopeSpans{Spans: []otlpSpan{sp}}
+	ss.Scope.Name = "github.com/sakesake/PBFT"
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+
+	data, err := json.Marshal(&otlpRequest{ResourceSpans: []otlpResourceSpans{rs}})
+	if err != nil {
+		return err
+	}
+
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	_, err = fe.f.Write(append(data, '\n'))
+	return err
+}
+
+func (fe *FileExporter) Close() error {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	return fe.f.Close()
+}